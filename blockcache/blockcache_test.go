@@ -21,14 +21,14 @@ func TestParallelismManyKey(t *testing.T) {
 		go func(obj int) {
 			err := cache.Access(nil, obj, true, func(_ interface{}, buf []byte, found bool) (interface{}, bool, error) {
 				if found {
-					t.Fatal("expected element to be created")
+					t.Error("expected element to be created")
 				}
 				wg.Done()
 				wg.Wait()
 				return nil, false, nil
 			})
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
 			}
 		}(i)
 	}
@@ -62,7 +62,7 @@ func TestParallelismSingleKey(t *testing.T) {
 				return nil, true, nil
 			})
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
 			}
 			wg.Done()
 		}()
@@ -26,6 +26,7 @@ type BlockAllocator interface {
 	Write(tag interface{}, index BlockIndex, buf []byte) error
 	WriteAt(tag interface{}, index BlockIndex, off int, buf []byte) error
 	SyncTag(tag interface{}) error
+	RetagBlocks(oldTag, newTag interface{}) error
 	AccessBlock(tag interface{}, index BlockIndex, accessFunc func(data []byte) (modified bool, err error)) error
 	AccessBlockMeta(index BlockIndex, accessFunc func(meta []byte) (modified bool, err error)) error
 	IsBlockReadOnly(index BlockIndex) bool
@@ -132,7 +133,11 @@ func (bf *BlockFile) GetNumBlocks() (BlockIndex, error) {
 	if err != nil {
 		return 0, err
 	}
-	return BlockIndex(bo.Uint64(buf) + 1), nil
+	numBlocks := BlockIndex(bo.Uint64(buf))
+	if numBlocks < bf.PreAllocatedBlocks {
+		numBlocks = bf.PreAllocatedBlocks
+	}
+	return numBlocks + 1, nil
 }
 
 func (bf *BlockFile) GetCache() *blockcache.BlockCache {
@@ -411,6 +416,52 @@ func (bf *BlockFile) SyncTag(tag interface{}) error {
 	return bf.SyncTag(bf)
 }
 
+// Moves the dirty blocks tagged by `oldTag` to `newTag` so that they are
+// written back by a later SyncTag(newTag).
+func (bf *BlockFile) RetagBlocks(oldTag, newTag interface{}) error {
+	bf.tagLock.Lock()
+	var blocks []BlockIndex
+	for block := range bf.tagDirtyBlocks[oldTag] {
+		blocks = append(blocks, block)
+	}
+	bf.tagLock.Unlock()
+
+	for _, block := range blocks {
+		err := bf.Cache.Access(bf, block, false, func(tag interface{}, data []byte, found bool) (interface{}, bool, error) {
+			if !found || tag != oldTag {
+				// Flushed or written by another tag since
+				return tag, false, nil
+			}
+			bf.updateCacheTag(block, oldTag, newTag)
+			return newTag, false, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flushes all dirty blocks regardless of tag and syncs the underlying file.
+func (bf *BlockFile) Sync() error {
+	bf.tagLock.Lock()
+	var blocks []BlockIndex
+	for _, tagBlocks := range bf.tagDirtyBlocks {
+		for block := range tagBlocks {
+			blocks = append(blocks, block)
+		}
+	}
+	bf.tagLock.Unlock()
+
+	for _, block := range blocks {
+		err := bf.Cache.Flush(bf, block)
+		if err != nil {
+			return err
+		}
+	}
+	return bf.File.Sync()
+}
+
 func (bf *BlockFile) AccessBlock(tag interface{}, index BlockIndex, accessFunc func(data []byte) (bool, error)) error {
 	return bf.Cache.Access(bf, index, true, func(prevTag interface{}, data []byte, found bool) (interface{}, bool, error) {
 		if !found {
@@ -1,12 +1,20 @@
 package blockfile
 
 import (
+	"sync"
+
 	"github.com/go-errors/errors"
 
 	"github.com/msg555/ctrfs/blockcache"
 )
 
 type BlockOverlayAllocator struct {
+	layerLock sync.RWMutex
+
+	// Set on layer stacks frozen by PushLayer(). Frozen stacks reject all
+	// modifications, including to blocks of their top layer.
+	frozen bool
+
 	blockSize    int
 	metaDataSize int
 	wrIndexShift BlockIndex
@@ -15,7 +23,12 @@ type BlockOverlayAllocator struct {
 	wrAllocator BlockAllocator
 }
 
+// Initializes the overlay with `wrAllocator` stacked over `roAllocator`. This
+// may also be used to replace the layers of an overlay already in use.
 func (bf *BlockOverlayAllocator) Init(roAllocator, wrAllocator BlockAllocator) error {
+	bf.layerLock.Lock()
+	defer bf.layerLock.Unlock()
+
 	wrIndexShift, err := roAllocator.GetNumBlocks()
 	if err != nil {
 		return err
@@ -35,6 +48,45 @@ func (bf *BlockOverlayAllocator) Init(roAllocator, wrAllocator BlockAllocator) e
 	return nil
 }
 
+// Freezes the current writable layer, stacking it on top of the read only
+// layers, and continues with `wrAllocator` as the new writable layer. Returns
+// the frozen stack of layers, which reflects the overlay as it was at the time
+// of the call and can no longer be modified. Block indexes are unchanged by
+// this operation.
+func (bf *BlockOverlayAllocator) PushLayer(wrAllocator BlockAllocator) (*BlockOverlayAllocator, error) {
+	bf.layerLock.Lock()
+	defer bf.layerLock.Unlock()
+
+	if bf.frozen {
+		return nil, errors.New("cannot push layer onto frozen overlay")
+	}
+	if bf.blockSize != wrAllocator.GetBlockSize() {
+		return nil, errors.New("layers must have matching block size")
+	}
+	if bf.metaDataSize != wrAllocator.GetMetaDataSize() {
+		return nil, errors.New("layers must have matching meta data size")
+	}
+
+	numBlocks, err := bf.wrAllocator.GetNumBlocks()
+	if err != nil {
+		return nil, err
+	}
+
+	frozen := &BlockOverlayAllocator{
+		frozen:       true,
+		blockSize:    bf.blockSize,
+		metaDataSize: bf.metaDataSize,
+		wrIndexShift: bf.wrIndexShift,
+		roAllocator:  bf.roAllocator,
+		wrAllocator:  bf.wrAllocator,
+	}
+
+	bf.wrIndexShift += numBlocks
+	bf.roAllocator = frozen
+	bf.wrAllocator = wrAllocator
+	return frozen, nil
+}
+
 func (bf *BlockOverlayAllocator) GetBlockSize() int {
 	return bf.blockSize
 }
@@ -44,6 +96,9 @@ func (bf *BlockOverlayAllocator) GetMetaDataSize() int {
 }
 
 func (bf *BlockOverlayAllocator) GetNumBlocks() (BlockIndex, error) {
+	bf.layerLock.RLock()
+	defer bf.layerLock.RUnlock()
+
 	res, err := bf.wrAllocator.GetNumBlocks()
 	if err != nil {
 		return 0, err
@@ -52,6 +107,9 @@ func (bf *BlockOverlayAllocator) GetNumBlocks() (BlockIndex, error) {
 }
 
 func (bf *BlockOverlayAllocator) GetCache() *blockcache.BlockCache {
+	bf.layerLock.RLock()
+	defer bf.layerLock.RUnlock()
+
 	return bf.wrAllocator.GetCache()
 }
 
@@ -60,6 +118,12 @@ func (bf *BlockOverlayAllocator) Close() error {
 }
 
 func (bf *BlockOverlayAllocator) Allocate(tag interface{}) (BlockIndex, error) {
+	bf.layerLock.RLock()
+	defer bf.layerLock.RUnlock()
+
+	if bf.frozen {
+		return 0, errors.New("cannot allocate from frozen overlay")
+	}
 	index, err := bf.wrAllocator.Allocate(tag)
 	if err != nil {
 		return 0, err
@@ -68,13 +132,19 @@ func (bf *BlockOverlayAllocator) Allocate(tag interface{}) (BlockIndex, error) {
 }
 
 func (bf *BlockOverlayAllocator) Free(index BlockIndex) error {
-	if index < bf.wrIndexShift {
+	bf.layerLock.RLock()
+	defer bf.layerLock.RUnlock()
+
+	if bf.frozen || index < bf.wrIndexShift {
 		return errors.New("cannot free read only block")
 	}
 	return bf.wrAllocator.Free(index - bf.wrIndexShift)
 }
 
 func (bf *BlockOverlayAllocator) Read(index BlockIndex, buf []byte) ([]byte, error) {
+	bf.layerLock.RLock()
+	defer bf.layerLock.RUnlock()
+
 	if index < bf.wrIndexShift {
 		return bf.roAllocator.Read(index, buf)
 	}
@@ -82,6 +152,9 @@ func (bf *BlockOverlayAllocator) Read(index BlockIndex, buf []byte) ([]byte, err
 }
 
 func (bf *BlockOverlayAllocator) ReadAt(index BlockIndex, off, sz int, buf []byte) ([]byte, error) {
+	bf.layerLock.RLock()
+	defer bf.layerLock.RUnlock()
+
 	if index < bf.wrIndexShift {
 		return bf.roAllocator.ReadAt(index, off, sz, buf)
 	}
@@ -89,55 +162,82 @@ func (bf *BlockOverlayAllocator) ReadAt(index BlockIndex, off, sz int, buf []byt
 }
 
 func (bf *BlockOverlayAllocator) Write(tag interface{}, index BlockIndex, buf []byte) error {
-	if index < bf.wrIndexShift {
+	bf.layerLock.RLock()
+	defer bf.layerLock.RUnlock()
+
+	if bf.frozen || index < bf.wrIndexShift {
 		return errors.New("cannot write to ro block")
 	}
 	return bf.wrAllocator.Write(tag, index-bf.wrIndexShift, buf)
 }
 
 func (bf *BlockOverlayAllocator) WriteAt(tag interface{}, index BlockIndex, off int, buf []byte) error {
-	if index < bf.wrIndexShift {
+	bf.layerLock.RLock()
+	defer bf.layerLock.RUnlock()
+
+	if bf.frozen || index < bf.wrIndexShift {
 		return errors.New("cannot write to ro block")
 	}
 	return bf.wrAllocator.WriteAt(tag, index-bf.wrIndexShift, off, buf)
 }
 
 func (bf *BlockOverlayAllocator) SyncTag(tag interface{}) error {
+	bf.layerLock.RLock()
+	defer bf.layerLock.RUnlock()
+
 	return bf.wrAllocator.SyncTag(tag)
 }
 
+func (bf *BlockOverlayAllocator) RetagBlocks(oldTag, newTag interface{}) error {
+	bf.layerLock.RLock()
+	defer bf.layerLock.RUnlock()
+
+	return bf.wrAllocator.RetagBlocks(oldTag, newTag)
+}
+
+// Wraps `accessFunc` so that it fails if it attempts to modify its argument.
+func readOnlyAccess(accessFunc func(data []byte) (modified bool, err error), msg string) func(data []byte) (bool, error) {
+	return func(data []byte) (bool, error) {
+		modified, err := accessFunc(data)
+		if err != nil {
+			return false, err
+		}
+		if modified {
+			return false, errors.New(msg)
+		}
+		return false, nil
+	}
+}
+
 func (bf *BlockOverlayAllocator) AccessBlock(tag interface{}, index BlockIndex, accessFunc func(data []byte) (modified bool, err error)) error {
+	bf.layerLock.RLock()
+	defer bf.layerLock.RUnlock()
+
 	if index < bf.wrIndexShift {
-		return bf.roAllocator.AccessBlock(tag, index, func(meta []byte) (bool, error) {
-			modified, err := accessFunc(meta)
-			if err != nil {
-				return false, err
-			}
-			if modified {
-				return false, errors.New("cannot modify ro block")
-			}
-			return false, nil
-		})
+		return bf.roAllocator.AccessBlock(tag, index, readOnlyAccess(accessFunc, "cannot modify ro block"))
+	}
+	if bf.frozen {
+		accessFunc = readOnlyAccess(accessFunc, "cannot modify ro block")
 	}
 	return bf.wrAllocator.AccessBlock(tag, index-bf.wrIndexShift, accessFunc)
 }
 
 func (bf *BlockOverlayAllocator) AccessBlockMeta(index BlockIndex, accessFunc func(meta []byte) (modified bool, err error)) error {
+	bf.layerLock.RLock()
+	defer bf.layerLock.RUnlock()
+
 	if index < bf.wrIndexShift {
-		return bf.roAllocator.AccessBlockMeta(index, func(meta []byte) (bool, error) {
-			modified, err := accessFunc(meta)
-			if err != nil {
-				return false, err
-			}
-			if modified {
-				return false, errors.New("cannot modify meta on ro block")
-			}
-			return false, nil
-		})
+		return bf.roAllocator.AccessBlockMeta(index, readOnlyAccess(accessFunc, "cannot modify meta on ro block"))
+	}
+	if bf.frozen {
+		accessFunc = readOnlyAccess(accessFunc, "cannot modify meta on ro block")
 	}
 	return bf.wrAllocator.AccessBlockMeta(index-bf.wrIndexShift, accessFunc)
 }
 
 func (bf *BlockOverlayAllocator) IsBlockReadOnly(index BlockIndex) bool {
-	return index < bf.wrIndexShift
+	bf.layerLock.RLock()
+	defer bf.layerLock.RUnlock()
+
+	return bf.frozen || index < bf.wrIndexShift
 }
@@ -216,6 +216,67 @@ func TestAllocateFree(t *testing.T) {
 	}
 }
 
+func TestPreAllocatedNumBlocks(t *testing.T) {
+	f, err := tempFileCreate()
+	if err != nil {
+		t.Fatalf("unexpected error creating temp file '%s'", err)
+	}
+
+	bf := BlockFile{
+		Cache:              blockcache.New(100, 32),
+		File:               f,
+		PreAllocatedBlocks: 2,
+	}
+	bf.Init()
+	defer func() {
+		err := bf.Close()
+		if err != nil {
+			t.Fatalf("failed to close temp file '%s'", err)
+		}
+	}()
+
+	numBlocks, err := bf.GetNumBlocks()
+	if err != nil {
+		t.Fatalf("failed to get number of blocks '%s'", err)
+	}
+	if numBlocks != 3 {
+		t.Fatalf("expected 3 blocks in fresh file, got %d", numBlocks)
+	}
+
+	f, err = tempFileCreate()
+	if err != nil {
+		t.Fatalf("unexpected error creating temp file '%s'", err)
+	}
+	bfWr := BlockFile{
+		Cache: blockcache.New(100, 32),
+		File:  f,
+	}
+	bfWr.Init()
+	defer func() {
+		err := bfWr.Close()
+		if err != nil {
+			t.Fatalf("failed to close temp file '%s'", err)
+		}
+	}()
+
+	overlay := BlockOverlayAllocator{}
+	err = overlay.Init(&bf, &bfWr)
+	if err != nil {
+		t.Fatalf("failed to init overlay '%s'", err)
+	}
+
+	index, err := overlay.Allocate(nil)
+	if err != nil {
+		t.Fatalf("failed to allocate block '%s'", err)
+	}
+	if index <= bf.PreAllocatedBlocks {
+		t.Fatalf("overlay allocated index %d over a pre-allocated block", index)
+	}
+	if overlay.IsBlockReadOnly(index) {
+		t.Fatalf("overlay allocated index %d in the read only layer", index)
+	}
+}
+
 func TestTags(t *testing.T) {
 	f, err := tempFileCreate()
 	if err != nil {
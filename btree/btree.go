@@ -1,22 +1,14 @@
-// Implements a simple, immutable B-tree implementation on disk featuring fixed
-// length keys and values. Keys are strings that have variable length not
-// exceeding MaxKeyLength. Values are fixed length byte arrays of size
-// RecordLength.
+// Implements a simple, immutable B-tree implementation on disk featuring
+// variable length keys and fixed length values. Keys are strings that have
+// variable length not exceeding MaxKeySize. Values are fixed length byte arrays
+// of size EntrySize.
 // Has a simple API for constructing the B-tree all at once or by writing
 // it record by record in sorted order.
 
-/*
-TODO: Add offset support by annotating elements with a 64-bit unique ID (e.g.
-insertion counter).
-
-Support resume by caching the position (sort index) of unique IDs recently
-requested. then we may need to look a little forward and backwards to find the
-starting position.
-*/
-
 package btree
 
 import (
+	"bytes"
 	"encoding/binary"
 
 	"github.com/go-errors/errors"
@@ -45,13 +37,14 @@ type BTree struct {
 	// Size in bytes of a value
 	EntrySize int
 
-	// The number of keys stored at each B-tree node. Each node has up to FanOut+1
-	// child nodes. FanOut must be set to an even number. Set FanOut to 0 to have
-	// it automatically set to the largest possible when calling Open().
+	// The maximum number of keys stored at each B-tree node. Each node has up to
+	// FanOut+1 child nodes. FanOut must be set to an even number. Set FanOut to 0
+	// to have it automatically set to the most keys that could fit in a block
+	// when calling Open(). Blocks may hold fewer keys when keys are long.
 	FanOut int
 
-	// Number of bytes in total for an entry
-	nodeSize int
+	// Size in bytes of each block
+	blockSize int
 
 	// Underlying block store to keep b-tree nodes
 	blocks blockfile.BlockAllocator
@@ -63,19 +56,42 @@ Block:
 Node:
 	A single key/value entry stored within a block
 
-Block Layout
-	nodes  uint32
-	height uint32 - leaf nodes have height=0
+Each child pointer is stored alongside the number of entries in that child's
+subtree so that the rank of a key, or the key of a given rank, can be found
+by descending a single path from the root.
 
-	... 0 <= i <= tr.FanOut
-	child[i] uint64
+Blocks use a slotted page layout. The header and slot array grow from the
+front of the block while cells are packed against the end of the block. Keys
+within a block share a common prefix that is stored once in the header; each
+cell only stores the remainder of its key. Slots are kept in key order so
+that a block can be binary searched without decoding its cells.
 
-	... 0 <= i < tr.FanOut (set only for i < nodes)
-	keylen[i] uint32
-	key[i]    [MaxKeySize]byte
-	value[i]  [EntrySize]byte
+Block Layout
+	nodes     uint16
+	prefixLen uint16
+	child[0]  uint64
+	count[0]  uint64
+	prefix    [prefixLen]byte
+
+	... 0 <= i < nodes
+	slot[i]   uint16 - offset of cell i within the block
+
+	... free space
+
+	... cells
+	child[i+1] uint64
+	count[i+1] uint64
+	suffixLen  uint16
+	suffix     [suffixLen]byte
+	value      [EntrySize]byte
 */
 
+const (
+	blockHeaderSize = 20
+	slotSize        = 2
+	cellHeaderSize  = 18
+)
+
 func dupBytes(arr []byte) []byte {
 	result := make([]byte, len(arr))
 	copy(result, arr)
@@ -88,22 +104,28 @@ func (tr *BTree) Open(bf blockfile.BlockAllocator) error {
 		return errors.New("tree fan out must be even")
 	}
 
+	blockSize := bf.GetBlockSize()
+	if blockSize > 1<<16 {
+		return errors.New("block size too large for tree")
+	}
+
+	// Splitting an overfull block must always produce two blocks that fit.
+	maxEntrySize := slotSize + cellHeaderSize + tr.MaxKeySize + tr.EntrySize
+	if blockHeaderSize+tr.MaxKeySize+3*maxEntrySize > blockSize {
+		return errors.New("insufficiently sized block allocator")
+	}
+
 	fanOut := tr.FanOut
-	nodeSize := 4 + tr.MaxKeySize + tr.EntrySize
 	if fanOut == 0 {
-		fanOut = (bf.GetBlockSize() - 12) / (8 + nodeSize)
+		fanOut = (blockSize - blockHeaderSize) / (slotSize + cellHeaderSize + tr.EntrySize)
 		fanOut = fanOut &^ 1
-		if fanOut <= 0 {
-			return errors.New("insufficiently sized block allocator")
-		}
 	}
-	blockSize := 12 + (8+nodeSize)*fanOut
-	if bf.GetBlockSize() < blockSize {
+	if fanOut <= 0 {
 		return errors.New("insufficiently sized block allocator")
 	}
 
 	tr.FanOut = fanOut
-	tr.nodeSize = nodeSize
+	tr.blockSize = blockSize
 	tr.blocks = bf
 	return nil
 }
@@ -146,48 +168,314 @@ func (tr *BTree) copyUpBlock(tag interface{}, index TreeIndex, block []byte) (Tr
 }
 
 func (tr *BTree) getBlockSize(block []byte) int {
-	return int(bo.Uint32(block))
+	return int(bo.Uint16(block))
 }
 
-func (tr *BTree) setBlockSize(block []byte, size int) {
-	bo.PutUint32(block, uint32(size))
+func (tr *BTree) getBlockPrefix(block []byte) []byte {
+	prefixLen := int(bo.Uint16(block[2:]))
+	return block[blockHeaderSize : blockHeaderSize+prefixLen]
+}
+
+func (tr *BTree) getCell(block []byte, i int) []byte {
+	prefixLen := int(bo.Uint16(block[2:]))
+	return block[bo.Uint16(block[blockHeaderSize+prefixLen+slotSize*i:]):]
 }
 
 func (tr *BTree) getBlockChild(block []byte, childInd int) TreeIndex {
-	if childInd < 0 || childInd > tr.FanOut {
+	if childInd < 0 || childInd > tr.getBlockSize(block) {
 		panic("child index out of range")
 	}
-	return TreeIndex(bo.Uint64(block[4+8*childInd:]))
+	if childInd == 0 {
+		return TreeIndex(bo.Uint64(block[4:]))
+	}
+	return TreeIndex(bo.Uint64(tr.getCell(block, childInd-1)))
 }
 
+// Updates a child pointer in place. Child pointers are fixed size so this
+// never changes the layout of the block.
 func (tr *BTree) setBlockChild(block []byte, childInd int, childTr TreeIndex) {
-	if childInd < 0 || childInd > tr.FanOut {
+	if childInd < 0 || childInd > tr.getBlockSize(block) {
+		panic("child index out of range")
+	}
+	if childInd == 0 {
+		bo.PutUint64(block[4:], uint64(childTr))
+		return
+	}
+	bo.PutUint64(tr.getCell(block, childInd-1), uint64(childTr))
+}
+
+// Returns the number of entries in the subtree rooted at child `childInd`.
+func (tr *BTree) getChildCount(block []byte, childInd int) int64 {
+	if childInd < 0 || childInd > tr.getBlockSize(block) {
 		panic("child index out of range")
 	}
-	bo.PutUint64(block[4+8*childInd:], uint64(childTr))
+	if childInd == 0 {
+		return int64(bo.Uint64(block[12:]))
+	}
+	return int64(bo.Uint64(tr.getCell(block, childInd-1)[8:]))
+}
+
+func (tr *BTree) setChildCount(block []byte, childInd int, count int64) {
+	if childInd < 0 || childInd > tr.getBlockSize(block) {
+		panic("child index out of range")
+	}
+	if childInd == 0 {
+		bo.PutUint64(block[12:], uint64(count))
+		return
+	}
+	bo.PutUint64(tr.getCell(block, childInd-1)[8:], uint64(count))
+}
+
+// Returns the number of entries in the subtree rooted at `block`.
+func (tr *BTree) getBlockCount(block []byte) int64 {
+	size := tr.getBlockSize(block)
+	count := int64(size)
+	for i := 0; i <= size; i++ {
+		count += tr.getChildCount(block, i)
+	}
+	return count
+}
+
+// Returns the part of the key of node `i` following the block's prefix.
+func (tr *BTree) getNodeSuffix(block []byte, i int) []byte {
+	cell := tr.getCell(block, i)
+	suffixLen := int(bo.Uint16(cell[16:]))
+	return cell[cellHeaderSize : cellHeaderSize+suffixLen]
+}
+
+// Returns a copy of the full key of node `i`, appended to `buf`.
+func (tr *BTree) getNodeKey(block []byte, i int, buf KeyType) KeyType {
+	buf = append(buf[:0], tr.getBlockPrefix(block)...)
+	return append(buf, tr.getNodeSuffix(block, i)...)
+}
+
+func (tr *BTree) getNodeValue(block []byte, i int) ValueType {
+	cell := tr.getCell(block, i)
+	suffixLen := int(bo.Uint16(cell[16:]))
+	return cell[cellHeaderSize+suffixLen : cellHeaderSize+suffixLen+tr.EntrySize]
+}
+
+// Compares `key` against the key of node `i` without materializing the
+// node's key.
+func (tr *BTree) compareNodeKey(block []byte, i int, key KeyType) int {
+	prefix := tr.getBlockPrefix(block)
+	if len(key) < len(prefix) {
+		if cmp := bytes.Compare(key, prefix[:len(key)]); cmp != 0 {
+			return cmp
+		}
+		return -1
+	}
+	if cmp := bytes.Compare(key[:len(prefix)], prefix); cmp != 0 {
+		return cmp
+	}
+	return bytes.Compare(key[len(prefix):], tr.getNodeSuffix(block, i))
+}
+
+// Decoded contents of a block. A block with n keys has n+1 children, each with
+// the number of entries in its subtree. Leaf blocks have all children set to
+// 0.
+type blockEntries struct {
+	children []TreeIndex
+	counts   []int64
+	keys     []KeyType
+	values   []ValueType
+}
+
+// Decodes all entries of `block`. The returned keys and values do not alias
+// the block.
+func (tr *BTree) readEntries(block []byte) *blockEntries {
+	size := tr.getBlockSize(block)
+	ents := &blockEntries{
+		children: make([]TreeIndex, 0, size+2),
+		counts:   make([]int64, 0, size+2),
+		keys:     make([]KeyType, 0, size+1),
+		values:   make([]ValueType, 0, size+1),
+	}
+	for i := 0; i <= size; i++ {
+		ents.children = append(ents.children, tr.getBlockChild(block, i))
+		ents.counts = append(ents.counts, tr.getChildCount(block, i))
+		if i < size {
+			ents.keys = append(ents.keys, tr.getNodeKey(block, i, nil))
+			ents.values = append(ents.values, dupBytes(tr.getNodeValue(block, i)))
+		}
+	}
+	return ents
+}
+
+// Returns a copy of entries [lo, hi) along with their surrounding children.
+func (ents *blockEntries) slice(lo, hi int) *blockEntries {
+	return &blockEntries{
+		children: append([]TreeIndex(nil), ents.children[lo:hi+1]...),
+		counts:   append([]int64(nil), ents.counts[lo:hi+1]...),
+		keys:     append([]KeyType(nil), ents.keys[lo:hi]...),
+		values:   append([]ValueType(nil), ents.values[lo:hi]...),
+	}
+}
+
+// Returns the number of entries in the subtree rooted at the block.
+func (ents *blockEntries) total() int64 {
+	count := int64(len(ents.keys))
+	for _, childCount := range ents.counts {
+		count += childCount
+	}
+	return count
+}
+
+// Inserts a node at index `i` with `child` as its right child.
+func (ents *blockEntries) insert(i int, key KeyType, value ValueType, child TreeIndex, count int64) {
+	ents.keys = append(ents.keys, nil)
+	copy(ents.keys[i+1:], ents.keys[i:])
+	ents.keys[i] = key
+
+	ents.values = append(ents.values, nil)
+	copy(ents.values[i+1:], ents.values[i:])
+	ents.values[i] = value
+
+	ents.children = append(ents.children, 0)
+	copy(ents.children[i+2:], ents.children[i+1:])
+	ents.children[i+1] = child
+
+	ents.counts = append(ents.counts, 0)
+	copy(ents.counts[i+2:], ents.counts[i+1:])
+	ents.counts[i+1] = count
 }
 
-func (tr *BTree) getNodeSlice(block []byte, i int) []byte {
-	posStart := 4 + 8*(tr.FanOut+1) + i*tr.nodeSize
-	return block[posStart : posStart+tr.nodeSize]
+// Removes the node at index `i` along with its right child.
+func (ents *blockEntries) remove(i int) {
+	ents.keys = append(ents.keys[:i], ents.keys[i+1:]...)
+	ents.values = append(ents.values[:i], ents.values[i+1:]...)
+	ents.children = append(ents.children[:i+1], ents.children[i+2:]...)
+	ents.counts = append(ents.counts[:i+1], ents.counts[i+2:]...)
 }
 
-func (tr *BTree) getNodeKey(node []byte) KeyType {
-	keylen := int(bo.Uint32(node))
-	if keylen > tr.MaxKeySize {
-		return nil
+func commonPrefixLen(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// Returns the size in bytes that a block holding the sorted `keys` would
+// occupy.
+func (tr *BTree) encodedSize(keys []KeyType) int {
+	if len(keys) == 0 {
+		return blockHeaderSize
+	}
+
+	// Keys are sorted so the prefix shared by all keys is the prefix shared by
+	// the first and last key.
+	prefixLen := commonPrefixLen(keys[0], keys[len(keys)-1])
+	size := blockHeaderSize + prefixLen
+	for _, key := range keys {
+		size += slotSize + cellHeaderSize + len(key) - prefixLen + tr.EntrySize
 	}
-	return node[4 : 4+keylen]
+	return size
 }
 
-func (tr *BTree) getNodeValue(node []byte) ValueType {
-	return node[4+tr.MaxKeySize : tr.nodeSize]
+// Returns true if a block could hold the sorted `keys`.
+func (tr *BTree) keysFit(keys []KeyType) bool {
+	return len(keys) <= tr.FanOut && tr.encodedSize(keys) <= tr.blockSize
 }
 
-func (tr *BTree) setNode(node []byte, key KeyType, value ValueType) {
-	bo.PutUint32(node, uint32(len(key)))
-	copy(node[4:], key)
-	copy(node[4+tr.MaxKeySize:], value)
+// Returns true if a non-root block holding the sorted `keys` is full enough
+// that it need not be merged with a sibling.
+func (tr *BTree) keysHalfFull(keys []KeyType) bool {
+	return len(keys)*2 >= tr.FanOut || tr.encodedSize(keys)*2 >= tr.blockSize
+}
+
+// Encodes `ents` into `block`. The entries must fit within a block.
+func (tr *BTree) writeEntries(block []byte, ents *blockEntries) {
+	if !tr.keysFit(ents.keys) {
+		panic("block entries do not fit")
+	}
+	for i := range block {
+		block[i] = 0
+	}
+
+	prefixLen := 0
+	if len(ents.keys) > 0 {
+		prefixLen = commonPrefixLen(ents.keys[0], ents.keys[len(ents.keys)-1])
+		copy(block[blockHeaderSize:], ents.keys[0][:prefixLen])
+	}
+	bo.PutUint16(block, uint16(len(ents.keys)))
+	bo.PutUint16(block[2:], uint16(prefixLen))
+	bo.PutUint64(block[4:], uint64(ents.children[0]))
+	bo.PutUint64(block[12:], uint64(ents.counts[0]))
+
+	cellEnd := tr.blockSize
+	for i, key := range ents.keys {
+		suffix := key[prefixLen:]
+		cellStart := cellEnd - cellHeaderSize - len(suffix) - tr.EntrySize
+		cell := block[cellStart:cellEnd]
+
+		bo.PutUint64(cell, uint64(ents.children[i+1]))
+		bo.PutUint64(cell[8:], uint64(ents.counts[i+1]))
+		bo.PutUint16(cell[16:], uint16(len(suffix)))
+		copy(cell[cellHeaderSize:], suffix)
+		copy(cell[cellHeaderSize+len(suffix):], ents.values[i])
+
+		bo.PutUint16(block[blockHeaderSize+prefixLen+slotSize*i:], uint16(cellStart))
+		cellEnd = cellStart
+	}
+}
+
+// Divides sorted `keys` into as few groups as possible that each fit within a
+// block, with a single separator key between consecutive groups. Returns the
+// indexes of the separator keys. Groups are balanced by encoded size.
+func (tr *BTree) partitionKeys(keys []KeyType) []int {
+	// Total key length of keys[:i] so that the encoded size of any range of
+	// keys can be found without visiting each key.
+	keyBytes := make([]int, len(keys)+1)
+	for i, key := range keys {
+		keyBytes[i+1] = keyBytes[i] + len(key)
+	}
+
+	// Equivalent to encodedSize(keys[lo:hi]).
+	rangeSize := func(lo, hi int) int {
+		if lo == hi {
+			return blockHeaderSize
+		}
+		prefixLen := commonPrefixLen(keys[lo], keys[hi-1])
+		cellSize := slotSize + cellHeaderSize + tr.EntrySize - prefixLen
+		return blockHeaderSize + prefixLen + (hi-lo)*cellSize + keyBytes[hi] - keyBytes[lo]
+	}
+	rangeFits := func(lo, hi int) bool {
+		return hi-lo <= tr.FanOut && rangeSize(lo, hi) <= tr.blockSize
+	}
+
+	var result []int
+	start := 0
+	for !rangeFits(start, len(keys)) {
+		// Find the most balanced split into two groups that both fit.
+		best := -1
+		bestDiff := 0
+		for m := start + 1; m+1 < len(keys); m++ {
+			if !rangeFits(start, m) || !rangeFits(m+1, len(keys)) {
+				continue
+			}
+			diff := rangeSize(start, m) - rangeSize(m+1, len(keys))
+			if diff < 0 {
+				diff = -diff
+			}
+			if best == -1 || diff < bestDiff {
+				best, bestDiff = m, diff
+			}
+		}
+		if best != -1 {
+			return append(result, best)
+		}
+
+		// Fall back to filling the first group as much as possible and dividing
+		// up the remainder.
+		m := start + 1
+		for m+1 < len(keys) && rangeFits(start, m+1) {
+			m++
+		}
+		result = append(result, m)
+		start = m + 1
+	}
+	return result
 }
 
 func (tr *BTree) CreateEmpty(tag interface{}) (TreeIndex, error) {
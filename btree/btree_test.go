@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/msg555/ctrfs/blockcache"
@@ -188,3 +190,986 @@ func TestFuzz(t *testing.T) {
 		}
 	}
 }
+
+func TestRange(t *testing.T) {
+	bf, err := blockFileCreate(1000)
+	if err != nil {
+		t.Fatalf("unexpected error creating temp file '%s'", err)
+	}
+
+	tr := BTree{
+		MaxKeySize: 4,
+		EntrySize:  4,
+		FanOut:     4,
+	}
+	err = tr.Open(bf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	treeRoot, err := tr.CreateEmpty(nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating empty tree '%s'", err)
+	}
+
+	rng := rand.New(rand.NewSource(555))
+	var keys []string
+	for i := 0; i < 2000; i++ {
+		k := fmt.Sprintf("%04d", rng.Int()%10000)
+		if err := tr.Insert(nil, treeRoot, []byte(k), []byte(k), false); err == nil {
+			keys = append(keys, k)
+		} else if err != ErrorKeyAlreadyExists {
+			t.Fatalf("unexpected error with Insert: '%s'", err)
+		}
+	}
+	sort.Strings(keys)
+
+	checkRange := func(lo, hi []byte, reverse bool) {
+		var expected []string
+		for _, k := range keys {
+			if lo != nil && k < string(lo) {
+				continue
+			}
+			if hi != nil && k >= string(hi) {
+				continue
+			}
+			expected = append(expected, k)
+		}
+		if reverse {
+			for i, j := 0, len(expected)-1; i < j; i, j = i+1, j-1 {
+				expected[i], expected[j] = expected[j], expected[i]
+			}
+		}
+
+		c := tr.Range(treeRoot, lo, hi, reverse)
+		defer c.Close()
+
+		count := 0
+		for c.Next() {
+			if count >= len(expected) {
+				t.Fatalf("range [%s, %s) returned too many keys", lo, hi)
+			}
+			if string(c.Key()) != expected[count] {
+				t.Fatalf("range [%s, %s) got key %s, wanted %s", lo, hi, c.Key(), expected[count])
+			}
+			if bytes.Compare(c.Key(), c.Value()) != 0 {
+				t.Fatalf("got unexpected value from range")
+			}
+
+			byIndexKey, _, err := tr.ByIndex(c.Index())
+			if err != nil {
+				t.Fatalf("unexpected error with ByIndex: '%s'", err)
+			}
+			if bytes.Compare(byIndexKey, c.Key()) != 0 {
+				t.Fatalf("got unexpected key from ByIndex")
+			}
+			count++
+		}
+		if err := c.Err(); err != nil {
+			t.Fatalf("unexpected range error: '%s'", err)
+		}
+		if count != len(expected) {
+			t.Fatalf("range [%s, %s) returned %d keys, wanted %d", lo, hi, count, len(expected))
+		}
+	}
+
+	checkRange(nil, nil, false)
+	checkRange(nil, nil, true)
+	checkRange([]byte(keys[10]), []byte(keys[20]), false)
+	checkRange([]byte(keys[10]), []byte(keys[20]), true)
+	for i := 0; i < 200; i++ {
+		lo := []byte(fmt.Sprintf("%04d", rng.Int()%10000))
+		hi := []byte(fmt.Sprintf("%04d", rng.Int()%10000))
+		if rng.Int()%4 == 0 {
+			lo = nil
+		}
+		if rng.Int()%4 == 0 {
+			hi = nil
+		}
+		checkRange(lo, hi, i%2 == 1)
+	}
+
+	// Stopping early should still release the cursor.
+	c := tr.Range(treeRoot, nil, nil, true)
+	if !c.Next() || string(c.Key()) != keys[len(keys)-1] {
+		t.Fatal("expected reverse range to start at last key")
+	}
+	c.Close()
+	if c.Next() {
+		t.Fatal("closed cursor returned an entry")
+	}
+}
+
+func TestPositionIndex(t *testing.T) {
+	bf, err := blockFileCreate(1000)
+	if err != nil {
+		t.Fatalf("unexpected error creating temp file '%s'", err)
+	}
+
+	var pi PositionIndex
+	if err := pi.Open(bf, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	// Use a weak hash so that many keys share a preferred position.
+	pi.keyPosition = func(key KeyType) Position {
+		return 1 + KeyPosition(key)%16
+	}
+
+	var keys []KeyType
+	for i := 0; i < 40; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("%04d", i)))
+	}
+
+	// Bulk load the first half of the keys and assign the rest one at a time.
+	root, positions, err := pi.Build(nil, keys[:20])
+	if err != nil {
+		t.Fatalf("unexpected error with Build: '%s'", err)
+	}
+	expected, err := assignPositions(keys[:20], pi.keyPosition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range expected {
+		if positions[i] != expected[i] {
+			t.Fatal("Build assigned different positions than assignPositions")
+		}
+	}
+	for _, key := range keys[20:] {
+		pos, err := pi.Assign(nil, root, key)
+		if err != nil {
+			t.Fatalf("unexpected error with Assign: '%s'", err)
+		}
+		positions = append(positions, pos)
+	}
+
+	checkPositions := func(present map[int]bool) {
+		used := make(map[Position]bool)
+		for i, key := range keys {
+			if !present[i] {
+				if _, err := pi.Position(root, key); err != ErrorPositionNotFound {
+					t.Fatalf("expected released key to have no position, got '%v'", err)
+				}
+				continue
+			}
+			if positions[i] == PositionStart || positions[i] == PositionEnd {
+				t.Fatal("key assigned reserved position")
+			}
+			if used[positions[i]] {
+				t.Fatalf("position %d assigned twice", positions[i])
+			}
+			used[positions[i]] = true
+
+			pos, err := pi.Position(root, key)
+			if err != nil {
+				t.Fatalf("unexpected error with Position: '%s'", err)
+			}
+			if pos != positions[i] {
+				t.Fatalf("position of key %s changed", key)
+			}
+			posKey, err := pi.Key(root, pos)
+			if err != nil {
+				t.Fatalf("unexpected error with Key: '%s'", err)
+			}
+			if bytes.Compare(posKey, key) != 0 {
+				t.Fatal("position resolved to the wrong key")
+			}
+		}
+	}
+
+	present := make(map[int]bool)
+	for i := range keys {
+		present[i] = true
+	}
+	checkPositions(present)
+
+	// Releasing keys must not move the keys that collided with them.
+	for i := 0; i < len(keys); i += 3 {
+		if err := pi.Release(nil, root, keys[i]); err != nil {
+			t.Fatalf("unexpected error with Release: '%s'", err)
+		}
+		if _, err := pi.Key(root, positions[i]); err != ErrorPositionNotFound {
+			t.Fatalf("expected released position to be missing, got '%v'", err)
+		}
+		delete(present, i)
+	}
+	checkPositions(present)
+
+	// Released keys are given free positions when assigned again.
+	for i := 0; i < len(keys); i += 6 {
+		pos, err := pi.Assign(nil, root, keys[i])
+		if err != nil {
+			t.Fatalf("unexpected error with Assign: '%s'", err)
+		}
+		positions[i] = pos
+		present[i] = true
+	}
+	checkPositions(present)
+
+	// Assigning an already assigned key returns its existing position.
+	pos, err := pi.Assign(nil, root, keys[1])
+	if err != nil || pos != positions[1] {
+		t.Fatal("expected Assign to return the existing position")
+	}
+
+	// Keys that all collide exhaust the positions that may be probed.
+	pi.keyPosition = func(key KeyType) Position {
+		return 1
+	}
+	root, err = pi.CreateEmpty(nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating empty tree '%s'", err)
+	}
+	for i := 0; i < maxPositionProbes; i++ {
+		if _, err := pi.Assign(nil, root, []byte(fmt.Sprintf("%04d", i))); err != nil {
+			t.Fatalf("unexpected error with Assign: '%s'", err)
+		}
+	}
+	if _, err := pi.Assign(nil, root, []byte("last")); err != ErrorPositionsExhausted {
+		t.Fatalf("expected ErrorPositionsExhausted, got '%v'", err)
+	}
+	keys = nil
+	for i := 0; i <= maxPositionProbes; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("%04d", i)))
+	}
+	if _, err := assignPositions(keys, pi.keyPosition); err != ErrorPositionsExhausted {
+		t.Fatalf("expected ErrorPositionsExhausted, got '%v'", err)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	bf, err := blockFileCreate(1000)
+	if err != nil {
+		t.Fatalf("unexpected error creating temp file '%s'", err)
+	}
+
+	tr := BTree{
+		MaxKeySize: 4,
+		EntrySize:  4,
+		FanOut:     4,
+	}
+	err = tr.Open(bf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, count := range []int{0, 1, 4, 5, 6, 7, 25, 26, 27, 1000, 1234} {
+		builder := tr.NewBuilder(nil)
+		data := make(map[string]bool)
+		for i := 0; i < count; i++ {
+			k := fmt.Sprintf("%04d", i)
+			if err := builder.Add([]byte(k), []byte(k)); err != nil {
+				t.Fatalf("unexpected error with Add: '%s'", err)
+			}
+			data[k] = true
+		}
+		treeRoot, err := builder.Finish()
+		if err != nil {
+			t.Fatalf("unexpected error with Finish: '%s'", err)
+		}
+		checkTreeStructure(t, &tr, treeRoot)
+
+		ind := 0
+		_, err = tr.Scan(treeRoot, nil, func(index IndexType, key KeyType, value ValueType) bool {
+			if string(key) != fmt.Sprintf("%04d", ind) || bytes.Compare(key, value) != 0 {
+				t.Fatalf("unexpected entry %s at %d of %d", key, ind, count)
+			}
+			ind++
+			return true
+		})
+		if err != nil {
+			t.Fatalf("unexpected error with Scan: '%s'", err)
+		}
+		if ind != count {
+			t.Fatalf("expected %d entries, found %d", count, ind)
+		}
+
+		// The built tree must remain balanced under further modification.
+		rng := rand.New(rand.NewSource(int64(count)))
+		for i := 0; i < 2*count+10; i++ {
+			k := fmt.Sprintf("%04d", rng.Int()%(count+100))
+			if data[k] {
+				err = tr.Delete(nil, treeRoot, []byte(k))
+				delete(data, k)
+			} else {
+				err = tr.Insert(nil, treeRoot, []byte(k), []byte(k), false)
+				data[k] = true
+			}
+			if err != nil {
+				t.Fatalf("unexpected error modifying built tree: '%s'", err)
+			}
+		}
+		for k := range data {
+			val, _, err := tr.Find(treeRoot, []byte(k))
+			if err != nil {
+				t.Fatalf("unexpected error with Find: '%s'", err)
+			}
+			if string(val) != k {
+				t.Fatalf("missing key %s", k)
+			}
+		}
+	}
+}
+
+// Walks the tree rooted at `treeIndex` verifying that keys are ordered, all
+// leaves are at the same depth, non-root blocks are non-empty and subtree
+// counts are accurate. Returns the number of blocks in the tree.
+func checkTreeStructure(t *testing.T, tr *BTree, treeIndex TreeIndex) int {
+	leafDepth := -1
+	numBlocks := 0
+
+	var walk func(treeIndex TreeIndex, depth int, lo, hi KeyType) int64
+	walk = func(treeIndex TreeIndex, depth int, lo, hi KeyType) int64 {
+		block := make([]byte, tr.blockSize)
+		if _, err := tr.blocks.Read(treeIndex, block); err != nil {
+			t.Fatalf("unexpected error reading block: '%s'", err)
+		}
+		numBlocks++
+
+		ents := tr.readEntries(block)
+		if depth > 0 && len(ents.keys) == 0 {
+			t.Fatal("found empty non-root block")
+		}
+		if !tr.keysFit(ents.keys) {
+			t.Fatal("found overfull block")
+		}
+		for _, key := range ents.keys {
+			if (lo != nil && bytes.Compare(lo, key) >= 0) || (hi != nil && bytes.Compare(key, hi) >= 0) {
+				t.Fatalf("key %q out of order", key)
+			}
+			lo = key
+		}
+
+		if ents.children[0] == 0 {
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if leafDepth != depth {
+				t.Fatal("leaves found at different depths")
+			}
+			return int64(len(ents.keys))
+		}
+
+		count := int64(len(ents.keys))
+		for i, child := range ents.children {
+			var childLo, childHi KeyType
+			if i > 0 {
+				childLo = ents.keys[i-1]
+			}
+			if i < len(ents.keys) {
+				childHi = ents.keys[i]
+			}
+			childCount := walk(child, depth+1, childLo, childHi)
+			if childCount != ents.counts[i] {
+				t.Fatalf("subtree count %d does not match actual count %d", ents.counts[i], childCount)
+			}
+			count += childCount
+		}
+		return count
+	}
+	walk(treeIndex, 0, nil, nil)
+	return numBlocks
+}
+
+func TestVariableLengthKeys(t *testing.T) {
+	bf, err := blockFileCreate(2048)
+	if err != nil {
+		t.Fatalf("unexpected error creating temp file '%s'", err)
+	}
+
+	tr := BTree{
+		MaxKeySize: 255,
+		EntrySize:  4,
+	}
+	err = tr.Open(bf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	treeRoot, err := tr.CreateEmpty(nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating empty tree '%s'", err)
+	}
+
+	rng := rand.New(rand.NewSource(555))
+	prefixes := []string{"", "lib", "libfoo.so.", strings.Repeat("x", 200)}
+	randomKey := func() string {
+		key := prefixes[rng.Int()%len(prefixes)]
+		n := 1 + rng.Int()%20
+		if rng.Int()%10 == 0 {
+			n = 1 + rng.Int()%(255-len(key))
+		}
+		for i := 0; i < n && len(key) < 255; i++ {
+			key += string(rune('a' + rng.Int()%4))
+		}
+		return key
+	}
+
+	data := make(map[string]string)
+	for i := 0; i < 20000; i++ {
+		k := randomKey()
+		if rng.Int()%3 == 0 {
+			// Delete a random existing key, occasionally one that is absent.
+			for existing := range data {
+				k = existing
+				break
+			}
+			_, ok := data[k]
+			delete(data, k)
+			if err := tr.Delete(nil, treeRoot, []byte(k)); err != nil && (ok || err != ErrorKeyNotFound) {
+				t.Fatalf("unexpected error with Delete: '%s'", err)
+			}
+		} else {
+			v := fmt.Sprintf("%04d", rng.Int()%10000)
+			data[k] = v
+			if err := tr.Insert(nil, treeRoot, []byte(k), []byte(v), true); err != nil {
+				t.Fatalf("unexpected error with Insert: '%s'", err)
+			}
+		}
+
+		if i%1000 == 0 {
+			checkTreeStructure(t, &tr, treeRoot)
+		}
+	}
+	checkTreeStructure(t, &tr, treeRoot)
+
+	var keys []string
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	c := tr.Range(treeRoot, nil, nil, false)
+	ind := 0
+	for c.Next() {
+		if ind >= len(keys) || string(c.Key()) != keys[ind] || string(c.Value()) != data[keys[ind]] {
+			t.Fatalf("unexpected entry %q at %d", c.Key(), ind)
+		}
+		ind++
+	}
+	if err := c.Err(); err != nil {
+		t.Fatalf("unexpected range error: '%s'", err)
+	}
+	if ind != len(keys) {
+		t.Fatalf("expected %d entries, found %d", len(keys), ind)
+	}
+
+	for _, k := range keys {
+		val, index, err := tr.Find(treeRoot, []byte(k))
+		if err != nil || string(val) != data[k] {
+			t.Fatalf("failed to find key %q", k)
+		}
+		key, _, err := tr.ByIndex(index)
+		if err != nil || string(key) != k {
+			t.Fatalf("unexpected key from ByIndex for %q", k)
+		}
+	}
+
+	// Short keys with a shared prefix should pack far more densely than the
+	// maximum key size would allow.
+	records := make(map[string]ValueType)
+	for i := 0; i < 1000; i++ {
+		records[fmt.Sprintf("/usr/lib/file%04d", i)] = []byte("abcd")
+	}
+	builtRoot, err := tr.WriteRecords(nil, records)
+	if err != nil {
+		t.Fatalf("unexpected error with WriteRecords: '%s'", err)
+	}
+	if numBlocks := checkTreeStructure(t, &tr, builtRoot); numBlocks > 20 {
+		t.Fatalf("expected densely packed tree, got %d blocks", numBlocks)
+	}
+}
+
+func TestCountRankSelect(t *testing.T) {
+	bf, err := blockFileCreate(1000)
+	if err != nil {
+		t.Fatalf("unexpected error creating temp file '%s'", err)
+	}
+
+	tr := BTree{
+		MaxKeySize: 4,
+		EntrySize:  4,
+		FanOut:     4,
+	}
+	err = tr.Open(bf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	treeRoot, err := tr.CreateEmpty(nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating empty tree '%s'", err)
+	}
+
+	checkRanks := func(treeRoot TreeIndex, data map[string]bool) {
+		var keys []string
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		checkTreeStructure(t, &tr, treeRoot)
+		count, err := tr.Count(treeRoot)
+		if err != nil {
+			t.Fatalf("unexpected error with Count: '%s'", err)
+		}
+		if count != int64(len(keys)) {
+			t.Fatalf("expected count %d, got %d", len(keys), count)
+		}
+
+		for i, k := range keys {
+			rank, err := tr.Rank(treeRoot, []byte(k))
+			if err != nil {
+				t.Fatalf("unexpected error with Rank: '%s'", err)
+			}
+			if rank != int64(i) {
+				t.Fatalf("expected rank %d for %s, got %d", i, k, rank)
+			}
+
+			key, val, index, err := tr.Select(treeRoot, int64(i))
+			if err != nil {
+				t.Fatalf("unexpected error with Select: '%s'", err)
+			}
+			if string(key) != k || string(val) != k {
+				t.Fatalf("expected %s at rank %d, got %s", k, i, key)
+			}
+			if key, _, err := tr.ByIndex(index); err != nil || string(key) != k {
+				t.Fatalf("unexpected index from Select for %s", k)
+			}
+		}
+
+		// Rank of absent keys counts the keys before them.
+		rank, err := tr.Rank(treeRoot, []byte("zzzz"))
+		if err != nil || rank != int64(len(keys)) {
+			t.Fatalf("unexpected rank past the end %d", rank)
+		}
+		if _, _, _, err := tr.Select(treeRoot, int64(len(keys))); err != ErrorRankOutOfRange {
+			t.Fatalf("expected out of range error, got '%v'", err)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(555))
+	data := make(map[string]bool)
+	for i := 0; i < 5000; i++ {
+		k := fmt.Sprintf("%04d", rng.Int()%1000)
+		if rng.Int()%3 == 0 {
+			delete(data, k)
+			if err := tr.Delete(nil, treeRoot, []byte(k)); err != nil && err != ErrorKeyNotFound {
+				t.Fatalf("unexpected error with Delete: '%s'", err)
+			}
+		} else {
+			data[k] = true
+			if err := tr.Insert(nil, treeRoot, []byte(k), []byte(k), true); err != nil {
+				t.Fatalf("unexpected error with Insert: '%s'", err)
+			}
+		}
+		if i%500 == 0 {
+			checkRanks(treeRoot, data)
+		}
+	}
+	checkRanks(treeRoot, data)
+
+	records := make(map[string]ValueType)
+	for k := range data {
+		records[k] = []byte(k)
+	}
+	builtRoot, err := tr.WriteRecords(nil, records)
+	if err != nil {
+		t.Fatalf("unexpected error with WriteRecords: '%s'", err)
+	}
+	checkRanks(builtRoot, data)
+}
+
+type countingAllocator struct {
+	blockfile.BlockAllocator
+	reads int
+}
+
+func (ca *countingAllocator) Read(index blockfile.BlockIndex, buf []byte) ([]byte, error) {
+	ca.reads++
+	return ca.BlockAllocator.Read(index, buf)
+}
+
+func TestDiff(t *testing.T) {
+	roFile, err := blockFileCreate(1000)
+	if err != nil {
+		t.Fatalf("unexpected error creating temp file '%s'", err)
+	}
+
+	roTree := BTree{
+		MaxKeySize: 4,
+		EntrySize:  4,
+		FanOut:     4,
+	}
+	if err := roTree.Open(roFile); err != nil {
+		t.Fatal(err)
+	}
+
+	records := make(map[string]ValueType)
+	for i := 0; i < 2000; i++ {
+		k := fmt.Sprintf("%04d", i*2)
+		records[k] = []byte(k)
+	}
+	rootA, err := roTree.WriteRecords(nil, records)
+	if err != nil {
+		t.Fatalf("unexpected error with WriteRecords: '%s'", err)
+	}
+
+	// Layer a writable file over the tree so that modifications copy up blocks
+	// and leave the rest shared.
+	wrFile, err := blockFileCreate(1000)
+	if err != nil {
+		t.Fatalf("unexpected error creating temp file '%s'", err)
+	}
+	overlay := &blockfile.BlockOverlayAllocator{}
+	if err := overlay.Init(roFile, wrFile); err != nil {
+		t.Fatal(err)
+	}
+	counter := &countingAllocator{BlockAllocator: overlay}
+
+	tr := BTree{
+		MaxKeySize: 4,
+		EntrySize:  4,
+		FanOut:     4,
+	}
+	if err := tr.Open(counter); err != nil {
+		t.Fatal(err)
+	}
+	rootB, err := blockfile.Duplicate(nil, overlay, rootA, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type change struct {
+		valueA string
+		valueB string
+	}
+	expected := map[string]change{
+		"0001": {"", "0001"},
+		"2001": {"", "2001"},
+		"1000": {"1000", ""},
+		"3998": {"3998", ""},
+		"0500": {"0500", "abcd"},
+	}
+	for k, ch := range expected {
+		var err error
+		if ch.valueB == "" {
+			err = tr.Delete(nil, rootB, []byte(k))
+		} else {
+			err = tr.Insert(nil, rootB, []byte(k), []byte(ch.valueB), true)
+		}
+		if err != nil {
+			t.Fatalf("unexpected error modifying tree: '%s'", err)
+		}
+	}
+
+	checkDiff := func(treeA, treeB TreeIndex, swap bool) {
+		var keys []string
+		counter.reads = 0
+		done, err := tr.Diff(treeA, treeB, func(key KeyType, valueA, valueB ValueType) bool {
+			if swap {
+				valueA, valueB = valueB, valueA
+			}
+			ch, ok := expected[string(key)]
+			if !ok || ch.valueA != string(valueA) || ch.valueB != string(valueB) {
+				t.Fatalf("unexpected difference at %s: %q -> %q", key, valueA, valueB)
+			}
+			keys = append(keys, string(key))
+			return true
+		})
+		if err != nil {
+			t.Fatalf("unexpected error with Diff: '%s'", err)
+		}
+		if !done {
+			t.Fatal("diff unexpectedly did not complete")
+		}
+		if len(keys) != len(expected) || !sort.StringsAreSorted(keys) {
+			t.Fatalf("unexpected differences %v", keys)
+		}
+		if counter.reads > 200 {
+			t.Fatalf("diff read %d blocks, expected shared subtrees to be skipped", counter.reads)
+		}
+	}
+	checkDiff(rootA, rootB, false)
+	checkDiff(rootB, rootA, true)
+
+	// Trees that share nothing still diff correctly.
+	rootC, err := tr.WriteRecords(nil, records)
+	if err != nil {
+		t.Fatalf("unexpected error with WriteRecords: '%s'", err)
+	}
+	var count int
+	_, err = tr.Diff(rootC, rootB, func(key KeyType, valueA, valueB ValueType) bool {
+		ch, ok := expected[string(key)]
+		if !ok || ch.valueA != string(valueA) || ch.valueB != string(valueB) {
+			t.Fatalf("unexpected difference at %s: %q -> %q", key, valueA, valueB)
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		t.Fatalf("unexpected error with Diff: '%s'", err)
+	}
+	if count != len(expected) {
+		t.Fatalf("expected %d differences, found %d", len(expected), count)
+	}
+}
+
+type liveAllocator struct {
+	blockfile.BlockAllocator
+	live int
+}
+
+func (la *liveAllocator) Allocate(tag interface{}) (blockfile.BlockIndex, error) {
+	index, err := la.BlockAllocator.Allocate(tag)
+	if err == nil {
+		la.live++
+	}
+	return index, err
+}
+
+func (la *liveAllocator) Free(index blockfile.BlockIndex) error {
+	la.live--
+	return la.BlockAllocator.Free(index)
+}
+
+// A failed build must not produce a tree, and abandoning it must release
+// every block the builder allocated.
+func TestBuilderAbort(t *testing.T) {
+	bf, err := blockFileCreate(1000)
+	if err != nil {
+		t.Fatalf("unexpected error creating temp file '%s'", err)
+	}
+	alloc := &liveAllocator{BlockAllocator: bf}
+
+	tr := BTree{
+		MaxKeySize: 4,
+		EntrySize:  4,
+		FanOut:     4,
+	}
+	if err := tr.Open(alloc); err != nil {
+		t.Fatal(err)
+	}
+
+	addKeys := func(builder *Builder) {
+		for i := 0; i < 500; i++ {
+			k := fmt.Sprintf("%04d", i)
+			if err := builder.Add([]byte(k), []byte(k)); err != nil {
+				t.Fatalf("unexpected error with Add: '%s'", err)
+			}
+		}
+	}
+
+	builder := tr.NewBuilder(nil)
+	addKeys(builder)
+	if err := builder.Add([]byte("0000"), []byte("0000")); err != ErrorKeyOutOfOrder {
+		t.Fatalf("expected out of order error, got '%v'", err)
+	}
+	if _, err := builder.Finish(); err != ErrorKeyOutOfOrder {
+		t.Fatalf("expected Finish to fail after out of order key, got '%v'", err)
+	}
+	if alloc.live != 0 {
+		t.Fatalf("expected all blocks to be freed, %d remain", alloc.live)
+	}
+
+	builder = tr.NewBuilder(nil)
+	addKeys(builder)
+	if err := builder.Add([]byte("toolong"), []byte("abcd")); err == nil {
+		t.Fatal("expected error adding oversized key")
+	}
+	if err := builder.Abort(); err != nil {
+		t.Fatalf("unexpected error with Abort: '%s'", err)
+	}
+	if alloc.live != 0 {
+		t.Fatalf("expected all blocks to be freed, %d remain", alloc.live)
+	}
+	if _, err := builder.Finish(); err == nil {
+		t.Fatal("expected Finish to fail after Abort")
+	}
+
+	// Aborting after a successful build leaves the tree intact.
+	builder = tr.NewBuilder(nil)
+	addKeys(builder)
+	treeRoot, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("unexpected error with Finish: '%s'", err)
+	}
+	live := alloc.live
+	if err := builder.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if alloc.live != live {
+		t.Fatal("Abort after Finish released blocks of the built tree")
+	}
+	checkTreeStructure(t, &tr, treeRoot)
+}
+
+func TestTx(t *testing.T) {
+	bf, err := blockFileCreate(1000)
+	if err != nil {
+		t.Fatalf("unexpected error creating temp file '%s'", err)
+	}
+	alloc := &liveAllocator{BlockAllocator: bf}
+
+	tr := BTree{
+		MaxKeySize: 4,
+		EntrySize:  4,
+		FanOut:     4,
+	}
+	if err := tr.Open(alloc); err != nil {
+		t.Fatal(err)
+	}
+
+	records := make(map[string]ValueType)
+	for i := 0; i < 500; i++ {
+		k := fmt.Sprintf("%04d", i*2)
+		records[k] = []byte(k)
+	}
+	root, err := tr.WriteRecords(nil, records)
+	if err != nil {
+		t.Fatalf("unexpected error with WriteRecords: '%s'", err)
+	}
+
+	checkContents := func(treeIndex TreeIndex, expected map[string]ValueType) {
+		checkTreeStructure(t, &tr, treeIndex)
+		if n, err := tr.Count(treeIndex); err != nil || n != int64(len(expected)) {
+			t.Fatalf("expected %d entries, found %d", len(expected), n)
+		}
+		for k, v := range expected {
+			value, _, err := tr.Find(treeIndex, []byte(k))
+			if err != nil {
+				t.Fatalf("unexpected error with Find: '%s'", err)
+			}
+			if !bytes.Equal(value, v) {
+				t.Fatalf("expected %q at %s, found %q", v, k, value)
+			}
+		}
+	}
+
+	modify := func(tx *Tx, expected map[string]ValueType) {
+		for i := 0; i < 100; i++ {
+			k := fmt.Sprintf("%04d", i*7)
+			if _, ok := expected[k]; ok && i%2 == 0 {
+				if err := tx.Delete([]byte(k)); err != nil {
+					t.Fatalf("unexpected error with Delete: '%s'", err)
+				}
+				delete(expected, k)
+			} else {
+				if err := tx.Insert([]byte(k), []byte("abcd"), true); err != nil {
+					t.Fatalf("unexpected error with Insert: '%s'", err)
+				}
+				expected[k] = []byte("abcd")
+			}
+		}
+	}
+
+	// Rolled back transactions leave no trace.
+	tx := tr.Begin(nil, root)
+	modify(tx, make(map[string]ValueType))
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Commit(); err != ErrorTxClosed {
+		t.Fatalf("expected ErrorTxClosed, found '%s'", err)
+	}
+
+	expected := make(map[string]ValueType)
+	for k, v := range records {
+		expected[k] = v
+	}
+	tx = tr.Begin(nil, root)
+	modify(tx, expected)
+	if err := tx.Insert([]byte("0002"), []byte("wxyz"), false); err != ErrorKeyAlreadyExists {
+		t.Fatalf("expected ErrorKeyAlreadyExists, found '%s'", err)
+	}
+	if err := tx.Delete([]byte("0001")); err != ErrorKeyNotFound {
+		t.Fatalf("expected ErrorKeyNotFound, found '%s'", err)
+	}
+	value, err := tx.Find([]byte("0007"))
+	if err != nil || !bytes.Equal(value, []byte("abcd")) {
+		t.Fatalf("expected pending insert to be visible within transaction, found %q", value)
+	}
+	if value, _, _ := tr.Find(root, []byte("0007")); value != nil {
+		t.Fatal("pending insert visible outside transaction")
+	}
+
+	newRoot, err := tx.Commit()
+	if err != nil {
+		t.Fatalf("unexpected error with Commit: '%s'", err)
+	}
+	if newRoot == root {
+		t.Fatal("expected commit to produce a new root")
+	}
+	checkContents(root, records)
+	checkContents(newRoot, expected)
+
+	if err := tx.FreeSuperseded(); err != nil {
+		t.Fatalf("unexpected error with FreeSuperseded: '%s'", err)
+	}
+	checkContents(newRoot, expected)
+
+	// Every block of the new tree should be accounted for.
+	if err := tr.FreeTree(newRoot, false); err != nil {
+		t.Fatal(err)
+	}
+	if alloc.live != 0 {
+		t.Fatalf("expected all blocks to be freed, %d remain", alloc.live)
+	}
+}
+
+// Freeing a tree should release every block, including the root, so that
+// building the same tree again reuses them.
+func TestFreeTree(t *testing.T) {
+	bf, err := blockFileCreate(1000)
+	if err != nil {
+		t.Fatalf("unexpected error creating temp file '%s'", err)
+	}
+
+	tr := BTree{
+		MaxKeySize: 4,
+		EntrySize:  4,
+		FanOut:     4,
+	}
+	err = tr.Open(bf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buildTree := func() TreeIndex {
+		treeRoot, err := tr.CreateEmpty(nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating empty tree '%s'", err)
+		}
+		for i := 0; i < 1000; i++ {
+			k := []byte(fmt.Sprintf("%04d", i))
+			if err := tr.Insert(nil, treeRoot, k, k, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return treeRoot
+	}
+
+	for i := 0; i < 3; i++ {
+		treeRoot := buildTree()
+		if err := tr.FreeTree(treeRoot, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	numBlocks, err := bf.GetNumBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	treeRoot := buildTree()
+	if err := tr.FreeTree(treeRoot, false); err != nil {
+		t.Fatal(err)
+	}
+
+	finalNumBlocks, err := bf.GetNumBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finalNumBlocks != numBlocks {
+		t.Fatalf("freed tree blocks were not reused, had=%d now=%d", numBlocks, finalNumBlocks)
+	}
+}
@@ -0,0 +1,262 @@
+package btree
+
+import (
+	"bytes"
+
+	"github.com/go-errors/errors"
+)
+
+var ErrorKeyOutOfOrder = errors.New("keys must be added in strictly increasing order")
+var ErrorBuilderAborted = errors.New("builder has been aborted")
+
+/*
+Builds a tree bottom up from entries supplied in sorted order. Blocks are
+filled completely and written exactly once rather than being split and
+rewritten repeatedly as they would be through Insert().
+
+Each level of the tree holds the block currently being filled. Once a block
+fills, the next entry at that level becomes the separator between it and a
+new block. The full block and separator are held back until the new block
+reaches minimum occupancy so that the final block of each level can be
+rebalanced with its left sibling when the build finishes. This keeps every
+non-root block at least half full, as Delete() expects.
+*/
+type Builder struct {
+	tr     *BTree
+	tag    interface{}
+	levels []*builderLevel
+
+	lastKey KeyType
+	count   int64
+	err     error
+
+	// Every block allocated by the builder that is part of the tree under
+	// construction, so that they can be released if the build is abandoned.
+	allocated map[TreeIndex]bool
+}
+
+type builderLevel struct {
+	ents  *blockEntries
+	index TreeIndex
+
+	// Full block awaiting a sufficiently filled right sibling before it and its
+	// separator can be committed.
+	pending      *blockEntries
+	pendingIndex TreeIndex
+	pendingKey   KeyType
+	pendingValue ValueType
+}
+
+// Returns a builder that writes a new tree using blocks allocated with `tag`.
+func (tr *BTree) NewBuilder(tag interface{}) *Builder {
+	return &Builder{
+		tr:        tr,
+		tag:       tag,
+		allocated: make(map[TreeIndex]bool),
+	}
+}
+
+func (b *Builder) newBlock(lvl *builderLevel, firstChild TreeIndex, firstCount int64) error {
+	index, err := b.tr.blocks.Allocate(b.tag)
+	if err != nil {
+		return err
+	}
+	b.allocated[index] = true
+
+	lvl.ents = &blockEntries{
+		children: []TreeIndex{firstChild},
+		counts:   []int64{firstCount},
+	}
+	lvl.index = index
+	return nil
+}
+
+func (b *Builder) writeBlock(index TreeIndex, ents *blockEntries) error {
+	cache := b.tr.blocks.GetCache()
+	block := cache.Pool.Get().([]byte)
+	defer cache.Pool.Put(block)
+
+	b.tr.writeEntries(block, ents)
+	return b.tr.blocks.Write(b.tag, index, block)
+}
+
+// Sets the entry count of the last child linked into level `depth`, if any.
+// Blocks are linked into their parent before they are complete so their count
+// is only known once they are written.
+func (b *Builder) setLastChildCount(depth int, count int64) {
+	if depth < len(b.levels) {
+		ents := b.levels[depth].ents
+		ents.counts[len(ents.counts)-1] = count
+	}
+}
+
+// Adds an entry with right child `child` to the level `depth`, creating the
+// level if needed with `leftChild` as its first child.
+func (b *Builder) addToLevel(depth int, key KeyType, value ValueType, leftChild TreeIndex, leftCount int64, child TreeIndex, childCount int64) error {
+	if depth == len(b.levels) {
+		lvl := &builderLevel{}
+		if err := b.newBlock(lvl, leftChild, leftCount); err != nil {
+			return err
+		}
+		b.levels = append(b.levels, lvl)
+	}
+	lvl := b.levels[depth]
+
+	if !b.tr.keysFit(append(lvl.ents.keys[:len(lvl.ents.keys):len(lvl.ents.keys)], key)) {
+		// Current block is full; hold it back with the new entry as separator.
+		lvl.pending = lvl.ents
+		lvl.pendingIndex = lvl.index
+		lvl.pendingKey = dupBytes(key)
+		lvl.pendingValue = dupBytes(value)
+		return b.newBlock(lvl, child, childCount)
+	}
+
+	lvl.ents.keys = append(lvl.ents.keys, dupBytes(key))
+	lvl.ents.values = append(lvl.ents.values, dupBytes(value))
+	lvl.ents.children = append(lvl.ents.children, child)
+	lvl.ents.counts = append(lvl.ents.counts, childCount)
+
+	if lvl.pending != nil && b.tr.keysHalfFull(lvl.ents.keys) {
+		return b.commitPending(depth)
+	}
+	return nil
+}
+
+// Writes out the pending block of level `depth` and adds its separator to the
+// parent level.
+func (b *Builder) commitPending(depth int) error {
+	lvl := b.levels[depth]
+	if err := b.writeBlock(lvl.pendingIndex, lvl.pending); err != nil {
+		return err
+	}
+	pendingCount := lvl.pending.total()
+	lvl.pending = nil
+
+	b.setLastChildCount(depth+1, pendingCount)
+	return b.addToLevel(depth+1, lvl.pendingKey, lvl.pendingValue, lvl.pendingIndex, pendingCount, lvl.index, 0)
+}
+
+// Adds an entry to the tree. Keys must be added in strictly increasing order.
+func (b *Builder) Add(key KeyType, value ValueType) error {
+	if b.err != nil {
+		return b.err
+	}
+	if err := b.tr.validateKey(key); err != nil {
+		b.err = err
+		return err
+	}
+	if err := b.tr.validateValue(value); err != nil {
+		b.err = err
+		return err
+	}
+	if b.count > 0 && bytes.Compare(b.lastKey, key) >= 0 {
+		b.err = ErrorKeyOutOfOrder
+		return b.err
+	}
+
+	b.lastKey = append(b.lastKey[:0], key...)
+	b.count++
+	if err := b.addToLevel(0, key, value, 0, 0, 0, 0); err != nil {
+		b.err = err
+		return err
+	}
+	return nil
+}
+
+// Returns the number of entries added so far.
+func (b *Builder) Count() int64 {
+	return b.count
+}
+
+// Rebalances the final block of level `depth` with its pending left sibling so
+// that both are at least half full, then writes both and adds the new
+// separator to the parent level.
+func (b *Builder) finishPending(depth int) error {
+	lvl := b.levels[depth]
+	combined := &blockEntries{
+		children: append(lvl.pending.children, lvl.ents.children...),
+		counts:   append(lvl.pending.counts, lvl.ents.counts...),
+		keys:     append(append(lvl.pending.keys, lvl.pendingKey), lvl.ents.keys...),
+		values:   append(append(lvl.pending.values, lvl.pendingValue), lvl.ents.values...),
+	}
+	lvl.pending = nil
+
+	groups, err := b.tr.writeGroups(b.tag, combined, []TreeIndex{lvl.pendingIndex, lvl.index})
+	if err != nil {
+		return err
+	}
+	delete(b.allocated, lvl.pendingIndex)
+	delete(b.allocated, lvl.index)
+	for _, child := range groups.children {
+		b.allocated[child] = true
+	}
+
+	b.setLastChildCount(depth+1, groups.counts[0])
+	for i := range groups.keys {
+		err := b.addToLevel(depth+1, groups.keys[i], groups.values[i], groups.children[i], groups.counts[i], groups.children[i+1], groups.counts[i+1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes out all remaining blocks and returns the root of the new tree. If any
+// Add() failed, or writing fails, the blocks allocated by the builder are
+// released and an error is returned. The builder may not be used after calling
+// Finish().
+func (b *Builder) Finish() (TreeIndex, error) {
+	if b.err != nil {
+		b.Abort()
+		return 0, b.err
+	}
+	root, err := b.finish()
+	if err != nil {
+		b.err = err
+		b.Abort()
+		return 0, err
+	}
+	b.levels = nil
+	b.allocated = nil
+	return root, nil
+}
+
+func (b *Builder) finish() (TreeIndex, error) {
+	if len(b.levels) == 0 {
+		return b.tr.CreateEmpty(b.tag)
+	}
+
+	for depth := 0; depth < len(b.levels); depth++ {
+		lvl := b.levels[depth]
+		if lvl.pending != nil {
+			if err := b.finishPending(depth); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		if err := b.writeBlock(lvl.index, lvl.ents); err != nil {
+			return 0, err
+		}
+		b.setLastChildCount(depth+1, lvl.ents.total())
+	}
+	return b.levels[len(b.levels)-1].index, nil
+}
+
+// Abandons the build, releasing every block allocated by the builder. Has no
+// effect once Finish() has returned a tree. The builder may not be used after
+// calling Abort().
+func (b *Builder) Abort() error {
+	if b.err == nil {
+		b.err = ErrorBuilderAborted
+	}
+	var firstErr error
+	for index := range b.allocated {
+		if err := b.tr.blocks.Free(index); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	b.levels = nil
+	b.allocated = nil
+	return firstErr
+}
@@ -0,0 +1,90 @@
+package btree
+
+import (
+	"github.com/go-errors/errors"
+)
+
+var ErrorRankOutOfRange = errors.New("rank out of range")
+
+// Returns the number of entries in the tree rooted at `treeIndex`.
+func (tr *BTree) Count(treeIndex TreeIndex) (int64, error) {
+	cache := tr.blocks.GetCache()
+	block := cache.Pool.Get().([]byte)
+	defer cache.Pool.Put(block)
+
+	_, err := tr.blocks.Read(treeIndex, block)
+	if err != nil {
+		return 0, err
+	}
+	return tr.getBlockCount(block), nil
+}
+
+// Returns the number of entries in the tree rooted at `treeIndex` with keys
+// less than `key`. If `key` is present this is its zero-based rank.
+func (tr *BTree) Rank(treeIndex TreeIndex, key KeyType) (int64, error) {
+	cache := tr.blocks.GetCache()
+	block := cache.Pool.Get().([]byte)
+	defer cache.Pool.Put(block)
+
+	var rank int64
+	for treeIndex != 0 {
+		_, err := tr.blocks.Read(treeIndex, block)
+		if err != nil {
+			return 0, err
+		}
+
+		insertInd, match, err := tr.searchBlock(block, key)
+		if err != nil {
+			return 0, err
+		}
+
+		rank += int64(insertInd)
+		for i := 0; i < insertInd; i++ {
+			rank += tr.getChildCount(block, i)
+		}
+		if match {
+			return rank + tr.getChildCount(block, insertInd), nil
+		}
+		treeIndex = tr.getBlockChild(block, insertInd)
+	}
+	return rank, nil
+}
+
+// Returns the entry with zero-based rank `rank` in the tree rooted at
+// `treeIndex`.
+func (tr *BTree) Select(treeIndex TreeIndex, rank int64) (KeyType, ValueType, IndexType, error) {
+	cache := tr.blocks.GetCache()
+	block := cache.Pool.Get().([]byte)
+	defer cache.Pool.Put(block)
+
+	if rank < 0 {
+		return nil, nil, 0, ErrorRankOutOfRange
+	}
+	for treeIndex != 0 {
+		_, err := tr.blocks.Read(treeIndex, block)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		size := tr.getBlockSize(block)
+		childTree := TreeIndex(0)
+		for i := 0; i <= size; i++ {
+			childCount := tr.getChildCount(block, i)
+			if rank < childCount {
+				childTree = tr.getBlockChild(block, i)
+				break
+			}
+			rank -= childCount
+
+			if i < size {
+				if rank == 0 {
+					index := treeIndex*int64(tr.FanOut) + int64(i)
+					return tr.getNodeKey(block, i, nil), dupBytes(tr.getNodeValue(block, i)), index, nil
+				}
+				rank--
+			}
+		}
+		treeIndex = childTree
+	}
+	return nil, nil, 0, ErrorRankOutOfRange
+}
@@ -16,15 +16,18 @@ func (tr *BTree) Delete(tag interface{}, treeIndex TreeIndex, key KeyType) error
 		return err
 	}
 
-	block, _, _, err := tr.deleteHelper(tag, treeIndex, key)
-	defer tr.blocks.GetCache().Pool.Put(block)
+	ents, _, _, err := tr.deleteHelper(tag, treeIndex, key)
 	if err != nil {
 		return err
 	}
 
-	if tr.getBlockSize(block) == 0 {
+	cache := tr.blocks.GetCache()
+	block := cache.Pool.Get().([]byte)
+	defer cache.Pool.Put(block)
+
+	if len(ents.keys) == 0 && ents.children[0] != 0 {
 		// Root has emptied out, copy child into root node and delete child.
-		childIndex := tr.getBlockChild(block, 0)
+		childIndex := ents.children[0]
 
 		_, err = tr.blocks.Read(childIndex, block)
 		if err != nil {
@@ -42,20 +45,35 @@ func (tr *BTree) Delete(tag interface{}, treeIndex TreeIndex, key KeyType) error
 		return tr.blocks.Free(childIndex)
 	}
 
+	if !tr.keysFit(ents.keys) {
+		// Replacing a separator with a longer key overflowed the root. Move its
+		// entries into new blocks beneath a new root.
+		ents, err = tr.writeGroups(tag, ents, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	tr.writeEntries(block, ents)
 	return tr.blocks.Write(tag, treeIndex, block)
 }
 
-func (tr *BTree) deleteHelper(tag interface{}, treeIndex TreeIndex, key KeyType) ([]byte, KeyType, ValueType, error) {
-	cache := tr.blocks.GetCache()
-	block := cache.Pool.Get().([]byte)
-
+// Deletes `key` from the tree rooted at `treeIndex`, or the largest key if
+// `key` is nil. Returns the updated entries of the block, which the caller is
+// responsible for writing as they may no longer fit within a single block or
+// may have become too small.
+func (tr *BTree) deleteHelper(tag interface{}, treeIndex TreeIndex, key KeyType) (*blockEntries, KeyType, ValueType, error) {
 	if treeIndex == 0 {
-		return block, nil, nil, ErrorKeyNotFound
+		return nil, nil, nil, ErrorKeyNotFound
 	}
 
+	cache := tr.blocks.GetCache()
+	block := cache.Pool.Get().([]byte)
+	defer cache.Pool.Put(block)
+
 	_, err := tr.blocks.Read(treeIndex, block)
 	if err != nil {
-		return block, nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	var insertInd int
@@ -70,175 +88,159 @@ func (tr *BTree) deleteHelper(tag interface{}, treeIndex TreeIndex, key KeyType)
 	} else {
 		insertInd, match, err = tr.searchBlock(block, key)
 		if err != nil {
-			return block, nil, nil, err
+			return nil, nil, nil, err
 		}
 	}
 
-	childTree := tr.getBlockChild(block, insertInd)
-	var childBlock []byte
+	ents := tr.readEntries(block)
+	childTree := ents.children[insertInd]
+
+	var childEnts *blockEntries
 	var deletedKey KeyType
 	var deletedValue ValueType
-
-	blockSize := tr.getBlockSize(block)
 	if match {
+		deletedKey = ents.keys[insertInd]
+		deletedValue = ents.values[insertInd]
 		if childTree == 0 {
-			if key == nil {
-				// we only need to copy the deleted key/value if we were doing a deleted
-				// max operation.
-				deletedKey = dupBytes(tr.getNodeKey(tr.getNodeSlice(block, insertInd)))
-				deletedValue = dupBytes(tr.getNodeValue(tr.getNodeSlice(block, insertInd)))
-			}
-
-			// Shift over elements on top of deleted element, no children to shift.
-			for i := insertInd; i+1 < blockSize; i++ {
-				copy(tr.getNodeSlice(block, i), tr.getNodeSlice(block, i+1))
-			}
-			tr.setBlockSize(block, blockSize-1)
-
-			return block, deletedKey, deletedValue, nil
+			// Remove the element, no children to shift.
+			ents.remove(insertInd)
+			return ents, deletedKey, deletedValue, nil
 		}
 
-		childBlock, deletedKey, deletedValue, err = tr.deleteHelper(tag, childTree, nil)
-		defer cache.Pool.Put(childBlock)
+		// Replace the element with its predecessor.
+		var predKey KeyType
+		var predValue ValueType
+		childEnts, predKey, predValue, err = tr.deleteHelper(tag, childTree, nil)
 		if err != nil {
-			return block, nil, nil, err
+			return nil, nil, nil, err
 		}
-
-		tr.setNode(tr.getNodeSlice(block, insertInd), deletedKey, deletedValue)
+		ents.keys[insertInd] = predKey
+		ents.values[insertInd] = predValue
 	} else {
-		childBlock, deletedKey, deletedValue, err = tr.deleteHelper(tag, childTree, key)
-		defer cache.Pool.Put(childBlock)
+		childEnts, deletedKey, deletedValue, err = tr.deleteHelper(tag, childTree, key)
 		if err != nil {
-			return block, nil, nil, err
+			return nil, nil, nil, err
 		}
 	}
 
-	childBlockSize := tr.getBlockSize(childBlock)
-	if childBlockSize*2 >= tr.FanOut {
+	if err := tr.updateChild(tag, ents, insertInd, childEnts); err != nil {
+		return nil, nil, nil, err
+	}
+	return ents, deletedKey, deletedValue, nil
+}
+
+// Writes `childEnts` as the new contents of child `childInd` of `ents`. If the
+// child is too small, or no longer fits within a block, it is combined with a
+// sibling and the entries redistributed between as many blocks as needed.
+func (tr *BTree) updateChild(tag interface{}, ents *blockEntries, childInd int, childEnts *blockEntries) error {
+	cache := tr.blocks.GetCache()
+	block := cache.Pool.Get().([]byte)
+	defer cache.Pool.Put(block)
+
+	childTree := ents.children[childInd]
+	if tr.keysFit(childEnts.keys) && tr.keysHalfFull(childEnts.keys) {
 		// Child size is fine
-		childTree, err := tr.copyUpBlock(tag, childTree, childBlock)
+		tr.writeEntries(block, childEnts)
+		childTree, err := tr.copyUpBlock(tag, childTree, block)
 		if err != nil {
-			return block, nil, nil, err
+			return err
 		}
-
-		tr.setBlockChild(block, insertInd, childTree)
-		return block, deletedKey, deletedValue, nil
+		ents.children[childInd] = childTree
+		ents.counts[childInd] = childEnts.total()
+		return nil
 	}
 
-	// Child is too small, match up with sibling
-	sibIndex := insertInd - 1
-	if sibIndex < 0 {
-		sibIndex = insertInd + 1
+	// Child is too small or too large, match up with sibling
+	sibInd := childInd - 1
+	if sibInd < 0 {
+		sibInd = childInd + 1
 	}
-	sibTree := tr.getBlockChild(block, sibIndex)
-
-	sibBlock := cache.Pool.Get().([]byte)
-	defer cache.Pool.Put(sibBlock)
+	sibTree := ents.children[sibInd]
 
-	_, err = tr.blocks.Read(sibTree, sibBlock)
+	_, err := tr.blocks.Read(sibTree, block)
 	if err != nil {
-		return block, nil, nil, err
+		return err
 	}
-	sibBlockSize := tr.getBlockSize(sibBlock)
-
-	// Normalize so that childX refers to the larger sibling
-	if insertInd < sibIndex {
-		sibIndex, insertInd = insertInd, sibIndex
-		sibBlock, childBlock = childBlock, sibBlock
-		sibTree, childTree = childTree, sibTree
-		sibBlockSize, childBlockSize = childBlockSize, sibBlockSize
+	sibEnts := tr.readEntries(block)
+
+	// Normalize so that the child is the right block of the pair
+	leftInd := sibInd
+	leftEnts, rightEnts := sibEnts, childEnts
+	if childInd < sibInd {
+		leftInd = childInd
+		leftEnts, rightEnts = childEnts, sibEnts
 	}
 
-	if childBlockSize+sibBlockSize >= tr.FanOut {
-		// Rebalance nodes with sibling block
-		var childTrees []TreeIndex
-		var nodeKeys []KeyType
-		var nodeValues []ValueType
-		for i := 0; i <= sibBlockSize; i++ {
-			childTrees = append(childTrees, tr.getBlockChild(sibBlock, i))
-			if i < sibBlockSize {
-				nodeKeys = append(nodeKeys, tr.getNodeKey(tr.getNodeSlice(sibBlock, i)))
-				nodeValues = append(nodeValues, tr.getNodeValue(tr.getNodeSlice(sibBlock, i)))
-			}
-		}
-		nodeKeys = append(nodeKeys, tr.getNodeKey(tr.getNodeSlice(block, sibIndex)))
-		nodeValues = append(nodeValues, tr.getNodeValue(tr.getNodeSlice(block, sibIndex)))
-		for i := 0; i <= childBlockSize; i++ {
-			childTrees = append(childTrees, tr.getBlockChild(childBlock, i))
-			if i < childBlockSize {
-				nodeKeys = append(nodeKeys, tr.getNodeKey(tr.getNodeSlice(childBlock, i)))
-				nodeValues = append(nodeValues, tr.getNodeValue(tr.getNodeSlice(childBlock, i)))
-			}
-		}
-
-		// Calculate new block sizes
-		sibBlockSize = (len(nodeKeys) - 1) / 2
-		childBlockSize = len(nodeKeys) - 1 - sibBlockSize
+	combined := &blockEntries{
+		children: append(append([]TreeIndex(nil), leftEnts.children...), rightEnts.children...),
+		counts:   append(append([]int64(nil), leftEnts.counts...), rightEnts.counts...),
+		keys:     append(append(append([]KeyType(nil), leftEnts.keys...), ents.keys[leftInd]), rightEnts.keys...),
+		values:   append(append(append([]ValueType(nil), leftEnts.values...), ents.values[leftInd]), rightEnts.values...),
+	}
 
-		sibBlock = cache.Pool.Get().([]byte)
-		defer cache.Pool.Put(sibBlock)
+	groups, err := tr.writeGroups(tag, combined, ents.children[leftInd:leftInd+2])
+	if err != nil {
+		return err
+	}
 
-		// Copy values back into blocks
-		tr.setBlockSize(sibBlock, sibBlockSize)
-		for i := 0; i <= sibBlockSize; i++ {
-			tr.setBlockChild(sibBlock, i, childTrees[i])
-			if i < sibBlockSize {
-				tr.setNode(tr.getNodeSlice(sibBlock, i), nodeKeys[i], nodeValues[i])
-			}
-		}
+	ents.children = append(append(append([]TreeIndex(nil), ents.children[:leftInd]...), groups.children...), ents.children[leftInd+2:]...)
+	ents.counts = append(append(append([]int64(nil), ents.counts[:leftInd]...), groups.counts...), ents.counts[leftInd+2:]...)
+	ents.keys = append(append(append([]KeyType(nil), ents.keys[:leftInd]...), groups.keys...), ents.keys[leftInd+1:]...)
+	ents.values = append(append(append([]ValueType(nil), ents.values[:leftInd]...), groups.values...), ents.values[leftInd+1:]...)
+	return nil
+}
 
-		childBlock = cache.Pool.Get().([]byte)
-		defer cache.Pool.Put(childBlock)
+// Partitions `ents` into as few blocks as possible and writes them out,
+// reusing the blocks in `reuse` where possible and freeing any left unused.
+// Returns the entries of a block linking to the written blocks.
+func (tr *BTree) writeGroups(tag interface{}, ents *blockEntries, reuse []TreeIndex) (*blockEntries, error) {
+	cache := tr.blocks.GetCache()
+	block := cache.Pool.Get().([]byte)
+	defer cache.Pool.Put(block)
 
-		tr.setBlockSize(childBlock, childBlockSize)
-		for i := 0; i <= childBlockSize; i++ {
-			tr.setBlockChild(childBlock, i, childTrees[sibBlockSize+1+i])
-			if i < childBlockSize {
-				tr.setNode(tr.getNodeSlice(childBlock, i), nodeKeys[sibBlockSize+1+i], nodeValues[sibBlockSize+1+i])
+	result := &blockEntries{}
+
+	seps := append(tr.partitionKeys(ents.keys), len(ents.keys))
+	start := 0
+	for i, sep := range seps {
+		group := ents.slice(start, sep)
+		tr.writeEntries(block, group)
+
+		var err error
+		var index TreeIndex
+		if i < len(reuse) {
+			index, err = tr.copyUpBlock(tag, reuse[i], block)
+		} else {
+			index, err = tr.blocks.Allocate(tag)
+			if err == nil {
+				err = tr.blocks.Write(tag, index, block)
 			}
 		}
-
-		sibTree, err = tr.copyUpBlock(tag, sibTree, sibBlock)
 		if err != nil {
-			return block, nil, nil, err
+			return nil, err
 		}
 
-		childTree, err = tr.copyUpBlock(tag, childTree, childBlock)
-		if err != nil {
-			return block, nil, nil, err
+		result.children = append(result.children, index)
+		result.counts = append(result.counts, group.total())
+		if sep < len(ents.keys) {
+			result.keys = append(result.keys, ents.keys[sep])
+			result.values = append(result.values, ents.values[sep])
 		}
-
-		tr.setNode(tr.getNodeSlice(block, sibIndex), nodeKeys[sibBlockSize], nodeValues[sibBlockSize])
-		tr.setBlockChild(block, sibIndex, sibTree)
-		tr.setBlockChild(block, sibIndex+1, childTree)
-
-		return block, deletedKey, deletedValue, nil
+		start = sep + 1
 	}
 
-	// Merge with sibling block
-	copy(tr.getNodeSlice(sibBlock, sibBlockSize), tr.getNodeSlice(block, sibIndex))
-	for i := 0; i <= childBlockSize; i++ {
-		tr.setBlockChild(sibBlock, sibBlockSize+1+i, tr.getBlockChild(childBlock, i))
-		if i < childBlockSize {
-			copy(tr.getNodeSlice(sibBlock, sibBlockSize+1+i), tr.getNodeSlice(childBlock, i))
+	for i := len(seps); i < len(reuse); i++ {
+		if index := reuse[i]; !tr.blocks.IsBlockReadOnly(index) {
+			if err := tr.blocks.Free(index); err != nil {
+				return nil, err
+			}
 		}
 	}
-	tr.setBlockSize(sibBlock, sibBlockSize+childBlockSize+1)
-
-	sibTree, err = tr.copyUpBlock(tag, sibTree, sibBlock)
-	if err != nil {
-		return block, nil, nil, err
-	}
-
-	for i := sibIndex; i+1 < blockSize; i++ {
-		tr.setBlockChild(block, i+1, tr.getBlockChild(block, i+2))
-		copy(tr.getNodeSlice(block, i), tr.getNodeSlice(block, i+1))
-	}
-	tr.setBlockSize(block, blockSize-1)
-
-	return block, deletedKey, deletedValue, nil
+	return result, nil
 }
 
+// Frees every block in the tree rooted at `treeIndex`. Read only blocks (and
+// their children) are skipped if `ignoreReadOnly` is set.
 func (tr *BTree) FreeTree(treeIndex TreeIndex, ignoreReadOnly bool) error {
 	if tr.blocks.IsBlockReadOnly(treeIndex) {
 		if ignoreReadOnly {
@@ -265,5 +267,5 @@ func (tr *BTree) FreeTree(treeIndex TreeIndex, ignoreReadOnly bool) error {
 			}
 		}
 	}
-	return nil
+	return tr.blocks.Free(treeIndex)
 }
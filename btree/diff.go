@@ -0,0 +1,179 @@
+package btree
+
+import (
+	"bytes"
+)
+
+// Pending item in the traversal of one side of a diff. Either a subtree that
+// has not yet been expanded or a single entry.
+type diffItem struct {
+	// Subtree root, or 0 if this item is an entry.
+	treeIndex TreeIndex
+	height    int
+
+	// Exclusive lower bound on the keys within the subtree; nil if unbounded.
+	// For entries this is the entry's key.
+	key   KeyType
+	value ValueType
+}
+
+type diffSide struct {
+	tr *BTree
+
+	// Items remaining to visit, in reverse order.
+	stack []diffItem
+}
+
+func (ds *diffSide) empty() bool {
+	return len(ds.stack) == 0
+}
+
+func (ds *diffSide) top() *diffItem {
+	return &ds.stack[len(ds.stack)-1]
+}
+
+func (ds *diffSide) pop() diffItem {
+	item := ds.stack[len(ds.stack)-1]
+	ds.stack = ds.stack[:len(ds.stack)-1]
+	return item
+}
+
+// Replaces the subtree at the top of the stack with its entries and child
+// subtrees.
+func (ds *diffSide) expand(block []byte) error {
+	item := ds.pop()
+	_, err := ds.tr.blocks.Read(item.treeIndex, block)
+	if err != nil {
+		return err
+	}
+
+	size := ds.tr.getBlockSize(block)
+	for i := size; i >= 0; i-- {
+		if child := ds.tr.getBlockChild(block, i); child != 0 {
+			lo := item.key
+			if i > 0 {
+				lo = ds.tr.getNodeKey(block, i-1, nil)
+			}
+			ds.stack = append(ds.stack, diffItem{
+				treeIndex: child,
+				height:    item.height - 1,
+				key:       lo,
+			})
+		}
+		if i > 0 {
+			ds.stack = append(ds.stack, diffItem{
+				key:   ds.tr.getNodeKey(block, i-1, nil),
+				value: dupBytes(ds.tr.getNodeValue(block, i-1)),
+			})
+		}
+	}
+	return nil
+}
+
+// Returns the height of the tree rooted at `treeIndex`; leaves have height 0.
+func (tr *BTree) treeHeight(treeIndex TreeIndex, block []byte) (int, error) {
+	height := 0
+	for {
+		_, err := tr.blocks.Read(treeIndex, block)
+		if err != nil {
+			return 0, err
+		}
+		treeIndex = tr.getBlockChild(block, 0)
+		if treeIndex == 0 {
+			return height, nil
+		}
+		height++
+	}
+}
+
+// Compares the trees rooted at `treeA` and `treeB`, invoking entryCallback in
+// key order for each key whose entry differs between the trees. valueA is nil
+// for keys only present in treeB and valueB is nil for keys only present in
+// treeA. Subtrees shared by both trees, as left behind by copy on write, are
+// skipped without being read. If entryCallback returns false the diff will
+// terminate.
+func (tr *BTree) Diff(treeA, treeB TreeIndex, entryCallback func(key KeyType, valueA, valueB ValueType) bool) (bool, error) {
+	if treeA == treeB {
+		return true, nil
+	}
+
+	cache := tr.blocks.GetCache()
+	block := cache.Pool.Get().([]byte)
+	defer cache.Pool.Put(block)
+
+	heightA, err := tr.treeHeight(treeA, block)
+	if err != nil {
+		return false, err
+	}
+	heightB, err := tr.treeHeight(treeB, block)
+	if err != nil {
+		return false, err
+	}
+
+	a := &diffSide{tr: tr, stack: []diffItem{{treeIndex: treeA, height: heightA}}}
+	b := &diffSide{tr: tr, stack: []diffItem{{treeIndex: treeB, height: heightB}}}
+	for !a.empty() || !b.empty() {
+		var itemA, itemB *diffItem
+		if !a.empty() {
+			itemA = a.top()
+		}
+		if !b.empty() {
+			itemB = b.top()
+		}
+
+		// Shared subtrees are identical; skip them entirely.
+		if itemA != nil && itemB != nil && itemA.treeIndex != 0 && itemA.treeIndex == itemB.treeIndex {
+			a.pop()
+			b.pop()
+			continue
+		}
+
+		// An entry can be compared once the other side's top entry or subtree
+		// cannot contain a smaller key.
+		readyA := itemA != nil && itemA.treeIndex == 0 && (itemB == nil || itemB.treeIndex == 0 ||
+			(itemB.key != nil && bytes.Compare(itemA.key, itemB.key) <= 0))
+		readyB := itemB != nil && itemB.treeIndex == 0 && (itemA == nil || itemA.treeIndex == 0 ||
+			(itemA.key != nil && bytes.Compare(itemB.key, itemA.key) <= 0))
+
+		if !readyA && !readyB {
+			// Expand a subtree, preferring the taller one so that subtrees shared
+			// by both trees line up at equal heights.
+			side := a
+			if itemA == nil || itemA.treeIndex == 0 || (itemB != nil && itemB.treeIndex != 0 && itemB.height > itemA.height) {
+				side = b
+			}
+			if err := side.expand(block); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		ctn := true
+		if readyA && readyB {
+			cmp := bytes.Compare(itemA.key, itemB.key)
+			if cmp < 0 {
+				ctn = entryCallback(itemA.key, itemA.value, nil)
+				a.pop()
+			} else if cmp > 0 {
+				ctn = entryCallback(itemB.key, nil, itemB.value)
+				b.pop()
+			} else {
+				if !bytes.Equal(itemA.value, itemB.value) {
+					ctn = entryCallback(itemA.key, itemA.value, itemB.value)
+				}
+				a.pop()
+				b.pop()
+			}
+		} else if readyA {
+			ctn = entryCallback(itemA.key, itemA.value, nil)
+			a.pop()
+		} else {
+			ctn = entryCallback(itemB.key, nil, itemB.value)
+			b.pop()
+		}
+		if !ctn {
+			return false, nil
+		}
+	}
+	return true, nil
+}
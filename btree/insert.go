@@ -2,6 +2,7 @@ package btree
 
 import (
 	"errors"
+	"sort"
 )
 
 var ErrorKeyAlreadyExists = errors.New("key already exists")
@@ -19,7 +20,7 @@ func (tr *BTree) Insert(tag interface{}, treeIndex TreeIndex, key KeyType, value
 		return err
 	}
 
-	tr1, tr2, key, value, err := tr.insertHelper(tag, treeIndex, key, value, overwrite)
+	tr1, tr2, count1, count2, key, value, err := tr.insertHelper(tag, treeIndex, key, value, overwrite)
 	if err != nil {
 		return err
 	}
@@ -51,160 +52,139 @@ func (tr *BTree) Insert(tag interface{}, treeIndex TreeIndex, key KeyType, value
 		return err
 	}
 
-	tr.setBlockSize(block, 1)
-	tr.setBlockChild(block, 0, newIndex)
-	tr.setBlockChild(block, 1, tr2)
-	tr.setNode(tr.getNodeSlice(block, 0), key, value)
-
+	tr.writeEntries(block, &blockEntries{
+		children: []TreeIndex{newIndex, tr2},
+		counts:   []int64{count1, count2},
+		keys:     []KeyType{key},
+		values:   []ValueType{value},
+	})
 	return tr.blocks.Write(tag, treeIndex, block)
 }
 
-func (tr *BTree) insertHelper(tag interface{}, treeIndex TreeIndex, key KeyType, value ValueType, overwrite bool) (TreeIndex, TreeIndex, KeyType, ValueType, error) {
+// Inserts into the tree rooted at `treeIndex`. Returns the new index of the
+// block and the number of entries beneath it. If the block had to be split the
+// second block, its count, and the separating key and value are also returned.
+func (tr *BTree) insertHelper(tag interface{}, treeIndex TreeIndex, key KeyType, value ValueType, overwrite bool) (TreeIndex, TreeIndex, int64, int64, KeyType, ValueType, error) {
 	cache := tr.blocks.GetCache()
 	block := cache.Pool.Get().([]byte)
 	defer cache.Pool.Put(block)
 
 	_, err := tr.blocks.Read(treeIndex, block)
 	if err != nil {
-		return 0, 0, nil, nil, err
+		return 0, 0, 0, 0, nil, nil, err
 	}
 
 	insertInd, match, err := tr.searchBlock(block, key)
 	if err != nil {
-		return 0, 0, nil, nil, err
+		return 0, 0, 0, 0, nil, nil, err
 	}
 
 	// Handle case where there's an exact key match.
 	if match {
 		if !overwrite {
-			return 0, 0, nil, nil, ErrorKeyAlreadyExists
+			return 0, 0, 0, 0, nil, nil, ErrorKeyAlreadyExists
 		}
 
-		tr.setNode(tr.getNodeSlice(block, insertInd), key, value)
+		copy(tr.getNodeValue(block, insertInd), value)
 		treeIndex, err = tr.copyUpBlock(tag, treeIndex, block)
 		if err != nil {
-			return 0, 0, nil, nil, err
+			return 0, 0, 0, 0, nil, nil, err
 		}
 
-		return treeIndex, 0, nil, nil, nil
+		return treeIndex, 0, tr.getBlockCount(block), 0, nil, nil, nil
 	}
 
 	var tr1 TreeIndex
 	var tr2 TreeIndex
+	var count1 int64
+	var count2 int64
 
 	// Continue inserting down the tree if needed.
 	childTree := tr.getBlockChild(block, insertInd)
 	if childTree != 0 {
-		tr1, tr2, key, value, err = tr.insertHelper(tag, childTree, key, value, overwrite)
+		tr1, tr2, count1, count2, key, value, err = tr.insertHelper(tag, childTree, key, value, overwrite)
 		if err != nil {
-			return 0, 0, nil, nil, err
+			return 0, 0, 0, 0, nil, nil, err
 		}
 
 		if tr2 == 0 {
 			// Insert into child was clean
 			tr.setBlockChild(block, insertInd, tr1)
+			tr.setChildCount(block, insertInd, count1)
 
 			treeIndex, err = tr.copyUpBlock(tag, treeIndex, block)
 			if err != nil {
-				return 0, 0, nil, nil, err
+				return 0, 0, 0, 0, nil, nil, err
 			}
-			return treeIndex, 0, nil, nil, err
+			return treeIndex, 0, tr.getBlockCount(block), 0, nil, nil, err
 		}
 	}
 
 	// We have to insert new node (key, value) with children (tr1, tr2)
-	blockSize := tr.getBlockSize(block)
-	if blockSize < tr.FanOut {
-		// We have room for the new child directly in our block.
-
-		// Shift over our child pointers
-		for i := blockSize; i >= insertInd+1; i-- {
-			tr.setBlockChild(block, i+1, tr.getBlockChild(block, i))
-		}
-		tr.setBlockChild(block, insertInd+1, tr2)
-		tr.setBlockChild(block, insertInd, tr1)
-
-		// Shift over our node data
-		for i := blockSize - 1; i >= insertInd; i-- {
-			copy(tr.getNodeSlice(block, i+1), tr.getNodeSlice(block, i))
-		}
-		tr.setNode(tr.getNodeSlice(block, insertInd), key, value)
-
-		tr.setBlockSize(block, blockSize+1)
+	ents := tr.readEntries(block)
+	ents.children[insertInd] = tr1
+	ents.counts[insertInd] = count1
+	ents.insert(insertInd, key, value, tr2, count2)
+	if tr.keysFit(ents.keys) {
+		// We have room for the new node directly in our block.
+		tr.writeEntries(block, ents)
 
 		treeIndex, err = tr.copyUpBlock(tag, treeIndex, block)
 		if err != nil {
-			return 0, 0, nil, nil, err
-		}
-		return treeIndex, 0, nil, nil, nil
-	}
-
-	// List out the children and nodes in order
-	var childTrees []TreeIndex
-	var nodeKeys []KeyType
-	var nodeValues []ValueType
-	for i := 0; i <= blockSize; i++ {
-		if i == insertInd {
-			childTrees = append(childTrees, tr1)
-			childTrees = append(childTrees, tr2)
-			nodeKeys = append(nodeKeys, key)
-			nodeValues = append(nodeValues, value)
-		} else {
-			childTrees = append(childTrees, tr.getBlockChild(block, i))
-		}
-		if i < blockSize {
-			nodeKeys = append(nodeKeys, tr.getNodeKey(tr.getNodeSlice(block, i)))
-			nodeValues = append(nodeValues, tr.getNodeValue(tr.getNodeSlice(block, i)))
+			return 0, 0, 0, 0, nil, nil, err
 		}
+		return treeIndex, 0, ents.total(), 0, nil, nil, nil
+	}
+
+	// Otherwise we will have to split our own node as well
+	seps := tr.partitionKeys(ents.keys)
+	if len(seps) != 1 {
+		return 0, 0, 0, 0, nil, nil, errors.New("unexpected block split")
 	}
+	sep := seps[0]
 
+	entsA := ents.slice(0, sep)
 	blockA := cache.Pool.Get().([]byte)
 	defer cache.Pool.Put(blockA)
+	tr.writeEntries(blockA, entsA)
 
+	entsB := ents.slice(sep+1, len(ents.keys))
 	blockB := cache.Pool.Get().([]byte)
 	defer cache.Pool.Put(blockB)
+	tr.writeEntries(blockB, entsB)
 
-	newBlockSize := tr.FanOut / 2
-	tr.setBlockSize(blockA, newBlockSize)
-	tr.setBlockSize(blockB, newBlockSize)
-
-	for i := 0; i <= newBlockSize; i++ {
-		tr.setBlockChild(blockA, i, childTrees[i])
-		tr.setBlockChild(blockB, i, childTrees[newBlockSize+i+1])
-		if i < newBlockSize {
-			tr.setNode(tr.getNodeSlice(blockA, i), nodeKeys[i], nodeValues[i])
-			tr.setNode(tr.getNodeSlice(blockB, i), nodeKeys[newBlockSize+i+1], nodeValues[newBlockSize+i+1])
-		}
-	}
-
-	// Otherwise we will have to split our own node as well
 	treeIndexA, err := tr.copyUpBlock(tag, treeIndex, blockA)
 	if err != nil {
-		return 0, 0, nil, nil, err
+		return 0, 0, 0, 0, nil, nil, err
 	}
 
-	treeIndexB, err := tr.blocks.Allocate(tr)
+	treeIndexB, err := tr.blocks.Allocate(tag)
 	if err != nil {
-		return 0, 0, nil, nil, err
+		return 0, 0, 0, 0, nil, nil, err
 	}
-	err = tr.blocks.Write(tr, treeIndexB, blockB)
+	err = tr.blocks.Write(tag, treeIndexB, blockB)
 	if err != nil {
-		return 0, 0, nil, nil, err
+		return 0, 0, 0, 0, nil, nil, err
 	}
 
-	return treeIndexA, treeIndexB, dupBytes(nodeKeys[newBlockSize]), dupBytes(nodeValues[newBlockSize]), nil
+	return treeIndexA, treeIndexB, entsA.total(), entsB.total(), ents.keys[sep], ents.values[sep], nil
 }
 
+// Writes a new tree containing all the entries in `data`.
 func (tr *BTree) WriteRecords(tag interface{}, data map[string]ValueType) (TreeIndex, error) {
-	treeNode, err := tr.CreateEmpty(tag)
-	if err != nil {
-		return 0, err
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
 	}
-	for key, value := range data {
-		err := tr.Insert(tag, treeNode, KeyType(key), value, false)
+	sort.Strings(keys)
+
+	builder := tr.NewBuilder(tag)
+	for _, key := range keys {
+		err := builder.Add(KeyType(key), data[key])
 		if err != nil {
+			builder.Abort()
 			return 0, err
 		}
 	}
-	return treeNode, nil
+	return builder.Finish()
 }
@@ -0,0 +1,300 @@
+package btree
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"github.com/go-errors/errors"
+
+	"github.com/msg555/ctrfs/blockfile"
+)
+
+// A position is a stable 64-bit identifier for an entry in a tree. Unlike an
+// IndexType, which names the slot an entry currently occupies, an entry's
+// position is assigned by a PositionIndex from a hash of its key and does not
+// change as other entries are inserted or deleted. Positions are not ordered
+// with respect to keys.
+type Position = uint64
+
+const (
+	// Reserved position never assigned to an entry. Callers may use it to
+	// start iteration at the first entry.
+	PositionStart Position = 0
+
+	// Reserved position never assigned to an entry. Callers may use it to mark
+	// the end of iteration.
+	PositionEnd Position = ^Position(0)
+)
+
+var ErrorPositionNotFound = errors.New("position not found")
+
+// Returns the preferred position of the entry with the passed key. The entry
+// is assigned a later position if another key already holds this one.
+func KeyPosition(key KeyType) Position {
+	hsh := fnv.New64a()
+	hsh.Write(key)
+
+	pos := hsh.Sum64()
+	if pos == PositionStart {
+		pos++
+	} else if pos == PositionEnd {
+		pos--
+	}
+	return pos
+}
+
+// Remembers the keys of recently visited positions so that iteration can be
+// resumed from a position even if the entry at that position has since been
+// deleted. Safe for concurrent use.
+type PositionCache struct {
+	// Maximum number of positions to remember. Set to 0 to remember all
+	// positions added.
+	MaxSize int
+
+	lock      sync.Mutex
+	keys      map[Position]*list.Element
+	evictList list.List
+}
+
+type positionCacheEntry struct {
+	Position Position
+	Key      KeyType
+}
+
+func (pc *PositionCache) Add(pos Position, key KeyType) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	if pc.keys == nil {
+		pc.keys = make(map[Position]*list.Element)
+	}
+	if elem, ok := pc.keys[pos]; ok {
+		pc.evictList.MoveToBack(elem)
+		return
+	}
+
+	pc.keys[pos] = pc.evictList.PushBack(&positionCacheEntry{
+		Position: pos,
+		Key:      dupBytes(key),
+	})
+	if pc.MaxSize > 0 && pc.evictList.Len() > pc.MaxSize {
+		elem := pc.evictList.Front()
+		pc.evictList.Remove(elem)
+		delete(pc.keys, elem.Value.(*positionCacheEntry).Position)
+	}
+}
+
+func (pc *PositionCache) Lookup(pos Position) (KeyType, bool) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	elem, ok := pc.keys[pos]
+	if !ok {
+		return nil, false
+	}
+	return elem.Value.(*positionCacheEntry).Key, true
+}
+
+// Returns the smallest key that sorts after `key`.
+func KeySuccessor(key KeyType) KeyType {
+	result := make([]byte, len(key)+1)
+	copy(result, key)
+	return result
+}
+
+// Maximum number of positions following KeyPosition(key) that are tried when
+// assigning a position to `key`. Bounding the probe keeps lookups to a small
+// window of the position index even after colliding keys are removed.
+const maxPositionProbes = 64
+
+var ErrorPositionsExhausted = errors.New("no free position near key")
+
+// Returns the position following `pos`, skipping reserved positions.
+func nextPosition(pos Position) Position {
+	pos++
+	if pos == PositionEnd {
+		pos = PositionStart + 1
+	}
+	return pos
+}
+
+// Assigns positions to `keys` as a PositionIndex built from them in the same
+// order would. Returns the position of each key.
+func AssignPositions(keys []KeyType) ([]Position, error) {
+	return assignPositions(keys, KeyPosition)
+}
+
+func assignPositions(keys []KeyType, keyPosition func(KeyType) Position) ([]Position, error) {
+	used := make(map[Position]bool, len(keys))
+	positions := make([]Position, len(keys))
+	for i, key := range keys {
+		pos, err := assignPosition(key, keyPosition, used)
+		if err != nil {
+			return nil, err
+		}
+		used[pos] = true
+		positions[i] = pos
+	}
+	return positions, nil
+}
+
+// Returns the position a PositionIndex would assign to `key` if it already
+// held the positions in `used`.
+func AssignPosition(key KeyType, used map[Position]bool) (Position, error) {
+	return assignPosition(key, KeyPosition, used)
+}
+
+func assignPosition(key KeyType, keyPosition func(KeyType) Position, used map[Position]bool) (Position, error) {
+	pos := keyPosition(key)
+	for probes := 0; used[pos]; probes++ {
+		if probes+1 == maxPositionProbes {
+			return 0, ErrorPositionsExhausted
+		}
+		pos = nextPosition(pos)
+	}
+	return pos, nil
+}
+
+/*
+A position index assigns each key of another tree a unique position and maps
+positions back to keys. A key is given the first free position starting from
+KeyPosition(key), probing at most maxPositionProbes positions, so that keys
+whose hashes collide still get distinct positions. Assignments are stored and
+do not change while the key remains in the index.
+
+Entry
+
+	key   - position uint64 (big endian)
+	        key      []byte
+	value - none
+*/
+type PositionIndex struct {
+	tree BTree
+
+	// Computes the preferred position of a key. Replaced by tests to force
+	// collisions.
+	keyPosition func(KeyType) Position
+}
+
+// Opens a position index for keys of up to `maxKeySize` bytes.
+func (pi *PositionIndex) Open(bf blockfile.BlockAllocator, maxKeySize int) error {
+	pi.tree = BTree{
+		MaxKeySize: 8 + maxKeySize,
+	}
+	pi.keyPosition = KeyPosition
+	return pi.tree.Open(bf)
+}
+
+func positionIndexKey(pos Position, key KeyType) KeyType {
+	result := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(result, pos)
+	copy(result[8:], key)
+	return result
+}
+
+func (pi *PositionIndex) CreateEmpty(tag interface{}) (TreeIndex, error) {
+	return pi.tree.CreateEmpty(tag)
+}
+
+func (pi *PositionIndex) FreeTree(treeIndex TreeIndex, ignoreReadOnly bool) error {
+	return pi.tree.FreeTree(treeIndex, ignoreReadOnly)
+}
+
+// Writes a new position index holding `keys`, assigning positions in the
+// order the keys are given. Returns the root of the index and the position
+// of each key.
+func (pi *PositionIndex) Build(tag interface{}, keys []KeyType) (TreeIndex, []Position, error) {
+	positions, err := assignPositions(keys, pi.keyPosition)
+	if err != nil {
+		return 0, nil, err
+	}
+	treeIndex, err := pi.BuildAssigned(tag, keys, positions)
+	return treeIndex, positions, err
+}
+
+// Writes a new position index holding `keys` at the previously assigned
+// `positions`. Positions must be distinct and each must be within the probe
+// window of its key, as those given by AssignPositions() are.
+func (pi *PositionIndex) BuildAssigned(tag interface{}, keys []KeyType, positions []Position) (TreeIndex, error) {
+	indexKeys := make([]KeyType, len(keys))
+	for i, key := range keys {
+		indexKeys[i] = positionIndexKey(positions[i], key)
+	}
+	sort.Slice(indexKeys, func(i, j int) bool {
+		return bytes.Compare(indexKeys[i], indexKeys[j]) < 0
+	})
+
+	builder := pi.tree.NewBuilder(tag)
+	for _, indexKey := range indexKeys {
+		if err := builder.Add(indexKey, nil); err != nil {
+			builder.Abort()
+			return 0, err
+		}
+	}
+	return builder.Finish()
+}
+
+// Returns the key assigned `pos` or ErrorPositionNotFound if there is none.
+func (pi *PositionIndex) Key(treeIndex TreeIndex, pos Position) (KeyType, error) {
+	indexKey, _, _, err := pi.tree.LowerBound(treeIndex, positionIndexKey(pos, nil))
+	if err != nil {
+		return nil, err
+	}
+	if indexKey == nil || binary.BigEndian.Uint64(indexKey) != pos {
+		return nil, ErrorPositionNotFound
+	}
+	return dupBytes(indexKey[8:]), nil
+}
+
+// Returns the position assigned to `key` or ErrorPositionNotFound if it has
+// not been assigned one.
+func (pi *PositionIndex) Position(treeIndex TreeIndex, key KeyType) (Position, error) {
+	pos := pi.keyPosition(key)
+	for i := 0; i < maxPositionProbes; i++ {
+		val, _, err := pi.tree.Find(treeIndex, positionIndexKey(pos, key))
+		if err != nil {
+			return 0, err
+		}
+		if val != nil {
+			return pos, nil
+		}
+		pos = nextPosition(pos)
+	}
+	return 0, ErrorPositionNotFound
+}
+
+// Assigns a position to `key` if it does not already have one. Returns the
+// position of the key.
+func (pi *PositionIndex) Assign(tag interface{}, treeIndex TreeIndex, key KeyType) (Position, error) {
+	pos, err := pi.Position(treeIndex, key)
+	if err != ErrorPositionNotFound {
+		return pos, err
+	}
+
+	pos = pi.keyPosition(key)
+	for i := 0; i < maxPositionProbes; i++ {
+		_, err := pi.Key(treeIndex, pos)
+		if err == ErrorPositionNotFound {
+			return pos, pi.tree.Insert(tag, treeIndex, positionIndexKey(pos, key), nil, false)
+		} else if err != nil {
+			return 0, err
+		}
+		pos = nextPosition(pos)
+	}
+	return 0, ErrorPositionsExhausted
+}
+
+// Removes the position assigned to `key`, if any.
+func (pi *PositionIndex) Release(tag interface{}, treeIndex TreeIndex, key KeyType) error {
+	pos, err := pi.Position(treeIndex, key)
+	if err == ErrorPositionNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return pi.tree.Delete(tag, treeIndex, positionIndexKey(pos, key))
+}
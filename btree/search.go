@@ -21,14 +21,8 @@ func (tr *BTree) searchBlock(block []byte, key KeyType) (int, bool, error) {
 	}
 	for {
 		md := lo + (hi-lo)/2
-		nodeData := tr.getNodeSlice(block, md)
 
-		nodeKey := tr.getNodeKey(nodeData)
-		if len(nodeKey) == 0 {
-			return 0, false, errors.New("unexpected key")
-		}
-
-		cmp := bytes.Compare(key, nodeKey)
+		cmp := tr.compareNodeKey(block, md, key)
 		if cmp == 0 {
 			return md, true, nil
 		} else if cmp == -1 {
@@ -45,105 +39,266 @@ func (tr *BTree) searchBlock(block []byte, key KeyType) (int, bool, error) {
 	}
 }
 
-// Start scanning entries at the given offset (pass 0 to start at the beginning).
-// Scan() will invoke entryCallback
-// for each entry. If entryCallback returns false the scan will terminate.
-// A scan can be resumed starting at a given entry by passing back the offset
-// parameter sent to the callback function.
-func (tr *BTree) Scan(treeIndex TreeIndex, startKey KeyType, entryCallback func(index IndexType, key KeyType, value ValueType) bool) (bool, error) {
-	cache := tr.blocks.GetCache()
+// Iterates over the entries of a tree within a key range. Obtain a cursor with
+// Range() and then call Next() until it returns false:
+//
+//	c := tr.Range(treeIndex, lo, hi, false)
+//	defer c.Close()
+//	for c.Next() {
+//	  ... c.Key(), c.Value(), c.Index()
+//	}
+//	if err := c.Err(); err != nil {
+//	  ...
+//	}
+//
+// The cursor holds copies of the blocks along its current path so the tree
+// should not be modified while a cursor is in use.
+type Cursor struct {
+	tr        *BTree
+	treeIndex TreeIndex
+	lo        KeyType
+	hi        KeyType
+	reverse   bool
+
+	// Blocks along the path from the root to the current entry. The entry
+	// position at each level is the next entry to visit at that level once
+	// any deeper levels are exhausted.
+	stackBlocks       [][]byte
+	stackBlockIndexes []TreeIndex
+	stackIndexes      []int
+	stackDepth        int
+
+	started bool
+	done    bool
+	err     error
+
+	key   KeyType
+	value ValueType
+	index IndexType
+
+	// Buffer the current key is assembled into.
+	keyBuf KeyType
+}
 
-	var stackBlocks [][]byte
-	var stackBlockIndexes []TreeIndex
-	var stackIndexes []int
-	for treeIndex != 0 {
-		block := cache.Pool.Get().([]byte)
-		defer cache.Pool.Put(block)
+// Returns a cursor over all entries with keys in [lo, hi) in the tree rooted
+// at treeIndex. Pass nil for lo or hi to leave that end of the range
+// unbounded. If reverse is set entries are visited in descending key order.
+func (tr *BTree) Range(treeIndex TreeIndex, lo, hi KeyType, reverse bool) *Cursor {
+	return &Cursor{
+		tr:         tr,
+		treeIndex:  treeIndex,
+		lo:         lo,
+		hi:         hi,
+		reverse:    reverse,
+		stackDepth: -1,
+	}
+}
 
-		_, err := tr.blocks.Read(treeIndex, block)
+// Reads block `treeIndex` into the stack at depth `stackDepth+1`, reusing any
+// buffer already allocated at that depth.
+func (c *Cursor) push(treeIndex TreeIndex) ([]byte, error) {
+	depth := c.stackDepth + 1
+
+	var block []byte
+	if depth < len(c.stackBlocks) {
+		block = c.stackBlocks[depth]
+	} else {
+		block = c.tr.blocks.GetCache().Pool.Get().([]byte)
+		c.stackBlocks = append(c.stackBlocks, block)
+	}
+
+	_, err := c.tr.blocks.Read(treeIndex, block)
+	if err != nil {
+		return nil, err
+	}
+
+	c.stackBlockIndexes = append(c.stackBlockIndexes[:depth], treeIndex)
+	c.stackIndexes = append(c.stackIndexes[:depth], 0)
+	c.stackDepth = depth
+	return block, nil
+}
+
+// Descends from the root to the first entry in the range.
+func (c *Cursor) seek(treeIndex TreeIndex) error {
+	for treeIndex != 0 {
+		block, err := c.push(treeIndex)
 		if err != nil {
-			return false, err
+			return err
+		}
+
+		if !c.reverse {
+			insertInd, match, err := c.tr.searchBlock(block, c.lo)
+			if err != nil {
+				return err
+			}
+			c.stackIndexes[c.stackDepth] = insertInd
+			if match {
+				return nil
+			}
+			treeIndex = c.tr.getBlockChild(block, insertInd)
+		} else {
+			insertInd := c.tr.getBlockSize(block)
+			if c.hi != nil {
+				insertInd, _, err = c.tr.searchBlock(block, c.hi)
+				if err != nil {
+					return err
+				}
+			}
+			c.stackIndexes[c.stackDepth] = insertInd - 1
+			treeIndex = c.tr.getBlockChild(block, insertInd)
 		}
+	}
+	return nil
+}
+
+// Moves past the entry at the top of the stack descending to the next
+// entry in iteration order.
+func (c *Cursor) advance() error {
+	block := c.stackBlocks[c.stackDepth]
+	index := c.stackIndexes[c.stackDepth]
+
+	var childIndex TreeIndex
+	if !c.reverse {
+		c.stackIndexes[c.stackDepth] = index + 1
+		childIndex = c.tr.getBlockChild(block, index+1)
+	} else {
+		c.stackIndexes[c.stackDepth] = index - 1
+		childIndex = c.tr.getBlockChild(block, index)
+	}
 
-		insertInd, match, err := tr.searchBlock(block, startKey)
+	for childIndex != 0 {
+		block, err := c.push(childIndex)
 		if err != nil {
-			return false, err
+			return err
 		}
 
-		stackBlocks = append(stackBlocks, block)
-		stackBlockIndexes = append(stackBlockIndexes, treeIndex)
-		stackIndexes = append(stackIndexes, insertInd)
-		if match {
-			break
+		if !c.reverse {
+			childIndex = c.tr.getBlockChild(block, 0)
+		} else {
+			size := c.tr.getBlockSize(block)
+			c.stackIndexes[c.stackDepth] = size - 1
+			childIndex = c.tr.getBlockChild(block, size)
 		}
+	}
+	return nil
+}
 
-		treeIndex = tr.getBlockChild(block, insertInd)
+func (c *Cursor) finish(err error) bool {
+	c.done = true
+	c.err = err
+	c.key = nil
+	c.value = nil
+	c.Close()
+	return false
+}
+
+// Advances the cursor to the next entry in the range. Returns false once the
+// range is exhausted or an error occurs; check Err() to distinguish the two.
+func (c *Cursor) Next() bool {
+	if c.done {
+		return false
+	}
+
+	var err error
+	if !c.started {
+		c.started = true
+		err = c.seek(c.treeIndex)
+	} else {
+		err = c.advance()
+	}
+	if err != nil {
+		return c.finish(err)
 	}
 
-	moveUp := false
-	stackDepth := len(stackIndexes) - 1
+	// Move up past any exhausted levels.
 	for {
-		if moveUp {
-			for {
-				childIndex := tr.getBlockChild(stackBlocks[stackDepth], stackIndexes[stackDepth])
-				if childIndex == 0 {
-					break
-				}
+		if c.stackDepth == -1 {
+			return c.finish(nil)
+		}
+		index := c.stackIndexes[c.stackDepth]
+		if index >= 0 && index < c.tr.getBlockSize(c.stackBlocks[c.stackDepth]) {
+			break
+		}
+		c.stackDepth--
+	}
 
-				var block []byte
-				if stackDepth+1 < len(stackBlocks) {
-					block = stackBlocks[stackDepth+1]
-				} else {
-					block = cache.Pool.Get().([]byte)
-					defer cache.Pool.Put(block)
-					stackBlocks = append(stackBlocks, block)
-				}
+	block := c.stackBlocks[c.stackDepth]
+	index := c.stackIndexes[c.stackDepth]
 
-				_, err := tr.blocks.Read(childIndex, block)
-				if err != nil {
-					return false, err
-				}
+	key := c.tr.getNodeKey(block, index, c.keyBuf)
+	c.keyBuf = key
+	if len(key) == 0 {
+		return c.finish(errors.New("unexpected key"))
+	}
+	if !c.reverse && c.hi != nil && bytes.Compare(key, c.hi) >= 0 {
+		return c.finish(nil)
+	}
+	if c.reverse && c.lo != nil && bytes.Compare(key, c.lo) < 0 {
+		return c.finish(nil)
+	}
 
-				stackBlockIndexes = append(stackBlockIndexes, childIndex)
-				stackIndexes = append(stackIndexes, 0)
-				stackDepth++
-			}
-		}
-		moveUp = true
+	c.key = key
+	c.value = c.tr.getNodeValue(block, index)
+	c.index = c.stackBlockIndexes[c.stackDepth]*int64(c.tr.FanOut) + int64(index)
+	return true
+}
 
-		for {
-			if stackDepth == -1 {
-				return true, nil
-			}
-			block := stackBlocks[stackDepth]
-			index := stackIndexes[stackDepth]
-			if index == tr.getBlockSize(block) {
-				stackDepth--
-			} else {
-				break
-			}
-		}
+// Returns the key of the current entry. The returned slice is only valid
+// until the next call to Next().
+func (c *Cursor) Key() KeyType {
+	return c.key
+}
 
-		stackBlockIndexes = stackBlockIndexes[:stackDepth+1]
-		stackIndexes = stackIndexes[:stackDepth+1]
+// Returns the value of the current entry. The returned slice is only valid
+// until the next call to Next().
+func (c *Cursor) Value() ValueType {
+	return c.value
+}
 
-		block := stackBlocks[stackDepth]
-		blockIndex := stackBlockIndexes[stackDepth]
-		index := stackIndexes[stackDepth]
-		nodeData := tr.getNodeSlice(block, index)
+// Returns the index of the current entry suitable to pass to ByIndex().
+func (c *Cursor) Index() IndexType {
+	return c.index
+}
 
-		key := tr.getNodeKey(nodeData)
-		if len(key) == 0 {
-			return false, errors.New("unexpected key")
-		}
+// Returns the error, if any, that terminated iteration.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Releases the block buffers held by the cursor. Close is called
+// automatically once Next() returns false but may be called early to stop
+// iterating.
+func (c *Cursor) Close() {
+	if c.stackBlocks == nil {
+		return
+	}
+	cache := c.tr.blocks.GetCache()
+	for _, block := range c.stackBlocks {
+		cache.Pool.Put(block)
+	}
+	c.stackBlocks = nil
+	c.stackDepth = -1
+	c.done = true
+}
 
-		value := tr.getNodeValue(nodeData)
-		if !entryCallback(blockIndex*int64(tr.FanOut)+int64(index), key, value) {
+// Start scanning entries at the given offset (pass 0 to start at the beginning).
+// Scan() will invoke entryCallback
+// for each entry. If entryCallback returns false the scan will terminate.
+// A scan can be resumed starting at a given entry by passing back the offset
+// parameter sent to the callback function.
+func (tr *BTree) Scan(treeIndex TreeIndex, startKey KeyType, entryCallback func(index IndexType, key KeyType, value ValueType) bool) (bool, error) {
+	c := tr.Range(treeIndex, startKey, nil, false)
+	defer c.Close()
+
+	for c.Next() {
+		if !entryCallback(c.Index(), c.Key(), c.Value()) {
 			return false, nil
 		}
-
-		stackIndexes[stackDepth]++
 	}
+	if err := c.Err(); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 func (tr *BTree) LowerBound(treeIndex TreeIndex, key KeyType) (KeyType, ValueType, IndexType, error) {
@@ -207,6 +362,8 @@ func (tr *BTree) ByIndex(index IndexType) (KeyType, ValueType, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	sl := tr.getNodeSlice(block, pos)
-	return dupBytes(tr.getNodeKey(sl)), dupBytes(tr.getNodeValue(sl)), nil
+	if pos >= tr.getBlockSize(block) {
+		return nil, nil, errors.New("index out of range")
+	}
+	return tr.getNodeKey(block, pos, nil), dupBytes(tr.getNodeValue(block, pos)), nil
 }
@@ -0,0 +1,296 @@
+package btree
+
+import (
+	"sort"
+
+	"github.com/go-errors/errors"
+
+	"github.com/msg555/ctrfs/blockfile"
+)
+
+var ErrorTxClosed = errors.New("transaction already committed or rolled back")
+
+/*
+Groups a set of modifications to a tree so that they become visible all at
+once. Modifications are buffered in memory until Commit(), which applies them
+by path copying: every block that changes is written to a newly allocated
+block, leaving the blocks of the original tree untouched. Commit() returns the
+root of the new tree; the caller publishes it by swapping the single root
+reference it holds. Readers of the original root continue to see the tree as
+it was before the transaction for as long as they need it.
+
+Once no reader can still reach the original root, FreeSuperseded() releases
+the blocks of the original tree that are not shared with the new tree.
+*/
+type Tx struct {
+	tr   *BTree
+	tag  interface{}
+	root TreeIndex
+
+	// Pending modifications keyed by key. A nil value marks a deletion.
+	pending map[string]ValueType
+
+	alloc   *txAllocator
+	newRoot TreeIndex
+	done    bool
+}
+
+// Wraps the tree's allocator so that every block that existed before the
+// transaction appears read only, forcing copy on write for each modified
+// block. Blocks allocated by the transaction are tracked so they can be
+// released on rollback.
+type txAllocator struct {
+	blockfile.BlockAllocator
+	allocated map[TreeIndex]bool
+}
+
+func (a *txAllocator) Allocate(tag interface{}) (TreeIndex, error) {
+	index, err := a.BlockAllocator.Allocate(tag)
+	if err != nil {
+		return 0, err
+	}
+	a.allocated[index] = true
+	return index, nil
+}
+
+func (a *txAllocator) Free(index TreeIndex) error {
+	if !a.allocated[index] {
+		return errors.New("attempt to free block not owned by transaction")
+	}
+	delete(a.allocated, index)
+	return a.BlockAllocator.Free(index)
+}
+
+func (a *txAllocator) IsBlockReadOnly(index TreeIndex) bool {
+	return !a.allocated[index] || a.BlockAllocator.IsBlockReadOnly(index)
+}
+
+// Starts a transaction against the tree rooted at `treeIndex`. Any blocks
+// written by the transaction are allocated with `tag`.
+func (tr *BTree) Begin(tag interface{}, treeIndex TreeIndex) *Tx {
+	return &Tx{
+		tr:      tr,
+		tag:     tag,
+		root:    treeIndex,
+		pending: make(map[string]ValueType),
+	}
+}
+
+// Looks up `key` as seen by the transaction, including its pending
+// modifications.
+func (tx *Tx) Find(key KeyType) (ValueType, error) {
+	if tx.done {
+		return nil, ErrorTxClosed
+	}
+	if value, ok := tx.pending[string(key)]; ok {
+		if value == nil {
+			return nil, nil
+		}
+		return dupBytes(value), nil
+	}
+	value, _, err := tx.tr.Find(tx.root, key)
+	return value, err
+}
+
+// Buffers the insertion of `key`. Fails with ErrorKeyAlreadyExists if the key
+// is present and `overwrite` is false.
+func (tx *Tx) Insert(key KeyType, value ValueType, overwrite bool) error {
+	if tx.done {
+		return ErrorTxClosed
+	}
+	if err := tx.tr.validateKey(key); err != nil {
+		return err
+	}
+	if err := tx.tr.validateValue(value); err != nil {
+		return err
+	}
+	if !overwrite {
+		existing, err := tx.Find(key)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return ErrorKeyAlreadyExists
+		}
+	}
+	tx.pending[string(key)] = dupBytes(value)
+	return nil
+}
+
+// Buffers the deletion of `key`. Fails with ErrorKeyNotFound if the key is not
+// present.
+func (tx *Tx) Delete(key KeyType) error {
+	if tx.done {
+		return ErrorTxClosed
+	}
+	if err := tx.tr.validateKey(key); err != nil {
+		return err
+	}
+	existing, err := tx.Find(key)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return ErrorKeyNotFound
+	}
+	tx.pending[string(key)] = nil
+	return nil
+}
+
+// Applies the pending modifications to a copy of the tree and returns the root
+// of the new tree. If there were no modifications the original root is
+// returned. On error all blocks written by the transaction are released and
+// the original tree remains as it was.
+func (tx *Tx) Commit() (TreeIndex, error) {
+	if tx.done {
+		return 0, ErrorTxClosed
+	}
+	tx.done = true
+	if len(tx.pending) == 0 {
+		tx.newRoot = tx.root
+		return tx.root, nil
+	}
+
+	tx.alloc = &txAllocator{
+		BlockAllocator: tx.tr.blocks,
+		allocated:      make(map[TreeIndex]bool),
+	}
+	txTree := *tx.tr
+	txTree.blocks = tx.alloc
+
+	newRoot, err := tx.apply(&txTree)
+	if err != nil {
+		tx.releaseAllocated()
+		return 0, err
+	}
+	tx.newRoot = newRoot
+	return newRoot, nil
+}
+
+func (tx *Tx) apply(txTree *BTree) (TreeIndex, error) {
+	keys := make([]string, 0, len(tx.pending))
+	for key := range tx.pending {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// The root is the only block modified in place so give the transaction its
+	// own copy; all other blocks are copied up as they are modified.
+	newRoot, err := blockfile.Duplicate(tx.tag, txTree.blocks, tx.root, false)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		if value := tx.pending[key]; value != nil {
+			err = txTree.Insert(tx.tag, newRoot, KeyType(key), value, true)
+		} else {
+			err = txTree.Delete(tx.tag, newRoot, KeyType(key))
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return newRoot, nil
+}
+
+func (tx *Tx) releaseAllocated() error {
+	var firstErr error
+	for index := range tx.alloc.allocated {
+		if err := tx.tr.blocks.Free(index); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	tx.alloc.allocated = nil
+	return firstErr
+}
+
+// Discards the transaction. If called after a successful Commit() the blocks
+// of the new tree are released instead, leaving the original tree as the only
+// valid root.
+func (tx *Tx) Rollback() error {
+	tx.pending = nil
+	if !tx.done {
+		tx.done = true
+		return nil
+	}
+	if tx.alloc == nil || tx.alloc.allocated == nil {
+		return nil
+	}
+	return tx.releaseAllocated()
+}
+
+// Frees the blocks of the original tree that are no longer referenced by the
+// committed tree. Must only be called once the new root has been published
+// and no readers of the original root remain.
+func (tx *Tx) FreeSuperseded() error {
+	if !tx.done || tx.alloc == nil || tx.alloc.allocated == nil {
+		return nil
+	}
+
+	cache := tx.tr.blocks.GetCache()
+	block := cache.Pool.Get().([]byte)
+	defer cache.Pool.Put(block)
+
+	// Collect the blocks of the original tree that were carried over into the
+	// new tree unchanged.
+	shared := make(map[TreeIndex]bool)
+	var walkNew func(TreeIndex) error
+	walkNew = func(index TreeIndex) error {
+		if !tx.alloc.allocated[index] {
+			shared[index] = true
+			return nil
+		}
+		_, err := tx.tr.blocks.Read(index, block)
+		if err != nil {
+			return err
+		}
+		ents := tx.tr.readEntries(block)
+		for _, child := range ents.children {
+			if child != 0 {
+				if err := walkNew(child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walkNew(tx.newRoot); err != nil {
+		return err
+	}
+
+	var superseded []TreeIndex
+	var walkOld func(TreeIndex) error
+	walkOld = func(index TreeIndex) error {
+		if shared[index] {
+			return nil
+		}
+		if !tx.tr.blocks.IsBlockReadOnly(index) {
+			superseded = append(superseded, index)
+		}
+		_, err := tx.tr.blocks.Read(index, block)
+		if err != nil {
+			return err
+		}
+		ents := tx.tr.readEntries(block)
+		for _, child := range ents.children {
+			if child != 0 {
+				if err := walkOld(child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walkOld(tx.root); err != nil {
+		return err
+	}
+
+	// The new tree now owns its blocks outright.
+	tx.alloc.allocated = nil
+	for _, index := range superseded {
+		if err := tx.tr.blocks.Free(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
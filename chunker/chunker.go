@@ -0,0 +1,146 @@
+// Implements content-defined chunking of byte streams using the FastCDC
+// algorithm. Chunk boundaries are chosen based on a rolling gear hash of the
+// data so that inserting or removing bytes only disturbs the chunks near the
+// edit. This lets similar files share most of their chunks even when their
+// contents have shifted.
+package chunker
+
+import (
+	"io"
+)
+
+var gearTable [256]uint64
+
+func init() {
+	// The gear table must never change as chunk boundaries (and therefore
+	// deduplication across imports) depend on it. Generate it with splitmix64
+	// from a fixed seed rather than relying on an external PRNG.
+	seed := uint64(0x6374726673636463)
+	for i := range gearTable {
+		seed += 0x9E3779B97F4A7C15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// Returns a mask selecting the `bits` most significant bits. The gear hash
+// shifts left each byte so the high bits depend on the largest window.
+func highMask(bits uint) uint64 {
+	return ^uint64(0) << (64 - bits)
+}
+
+// Splits a stream into content-defined chunks. Create one with New().
+type Chunker struct {
+	// No chunk other than the last will be smaller than MinSize.
+	MinSize int
+
+	// Chunks are biased towards this size using normalized chunking.
+	NormalSize int
+
+	// No chunk will be larger than MaxSize.
+	MaxSize int
+
+	maskS uint64
+	maskL uint64
+
+	rd    io.Reader
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+// Creates a chunker that reads from `rd` and produces chunks no larger than
+// `maxSize`. Chunks will typically be between half and all of `maxSize`
+// bytes long which makes them a good fit for storing one chunk per block.
+func New(rd io.Reader, maxSize int) *Chunker {
+	minSize := maxSize / 2
+	normalSize := maxSize * 3 / 4
+
+	bits := uint(0)
+	for (1 << (bits + 1)) <= normalSize-minSize {
+		bits++
+	}
+	if bits < 2 {
+		bits = 2
+	}
+
+	return &Chunker{
+		MinSize:    minSize,
+		NormalSize: normalSize,
+		MaxSize:    maxSize,
+		maskS:      highMask(bits + 2),
+		maskL:      highMask(bits - 2),
+		rd:         rd,
+		buf:        make([]byte, 2*maxSize),
+	}
+}
+
+func (c *Chunker) fill() error {
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+
+	for c.end < len(c.buf) && !c.eof {
+		n, err := c.rd.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the length of the first chunk in data.
+func (c *Chunker) cutPoint(data []byte) int {
+	if len(data) <= c.MinSize {
+		return len(data)
+	}
+
+	n := len(data)
+	if n > c.MaxSize {
+		n = c.MaxSize
+	}
+	normal := c.NormalSize
+	if normal > n {
+		normal = n
+	}
+
+	fp := uint64(0)
+	i := c.MinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Returns the next chunk from the stream or io.EOF once the stream has been
+// exhausted. The returned slice is only valid until the next call to Next().
+func (c *Chunker) Next() ([]byte, error) {
+	if c.end-c.start < c.MaxSize && !c.eof {
+		if err := c.fill(); err != nil {
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.cutPoint(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
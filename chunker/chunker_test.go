@@ -0,0 +1,71 @@
+package chunker
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunkAll(t *testing.T, data []byte, maxSize int) [][]byte {
+	var chunks [][]byte
+	c := New(bytes.NewReader(data), maxSize)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error chunking data '%s'", err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+	return chunks
+}
+
+func TestChunkBounds(t *testing.T) {
+	rng := rand.New(rand.NewSource(555))
+	data := make([]byte, 1000000)
+	rng.Read(data)
+
+	chunks := chunkAll(t, data, 4096)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("chunks do not reassemble to original data")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > 4096 {
+			t.Fatalf("chunk too large, got=%d", len(chunk))
+		}
+		if i+1 < len(chunks) && len(chunk) < 2048 {
+			t.Fatalf("chunk too small, got=%d", len(chunk))
+		}
+	}
+
+	if len(chunkAll(t, nil, 4096)) != 0 {
+		t.Fatal("expected no chunks from empty stream")
+	}
+}
+
+func TestChunkShift(t *testing.T) {
+	rng := rand.New(rand.NewSource(555))
+	data := make([]byte, 1000000)
+	rng.Read(data)
+
+	shifted := append([]byte{0x55}, data...)
+
+	chunkSet := make(map[string]bool)
+	for _, chunk := range chunkAll(t, data, 4096) {
+		chunkSet[string(chunk)] = true
+	}
+
+	shared := 0
+	chunks := chunkAll(t, shifted, 4096)
+	for _, chunk := range chunks {
+		if chunkSet[string(chunk)] {
+			shared++
+		}
+	}
+	if shared*10 < len(chunks)*9 {
+		t.Fatalf("too few chunks shared after insert, got=%d of %d", shared, len(chunks))
+	}
+}
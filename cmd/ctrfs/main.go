@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 
+	"bazil.org/fuse"
 	"github.com/go-errors/errors"
 	"github.com/spf13/pflag"
 	"golang.org/x/sys/unix"
@@ -15,12 +16,20 @@ import (
 )
 
 func main() {
+	allowDev := pflag.Bool("allow-dev", false, "allow device nodes within the mount to be used")
+	fsync := pflag.String("fsync", "ignore", "fsync policy; one of 'ignore', 'file' or 'full'")
 	pflag.Parse()
 	if pflag.NArg() != 2 {
 		fmt.Println("Must specify mount point and root address")
 		os.Exit(1)
 	}
 
+	syncPolicy, err := fusefs.ParseSyncPolicy(*fsync)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	srv, err := fusefs.CreateDefaultServer()
 	if err != nil {
 		log.Fatal("failed to initialize", err)
@@ -34,7 +43,12 @@ func main() {
 		log.Fatal("failed to decode content address", err)
 	}
 
-	err = srv.Mount(pflag.Arg(0), rootAddress, false)
+	var options []fuse.MountOption
+	if *allowDev {
+		options = append(options, fuse.AllowDev())
+	}
+
+	err = srv.Mount(pflag.Arg(0), rootAddress, false, syncPolicy, options...)
 	if err != nil {
 		gerr, ok := err.(*errors.Error)
 		if ok {
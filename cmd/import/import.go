@@ -7,21 +7,25 @@ import (
 	"os"
 
 	"github.com/go-errors/errors"
+	"github.com/spf13/pflag"
 
 	"github.com/msg555/ctrfs/storage"
 )
 
+var chunked = pflag.Bool("chunked", false, "split files into content-defined chunks")
+
 func help() {
-	fmt.Printf("%s (dir|tar) file [file ...]\n", os.Args[0])
+	fmt.Printf("%s [--chunked] (dir|tar) file [file ...]\n", os.Args[0])
 }
 
 func main() {
-	if len(os.Args) < 3 {
+	pflag.Parse()
+	if pflag.NArg() < 2 {
 		help()
 		os.Exit(1)
 	}
 
-	mode := os.Args[1]
+	mode := pflag.Arg(0)
 	if mode != "dir" && mode != "tar" {
 		help()
 		os.Exit(1)
@@ -32,20 +36,23 @@ func main() {
 		log.Fatal(err)
 	}
 
-	for _, file := range os.Args[2:] {
+	sc.ContentDefinedChunking = *chunked
+
+	for _, file := range pflag.Args()[1:] {
 		if file == "-" {
 			file = "/dev/stdin"
 		}
 
 		var err error
 		var nd *storage.StorageNode
+		var stats *storage.ImportStats
 		if mode == "dir" {
-			nd, err = sc.ImportPath(file)
+			nd, stats, err = sc.ImportPath(file)
 		} else {
 			var f *os.File
 			f, err = os.Open(file)
 			if err == nil {
-				nd, err = sc.ImportTar(f)
+				nd, stats, err = sc.ImportTar(f)
 				f.Close()
 			}
 		}
@@ -58,6 +65,7 @@ func main() {
 			}
 		} else {
 			fmt.Printf("imported '%s' as %s\n", file, hex.EncodeToString(nd.NodeAddress[:]))
+			fmt.Printf("  %d bytes stored, %d bytes deduplicated\n", stats.BytesStored, stats.BytesDeduplicated)
 		}
 	}
 
@@ -1,9 +1,8 @@
 package fusefs
 
-//EROFS
-
 import (
 	"fmt"
+	"log"
 	"sync"
 
 	"bazil.org/fuse"
@@ -20,34 +19,49 @@ type Connection struct {
 	Conn       *fuse.Conn
 	MountPoint string
 	ReadOnly   bool
+	SyncPolicy SyncPolicy
 	Mount      *storage.MountView
 
 	handleLock   sync.RWMutex
 	handleMap    map[fuse.HandleID]Handle
 	lastHandleID fuse.HandleID
+
+	nodes nodeTable
+	locks lockManager
 }
 
 func (conn *Connection) Serve() error {
 	for {
 		req, err := conn.Conn.ReadRequest()
 		if err != nil {
+			if releaseErr := conn.releaseNodes(); releaseErr != nil {
+				log.Printf("Failed to release nodes of '%s': %s", conn.MountPoint, releaseErr)
+			}
 			return err
 		}
+		if lockReq, ok := req.(*fuse.LockWaitRequest); ok {
+			// Track lock waits before reading any interrupt for them
+			conn.locks.trackInterrupt(lockReq.ID)
+		}
 		go conn.handleRequest(req)
 	}
 }
 
-func (conn *Connection) GetInode(inodeId fuse.NodeID) (*storage.InodeData, error) {
-	if inodeId == FUSE_ROOT_ID {
-		return &conn.Mount.RootInode, nil
+// Returns the storage inode id backing the fuse node `nodeId`.
+func (conn *Connection) nodeInodeId(nodeId fuse.NodeID) storage.InodeId {
+	if nodeId == FUSE_ROOT_ID {
+		return conn.Mount.RootInodeId
 	}
-	return conn.Mount.GetInode(storage.InodeId(inodeId))
+	return storage.InodeId(nodeId)
+}
+
+func (conn *Connection) GetInode(inodeId fuse.NodeID) (*storage.InodeData, error) {
+	return conn.Mount.GetInode(conn.nodeInodeId(inodeId))
 }
 
 func (conn *Connection) handleRequest(req fuse.Request) {
 	var err error
 
-	// fmt.Println("REQUEST:", req)
 	switch req.(type) {
 	case *fuse.StatfsRequest:
 		err = conn.handleStatfsRequest(req.(*fuse.StatfsRequest))
@@ -67,16 +81,32 @@ func (conn *Connection) handleRequest(req fuse.Request) {
 		err = conn.handleListxattrRequest(req.(*fuse.ListxattrRequest))
 	case *fuse.GetxattrRequest:
 		err = conn.handleGetxattrRequest(req.(*fuse.GetxattrRequest))
-		/*
-		   case *fuse.SetattrRequest:
-		     nd.handleSetattrRequest(req.(*fuse.SetattrRequest))
-		   case *fuse.CreateRequest:
-		     nd.handleCreateRequest(req.(*fuse.CreateRequest))
-		   case *fuse.RemoveRequest:
-		     nd.handleRemoveRequest(req.(*fuse.RemoveRequest))
-		*/
-
-		// fsync, forget
+	case *fuse.SetxattrRequest:
+		err = conn.handleSetxattrRequest(req.(*fuse.SetxattrRequest))
+	case *fuse.RemovexattrRequest:
+		err = conn.handleRemovexattrRequest(req.(*fuse.RemovexattrRequest))
+	case *fuse.CreateRequest:
+		err = conn.handleCreateRequest(req.(*fuse.CreateRequest))
+	case *fuse.MkdirRequest:
+		err = conn.handleMkdirRequest(req.(*fuse.MkdirRequest))
+	case *fuse.MknodRequest:
+		err = conn.handleMknodRequest(req.(*fuse.MknodRequest))
+	case *fuse.SymlinkRequest:
+		err = conn.handleSymlinkRequest(req.(*fuse.SymlinkRequest))
+	case *fuse.LinkRequest:
+		err = conn.handleLinkRequest(req.(*fuse.LinkRequest))
+	case *fuse.RemoveRequest:
+		err = conn.handleRemoveRequest(req.(*fuse.RemoveRequest))
+	case *fuse.RenameRequest:
+		err = conn.handleRenameRequest(req.(*fuse.RenameRequest))
+	case *fuse.SetattrRequest:
+		err = conn.handleSetattrRequest(req.(*fuse.SetattrRequest))
+	case *fuse.ForgetRequest:
+		err = conn.handleForgetRequest(req.(*fuse.ForgetRequest))
+	case *fuse.BatchForgetRequest:
+		err = conn.handleBatchForgetRequest(req.(*fuse.BatchForgetRequest))
+	case *fuse.FsyncRequest:
+		err = conn.handleFsyncRequest(req.(*fuse.FsyncRequest))
 
 	// Handle methods
 	case *fuse.ReadRequest:
@@ -87,12 +117,18 @@ func (conn *Connection) handleRequest(req fuse.Request) {
 		err = conn.handleReleaseRequest(req.(*fuse.ReleaseRequest))
 	case *fuse.FlushRequest:
 		err = conn.handleFlushRequest(req.(*fuse.FlushRequest))
-		/*
-		   case *fuse.WriteRequest:
-		     nd.handleWriteRequest(req.(*fuse.WriteRequest))
-		   case *fuse.IoctlRequest:
-		     nd.handleIoctlRequest(req.(*fuse.IoctlRequest))
-		*/
+
+	// Lock methods
+	case *fuse.QueryLockRequest:
+		err = conn.handleQueryLockRequest(req.(*fuse.QueryLockRequest))
+	case *fuse.LockRequest:
+		err = conn.handleLockRequest(req.(*fuse.LockRequest))
+	case *fuse.LockWaitRequest:
+		err = conn.handleLockWaitRequest(req.(*fuse.LockWaitRequest))
+	case *fuse.UnlockRequest:
+		err = conn.handleUnlockRequest(req.(*fuse.UnlockRequest))
+	case *fuse.InterruptRequest:
+		err = conn.handleInterruptRequest(req.(*fuse.InterruptRequest))
 
 	// Not implemented/rely on default kernel level behavior. These failures are
 	// cached by the fuse-driver and future calls will be automatically skipped.
@@ -102,6 +138,22 @@ func (conn *Connection) handleRequest(req fuse.Request) {
 			errno:  unix.ENOSYS,
 		}
 
+	// File range methods
+	case *fuse.LseekRequest:
+		err = conn.handleLseekRequest(req.(*fuse.LseekRequest))
+	case *fuse.FallocateRequest:
+		err = conn.handleFallocateRequest(req.(*fuse.FallocateRequest))
+	case *fuse.CopyFileRangeRequest:
+		err = conn.handleCopyFileRangeRequest(req.(*fuse.CopyFileRangeRequest))
+
+	// The kernel falls back to older requests or generic behavior for
+	// opcodes answered with ENOSYS.
+	case *fuse.UnrecognizedRequest:
+		err = FuseError{
+			source: errors.New("not implemented"),
+			errno:  unix.ENOSYS,
+		}
+
 	case *fuse.DestroyRequest:
 		fmt.Println("TODO: Got destroy request")
 
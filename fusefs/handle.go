@@ -2,10 +2,12 @@ package fusefs
 
 import (
 	"io"
+	"math"
 
 	"bazil.org/fuse"
 	"github.com/go-errors/errors"
 
+	"github.com/msg555/ctrfs/btree"
 	"github.com/msg555/ctrfs/storage"
 	"github.com/msg555/ctrfs/unix"
 )
@@ -28,6 +30,9 @@ func (conn *Connection) handleReleaseRequest(req *fuse.ReleaseRequest) error {
 			errno:  unix.EBADF,
 		}
 	}
+	if req.ReleaseFlags&fuse.ReleaseFlockUnlock != 0 {
+		conn.locks.releaseOwner(conn.nodeInodeId(req.Node), req.LockOwner, true)
+	}
 	return handle.Release(req)
 }
 
@@ -60,11 +65,51 @@ func (conn *Connection) handleWriteRequest(req *fuse.WriteRequest) error {
 }
 
 func (conn *Connection) handleFlushRequest(req *fuse.FlushRequest) error {
-	// Read only file system, flush does nothing
+	// POSIX locks are released when any descriptor of the owner is closed
+	conn.locks.releaseOwner(conn.nodeInodeId(req.Node), req.LockOwner, false)
+	req.Respond()
+	return nil
+}
+
+func (conn *Connection) handleLseekRequest(req *fuse.LseekRequest) error {
+	off, err := conn.Mount.SeekFile(conn.nodeInodeId(req.Node), req.Offset, req.Whence)
+	if err != nil {
+		return err
+	}
+	req.Respond(&fuse.LseekResponse{Offset: off})
+	return nil
+}
+
+func (conn *Connection) handleFallocateRequest(req *fuse.FallocateRequest) error {
+	if err := conn.checkWritable(); err != nil {
+		return err
+	}
+	err := conn.Mount.Fallocate(conn.nodeInodeId(req.Node), int(req.Mode), int64(req.Offset), int64(req.Length))
+	if err != nil {
+		return err
+	}
 	req.Respond()
 	return nil
 }
 
+func (conn *Connection) handleCopyFileRangeRequest(req *fuse.CopyFileRangeRequest) error {
+	if err := conn.checkWritable(); err != nil {
+		return err
+	}
+
+	// Without a 64-bit reply the copied size must fit in 32 bits
+	length := int64(req.Len)
+	if !req.Reply64 && length > math.MaxUint32 {
+		length = math.MaxUint32
+	}
+	copied, err := conn.Mount.CopyFileRange(conn.nodeInodeId(req.Node), int64(req.Offset), conn.nodeInodeId(req.NodeOut), int64(req.OffsetOut), length)
+	if err != nil {
+		return err
+	}
+	req.Respond(&fuse.CopyFileRangeResponse{Size: uint64(copied)})
+	return nil
+}
+
 func (conn *Connection) OpenHandle(handle Handle) fuse.HandleID {
 	conn.handleLock.Lock()
 	conn.lastHandleID++
@@ -78,31 +123,6 @@ type FileHandleDir struct {
 	Conn *Connection
 	storage.InodeId
 	*storage.DirView
-
-	Offset    uint64
-	OffsetKey string
-}
-
-func keyToOffset(key string) uint64 {
-	offset := uint64(0)
-	for i := 0; i < 8 && i < len(key); i++ {
-		offset |= uint64(key[i]) << (64 - (i+1)*8)
-	}
-	if offset == DIRENT_OFFSET_EOF {
-		offset--
-	}
-	return offset
-}
-
-func offsetToKey(offset uint64) string {
-	var key [8]byte
-	for i := 0; i < 8; i++ {
-		bt := (offset >> (64 - (i+1)*8)) & 0xFF
-		if bt == 0 {
-			return string(key[:i])
-		}
-	}
-	return string(key[:])
 }
 
 func (h *FileHandleDir) Read(req *fuse.ReadRequest) error {
@@ -114,23 +134,15 @@ func (h *FileHandleDir) Read(req *fuse.ReadRequest) error {
 		return nil
 	}
 
-	// Someone seek'ed our handle. This isn't well supported but we'll try to
-	// handle it.
-	if uint64(req.Offset) != h.Offset {
-		h.Offset = uint64(req.Offset)
-		h.OffsetKey = offsetToKey(h.Offset)
-	}
-
 	buf := make([]byte, req.Size)
 
+	// Each entry's offset is its stable position within the directory. This
+	// lets the listing resume after any entry returned even if the directory
+	// has been modified since.
 	lastOffset := 0
 	bufOffset := 0
-	complete, err := h.DirView.ScanChildren(h.OffsetKey, func(inodeId storage.InodeId, name string, inode *storage.InodeData) bool {
-		if bufOffset != 0 {
-			updateDirEntryOffset(buf[lastOffset:], keyToOffset(name))
-		}
-
-		size := addDirEntry(buf[bufOffset:], name, inodeId, inode)
+	complete, err := h.DirView.ScanChildren(uint64(req.Offset), func(position uint64, name string, dtType int, inodeId storage.InodeId) bool {
+		size := addDirEntry(buf[bufOffset:], name, inodeId, dtType, position)
 		if size == 0 {
 			return false
 		}
@@ -138,7 +150,12 @@ func (h *FileHandleDir) Read(req *fuse.ReadRequest) error {
 		bufOffset += size
 		return true
 	})
-	if err != nil {
+	if err == btree.ErrorPositionNotFound {
+		return FuseError{
+			source: err,
+			errno:  unix.EINVAL,
+		}
+	} else if err != nil {
 		return err
 	}
 
@@ -160,7 +177,7 @@ func (h *FileHandleDir) Write(req *fuse.WriteRequest) error {
 }
 
 func (h *FileHandleDir) Release(req *fuse.ReleaseRequest) error {
-	err := h.Conn.Mount.ReleaseDirView(h.InodeId)
+	err := h.Conn.Mount.ReleaseDirView(h.DirView)
 	if err != nil {
 		return err
 	}
@@ -196,6 +213,11 @@ func (h *FileHandleReg) Write(req *fuse.WriteRequest) error {
 	if err != nil {
 		return err
 	}
+	if isSyncWrite(req.FileFlags) {
+		if err := h.Conn.syncInode(h.InodeId); err != nil {
+			return err
+		}
+	}
 	req.Respond(&fuse.WriteResponse{
 		Size: written,
 	})
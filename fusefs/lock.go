@@ -0,0 +1,311 @@
+package fusefs
+
+import (
+	"math"
+	"sync"
+
+	"bazil.org/fuse"
+
+	"github.com/msg555/ctrfs/storage"
+	"github.com/msg555/ctrfs/unix"
+)
+
+/*
+Locks are managed per mount rather than by the kernel so that flock(2) and
+fcntl(2) record locks behave the same as on other file systems. flock locks
+and POSIX locks are kept apart and never conflict with each other, matching
+Linux. The kernel passes flock locks as a lock over the whole file owned by
+the open file; POSIX locks are owned by the locking process.
+
+Unlike Linux, waiting for a POSIX lock never fails with EDEADLK. Owners that
+wait on each other's locks block until one of the waits is interrupted.
+*/
+
+type fileLock struct {
+	owner fuse.LockOwner
+	flock bool
+
+	// Range of the lock, inclusive of `end`.
+	start uint64
+	end   uint64
+
+	lockType fuse.LockType
+	pid      int32
+}
+
+type lockManager struct {
+	lock      sync.Mutex
+	fileLocks map[storage.InodeId][]fileLock
+
+	// Closed and replaced whenever locks are released to wake waiters.
+	released chan struct{}
+
+	interruptLock sync.Mutex
+	interruptMap  map[fuse.RequestID]chan struct{}
+}
+
+func (lk *fileLock) overlaps(other *fileLock) bool {
+	return lk.start <= other.end && other.start <= lk.end
+}
+
+// Returns true if the two locks overlap or if one begins directly after the
+// other ends.
+func (lk *fileLock) touches(other *fileLock) bool {
+	return (other.end == math.MaxUint64 || lk.start <= other.end+1) &&
+		(lk.end == math.MaxUint64 || other.start <= lk.end+1)
+}
+
+// Returns true if `other` prevents `lk` from being taken.
+func (lk *fileLock) conflicts(other *fileLock) bool {
+	return lk.flock == other.flock && lk.owner != other.owner &&
+		(lk.lockType == fuse.LockWrite || other.lockType == fuse.LockWrite) &&
+		lk.overlaps(other)
+}
+
+func (lm *lockManager) init() {
+	lm.fileLocks = make(map[storage.InodeId][]fileLock)
+	lm.released = make(chan struct{})
+	lm.interruptMap = make(map[fuse.RequestID]chan struct{})
+}
+
+// Returns the first lock of `inodeId` that conflicts with `lk` or nil if there
+// is none. Must be called with lm.lock held.
+func (lm *lockManager) findConflict(inodeId storage.InodeId, lk *fileLock) *fileLock {
+	locks := lm.fileLocks[inodeId]
+	for i := range locks {
+		if lk.conflicts(&locks[i]) {
+			return &locks[i]
+		}
+	}
+	return nil
+}
+
+// Removes the range of `lk` from the locks of the same owner and kind on
+// `inodeId`, splitting locks that extend past either end of the range. Must be
+// called with lm.lock held.
+func (lm *lockManager) removeRange(inodeId storage.InodeId, lk *fileLock) {
+	locks := lm.fileLocks[inodeId]
+	result := make([]fileLock, 0, len(locks)+1)
+	removed := false
+	for _, other := range locks {
+		if other.owner != lk.owner || other.flock != lk.flock || !other.overlaps(lk) {
+			result = append(result, other)
+			continue
+		}
+		removed = true
+		if other.start < lk.start {
+			before := other
+			before.end = lk.start - 1
+			result = append(result, before)
+		}
+		if other.end > lk.end {
+			after := other
+			after.start = lk.end + 1
+			result = append(result, after)
+		}
+	}
+
+	if len(result) == 0 {
+		delete(lm.fileLocks, inodeId)
+	} else {
+		lm.fileLocks[inodeId] = result
+	}
+	if removed {
+		close(lm.released)
+		lm.released = make(chan struct{})
+	}
+}
+
+// Adds `lk` to the locks of `inodeId`, replacing any locks of the same owner
+// within its range and merging it with neighbouring locks of the same type.
+// Must be called with lm.lock held.
+func (lm *lockManager) addLock(inodeId storage.InodeId, lk fileLock) {
+	lm.removeRange(inodeId, &lk)
+
+	locks := lm.fileLocks[inodeId]
+	result := make([]fileLock, 0, len(locks)+1)
+	for _, other := range locks {
+		if other.owner == lk.owner && other.flock == lk.flock &&
+			other.lockType == lk.lockType && other.touches(&lk) {
+			if other.start < lk.start {
+				lk.start = other.start
+			}
+			if other.end > lk.end {
+				lk.end = other.end
+			}
+			continue
+		}
+		result = append(result, other)
+	}
+	lm.fileLocks[inodeId] = append(result, lk)
+}
+
+// Takes, changes or releases the lock `lk` on `inodeId`. Returns EAGAIN if a
+// conflicting lock is held and `wait` is not set. Otherwise waits for
+// conflicting locks to be released, returning EINTR if `interrupt` is closed
+// first. Deadlocks between waiting owners are not detected.
+func (lm *lockManager) setLock(inodeId storage.InodeId, lk fileLock, wait bool, interrupt <-chan struct{}) error {
+	if lk.start > lk.end {
+		return unix.EINVAL
+	}
+
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+
+	if lk.lockType == fuse.LockUnlock {
+		lm.removeRange(inodeId, &lk)
+		return nil
+	}
+	if lk.lockType != fuse.LockRead && lk.lockType != fuse.LockWrite {
+		return unix.EINVAL
+	}
+
+	for lm.findConflict(inodeId, &lk) != nil {
+		if !wait {
+			return unix.EAGAIN
+		}
+
+		released := lm.released
+		lm.lock.Unlock()
+		select {
+		case <-released:
+		case <-interrupt:
+			lm.lock.Lock()
+			return unix.EINTR
+		}
+		lm.lock.Lock()
+	}
+
+	lm.addLock(inodeId, lk)
+	return nil
+}
+
+// Returns a lock that would prevent `lk` from being taken on `inodeId`. If no
+// such lock exists the returned lock has type LockUnlock.
+func (lm *lockManager) queryLock(inodeId storage.InodeId, lk fileLock) fuse.FileLock {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+
+	conflict := lm.findConflict(inodeId, &lk)
+	if conflict == nil {
+		return fuse.FileLock{
+			Start: lk.start,
+			End:   lk.end,
+			Type:  fuse.LockUnlock,
+			PID:   lk.pid,
+		}
+	}
+	return fuse.FileLock{
+		Start: conflict.start,
+		End:   conflict.end,
+		Type:  conflict.lockType,
+		PID:   conflict.pid,
+	}
+}
+
+// Releases all locks of the given kind held by `owner` on `inodeId`.
+func (lm *lockManager) releaseOwner(inodeId storage.InodeId, owner fuse.LockOwner, flock bool) {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+
+	lm.removeRange(inodeId, &fileLock{
+		owner: owner,
+		flock: flock,
+		start: 0,
+		end:   math.MaxUint64,
+	})
+}
+
+// Registers request `id` as one that may be interrupted. Returns a channel that
+// is closed if the request is interrupted. Requests must be registered before
+// later requests are read so that their interrupt cannot be missed.
+func (lm *lockManager) trackInterrupt(id fuse.RequestID) <-chan struct{} {
+	lm.interruptLock.Lock()
+	defer lm.interruptLock.Unlock()
+
+	ch, ok := lm.interruptMap[id]
+	if !ok {
+		ch = make(chan struct{})
+		lm.interruptMap[id] = ch
+	}
+	return ch
+}
+
+func (lm *lockManager) untrackInterrupt(id fuse.RequestID) {
+	lm.interruptLock.Lock()
+	delete(lm.interruptMap, id)
+	lm.interruptLock.Unlock()
+}
+
+// Interrupts request `id` if it is tracked.
+func (lm *lockManager) interrupt(id fuse.RequestID) {
+	lm.interruptLock.Lock()
+	defer lm.interruptLock.Unlock()
+
+	ch, ok := lm.interruptMap[id]
+	if ok {
+		select {
+		case <-ch:
+		default:
+			close(ch)
+		}
+	}
+}
+
+func requestLock(owner fuse.LockOwner, lock fuse.FileLock, flags fuse.LockFlags) fileLock {
+	return fileLock{
+		owner:    owner,
+		flock:    flags&fuse.LockFlock != 0,
+		start:    lock.Start,
+		end:      lock.End,
+		lockType: lock.Type,
+		pid:      lock.PID,
+	}
+}
+
+func (conn *Connection) handleQueryLockRequest(req *fuse.QueryLockRequest) error {
+	lk := requestLock(req.LockOwner, req.Lock, req.LockFlags)
+	req.Respond(&fuse.QueryLockResponse{
+		Lock: conn.locks.queryLock(conn.nodeInodeId(req.Node), lk),
+	})
+	return nil
+}
+
+func (conn *Connection) handleLockRequest(req *fuse.LockRequest) error {
+	lk := requestLock(req.LockOwner, req.Lock, req.LockFlags)
+	if err := conn.locks.setLock(conn.nodeInodeId(req.Node), lk, false, nil); err != nil {
+		return err
+	}
+	req.Respond()
+	return nil
+}
+
+func (conn *Connection) handleLockWaitRequest(req *fuse.LockWaitRequest) error {
+	// Registered when the request was read
+	interrupt := conn.locks.trackInterrupt(req.ID)
+	defer conn.locks.untrackInterrupt(req.ID)
+
+	lk := requestLock(req.LockOwner, req.Lock, req.LockFlags)
+	if err := conn.locks.setLock(conn.nodeInodeId(req.Node), lk, true, interrupt); err != nil {
+		return err
+	}
+	req.Respond()
+	return nil
+}
+
+func (conn *Connection) handleUnlockRequest(req *fuse.UnlockRequest) error {
+	lk := requestLock(req.LockOwner, req.Lock, req.LockFlags)
+	lk.lockType = fuse.LockUnlock
+	if err := conn.locks.setLock(conn.nodeInodeId(req.Node), lk, false, nil); err != nil {
+		return err
+	}
+	req.Respond()
+	return nil
+}
+
+func (conn *Connection) handleInterruptRequest(req *fuse.InterruptRequest) error {
+	// Only lock waits can be interrupted; other requests are left to finish.
+	conn.locks.interrupt(req.IntrID)
+	req.Respond()
+	return nil
+}
@@ -0,0 +1,221 @@
+package fusefs
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+
+	"github.com/msg555/ctrfs/unix"
+)
+
+const testLockInode = 2
+
+type lockRange struct {
+	owner    fuse.LockOwner
+	start    uint64
+	end      uint64
+	lockType fuse.LockType
+}
+
+func newLockManager() *lockManager {
+	var lm lockManager
+	lm.init()
+	return &lm
+}
+
+// Returns the locks held on the test inode ordered by owner and start.
+func heldLocks(lm *lockManager) []lockRange {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+
+	var result []lockRange
+	for _, lk := range lm.fileLocks[testLockInode] {
+		result = append(result, lockRange{
+			owner:    lk.owner,
+			start:    lk.start,
+			end:      lk.end,
+			lockType: lk.lockType,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].owner != result[j].owner {
+			return result[i].owner < result[j].owner
+		}
+		return result[i].start < result[j].start
+	})
+	return result
+}
+
+func TestLockRanges(t *testing.T) {
+	for _, check := range []struct {
+		name     string
+		locks    []lockRange
+		expected []lockRange
+	}{
+		{
+			name: "split on partial unlock",
+			locks: []lockRange{
+				{1, 0, 99, fuse.LockWrite},
+				{1, 40, 59, fuse.LockUnlock},
+			},
+			expected: []lockRange{
+				{1, 0, 39, fuse.LockWrite},
+				{1, 60, 99, fuse.LockWrite},
+			},
+		},
+		{
+			name: "unlock of either end",
+			locks: []lockRange{
+				{1, 10, 99, fuse.LockRead},
+				{1, 0, 19, fuse.LockUnlock},
+				{1, 90, math.MaxUint64, fuse.LockUnlock},
+			},
+			expected: []lockRange{
+				{1, 20, 89, fuse.LockRead},
+			},
+		},
+		{
+			name: "merge adjacent same type",
+			locks: []lockRange{
+				{1, 0, 9, fuse.LockRead},
+				{1, 20, 29, fuse.LockRead},
+				{1, 10, 19, fuse.LockRead},
+			},
+			expected: []lockRange{
+				{1, 0, 29, fuse.LockRead},
+			},
+		},
+		{
+			name: "merge overlapping same type",
+			locks: []lockRange{
+				{1, 0, 19, fuse.LockWrite},
+				{1, 10, math.MaxUint64, fuse.LockWrite},
+			},
+			expected: []lockRange{
+				{1, 0, math.MaxUint64, fuse.LockWrite},
+			},
+		},
+		{
+			name: "no merge of different types",
+			locks: []lockRange{
+				{1, 0, 9, fuse.LockRead},
+				{1, 10, 19, fuse.LockWrite},
+			},
+			expected: []lockRange{
+				{1, 0, 9, fuse.LockRead},
+				{1, 10, 19, fuse.LockWrite},
+			},
+		},
+		{
+			name: "type change splits",
+			locks: []lockRange{
+				{1, 0, 29, fuse.LockRead},
+				{1, 10, 19, fuse.LockWrite},
+			},
+			expected: []lockRange{
+				{1, 0, 9, fuse.LockRead},
+				{1, 10, 19, fuse.LockWrite},
+				{1, 20, 29, fuse.LockRead},
+			},
+		},
+		{
+			name: "no merge across owners",
+			locks: []lockRange{
+				{1, 0, 9, fuse.LockRead},
+				{2, 10, 19, fuse.LockRead},
+				{2, 0, 4, fuse.LockUnlock},
+			},
+			expected: []lockRange{
+				{1, 0, 9, fuse.LockRead},
+				{2, 10, 19, fuse.LockRead},
+			},
+		},
+	} {
+		lm := newLockManager()
+		for _, lk := range check.locks {
+			err := lm.setLock(testLockInode, fileLock{
+				owner:    lk.owner,
+				start:    lk.start,
+				end:      lk.end,
+				lockType: lk.lockType,
+			}, false, nil)
+			if err != nil {
+				t.Fatalf("%s: unexpected error setting lock '%s'", check.name, err)
+			}
+		}
+
+		held := heldLocks(lm)
+		if len(held) != len(check.expected) {
+			t.Fatalf("%s: expected locks %v, got %v", check.name, check.expected, held)
+		}
+		for i := range held {
+			if held[i] != check.expected[i] {
+				t.Fatalf("%s: expected locks %v, got %v", check.name, check.expected, held)
+			}
+		}
+	}
+}
+
+func TestLockWait(t *testing.T) {
+	lm := newLockManager()
+	reader := fileLock{owner: 1, start: 0, end: 99, lockType: fuse.LockRead}
+	writer := fileLock{owner: 2, start: 50, end: 59, lockType: fuse.LockWrite}
+	if err := lm.setLock(testLockInode, reader, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := lm.setLock(testLockInode, writer, false, nil); err != unix.EAGAIN {
+		t.Fatalf("expected EAGAIN, got '%v'", err)
+	}
+
+	waitLock := func(interrupt <-chan struct{}) <-chan error {
+		result := make(chan error, 1)
+		go func() {
+			result <- lm.setLock(testLockInode, writer, true, interrupt)
+		}()
+		return result
+	}
+	expectBlocked := func(result <-chan error) {
+		select {
+		case err := <-result:
+			t.Fatalf("expected writer to block, got '%v'", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	expectResult := func(result <-chan error, expected error) {
+		select {
+		case err := <-result:
+			if err != expected {
+				t.Fatalf("expected '%v', got '%v'", expected, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("writer was never woken")
+		}
+	}
+
+	// Woken by an interrupt
+	result := waitLock(lm.trackInterrupt(1))
+	expectBlocked(result)
+	lm.interrupt(1)
+	expectResult(result, unix.EINTR)
+	lm.untrackInterrupt(1)
+
+	// Releasing an unrelated range leaves the writer waiting
+	result = waitLock(nil)
+	expectBlocked(result)
+	if err := lm.setLock(testLockInode, fileLock{owner: 1, start: 0, end: 9, lockType: fuse.LockUnlock}, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectBlocked(result)
+
+	// Woken by the release of the conflicting lock
+	lm.releaseOwner(testLockInode, 1, false)
+	expectResult(result, nil)
+
+	held := heldLocks(lm)
+	if len(held) != 1 || held[0] != (lockRange{2, 50, 59, fuse.LockWrite}) {
+		t.Fatalf("expected only the writer's lock, got %v", held)
+	}
+}
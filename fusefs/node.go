@@ -1,6 +1,10 @@
 package fusefs
 
 import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
 	"time"
 
 	"bazil.org/fuse"
@@ -14,52 +18,142 @@ func nsTimestampToTime(nsTimestamp uint64) time.Time {
 	return time.Unix(int64(nsTimestamp/1000000000), int64(nsTimestamp%1000000000))
 }
 
-func (conn *Connection) nodeToAttr(inodeId storage.InodeId, inode *storage.InodeData) fuse.Attr {
+func (conn *Connection) nodeToAttr(inodeId storage.InodeId, inode *storage.InodeData) (fuse.Attr, error) {
 	size := inode.Size
 	if unix.S_ISDIR(inode.Mode) {
 		size = 1024
 	}
+
+	// Regular files are sparse; report the data actually mapped to them in 512
+	// byte units. The inode of a chunked file counts chunks rather than blocks
+	// so their lengths are summed instead.
+	blocks := (size + 511) >> 9
+	if unix.S_ISREG(inode.Mode) {
+		allocated := int64(inode.Blocks) * int64(conn.Mount.Blocks.GetBlockSize())
+		if inode.Flags&storage.INODE_FLAG_CHUNKED != 0 {
+			var err error
+			allocated, err = conn.Mount.AllocatedBytes(inodeId)
+			if err != nil {
+				return fuse.Attr{}, err
+			}
+		}
+		blocks = uint64(allocated+511) >> 9
+	}
+
+	// Device numbers the kernel cannot represent are reported as 0.
+	rdev, _ := unix.EncodeDev32(inode.Dev)
+
 	return fuse.Attr{
 		Valid:     DURATION_DEFAULT,
 		Inode:     uint64(inodeId),
 		Size:      size,
-		Blocks:    (size + 511) >> 9,
+		Blocks:    blocks,
 		Atime:     nsTimestampToTime(inode.Atim),
 		Mtime:     nsTimestampToTime(inode.Mtim),
 		Ctime:     nsTimestampToTime(inode.Ctim),
 		Mode:      unix.UnixToFileStatMode(inode.Mode),
-		Nlink:     1,
+		Nlink:     inode.Nlink,
 		Uid:       inode.Uid,
 		Gid:       inode.Gid,
-		Rdev:      uint32(inode.Dev),
+		Rdev:      rdev,
 		BlockSize: 1024,
-	}
+	}, nil
 }
 
 func (conn *Connection) handleAccessRequest(req *fuse.AccessRequest) error {
-	inode, err := conn.GetInode(req.Node)
-	if err != nil {
+	if err := conn.checkAccess(req.Node, &req.Header, req.Mask); err != nil {
 		return err
 	}
 
-	if !unix.TestAccess(req.Uid == inode.Uid, req.Gid == inode.Gid, inode.Mode, req.Mask) {
+	req.Respond()
+	return nil
+}
+
+// Returns an EACCES error unless the caller described by `hdr` has all the
+// access in `mask` to the node.
+func (conn *Connection) checkAccess(nodeId fuse.NodeID, hdr *fuse.Header, mask uint32) error {
+	allowed, err := conn.Mount.CheckAccess(conn.nodeInodeId(nodeId), hdr.Uid, callerGroups(hdr), mask)
+	if err != nil {
+		return err
+	}
+	if !allowed {
 		return FuseError{
 			source: errors.New("permission denied"),
 			errno:  unix.EACCES,
 		}
 	}
-
-	req.Respond()
 	return nil
 }
 
-func (conn *Connection) handleLookupRequest(req *fuse.LookupRequest) error {
-	inode, err := conn.GetInode(req.Node)
+// Returns the supplementary groups of the process `pid`.
+func supplementaryGroups(pid uint32) []uint32 {
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
 	if err != nil {
+		return nil
+	}
+	var groups []uint32
+	for _, line := range strings.Split(string(status), "\n") {
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		for _, field := range strings.Fields(line[len("Groups:"):]) {
+			gid, err := strconv.ParseUint(field, 10, 32)
+			if err == nil {
+				groups = append(groups, uint32(gid))
+			}
+		}
+		break
+	}
+	return groups
+}
+
+// Returns a function reporting whether the caller described by `hdr` is a
+// member of a group. Fuse requests only carry the caller's primary group so
+// its supplementary groups are read from /proc the first time they are needed.
+func callerGroups(hdr *fuse.Header) func(gid uint32) bool {
+	var groups []uint32
+	loaded := false
+	return func(gid uint32) bool {
+		if gid == hdr.Gid {
+			return true
+		}
+		if !loaded {
+			groups = supplementaryGroups(hdr.Pid)
+			loaded = true
+		}
+		for _, group := range groups {
+			if group == gid {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Returns true if the caller described by `hdr` is a member of `group`.
+func callerInGroup(hdr *fuse.Header, group uint32) bool {
+	return callerGroups(hdr)(group)
+}
+
+// Returns the access mask needed to open a file with `flags`.
+func openAccessMask(flags fuse.OpenFlags) uint32 {
+	var mask uint32
+	if flags.IsReadOnly() || flags.IsReadWrite() {
+		mask |= unix.ACL_READ
+	}
+	if flags.IsWriteOnly() || flags.IsReadWrite() || flags&fuse.OpenTruncate != 0 {
+		mask |= unix.ACL_WRITE
+	}
+	return mask
+}
+
+func (conn *Connection) handleLookupRequest(req *fuse.LookupRequest) error {
+	// Searching a directory requires execute permission on it.
+	if err := conn.checkAccess(req.Node, &req.Header, unix.ACL_EXECUTE); err != nil {
 		return err
 	}
 
-	childInode, childInodeId, err := conn.Mount.LookupChild(inode, req.Name)
+	childInode, childInodeId, err := conn.Mount.LookupChild(conn.nodeInodeId(req.Node), req.Name)
 	if err != nil {
 		return err
 	}
@@ -70,14 +164,30 @@ func (conn *Connection) handleLookupRequest(req *fuse.LookupRequest) error {
 		}
 	}
 
-	req.Respond(&fuse.LookupResponse{
-		Node:       fuse.NodeID(childInodeId),
+	lookup, err := conn.lookupResponse(childInodeId, childInode)
+	if err != nil {
+		return err
+	}
+	req.Respond(lookup)
+	return nil
+}
+
+// Returns a lookup response handing `inodeId` to the kernel. The lookup is
+// counted until the kernel forgets it.
+func (conn *Connection) lookupResponse(inodeId storage.InodeId, inode *storage.InodeData) (*fuse.LookupResponse, error) {
+	attr, err := conn.nodeToAttr(inodeId, inode)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.acquireNode(inodeId); err != nil {
+		return nil, err
+	}
+	return &fuse.LookupResponse{
+		Node:       fuse.NodeID(inodeId),
 		Generation: 1,
 		EntryValid: DURATION_DEFAULT,
-		Attr:       conn.nodeToAttr(childInodeId, childInode),
-	})
-
-	return nil
+		Attr:       attr,
+	}, nil
 }
 
 func (conn *Connection) handleGetattrRequest(req *fuse.GetattrRequest) error {
@@ -86,8 +196,12 @@ func (conn *Connection) handleGetattrRequest(req *fuse.GetattrRequest) error {
 		return err
 	}
 
+	attr, err := conn.nodeToAttr(storage.InodeId(req.Node), inode)
+	if err != nil {
+		return err
+	}
 	req.Respond(&fuse.GetattrResponse{
-		Attr: conn.nodeToAttr(storage.InodeId(req.Node), inode),
+		Attr: attr,
 	})
 	return nil
 }
@@ -97,7 +211,7 @@ func (conn *Connection) handleOpenRequest(req *fuse.OpenRequest) error {
 	if err != nil {
 		return err
 	}
-	inodeId := storage.InodeId(req.Node)
+	inodeId := conn.nodeInodeId(req.Node)
 
 	if req.Dir && !unix.S_ISDIR(inode.Mode) {
 		return FuseError{
@@ -105,27 +219,21 @@ func (conn *Connection) handleOpenRequest(req *fuse.OpenRequest) error {
 			errno:  unix.ENOTDIR,
 		}
 	}
-	/*
-		TODO: implement needed access checks here
-		if req.Flags.IsWriteOnly() || req.Flags.IsReadWrite() {
-			return FuseError{
-				source: errors.New("read only file system"),
-				errno:  unix.EROFS,
-			}
-		}
-		if (req.Flags & (fuse.OpenAppend | fuse.OpenCreate | fuse.OpenTruncate)) != 0 {
-			return FuseError{
-				source: errors.New("read only file system"),
-				errno:  unix.EROFS,
-			}
+
+	mask := openAccessMask(req.Flags)
+	if mask&unix.ACL_WRITE != 0 {
+		if err := conn.checkWritable(); err != nil {
+			return err
 		}
-	*/
+	}
+	if err := conn.checkAccess(req.Node, &req.Header, mask); err != nil {
+		return err
+	}
 
-	// TODO: Ensure we havethe right permissions
 	var handleID fuse.HandleID
 	switch inode.Mode & unix.S_IFMT {
 	case unix.S_IFDIR:
-		dirView, err := conn.Mount.GetDirView(inodeId, inode)
+		dirView, err := conn.Mount.GetDirView(inodeId)
 		if err != nil {
 			return err
 		}
@@ -146,7 +254,12 @@ func (conn *Connection) handleOpenRequest(req *fuse.OpenRequest) error {
 			FileView: file,
 		})
 	default:
-		return errors.New("not implemented")
+		// The kernel opens device nodes, FIFOs and sockets itself without
+		// consulting the file system.
+		return FuseError{
+			source: errors.New("cannot open special file"),
+			errno:  unix.ENXIO,
+		}
 	}
 
 	req.Respond(&fuse.OpenResponse{
@@ -157,30 +270,530 @@ func (conn *Connection) handleOpenRequest(req *fuse.OpenRequest) error {
 }
 
 func (conn *Connection) handleReadlinkRequest(req *fuse.ReadlinkRequest) error {
-	inode, err := conn.GetInode(req.Node)
+	target, err := conn.Mount.Readlink(conn.nodeInodeId(req.Node))
 	if err != nil {
 		return err
 	}
 
-	target, err := conn.Mount.Readlink(inode)
+	req.Respond(target)
+	return nil
+}
+
+// Returns an EROFS error if the mount cannot be modified.
+func (conn *Connection) checkWritable() error {
+	if conn.ReadOnly || conn.Mount.ReadOnly {
+		return FuseError{
+			source: errors.New("read only file system"),
+			errno:  unix.EROFS,
+		}
+	}
+	return nil
+}
+
+func (conn *Connection) handleListxattrRequest(req *fuse.ListxattrRequest) error {
+	names, err := conn.Mount.ListXattrs(conn.nodeInodeId(req.Node))
 	if err != nil {
 		return err
 	}
 
-	req.Respond(string(target))
+	resp := &fuse.ListxattrResponse{}
+	resp.Append(names...)
+	if req.Size != 0 && len(resp.Xattr) > int(req.Size) {
+		return FuseError{
+			source: errors.New("xattr list too large for buffer"),
+			errno:  unix.ERANGE,
+		}
+	}
+
+	req.Respond(resp)
 	return nil
 }
 
-func (conn *Connection) handleListxattrRequest(req *fuse.ListxattrRequest) error {
-	return FuseError{
-		source: errors.New("xattr not supported"),
-		errno:  unix.ENOTSUP,
+func (conn *Connection) handleGetxattrRequest(req *fuse.GetxattrRequest) error {
+	value, found, err := conn.Mount.GetXattr(conn.nodeInodeId(req.Node), req.Name)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return FuseError{
+			source: errors.New("xattr not found"),
+			errno:  unix.ENODATA,
+		}
 	}
+	if req.Size != 0 && len(value) > int(req.Size) {
+		return FuseError{
+			source: errors.New("xattr too large for buffer"),
+			errno:  unix.ERANGE,
+		}
+	}
+
+	req.Respond(&fuse.GetxattrResponse{
+		Xattr: value,
+	})
+	return nil
 }
 
-func (conn *Connection) handleGetxattrRequest(req *fuse.GetxattrRequest) error {
-	return FuseError{
-		source: errors.New("xattr not supported"),
-		errno:  unix.ENOTSUP,
+// Returns an error unless the mount is writable and the user making `header`
+// may set or remove the extended attribute `name` of the node `nodeId`. As on
+// Linux, trusted and security attributes are reserved for root, ACLs may only
+// be changed by the file's owner and user attributes may only be placed on
+// regular files and directories by users with write access to them.
+func (conn *Connection) checkXattrWritable(nodeId fuse.NodeID, header *fuse.Header, name string) error {
+	if err := conn.checkWritable(); err != nil {
+		return err
+	}
+
+	permissionDenied := FuseError{
+		source: errors.New("operation not permitted"),
+		errno:  unix.EPERM,
+	}
+	switch {
+	case strings.HasPrefix(name, "trusted.") || strings.HasPrefix(name, "security."):
+		if header.Uid != 0 {
+			return permissionDenied
+		}
+	case name == unix.XATTR_POSIX_ACL_ACCESS || name == unix.XATTR_POSIX_ACL_DEFAULT:
+		inode, err := conn.GetInode(nodeId)
+		if err != nil {
+			return err
+		}
+		if header.Uid != 0 && header.Uid != inode.Uid {
+			return permissionDenied
+		}
+	case strings.HasPrefix(name, "system."):
+		return FuseError{
+			source: errors.New("unsupported xattr"),
+			errno:  unix.EOPNOTSUPP,
+		}
+	case strings.HasPrefix(name, "user."):
+		inode, err := conn.GetInode(nodeId)
+		if err != nil {
+			return err
+		}
+		if !unix.S_ISREG(inode.Mode) && !unix.S_ISDIR(inode.Mode) {
+			return permissionDenied
+		}
+		return conn.checkAccess(nodeId, header, unix.ACL_WRITE)
+	}
+	return nil
+}
+
+func (conn *Connection) handleSetxattrRequest(req *fuse.SetxattrRequest) error {
+	if err := conn.checkXattrWritable(req.Node, &req.Header, req.Name); err != nil {
+		return err
+	}
+
+	err := conn.Mount.SetXattr(conn.nodeInodeId(req.Node), req.Name, req.Xattr, int(req.Flags))
+	if err != nil {
+		return err
+	}
+
+	req.Respond()
+	return nil
+}
+
+func (conn *Connection) handleRemovexattrRequest(req *fuse.RemovexattrRequest) error {
+	if err := conn.checkXattrWritable(req.Node, &req.Header, req.Name); err != nil {
+		return err
+	}
+
+	removed, err := conn.Mount.RemoveXattr(conn.nodeInodeId(req.Node), req.Name)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return FuseError{
+			source: errors.New("xattr not found"),
+			errno:  unix.ENODATA,
+		}
+	}
+
+	req.Respond()
+	return nil
+}
+
+// Returns an error unless the mount is writable and the user making `header`
+// may add or remove entries of the directory `nodeId`.
+func (conn *Connection) checkDirWritable(nodeId fuse.NodeID, header *fuse.Header) error {
+	if err := conn.checkWritable(); err != nil {
+		return err
+	}
+	return conn.checkAccess(nodeId, header, unix.ACL_WRITE|unix.ACL_EXECUTE)
+}
+
+// Returns the inode data for a new file with `mode` created in the directory
+// `parentNodeId` by the user making `header`. Files created in a setgid
+// directory take on the directory's group and new directories inherit the
+// setgid bit.
+func (conn *Connection) newInodeData(parentNodeId fuse.NodeID, header *fuse.Header, mode uint32) (*storage.InodeData, error) {
+	parent, err := conn.GetInode(parentNodeId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := storage.TimestampNow()
+	inodeData := &storage.InodeData{
+		Mode: mode,
+		Uid:  header.Uid,
+		Gid:  header.Gid,
+		Atim: now,
+		Mtim: now,
+		Ctim: now,
+	}
+	if parent.Mode&unix.S_ISGID != 0 {
+		inodeData.Gid = parent.Gid
+		if unix.S_ISDIR(mode) {
+			inodeData.Mode |= unix.S_ISGID
+		}
+	}
+	return inodeData, nil
+}
+
+// Creates a file in the directory `parentNodeId` and returns the lookup
+// response describing it. `dev` is the device number of device nodes.
+func (conn *Connection) createFile(parentNodeId fuse.NodeID, header *fuse.Header, name string, mode uint32, dev uint64, umask uint32) (*fuse.LookupResponse, error) {
+	if err := conn.checkDirWritable(parentNodeId, header); err != nil {
+		return nil, err
+	}
+
+	inodeData, err := conn.newInodeData(parentNodeId, header, mode)
+	if err != nil {
+		return nil, err
+	}
+	inodeData.Dev = dev
+	inodeId, err := conn.Mount.CreateFile(conn.nodeInodeId(parentNodeId), name, inodeData, umask)
+	if err != nil {
+		return nil, err
+	}
+
+	inode, err := conn.Mount.GetInode(inodeId)
+	if err != nil {
+		return nil, err
+	}
+	return conn.lookupResponse(inodeId, inode)
+}
+
+func (conn *Connection) handleCreateRequest(req *fuse.CreateRequest) error {
+	mode := unix.S_IFREG | (unix.FileStatToUnixMode(req.Mode) &^ unix.S_IFMT)
+	lookup, err := conn.createFile(req.Node, &req.Header, req.Name, mode, 0, uint32(req.Umask))
+	if err != nil {
+		return err
+	}
+
+	inodeId := storage.InodeId(lookup.Node)
+	file, err := conn.openCreatedFile(inodeId)
+	if err != nil {
+		// The kernel never learns of the node so drop the lookup taken for it.
+		conn.forgetNode(lookup.Node, 1)
+		return err
+	}
+	handleID := conn.OpenHandle(&FileHandleReg{
+		Conn:     conn,
+		InodeId:  inodeId,
+		FileView: file,
+	})
+
+	req.Respond(&fuse.CreateResponse{
+		LookupResponse: *lookup,
+		OpenResponse: fuse.OpenResponse{
+			Handle: handleID,
+			Flags:  fuse.OpenKeepCache,
+		},
+	})
+	return nil
+}
+
+// Opens the file `inodeId` just created by a create request.
+func (conn *Connection) openCreatedFile(inodeId storage.InodeId) (storage.FileView, error) {
+	inode, err := conn.Mount.GetInode(inodeId)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Mount.GetFileView(inodeId, inode)
+}
+
+func (conn *Connection) handleMkdirRequest(req *fuse.MkdirRequest) error {
+	mode := unix.S_IFDIR | (unix.FileStatToUnixMode(req.Mode) &^ unix.S_IFMT)
+	lookup, err := conn.createFile(req.Node, &req.Header, req.Name, mode, 0, uint32(req.Umask))
+	if err != nil {
+		return err
+	}
+
+	req.Respond(&fuse.MkdirResponse{
+		LookupResponse: *lookup,
+	})
+	return nil
+}
+
+func (conn *Connection) handleMknodRequest(req *fuse.MknodRequest) error {
+	mode := unix.FileStatToUnixMode(req.Mode)
+
+	var dev uint64
+	switch mode & unix.S_IFMT {
+	case unix.S_IFCHR, unix.S_IFBLK:
+		// Only root may create device nodes.
+		if req.Uid != 0 {
+			return FuseError{
+				source: errors.New("operation not permitted"),
+				errno:  unix.EPERM,
+			}
+		}
+		dev = unix.DecodeDev32(req.Rdev)
+	case unix.S_IFIFO, unix.S_IFSOCK, unix.S_IFREG:
+	default:
+		return FuseError{
+			source: errors.New("invalid file type"),
+			errno:  unix.EINVAL,
+		}
+	}
+
+	lookup, err := conn.createFile(req.Node, &req.Header, req.Name, mode, dev, uint32(req.Umask))
+	if err != nil {
+		return err
+	}
+	req.Respond(lookup)
+	return nil
+}
+
+func (conn *Connection) handleSymlinkRequest(req *fuse.SymlinkRequest) error {
+	if err := conn.checkDirWritable(req.Node, &req.Header); err != nil {
+		return err
+	}
+
+	inodeData, err := conn.newInodeData(req.Node, &req.Header, unix.S_IFLNK|0777)
+	if err != nil {
+		return err
 	}
+	inodeId, err := conn.Mount.CreateSymlink(conn.nodeInodeId(req.Node), req.NewName, req.Target, inodeData)
+	if err != nil {
+		return err
+	}
+
+	inode, err := conn.Mount.GetInode(inodeId)
+	if err != nil {
+		return err
+	}
+	lookup, err := conn.lookupResponse(inodeId, inode)
+	if err != nil {
+		return err
+	}
+	req.Respond(&fuse.SymlinkResponse{
+		LookupResponse: *lookup,
+	})
+	return nil
+}
+
+func (conn *Connection) handleLinkRequest(req *fuse.LinkRequest) error {
+	if err := conn.checkDirWritable(req.Node, &req.Header); err != nil {
+		return err
+	}
+
+	inodeId := conn.nodeInodeId(req.OldNode)
+	if err := conn.Mount.LinkFile(conn.nodeInodeId(req.Node), req.NewName, inodeId); err != nil {
+		return err
+	}
+
+	inode, err := conn.Mount.GetInode(inodeId)
+	if err != nil {
+		return err
+	}
+	lookup, err := conn.lookupResponse(inodeId, inode)
+	if err != nil {
+		return err
+	}
+	req.Respond(lookup)
+	return nil
+}
+
+// Returns an EPERM error if the user making `header` may not remove or
+// replace the entry `name` of the directory `parentNodeId`. Entries of sticky
+// directories may only be removed by their owner, the directory's owner or
+// root.
+func (conn *Connection) checkSticky(parentNodeId fuse.NodeID, header *fuse.Header, name string) error {
+	parent, err := conn.GetInode(parentNodeId)
+	if err != nil {
+		return err
+	}
+	if parent.Mode&unix.S_ISVTX == 0 || header.Uid == 0 || header.Uid == parent.Uid {
+		return nil
+	}
+
+	child, _, err := conn.Mount.LookupChild(conn.nodeInodeId(parentNodeId), name)
+	if err != nil {
+		return err
+	}
+	if child != nil && child.Uid != header.Uid {
+		return FuseError{
+			source: errors.New("operation not permitted"),
+			errno:  unix.EPERM,
+		}
+	}
+	return nil
+}
+
+func (conn *Connection) handleRemoveRequest(req *fuse.RemoveRequest) error {
+	if err := conn.checkDirWritable(req.Node, &req.Header); err != nil {
+		return err
+	}
+
+	if err := conn.checkSticky(req.Node, &req.Header, req.Name); err != nil {
+		return err
+	}
+
+	if err := conn.Mount.RemoveFile(conn.nodeInodeId(req.Node), req.Name, req.Dir); err != nil {
+		return err
+	}
+
+	req.Respond()
+	return nil
+}
+
+func (conn *Connection) handleRenameRequest(req *fuse.RenameRequest) error {
+	if err := conn.checkDirWritable(req.Node, &req.Header); err != nil {
+		return err
+	}
+	if err := conn.checkDirWritable(req.NewDir, &req.Header); err != nil {
+		return err
+	}
+	if err := conn.checkSticky(req.Node, &req.Header, req.OldName); err != nil {
+		return err
+	}
+	if err := conn.checkSticky(req.NewDir, &req.Header, req.NewName); err != nil {
+		return err
+	}
+
+	// The kernel has already refused to move a directory beneath itself.
+	err := conn.Mount.RenameFile(conn.nodeInodeId(req.Node), req.OldName, conn.nodeInodeId(req.NewDir), req.NewName)
+	if err != nil {
+		return err
+	}
+
+	req.Respond()
+	return nil
+}
+
+func (conn *Connection) handleSetattrRequest(req *fuse.SetattrRequest) error {
+	if err := conn.checkWritable(); err != nil {
+		return err
+	}
+
+	inode, err := conn.GetInode(req.Node)
+	if err != nil {
+		return err
+	}
+	// The Uid and Gid fields of the request hold the requested ownership; the
+	// caller is identified by the request header.
+	caller := req.Header
+	isRoot := caller.Uid == 0
+	isOwner := isRoot || caller.Uid == inode.Uid
+	permissionDenied := FuseError{
+		source: errors.New("operation not permitted"),
+		errno:  unix.EPERM,
+	}
+
+	if req.Valid.Mode() && !isOwner {
+		return permissionDenied
+	}
+	if req.Valid.Uid() && req.Uid != inode.Uid && !isRoot {
+		return permissionDenied
+	}
+	if req.Valid.Gid() && req.Gid != inode.Gid && !isRoot && !(isOwner && callerInGroup(&caller, req.Gid)) {
+		return permissionDenied
+	}
+
+	// Setting explicit times requires ownership while setting them to the
+	// current time only requires write access.
+	if (req.Valid.Atime() && !req.Valid.AtimeNow()) || (req.Valid.Mtime() && !req.Valid.MtimeNow()) {
+		if !isOwner {
+			return permissionDenied
+		}
+	} else if (req.Valid.AtimeNow() || req.Valid.MtimeNow()) && !isOwner {
+		if err := conn.checkAccess(req.Node, &caller, unix.ACL_WRITE); err != nil {
+			return err
+		}
+	}
+
+	if req.Valid.Size() {
+		if unix.S_ISDIR(inode.Mode) {
+			return FuseError{
+				source: errors.New("cannot truncate directory"),
+				errno:  unix.EISDIR,
+			}
+		}
+		if !unix.S_ISREG(inode.Mode) {
+			return FuseError{
+				source: errors.New("cannot truncate non-regular file"),
+				errno:  unix.EINVAL,
+			}
+		}
+		// Truncating through an open handle was already checked on open.
+		if !req.Valid.Handle() {
+			if err := conn.checkAccess(req.Node, &caller, unix.ACL_WRITE); err != nil {
+				return err
+			}
+		}
+	}
+
+	inFileGroup := req.Valid.Mode() && callerInGroup(&caller, inode.Gid)
+
+	now := storage.TimestampNow()
+	inodeId := conn.nodeInodeId(req.Node)
+	inode, err = conn.Mount.UpdateInode(inodeId, func(inodeData *storage.InodeData) error {
+		if req.Valid.Mode() {
+			mode := unix.FileStatToUnixMode(req.Mode) &^ unix.S_IFMT
+			// Only members of the file's group may set the setgid bit.
+			if !isRoot && !inFileGroup {
+				mode &^= unix.S_ISGID
+			}
+			inodeData.Mode = (inodeData.Mode & unix.S_IFMT) | mode
+		}
+
+		if req.Valid.Uid() || req.Valid.Gid() {
+			if req.Valid.Uid() {
+				inodeData.Uid = req.Uid
+			}
+			if req.Valid.Gid() {
+				inodeData.Gid = req.Gid
+			}
+			// Changing ownership clears the setuid bit and the setgid bit when it
+			// marks the file as executable by its group.
+			if !unix.S_ISDIR(inodeData.Mode) && !req.Valid.Mode() {
+				inodeData.Mode &^= unix.S_ISUID
+				if inodeData.Mode&0010 != 0 {
+					inodeData.Mode &^= unix.S_ISGID
+				}
+			}
+		}
+
+		if req.Valid.Size() {
+			inodeData.Size = req.Size
+			if !req.Valid.Mtime() {
+				inodeData.Mtim = now
+			}
+		}
+
+		if req.Valid.AtimeNow() {
+			inodeData.Atim = now
+		} else if req.Valid.Atime() {
+			inodeData.Atim = uint64(req.Atime.UnixNano())
+		}
+		if req.Valid.MtimeNow() {
+			inodeData.Mtim = now
+		} else if req.Valid.Mtime() {
+			inodeData.Mtim = uint64(req.Mtime.UnixNano())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	attr, err := conn.nodeToAttr(inodeId, inode)
+	if err != nil {
+		return err
+	}
+	req.Respond(&fuse.SetattrResponse{
+		Attr: attr,
+	})
+	return nil
 }
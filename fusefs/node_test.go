@@ -0,0 +1,280 @@
+package fusefs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+
+	"github.com/msg555/ctrfs/storage"
+	"github.com/msg555/ctrfs/unix"
+)
+
+// Returns a connection to a new writable mount whose root directory is owned
+// by root. No fuse connection is made so handlers cannot respond to requests.
+func testConnection(t *testing.T) *Connection {
+	tmpDir, err := ioutil.TempDir("", "ctrfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	sc, err := storage.OpenStorageContext(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sc.Close()
+	})
+
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootFile, err := mnt.FileManager.NewFile(&storage.InodeData{Mode: unix.S_IFDIR | 0755, Nlink: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootInodeId := rootFile.GetInodeId()
+	rootFile.Close()
+	if err := mnt.SetRoot(rootInodeId); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := &Connection{
+		Mount:     mnt,
+		handleMap: make(map[fuse.HandleID]Handle),
+	}
+	conn.nodes.init()
+	conn.locks.init()
+	return conn
+}
+
+// Returns a request header for the current process acting as `uid` and
+// `gid`.
+func testHeader(nodeId fuse.NodeID, uid, gid uint32) fuse.Header {
+	return fuse.Header{
+		Node: nodeId,
+		Uid:  uid,
+		Gid:  gid,
+		Pid:  uint32(os.Getpid()),
+	}
+}
+
+// Returns the errno of an error returned by a request handler, or 0 if it
+// succeeded.
+func requestErrno(err error) unix.Errno {
+	if err == nil {
+		return 0
+	}
+	return unix.Errno(WrapIOError(err).errno)
+}
+
+func TestCallerInGroup(t *testing.T) {
+	groups, err := os.Getgroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const otherGid = 0xfffffff0
+	hdr := &fuse.Header{Pid: uint32(os.Getpid()), Gid: otherGid - 1}
+	if !callerInGroup(hdr, hdr.Gid) {
+		t.Fatal("expected caller to be a member of its primary group")
+	}
+	for _, gid := range groups {
+		if !callerInGroup(hdr, uint32(gid)) {
+			t.Fatalf("expected caller to be a member of supplementary group %d", gid)
+		}
+	}
+	if callerInGroup(hdr, otherGid) {
+		t.Fatal("unexpected group membership")
+	}
+}
+
+func TestNodeToAttrBlocks(t *testing.T) {
+	conn := testConnection(t)
+	rootInodeId := conn.nodeInodeId(FUSE_ROOT_ID)
+	blockSize := uint64(conn.Mount.Blocks.GetBlockSize())
+
+	for _, tc := range []struct {
+		name   string
+		flags  uint32
+		blocks uint64
+	}{
+		{"blocks", 0, blockSize >> 9},
+		// The chunk truncated to 100 bytes occupies a single sector.
+		{"chunks", storage.INODE_FLAG_CHUNKED, 1},
+	} {
+		inodeId, err := conn.Mount.CreateFile(rootInodeId, tc.name, &storage.InodeData{Mode: unix.S_IFREG | 0644, Flags: tc.flags}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := conn.Mount.FileManager.OpenFile(unix.DT_REG, inodeId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = file.(storage.FileObjectReg).WriteAt(make([]byte, blockSize), 0)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		inode, err := conn.Mount.UpdateInode(inodeId, func(inodeData *storage.InodeData) error {
+			inodeData.Size = 100
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		attr, err := conn.nodeToAttr(inodeId, inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attr.Blocks != tc.blocks {
+			t.Fatalf("expected %s file to report %d blocks, got %d", tc.name, tc.blocks, attr.Blocks)
+		}
+	}
+}
+
+func TestXattrPermissions(t *testing.T) {
+	conn := testConnection(t)
+	mnt := conn.Mount
+
+	fileInodeId, err := mnt.CreateFile(mnt.RootInodeId, "f", &storage.InodeData{Mode: unix.S_IFREG | 0644, Uid: 1000, Gid: 1000}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkInodeId, err := mnt.CreateSymlink(mnt.RootInodeId, "l", "f", &storage.InodeData{Uid: 1000, Gid: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := fuse.NodeID(fileInodeId)
+	link := fuse.NodeID(linkInodeId)
+	if err := mnt.SetXattr(fileInodeId, "trusted.a", []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		node     fuse.NodeID
+		uid, gid uint32
+		name     string
+		errno    unix.Errno
+	}{
+		{file, 2000, 2000, "user.a", unix.EACCES},
+		{file, 2000, 1000, "user.a", unix.EACCES},
+		{file, 1000, 1000, "user.a", 0},
+		{file, 0, 0, "user.a", 0},
+		{link, 1000, 1000, "user.a", unix.EPERM},
+		{link, 0, 0, "user.a", unix.EPERM},
+		{file, 1000, 1000, "trusted.a", unix.EPERM},
+		{file, 1000, 1000, "security.capability", unix.EPERM},
+		{file, 0, 0, "trusted.a", 0},
+		{file, 0, 0, "security.capability", 0},
+		{file, 2000, 1000, unix.XATTR_POSIX_ACL_ACCESS, unix.EPERM},
+		{file, 1000, 1000, unix.XATTR_POSIX_ACL_ACCESS, 0},
+		{file, 0, 0, unix.XATTR_POSIX_ACL_ACCESS, 0},
+		{fuse.NodeID(mnt.RootInodeId), 1000, 1000, unix.XATTR_POSIX_ACL_DEFAULT, unix.EPERM},
+		{file, 0, 0, "system.other", unix.EOPNOTSUPP},
+	}
+	for i, check := range checks {
+		hdr := testHeader(check.node, check.uid, check.gid)
+		if check.errno == 0 {
+			// Handlers cannot respond without a kernel connection so only the
+			// permission check is run for requests that are allowed.
+			if err := conn.checkXattrWritable(check.node, &hdr, check.name); err != nil {
+				t.Fatalf("check %d: unexpected error '%s'", i, err)
+			}
+			continue
+		}
+
+		err := conn.handleSetxattrRequest(&fuse.SetxattrRequest{
+			Header: hdr,
+			Name:   check.name,
+			Xattr:  []byte("value"),
+		})
+		if requestErrno(err) != check.errno {
+			t.Fatalf("check %d: unexpected setxattr result '%v'", i, err)
+		}
+		err = conn.handleRemovexattrRequest(&fuse.RemovexattrRequest{
+			Header: hdr,
+			Name:   check.name,
+		})
+		if requestErrno(err) != check.errno {
+			t.Fatalf("check %d: unexpected removexattr result '%v'", i, err)
+		}
+	}
+
+	names, err := mnt.ListXattrs(fileInodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "trusted.a" {
+		t.Fatalf("unexpected xattrs %v", names)
+	}
+}
+
+func TestAccessSupplementaryGroups(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("setting the groups of a process requires root")
+	}
+
+	// Start a process with a supplementary group to act as the caller.
+	const group = 4242
+	cmd := exec.Command("sleep", "60")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Groups: []uint32{group}},
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	conn := testConnection(t)
+	mnt := conn.Mount
+	inodeId, err := mnt.CreateFile(mnt.RootInodeId, "f", &storage.InodeData{Mode: unix.S_IFREG | 0640, Uid: 1000, Gid: group}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aclInodeId, err := mnt.CreateFile(mnt.RootInodeId, "acl", &storage.InodeData{Mode: unix.S_IFREG | 0600, Uid: 1000, Gid: 1000}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := unix.ParseACLText(fmt.Sprintf("user::rw-,group::---,group:%d:r--,mask::r--,other::---", group))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mnt.SetXattr(aclInodeId, unix.XATTR_POSIX_ACL_ACCESS, acl.Bytes(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The caller's primary group does not own either file but the process's
+	// supplementary group matches the owning group and the named ACL entry.
+	for _, inodeId := range []storage.InodeId{inodeId, aclInodeId} {
+		hdr := testHeader(fuse.NodeID(inodeId), 2000, 2000)
+		hdr.Pid = uint32(cmd.Process.Pid)
+		if err := conn.checkAccess(hdr.Node, &hdr, unix.ACL_READ); err != nil {
+			t.Fatalf("expected supplementary group to grant read access '%s'", err)
+		}
+		err = conn.handleAccessRequest(&fuse.AccessRequest{
+			Header: hdr,
+			Mask:   unix.ACL_WRITE,
+		})
+		if requestErrno(err) != unix.EACCES {
+			t.Fatalf("expected EACCES, got '%v'", err)
+		}
+
+		hdr.Pid = uint32(os.Getpid())
+		if err := conn.checkAccess(hdr.Node, &hdr, unix.ACL_READ); err == nil {
+			t.Fatal("expected access to be denied without the supplementary group")
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package fusefs
+
+import (
+	"log"
+	"sync"
+
+	"bazil.org/fuse"
+
+	"github.com/msg555/ctrfs/storage"
+)
+
+/*
+The kernel counts each node id it is handed in a lookup style response and
+later returns those counts through forget requests. While the kernel knows of
+a node the connection holds a reference to its inode so that files removed
+while still in use stay alive, and so that their inode ids are not reused for
+new files, until the kernel forgets them.
+*/
+
+type nodeTable struct {
+	lock    sync.Mutex
+	lookups map[storage.InodeId]uint64
+}
+
+func (nt *nodeTable) init() {
+	nt.lookups = make(map[storage.InodeId]uint64)
+}
+
+// Counts a lookup of `inodeId` handed to the kernel, taking a reference to the
+// inode the first time it is seen.
+func (conn *Connection) acquireNode(inodeId storage.InodeId) error {
+	nt := &conn.nodes
+	nt.lock.Lock()
+	defer nt.lock.Unlock()
+
+	count, ok := nt.lookups[inodeId]
+	if !ok {
+		if err := conn.Mount.AcquireInode(inodeId); err != nil {
+			return err
+		}
+	}
+	nt.lookups[inodeId] = count + 1
+	return nil
+}
+
+// Drops `n` lookups of `nodeId`, releasing the inode once the kernel has
+// forgotten every lookup of it.
+func (conn *Connection) forgetNode(nodeId fuse.NodeID, n uint64) error {
+	if nodeId == FUSE_ROOT_ID {
+		return nil
+	}
+	inodeId := storage.InodeId(nodeId)
+
+	nt := &conn.nodes
+	nt.lock.Lock()
+	defer nt.lock.Unlock()
+
+	count, ok := nt.lookups[inodeId]
+	if !ok {
+		return nil
+	}
+	if count > n {
+		nt.lookups[inodeId] = count - n
+		return nil
+	}
+	delete(nt.lookups, inodeId)
+	return conn.Mount.ReleaseInode(inodeId)
+}
+
+// Releases every node still known to the kernel once the connection is
+// closed.
+func (conn *Connection) releaseNodes() error {
+	nt := &conn.nodes
+	nt.lock.Lock()
+	defer nt.lock.Unlock()
+
+	var firstErr error
+	for inodeId := range nt.lookups {
+		if err := conn.Mount.ReleaseInode(inodeId); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	nt.lookups = make(map[storage.InodeId]uint64)
+	return firstErr
+}
+
+// Forget requests have no reply so failures to release nodes are only logged.
+func (conn *Connection) handleForgetRequest(req *fuse.ForgetRequest) error {
+	if err := conn.forgetNode(req.Node, req.N); err != nil {
+		log.Printf("Failed to release node %d: %s", req.Node, err)
+	}
+	req.Respond()
+	return nil
+}
+
+func (conn *Connection) handleBatchForgetRequest(req *fuse.BatchForgetRequest) error {
+	for _, item := range req.Forget {
+		if err := conn.forgetNode(item.NodeID, item.N); err != nil {
+			log.Printf("Failed to release node %d: %s", item.NodeID, err)
+		}
+	}
+	req.Respond()
+	return nil
+}
@@ -72,7 +72,9 @@ func (srv *Server) Close() error {
 	return srv.Storage.Close()
 }
 
-func (srv *Server) Mount(mountPoint string, contentAddress []byte, readOnly bool, options ...fuse.MountOption) error {
+// Mounts the tree at `contentAddress` at `mountPoint`. `syncPolicy` selects
+// how fsync requests and synchronous writes to the mount are handled.
+func (srv *Server) Mount(mountPoint string, contentAddress []byte, readOnly bool, syncPolicy SyncPolicy, options ...fuse.MountOption) error {
 	mnt, err := srv.Storage.CreateMount(contentAddress, readOnly)
 	if err != nil {
 		return err
@@ -93,7 +95,7 @@ func (srv *Server) Mount(mountPoint string, contentAddress []byte, readOnly bool
 		return errors.New("mount already exists")
 	}
 
-	options = append(options, fuse.Subtype("ctrfs"))
+	options = append(options, fuse.Subtype("ctrfs"), fuse.LockingFlock(), fuse.LockingPOSIX())
 	if readOnly {
 		options = append(options, fuse.ReadOnly())
 	}
@@ -106,9 +108,12 @@ func (srv *Server) Mount(mountPoint string, contentAddress []byte, readOnly bool
 		Conn:       conn,
 		MountPoint: mountPoint,
 		ReadOnly:   readOnly,
+		SyncPolicy: syncPolicy,
 		Mount:      mnt,
 		handleMap:  make(map[fuse.HandleID]Handle),
 	}
+	ctrfsConn.nodes.init()
+	ctrfsConn.locks.init()
 
 	srv.connectionMap[mountPoint] = ctrfsConn
 	srv.mountCond.Broadcast()
@@ -120,6 +125,9 @@ func (srv *Server) Mount(mountPoint string, contentAddress []byte, readOnly bool
 		} else {
 			log.Printf("Connection '%s' shutting down do to '%s'", mountPoint, err)
 		}
+		if err := mnt.Close(); err != nil {
+			log.Printf("Failed to close mount of '%s': %s", mountPoint, err)
+		}
 
 		srv.mountLock.Lock()
 		delete(srv.connectionMap, mountPoint)
@@ -0,0 +1,64 @@
+package fusefs
+
+import (
+	"bazil.org/fuse"
+	"github.com/go-errors/errors"
+
+	"github.com/msg555/ctrfs/storage"
+	"github.com/msg555/ctrfs/unix"
+)
+
+// Controls how a mount handles fsync requests and writes to files opened with
+// O_SYNC or O_DSYNC.
+type SyncPolicy int
+
+const (
+	// Sync requests are ignored; data is written back to disk lazily.
+	SyncIgnore SyncPolicy = iota
+
+	// Sync requests write back the dirty blocks of the file being synced.
+	SyncFile
+
+	// Sync requests write back every dirty block of the mount.
+	SyncFull
+)
+
+var syncPolicyNames = map[string]SyncPolicy{
+	"ignore": SyncIgnore,
+	"file":   SyncFile,
+	"full":   SyncFull,
+}
+
+// Returns the sync policy named `name`; one of "ignore", "file" or "full".
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	policy, ok := syncPolicyNames[name]
+	if !ok {
+		return SyncIgnore, errors.Errorf("unknown sync policy '%s'", name)
+	}
+	return policy, nil
+}
+
+// Writes `inodeId` back to disk as required by the mount's sync policy.
+func (conn *Connection) syncInode(inodeId storage.InodeId) error {
+	switch conn.SyncPolicy {
+	case SyncFile:
+		return conn.Mount.SyncFile(inodeId)
+	case SyncFull:
+		return conn.Mount.Sync()
+	}
+	return nil
+}
+
+// Returns true if writes through a handle opened with `flags` must reach the
+// disk before completing. O_SYNC implies O_DSYNC.
+func isSyncWrite(flags fuse.OpenFlags) bool {
+	return flags&fuse.OpenFlags(unix.O_DSYNC) != 0
+}
+
+func (conn *Connection) handleFsyncRequest(req *fuse.FsyncRequest) error {
+	if err := conn.syncInode(conn.nodeInodeId(req.Node)); err != nil {
+		return err
+	}
+	req.Respond()
+	return nil
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"github.com/msg555/ctrfs/unix"
+)
+
+/*
+POSIX ACLs are stored as the system.posix_acl_access and
+system.posix_acl_default extended attributes in the binary format used by
+the kernel. An access ACL that is fully represented by the mode of its file
+is not stored; the permission bits of the mode always reflect the owner,
+group class and other entries of the access ACL.
+*/
+
+// Returns the ACL stored in the extended attribute `name` of the file, or nil
+// if the file has no such ACL. Malformed ACLs are ignored.
+func readACL(file FileObject, name string) (unix.ACL, error) {
+	value, found, err := file.GetXattr(name)
+	if err != nil || !found {
+		return nil, err
+	}
+	acl, err := unix.ParseACL(value)
+	if err != nil {
+		return nil, nil
+	}
+	return acl, nil
+}
+
+// Returns true if `name` is an extended attribute holding a POSIX ACL.
+func isACLXattr(name string) bool {
+	return name == unix.XATTR_POSIX_ACL_ACCESS || name == unix.XATTR_POSIX_ACL_DEFAULT
+}
+
+// Sets the ACL extended attribute `name` of the file. Setting the access ACL
+// updates the permission bits of the file's mode to match.
+func setACLXattr(file FileObject, name string, value []byte, flags int) error {
+	acl, err := unix.ParseACL(value)
+	if err != nil {
+		return err
+	}
+
+	if name == unix.XATTR_POSIX_ACL_DEFAULT {
+		if !unix.S_ISDIR(file.GetInode().Mode) {
+			return unix.EACCES
+		}
+		return file.SetXattr(name, value, flags)
+	}
+
+	if acl.IsMinimal() {
+		if _, err := file.RemoveXattr(name); err != nil {
+			return err
+		}
+	} else if err := file.SetXattr(name, value, flags); err != nil {
+		return err
+	}
+	return file.UpdateInode(func(inodeData *InodeData) error {
+		inodeData.Mode = (inodeData.Mode &^ 0777) | acl.Mode()
+		return nil
+	})
+}
+
+// Returns the ACL extended attributes a new file created in `parent` with
+// `inodeData` inherits from the parent's default ACL. The permission bits of
+// `inodeData` are restricted by the inherited access ACL. If the parent has
+// no default ACL, `umask` is applied to the mode instead.
+func inheritACL(parent FileObject, inodeData *InodeData, umask uint32) ([]xattrEntry, error) {
+	if unix.S_ISLNK(inodeData.Mode) {
+		// Symlinks have no ACLs and their permissions are never used.
+		return nil, nil
+	}
+
+	defaultACL, err := readACL(parent, unix.XATTR_POSIX_ACL_DEFAULT)
+	if err != nil {
+		return nil, err
+	}
+	if defaultACL == nil {
+		inodeData.Mode &^= umask & 0777
+		return nil, nil
+	}
+
+	var xattrs []xattrEntry
+	accessACL := defaultACL.Mask(inodeData.Mode)
+	inodeData.Mode = (inodeData.Mode &^ 0777) | accessACL.Mode()
+	if !accessACL.IsMinimal() {
+		xattrs = append(xattrs, xattrEntry{
+			Name:  unix.XATTR_POSIX_ACL_ACCESS,
+			Value: accessACL.Bytes(),
+		})
+	}
+	if unix.S_ISDIR(inodeData.Mode) {
+		xattrs = append(xattrs, xattrEntry{
+			Name:  unix.XATTR_POSIX_ACL_DEFAULT,
+			Value: defaultACL.Bytes(),
+		})
+	}
+	return xattrs, nil
+}
+
+// Returns true if a process with `uid` whose group membership is reported by
+// `inGroup` has all the access in `mask` to the file. The file's access ACL is
+// used if it has one, otherwise its mode. The root user is granted all access
+// except execute access to files that no one can execute.
+func checkAccess(file FileObject, uid uint32, inGroup func(gid uint32) bool, mask uint32) (bool, error) {
+	inodeData := file.GetInode()
+	if uid == 0 {
+		if mask&unix.ACL_EXECUTE == 0 || unix.S_ISDIR(inodeData.Mode) {
+			return true, nil
+		}
+		return inodeData.Mode&0111 != 0, nil
+	}
+
+	acl, err := readACL(file, unix.XATTR_POSIX_ACL_ACCESS)
+	if err != nil {
+		return false, err
+	}
+	if acl != nil {
+		return acl.TestAccess(uid, inGroup, inodeData.Uid, inodeData.Gid, mask), nil
+	}
+	return unix.TestAccess(uid == inodeData.Uid, inGroup(inodeData.Gid), inodeData.Mode, mask), nil
+}
@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"archive/tar"
+	"testing"
+	"time"
+
+	"github.com/msg555/ctrfs/unix"
+)
+
+func mustParseACLText(t *testing.T, text string) unix.ACL {
+	acl, err := unix.ParseACLText(text)
+	if err != nil {
+		t.Fatalf("unexpected error parsing acl '%s'", err)
+	}
+	return acl
+}
+
+// Returns a group membership test for a process in the groups `gids`.
+func inGroups(gids ...uint32) func(gid uint32) bool {
+	return func(gid uint32) bool {
+		for _, group := range gids {
+			if group == gid {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestACLAccess(t *testing.T) {
+	sc := storageContextCreate(t)
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+	rootFile, err := mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFDIR | 0755, Nlink: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootInodeId := rootFile.GetInodeId()
+	rootFile.Close()
+	if err := mnt.SetRoot(rootInodeId); err != nil {
+		t.Fatal(err)
+	}
+
+	inodeId, err := mnt.CreateFile(rootInodeId, "f", &InodeData{Mode: unix.S_IFREG | 0640, Uid: 1000, Gid: 1000}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mnt.CreateFile(rootInodeId, "f", &InodeData{Mode: unix.S_IFREG | 0640}, 0); err != unix.EEXIST {
+		t.Fatalf("expected EEXIST, got '%v'", err)
+	}
+
+	checks := []struct {
+		uid, gid, mask uint32
+		allowed        bool
+	}{
+		{1000, 1000, unix.ACL_READ | unix.ACL_WRITE, true},
+		{1000, 1000, unix.ACL_EXECUTE, false},
+		{2000, 1000, unix.ACL_READ, true},
+		{2000, 1000, unix.ACL_WRITE, false},
+		{2000, 2000, unix.ACL_READ, false},
+		{0, 0, unix.ACL_READ | unix.ACL_WRITE, true},
+		{0, 0, unix.ACL_EXECUTE, false},
+	}
+	for i, check := range checks {
+		allowed, err := mnt.CheckAccess(inodeId, check.uid, inGroups(check.gid), check.mask)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != check.allowed {
+			t.Fatalf("mode check %d: expected access %v", i, check.allowed)
+		}
+	}
+	if allowed, _ := mnt.CheckAccess(inodeId, 2000, inGroups(2000, 1000), unix.ACL_READ); !allowed {
+		t.Fatal("expected supplementary group to grant group access")
+	}
+
+	// Named entries are limited by the mask, which becomes the group bits of
+	// the mode.
+	acl := mustParseACLText(t, "user::rw-,user:2000:rwx,group::r--,group:3000:rw-,mask::rw-,other::---")
+	if err := mnt.SetXattr(inodeId, unix.XATTR_POSIX_ACL_ACCESS, acl.Bytes(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnt.SetXattr(inodeId, unix.XATTR_POSIX_ACL_ACCESS, []byte("junk"), 0); err != unix.EINVAL {
+		t.Fatalf("expected EINVAL, got '%v'", err)
+	}
+	if err := mnt.SetXattr(inodeId, unix.XATTR_POSIX_ACL_DEFAULT, acl.Bytes(), 0); err != unix.EACCES {
+		t.Fatalf("expected EACCES setting default acl on file, got '%v'", err)
+	}
+	inodeData, err := mnt.GetInode(inodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inodeData.Mode != unix.S_IFREG|0660 {
+		t.Fatalf("unexpected mode %o after setting acl", inodeData.Mode)
+	}
+
+	checks = []struct {
+		uid, gid, mask uint32
+		allowed        bool
+	}{
+		{2000, 2000, unix.ACL_READ | unix.ACL_WRITE, true},
+		{2000, 2000, unix.ACL_EXECUTE, false},
+		{4000, 3000, unix.ACL_WRITE, true},
+		{4000, 1000, unix.ACL_WRITE, false},
+		{4000, 4000, unix.ACL_READ, false},
+	}
+	for i, check := range checks {
+		allowed, err := mnt.CheckAccess(inodeId, check.uid, inGroups(check.gid), check.mask)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != check.allowed {
+			t.Fatalf("acl check %d: expected access %v", i, check.allowed)
+		}
+	}
+	if allowed, _ := mnt.CheckAccess(inodeId, 4000, inGroups(4000, 3000), unix.ACL_WRITE); !allowed {
+		t.Fatal("expected supplementary group to match named group entry")
+	}
+	if allowed, _ := mnt.CheckAccess(inodeId, 4000, inGroups(4000, 1000), unix.ACL_READ); !allowed {
+		t.Fatal("expected supplementary group to match owning group entry")
+	}
+
+	// Setting a minimal ACL only changes the mode.
+	if err := mnt.SetXattr(inodeId, unix.XATTR_POSIX_ACL_ACCESS, mustParseACLText(t, "u::rwx,g::r-x,o::r--").Bytes(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := mnt.GetXattr(inodeId, unix.XATTR_POSIX_ACL_ACCESS); found {
+		t.Fatal("expected minimal acl to not be stored")
+	}
+	if inodeData, _ := mnt.GetInode(inodeId); inodeData.Mode != unix.S_IFREG|0754 {
+		t.Fatalf("unexpected mode %o after setting minimal acl", inodeData.Mode)
+	}
+}
+
+func TestACLInherit(t *testing.T) {
+	sc := storageContextCreate(t)
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+	rootFile, err := mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFDIR | 0755, Nlink: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootInodeId := rootFile.GetInodeId()
+	rootFile.Close()
+	if err := mnt.SetRoot(rootInodeId); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a default ACL the umask applies.
+	inodeId, err := mnt.CreateFile(rootInodeId, "plain", &InodeData{Mode: unix.S_IFREG | 0666}, 022)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inodeData, _ := mnt.GetInode(inodeId); inodeData.Mode != unix.S_IFREG|0644 || inodeData.Nlink != 1 {
+		t.Fatalf("unexpected mode %o or link count %d", inodeData.Mode, inodeData.Nlink)
+	}
+
+	dirInodeId, err := mnt.CreateFile(rootInodeId, "shared", &InodeData{Mode: unix.S_IFDIR | 0777}, 022)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inodeData, _ := mnt.GetInode(dirInodeId); inodeData.Nlink != 2 {
+		t.Fatalf("unexpected directory link count %d", inodeData.Nlink)
+	}
+	defaultACL := mustParseACLText(t, "user::rwx,group::r-x,group:3000:rwx,mask::rwx,other::---")
+	if err := mnt.SetXattr(dirInodeId, unix.XATTR_POSIX_ACL_DEFAULT, defaultACL.Bytes(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files inherit the default ACL restricted by their requested mode and
+	// ignore the umask.
+	fileInodeId, err := mnt.CreateFile(dirInodeId, "file", &InodeData{Mode: unix.S_IFREG | 0666}, 077)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inodeData, _ := mnt.GetInode(fileInodeId); inodeData.Mode != unix.S_IFREG|0660 {
+		t.Fatalf("unexpected inherited mode %o", inodeData.Mode)
+	}
+	if allowed, _ := mnt.CheckAccess(fileInodeId, 4000, inGroups(3000), unix.ACL_READ|unix.ACL_WRITE); !allowed {
+		t.Fatal("expected inherited acl to grant access")
+	}
+	if _, found, _ := mnt.GetXattr(fileInodeId, unix.XATTR_POSIX_ACL_DEFAULT); found {
+		t.Fatal("expected files to not inherit a default acl")
+	}
+
+	// Directories also inherit the default ACL as their own.
+	subdirInodeId, err := mnt.CreateFile(dirInodeId, "subdir", &InodeData{Mode: unix.S_IFDIR | 0777}, 077)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inodeData, _ := mnt.GetInode(subdirInodeId); inodeData.Mode != unix.S_IFDIR|0770 {
+		t.Fatalf("unexpected inherited mode %o", inodeData.Mode)
+	}
+	value, found, err := mnt.GetXattr(subdirInodeId, unix.XATTR_POSIX_ACL_DEFAULT)
+	if err != nil || !found {
+		t.Fatalf("expected directory to inherit default acl '%v'", err)
+	}
+	if string(value) != string(defaultACL.Bytes()) {
+		t.Fatal("unexpected inherited default acl")
+	}
+}
+
+func TestImportTarACL(t *testing.T) {
+	modTime := time.Unix(1600000000, 0)
+	entries := []tarTestEntry{
+		{Header: tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     "d/",
+			Mode:     0770,
+			ModTime:  modTime,
+			Format:   tar.FormatPAX,
+			PAXRecords: map[string]string{
+				"SCHILY.acl.access":  "user::rwx,user:lisa:rwx:1001,group::r-x,mask::rwx,other::---",
+				"SCHILY.acl.default": "user::rwx,group::r-x,other::---",
+			},
+		}},
+	}
+
+	sc := storageContextCreate(t)
+	nd, _, err := sc.ImportTar(writeTestArchive(t, entries, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, _ := lookupTestPath(t, sc, nd, "d")
+	acl, err := readACL(d, unix.XATTR_POSIX_ACL_ACCESS)
+	if err != nil || acl == nil {
+		t.Fatalf("expected access acl to be imported '%v'", err)
+	}
+	if !acl.TestAccess(1001, inGroups(1001), 0, 0, unix.ACL_WRITE) {
+		t.Fatal("expected named user to be granted access")
+	}
+	if acl, _ := readACL(d, unix.XATTR_POSIX_ACL_DEFAULT); acl == nil || acl.Mode() != 0750 {
+		t.Fatal("expected default acl to be imported")
+	}
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"github.com/msg555/ctrfs/blockfile"
+	"github.com/msg555/ctrfs/btree"
+	"github.com/msg555/ctrfs/unix"
+)
+
+/*
+A hardlink layer wraps the root directory of a tree that contains hardlinks.
+
+Regular files with identical content are deduplicated by copying the inode of
+the first such file stored, so each name still gets an inode of its own that
+shares the block map and data blocks of the original. Files with hardlinks
+are given an inode of their own that is never used as the source of these
+copies; every directory entry referencing one of these inodes is a hardlink
+to it. The layer records these inodes along with the number of names each has
+within the tree.
+
+Layer Inode
+
+	Mode     MODE_HARDLINK_LAYER
+	TreeNode btree mapping inode id -> link count
+	... inline data
+	root     uint64 - inode id of the wrapped root directory
+*/
+type HardlinkLayer struct {
+	RootInodeId InodeId
+
+	tree     btree.BTree
+	treeRoot btree.TreeIndex
+}
+
+func openHardlinkTree(blocks blockfile.BlockAllocator) (btree.BTree, error) {
+	tree := btree.BTree{
+		MaxKeySize: 8,
+		EntrySize:  8,
+	}
+	return tree, tree.Open(blocks)
+}
+
+// Writes a hardlink layer wrapping the root directory `rootInodeId`. `links`
+// holds the link count of each inode within the tree with more than one name.
+// Returns the inode id of the layer.
+func writeHardlinkLayer(blocks blockfile.BlockAllocator, tag interface{}, rootInodeId InodeId, links map[InodeId]uint32) (InodeId, error) {
+	tree, err := openHardlinkTree(blocks)
+	if err != nil {
+		return 0, err
+	}
+
+	records := make(map[string]btree.ValueType, len(links))
+	for inodeId, count := range links {
+		var key, val [8]byte
+		bo.PutUint64(key[:], uint64(inodeId))
+		bo.PutUint64(val[:], uint64(count))
+		records[string(key[:])] = val[:]
+	}
+	treeRoot, err := tree.WriteRecords(tag, records)
+	if err != nil {
+		return 0, err
+	}
+
+	layerInodeId, err := blocks.Allocate(tag)
+	if err != nil {
+		return 0, err
+	}
+
+	inodeData := InodeData{
+		Mode:     MODE_HARDLINK_LAYER,
+		TreeNode: treeRoot,
+	}
+	var buf [INODE_SIZE + 8]byte
+	inodeData.Write(buf[:], false)
+	bo.PutUint64(buf[INODE_SIZE:], uint64(rootInodeId))
+	if err := blocks.WriteAt(tag, layerInodeId, 0, buf[:]); err != nil {
+		return 0, err
+	}
+	return layerInodeId, nil
+}
+
+// Reads the hardlink layer stored at `inodeId`. Returns nil if the inode is
+// not a hardlink layer.
+func readHardlinkLayer(blocks blockfile.BlockAllocator, inodeId InodeId) (*HardlinkLayer, error) {
+	buf, err := blocks.ReadAt(inodeId, 0, INODE_SIZE+8, nil)
+	if err != nil {
+		return nil, err
+	}
+	inodeData := InodeFromBytes(buf)
+	if inodeData.Mode != MODE_HARDLINK_LAYER {
+		return nil, nil
+	}
+
+	tree, err := openHardlinkTree(blocks)
+	if err != nil {
+		return nil, err
+	}
+	return &HardlinkLayer{
+		RootInodeId: InodeId(bo.Uint64(buf[INODE_SIZE:])),
+		tree:        tree,
+		treeRoot:    inodeData.TreeNode,
+	}, nil
+}
+
+// Returns the number of names `inodeId` has within the layer's tree, or 0 if
+// the inode is not hardlinked.
+func (hl *HardlinkLayer) LinkCount(inodeId InodeId) (uint32, error) {
+	if hl == nil {
+		return 0, nil
+	}
+
+	var key [8]byte
+	bo.PutUint64(key[:], uint64(inodeId))
+	val, _, err := hl.tree.Find(hl.treeRoot, key[:])
+	if err != nil || val == nil {
+		return 0, err
+	}
+	return uint32(bo.Uint64(val)), nil
+}
+
+// Resolves `inodeId`, as returned by an import, to the root directory of the
+// imported tree along with its hardlink layer, if any.
+func (sc *StorageContext) ResolveRoot(inodeId InodeId) (InodeId, *HardlinkLayer, error) {
+	layer, err := readHardlinkLayer(sc.Blocks, inodeId)
+	if err != nil {
+		return 0, nil, err
+	}
+	if layer == nil {
+		return inodeId, nil, nil
+	}
+	return layer.RootInodeId, layer, nil
+}
+
+// Tracks the files of an import that have hardlinks along with the number of
+// names each has been given.
+type hardlinkTracker struct {
+	links map[InodeId]uint32
+}
+
+// Returns the inode to use for a file that has, or is about to gain, more than
+// one name. The inode of a regular file may be the source that later identical
+// files are copied from so the inode is copied into a new inode of its own
+// that is never used for deduplication. The copy shares its block map with the
+// original; stored trees are never modified in place so this is safe. Inodes
+// that are already such copies, as indicated by `copied`, are used as is.
+func (ht *hardlinkTracker) privateInode(sc *StorageContext, dtType int, inodeId InodeId, copied bool) (InodeId, error) {
+	if _, ok := ht.links[inodeId]; ok {
+		return inodeId, nil
+	}
+	if dtType == unix.DT_REG && !copied {
+		var err error
+		inodeId, err = blockfile.Duplicate(sc, sc.Blocks, inodeId, false)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if ht.links == nil {
+		ht.links = make(map[InodeId]uint32)
+	}
+	ht.links[inodeId] = 0
+	return inodeId, nil
+}
+
+// Counts a directory entry referencing `inodeId`. Entries referencing inodes
+// not returned by privateInode() are ignored.
+func (ht *hardlinkTracker) addLink(inodeId InodeId) {
+	if count, ok := ht.links[inodeId]; ok {
+		ht.links[inodeId] = count + 1
+	}
+}
+
+// Wraps `rootInodeId` in a hardlink layer if the import produced any
+// hardlinks. The link count of each inode given by privateInode() is updated
+// to the number of names it was given. Returns the inode that should
+// represent the imported tree.
+func (ht *hardlinkTracker) wrapRoot(sc *StorageContext, rootInodeId InodeId) (InodeId, error) {
+	links := make(map[InodeId]uint32)
+	for inodeId, count := range ht.links {
+		buf, err := sc.Blocks.ReadAt(inodeId, 0, INODE_SIZE, nil)
+		if err != nil {
+			return 0, err
+		}
+		inodeData := InodeFromBytes(buf)
+		inodeData.Nlink = count
+		if err := sc.Blocks.WriteAt(sc, inodeId, 0, inodeData.ToBytes()); err != nil {
+			return 0, err
+		}
+
+		if count > 1 {
+			links[inodeId] = count
+		}
+	}
+	if len(links) == 0 {
+		return rootInodeId, nil
+	}
+	return writeHardlinkLayer(sc.Blocks, sc, rootInodeId, links)
+}
@@ -1,6 +1,10 @@
 package storage
 
 import (
+	"io"
+
+	"github.com/msg555/ctrfs/blockfile"
+	"github.com/msg555/ctrfs/chunker"
 	"github.com/msg555/ctrfs/unix"
 )
 
@@ -23,3 +27,490 @@ func validatePathName(name string) bool {
 	}
 	return true
 }
+
+// Tracks how much file data an import wrote compared to how much it was able
+// to share with data already in storage.
+type ImportStats struct {
+	// Number of file data bytes written to new data blocks.
+	BytesStored int64
+
+	// Number of file data bytes that referenced an existing identical block.
+	BytesDeduplicated int64
+}
+
+func (stats *ImportStats) addBlock(length int, stored bool) {
+	if stored {
+		stats.BytesStored += int64(length)
+	} else {
+		stats.BytesDeduplicated += int64(length)
+	}
+}
+
+// Writes imported file data into the storage context deduplicating each data
+// block against the data block cache and each regular file against the cached
+// content addresses of previously imported files. Files written must belong to
+// the storage context's file manager.
+type importWriter struct {
+	Storage *StorageContext
+	Stats   ImportStats
+
+	hardlinks hardlinkTracker
+
+	// Content addresses of the regular files imported so far.
+	fileAddresses map[InodeId][]byte
+
+	// Regular files that are copies of a stored file made by copyRegular().
+	copies map[InodeId]bool
+}
+
+// Implemented by readers of sparse files that can report where their data
+// lies so that holes can be skipped without reading them.
+type sparseReader interface {
+	io.ReaderAt
+
+	// Returns the start and end of the first range of data at or after `off`.
+	// Both are the total size if no data follows `off`.
+	dataExtent(off int64) (int64, int64, error)
+	totalSize() int64
+}
+
+// Returns true if `data` is entirely zero.
+func isZeroData(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Splits the contents of `r` into the pieces a file is stored as; either fixed
+// size blocks or content-defined chunks. `dataFunc` is passed the offset of
+// each piece within the file. The passed slice is only valid until
+// `dataFunc` returns. Pieces that are entirely zero, and holes of sparse
+// readers, are instead passed to `holeFunc` so that they can be stored as
+// holes. Returns the number of bytes read.
+func (iw *importWriter) splitData(r io.Reader, chunked bool, dataFunc func(off int64, data []byte) error, holeFunc func(off, length int64) error) (int64, error) {
+	pieceFunc := func(off int64, data []byte) error {
+		if isZeroData(data) {
+			return holeFunc(off, int64(len(data)))
+		}
+		return dataFunc(off, data)
+	}
+
+	sr, ok := r.(sparseReader)
+	if !ok {
+		return iw.splitSegment(r, 0, chunked, pieceFunc)
+	}
+
+	// Data ranges are widened to whole blocks so that skipping holes never
+	// changes how blocks are split.
+	blockSize := int64(iw.Storage.Cache.BlockSize)
+	size := sr.totalSize()
+	off := int64(0)
+	for off < size {
+		start, end, err := sr.dataExtent(off)
+		if err != nil {
+			return off, err
+		}
+		start -= start % blockSize
+		if start > off {
+			if err := holeFunc(off, start-off); err != nil {
+				return off, err
+			}
+			off = start
+		}
+		if end = (end + blockSize - 1) / blockSize * blockSize; end > size || end <= off {
+			end = size
+		}
+
+		segmentStart := off
+		n, err := iw.splitSegment(io.NewSectionReader(sr, segmentStart, end-segmentStart), segmentStart, chunked, pieceFunc)
+		off += n
+		if err != nil {
+			return off, err
+		}
+		if n < end-segmentStart {
+			// The file was truncated while being read.
+			return off, nil
+		}
+	}
+	return off, nil
+}
+
+// Splits the contents of `r`, which start at offset `base` of the file, as
+// with splitData().
+func (iw *importWriter) splitSegment(r io.Reader, base int64, chunked bool, pieceFunc func(off int64, data []byte) error) (int64, error) {
+	off := base
+	if chunked {
+		ch := chunker.New(r, iw.Storage.Cache.BlockSize)
+		for {
+			chunk, err := ch.Next()
+			if err == io.EOF {
+				return off - base, nil
+			} else if err != nil {
+				return off - base, err
+			}
+			if err := pieceFunc(off, chunk); err != nil {
+				return off - base, err
+			}
+			off += int64(len(chunk))
+		}
+	}
+
+	buf := make([]byte, iw.Storage.Cache.BlockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return off - base, nil
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return off - base, err
+		}
+		if err := pieceFunc(off, buf[:n]); err != nil {
+			return off - base, err
+		}
+		off += int64(n)
+		if n < len(buf) {
+			return off - base, nil
+		}
+	}
+}
+
+// Copies the contents of `r` into a newly created file, using content-defined
+// chunk boundaries if the file is chunked. Returns the number of bytes written
+// and the content address of the resulting file.
+func (iw *importWriter) importData(tf *TreeFileReg, r io.Reader) (int64, []byte, error) {
+	blockSize := int64(iw.Storage.Cache.BlockSize)
+	chunked := tf.isChunked()
+
+	hsh := iw.Storage.newFileContentHasher()
+	loader := tf.newLoader()
+	written, err := iw.splitData(r, chunked, func(off int64, data []byte) error {
+		blockIndex, blockAddress, stored, err := iw.Storage.storeDataBlock(data)
+		if err != nil {
+			return err
+		}
+		if chunked {
+			err = loader.appendChunk(blockIndex, len(data))
+			hsh.addChunk(off+int64(len(data)), len(data), blockAddress)
+		} else {
+			err = loader.appendBlock(blockIndex, len(data))
+			hsh.addBlock(off/blockSize, blockAddress)
+		}
+		if err != nil {
+			return err
+		}
+		iw.Stats.addBlock(len(data), stored)
+		return nil
+	}, loader.appendHole)
+	if err == nil {
+		err = loader.finish()
+	}
+	if err != nil {
+		loader.abort()
+		return written, nil, err
+	}
+
+	tf.lock.RLock()
+	inodeData := tf.inodeData
+	xattrs, err := tf.readXattrs()
+	tf.lock.RUnlock()
+	if err != nil {
+		return written, nil, err
+	}
+	hsh.addXattrs(xattrs)
+	return written, hsh.contentAddress(&inodeData), nil
+}
+
+// Computes the content address a regular file described by `inodeData` and
+// `xattrs` would have after importing the contents of `r` without writing
+// anything to storage.
+func (iw *importWriter) hashData(inodeData *InodeData, xattrs []xattrEntry, r io.Reader) ([]byte, error) {
+	blockSize := int64(iw.Storage.Cache.BlockSize)
+	chunked := inodeData.Flags&INODE_FLAG_CHUNKED != 0
+
+	hsh := iw.Storage.newFileContentHasher()
+	_, err := iw.splitData(r, chunked, func(off int64, data []byte) error {
+		blockAddress := iw.Storage.paddedDataBlockContentAddress(data)
+		if chunked {
+			hsh.addChunk(off+int64(len(data)), len(data), blockAddress)
+		} else {
+			hsh.addBlock(off/blockSize, blockAddress)
+		}
+		return nil
+	}, func(off, length int64) error {
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortXattrEntries(xattrs)
+	hsh.addXattrs(xattrs)
+	return hsh.contentAddress(inodeData), nil
+}
+
+// Looks up an existing file identical to the regular file described by
+// `inodeData` and `xattrs` with contents `r`. Returns a new inode sharing the
+// data of the existing file or 0 if no such file exists. This allows callers
+// that can read a file's contents twice to avoid writing anything for
+// duplicate files.
+func (iw *importWriter) findRegular(inodeData *InodeData, xattrs []xattrEntry, r io.Reader) (InodeId, error) {
+	contentAddress, err := iw.hashData(inodeData, xattrs, r)
+	if err != nil {
+		return 0, err
+	}
+
+	inodeId, err := iw.Storage.lookupAddressInode(contentAddress)
+	if err != nil || inodeId == 0 {
+		return 0, err
+	}
+	iw.Stats.BytesDeduplicated += int64(inodeData.Size)
+	inodeId, err = iw.copyRegular(inodeId)
+	if err != nil {
+		return 0, err
+	}
+	iw.addFileAddress(inodeId, contentAddress)
+	return inodeId, nil
+}
+
+func (iw *importWriter) addFileAddress(inodeId InodeId, contentAddress []byte) {
+	if iw.fileAddresses == nil {
+		iw.fileAddresses = make(map[InodeId][]byte)
+	}
+	iw.fileAddresses[inodeId] = contentAddress
+}
+
+// Copies the inode of the stored regular file `inodeId` into a new inode. The
+// copy shares the block map, data blocks and extended attributes of the
+// original; stored trees are never modified in place so this is safe. Each
+// name of a duplicate file needs an inode of its own as mounts track changes
+// per inode.
+func (iw *importWriter) copyRegular(inodeId InodeId) (InodeId, error) {
+	inodeId, err := blockfile.Duplicate(iw.Storage, iw.Storage.Blocks, inodeId, false)
+	if err != nil {
+		return 0, err
+	}
+	if iw.copies == nil {
+		iw.copies = make(map[InodeId]bool)
+	}
+	iw.copies[inodeId] = true
+	return inodeId, nil
+}
+
+// Imports a regular file described by `inodeData` and `xattrs` with contents
+// read from `r`. If an identical file has already been imported the new file
+// is discarded and a copy of the existing inode is returned instead. Returns
+// the number of bytes read from `r` along with the inode of the file.
+func (iw *importWriter) importRegular(inodeData *InodeData, xattrs []xattrEntry, r io.Reader) (InodeId, int64, error) {
+	fileInodeData := *inodeData
+	fileInodeData.Size = 0
+	fileInodeData.Blocks = 0
+	fileInodeData.TreeNode = 0
+
+	file, err := iw.Storage.FileManager.NewFile(&fileInodeData)
+	if err != nil {
+		return 0, 0, err
+	}
+	tf := file.(*TreeFileReg)
+	if err := iw.initXattrs(file, xattrs); err != nil {
+		tf.Close()
+		return 0, 0, err
+	}
+
+	written, contentAddress, err := iw.importData(tf, r)
+	if err != nil {
+		tf.Close()
+		return 0, written, err
+	}
+
+	inodeId, err := iw.Storage.lookupAddressInode(contentAddress)
+	if err != nil {
+		tf.Close()
+		return 0, written, err
+	}
+	if inodeId != 0 {
+		// Every block of a duplicate file is already shared with the existing
+		// file so only the inode and its block map need to be released.
+		if err := iw.discardFile(tf); err != nil {
+			return 0, written, err
+		}
+		inodeId, err = iw.copyRegular(inodeId)
+		if err != nil {
+			return 0, written, err
+		}
+		iw.addFileAddress(inodeId, contentAddress)
+		return inodeId, written, nil
+	}
+
+	if err := iw.Storage.insertBlockIntoCache(contentAddress, tf.GetInodeId()); err != nil {
+		tf.Close()
+		return 0, written, err
+	}
+	iw.addFileAddress(tf.GetInodeId(), contentAddress)
+	return tf.GetInodeId(), written, tf.Close()
+}
+
+// Sets the extended attributes of a newly imported file.
+func (iw *importWriter) initXattrs(file FileObject, xattrs []xattrEntry) error {
+	tf := file.getObject()
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+	return tf.initXattrs(xattrs)
+}
+
+// Closes and frees the inode, block map and extended attributes of a newly
+// imported file. Data blocks are left in place as they may be shared with
+// other files.
+func (iw *importWriter) discardFile(tf *TreeFileReg) error {
+	inodeData := tf.GetInode()
+	if err := tf.Close(); err != nil {
+		return err
+	}
+
+	if err := tf.freeXattrs(); err != nil {
+		return err
+	}
+	if inodeData.TreeNode != 0 {
+		tree := &tf.manager.fileBlockTree
+		if inodeData.Flags&INODE_FLAG_CHUNKED != 0 {
+			tree = &tf.manager.fileChunkTree
+		}
+		if err := tree.FreeTree(inodeData.TreeNode, false); err != nil {
+			return err
+		}
+	}
+	return iw.Storage.Blocks.Free(tf.inodeId)
+}
+
+// Returns the storage node representing the imported tree rooted at `root`.
+// If the import created any hardlinks the root is wrapped in a hardlink layer.
+// The content address of the tree is registered so that the tree can later be
+// mounted by its address.
+func (iw *importWriter) storageNode(root FileObject) (*StorageNode, error) {
+	inodeId, err := iw.hardlinks.wrapRoot(iw.Storage, root.GetInodeId())
+	if err != nil {
+		return nil, err
+	}
+
+	inode := root.GetInode()
+	if inodeId != root.GetInodeId() {
+		buf, err := iw.Storage.Blocks.ReadAt(inodeId, 0, INODE_SIZE, nil)
+		if err != nil {
+			return nil, err
+		}
+		inode = *InodeFromBytes(buf)
+	}
+
+	th := treeContentHasher{
+		sc:            iw.Storage,
+		fileAddresses: iw.fileAddresses,
+	}
+	nodeAddress, err := th.rootAddress(inodeId)
+	if err != nil {
+		return nil, err
+	}
+
+	// An identical tree may already be stored; keep mounting that one and free
+	// the tree just imported.
+	existingInodeId, err := iw.Storage.lookupAddressInode(nodeAddress)
+	if err != nil {
+		return nil, err
+	}
+	if existingInodeId == 0 {
+		if err := iw.Storage.insertBlockIntoCache(nodeAddress, inodeId); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := iw.discardTree(root, inodeId); err != nil {
+			return nil, err
+		}
+		buf, err := iw.Storage.Blocks.ReadAt(existingInodeId, 0, INODE_SIZE, nil)
+		if err != nil {
+			return nil, err
+		}
+		inodeId = existingInodeId
+		inode = *InodeFromBytes(buf)
+	}
+
+	nd := &StorageNode{
+		InodeId: inodeId,
+		Inode:   &inode,
+	}
+	copy(nd.NodeAddress[:], nodeAddress)
+	return nd, nil
+}
+
+// Frees the newly imported tree `inodeId` with root directory `root` after
+// finding that an identical tree is already stored. `root` is freed once its
+// last reference is closed. Every regular file in an identical tree was found
+// in the content address cache while importing, so each is a copy of a stored
+// file sharing its block map, data blocks and extended attributes; only the
+// inodes of regular files are freed.
+func (iw *importWriter) discardTree(root FileObject, inodeId InodeId) error {
+	if inodeId != root.GetInodeId() {
+		layer, err := readHardlinkLayer(iw.Storage.Blocks, inodeId)
+		if err != nil {
+			return err
+		}
+		if err := layer.tree.FreeTree(layer.treeRoot, false); err != nil {
+			return err
+		}
+		if err := iw.Storage.Blocks.Free(inodeId); err != nil {
+			return err
+		}
+	}
+
+	visited := map[InodeId]bool{root.GetInodeId(): true}
+	if err := iw.discardEntries(root.(FileObjectDir), visited); err != nil {
+		return err
+	}
+	root.getObject().markDiscarded()
+	return nil
+}
+
+// Frees everything reachable from the entries of the discarded directory
+// `dir`. Inodes in `visited` have already been freed.
+func (iw *importWriter) discardEntries(dir FileObjectDir, visited map[InodeId]bool) error {
+	type entry struct {
+		dtType  int
+		inodeId InodeId
+	}
+	var entries []entry
+	_, err := dir.Scan("", func(name string, dtType int, inodeId InodeId) bool {
+		entries = append(entries, entry{dtType: dtType, inodeId: inodeId})
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, ent := range entries {
+		if visited[ent.inodeId] {
+			continue
+		}
+		visited[ent.inodeId] = true
+
+		if ent.dtType == unix.DT_REG {
+			if err := iw.Storage.Blocks.Free(ent.inodeId); err != nil {
+				return err
+			}
+			continue
+		}
+
+		file, err := iw.Storage.FileManager.OpenFile(ent.dtType, ent.inodeId)
+		if err != nil {
+			return err
+		}
+		if subdir, ok := file.(FileObjectDir); ok {
+			if err := iw.discardEntries(subdir, visited); err != nil {
+				file.Close()
+				return err
+			}
+		}
+		file.getObject().markDiscarded()
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
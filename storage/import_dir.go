@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"fmt"
 	"io"
+	"strings"
 
 	"github.com/go-errors/errors"
 
@@ -14,8 +16,7 @@ type hostInode struct {
 }
 
 type dirImportContext struct {
-	Storage         *StorageContext
-	MountView *MountView
+	importWriter
 	HostInodeMap        map[hostInode]InodeId
 	IgnoreHardlinks bool
 }
@@ -32,6 +33,43 @@ func (f fdReader) Read(buf []byte) (int, error) {
   return n, err
 }
 
+func (f fdReader) ReadAt(buf []byte, off int64) (int, error) {
+	n, err := unix.Pread(f.FileDescriptor, buf, off)
+	if err == nil && n == 0 && len(buf) > 0 {
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+// Reads a regular file that may contain holes. Holes are located with
+// SEEK_DATA and SEEK_HOLE so that they can be skipped rather than read.
+type sparseFdReader struct {
+	fdReader
+	size int64
+}
+
+func (f sparseFdReader) totalSize() int64 {
+	return f.size
+}
+
+func (f sparseFdReader) dataExtent(off int64) (int64, int64, error) {
+	start, err := unix.Seek(f.FileDescriptor, off, unix.SEEK_DATA)
+	if errors.Is(err, unix.ENXIO) {
+		return f.size, f.size, nil
+	} else if err != nil {
+		// The file system cannot report holes; treat everything as data.
+		return off, f.size, nil
+	}
+	end, err := unix.Seek(f.FileDescriptor, start, unix.SEEK_HOLE)
+	if err != nil || end > f.size {
+		end = f.size
+	}
+	if start > f.size {
+		start = f.size
+	}
+	return start, end, nil
+}
+
 func nullTerminatedString(data []byte) string {
   for i, ch := range data {
     if ch == 0 {
@@ -41,26 +79,117 @@ func nullTerminatedString(data []byte) string {
   return string(data)
 }
 
-func (dc *dirImportContext) ImportFile(fd int, st *unix.Stat_t) (InodeId, error) {
+// Reads the extended attributes of the file open at `fd`, which must not have
+// been opened with O_PATH. Returns no attributes if the host file system does
+// not support them.
+func readHostXattrs(fd int) ([]xattrEntry, error) {
+	return readXattrs(func(dest []byte) (int, error) {
+		return unix.Flistxattr(fd, dest)
+	}, func(name string, dest []byte) (int, error) {
+		return unix.Fgetxattr(fd, name, dest)
+	})
+}
+
+// Reads the extended attributes of the entry `name` of the directory open at
+// `dirFd` without following it if it is a symlink. Used for files opened with
+// O_PATH, which the descriptor based calls reject.
+func readHostXattrsAt(dirFd int, name string) ([]xattrEntry, error) {
+	path := fmt.Sprintf("/proc/self/fd/%d/%s", dirFd, name)
+	return readXattrs(func(dest []byte) (int, error) {
+		return unix.Llistxattr(path, dest)
+	}, func(name string, dest []byte) (int, error) {
+		return unix.Lgetxattr(path, name, dest)
+	})
+}
+
+func readXattrs(listFunc func(dest []byte) (int, error), getFunc func(name string, dest []byte) (int, error)) ([]xattrEntry, error) {
+	// Reads into a buffer sized by a first call made with no buffer, retrying
+	// if the data grows in between.
+	readSized := func(readFunc func(dest []byte) (int, error)) ([]byte, error) {
+		for {
+			size, err := readFunc(nil)
+			if err != nil {
+				return nil, err
+			}
+			buf := make([]byte, size)
+			size, err = readFunc(buf)
+			if errors.Is(err, unix.ERANGE) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			return buf[:size], nil
+		}
+	}
+
+	names, err := readSized(listFunc)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries []xattrEntry
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name == "" {
+			continue
+		}
+		value, err := readSized(func(dest []byte) (int, error) {
+			return getFunc(name, dest)
+		})
+		if errors.Is(err, unix.ENODATA) {
+			// Attribute removed since listing
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, xattrEntry{
+			Name:  name,
+			Value: value,
+		})
+	}
+	return entries, nil
+}
+
+// Imports the entry `name` of the directory open at `dirFd`. `fd` is the entry
+// opened for reading if it is a regular file and with O_PATH otherwise.
+func (dc *dirImportContext) ImportFile(dirFd int, name string, fd int, st *unix.Stat_t) (InodeId, error) {
 	inodeData := InodeFromStat(st)
-	inodeData.Size = 0
 
-	file, err := dc.MountView.FileManager.NewFile(inodeData)
+	// The host link count may include names outside of the imported tree.
+	// Files with hardlinks have their count set once the import is complete.
+	inodeData.Nlink = 1
+
+	var xattrs []xattrEntry
+	var err error
+	if unix.S_ISREG(st.Mode) {
+		xattrs, err = readHostXattrs(fd)
+	} else {
+		xattrs, err = readHostXattrsAt(dirFd, name)
+	}
 	if err != nil {
 		return 0, err
 	}
-	defer file.Close()
 
-	switch st.Mode & unix.S_IFMT {
-	case unix.S_IFREG:
-		written, err := io.Copy(file.(io.Writer), &fdReader{FileDescriptor: fd})
-		if err != nil {
-			return 0, err
+	if unix.S_ISREG(st.Mode) {
+		if dc.Storage.ContentDefinedChunking && st.Size > int64(dc.Storage.Cache.BlockSize) {
+			inodeData.Flags |= INODE_FLAG_CHUNKED
 		}
-		if written != st.Size {
-			return 0, errors.New("failed to copy file")
-		}
-	case unix.S_IFLNK:
+		return dc.importRegularFd(fd, inodeData, xattrs)
+	}
+
+	inodeData.Size = 0
+	file, err := dc.Storage.FileManager.NewFile(inodeData)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if err := dc.initXattrs(file, xattrs); err != nil {
+		return 0, err
+	}
+
+	if unix.S_ISLNK(st.Mode) {
 		if st.Size > unix.PATH_MAX_LIMIT {
 			return 0, errors.New("symlink path too long")
 		}
@@ -72,31 +201,66 @@ func (dc *dirImportContext) ImportFile(fd int, st *unix.Stat_t) (InodeId, error)
 			return 0, errors.New("unexpected symlink data")
 		}
 
-		written, err := file.(io.Writer).Write(buf[:n])
-		if err != nil {
+		if err := file.(*TreeFileLnk).setTarget(string(buf[:n])); err != nil {
 			return 0, err
 		}
-		if int64(written) != st.Size {
-			return 0, errors.New("failed to write symlink")
-		}
 	}
 
 	return file.GetInodeId(), nil
 }
 
+// Imports the regular file open at `fd`. The file is hashed before anything is
+// written so that files identical to one already in storage share its data
+// without writing any blocks.
+func (dc *dirImportContext) importRegularFd(fd int, inodeData *InodeData, xattrs []xattrEntry) (InodeId, error) {
+	size := int64(inodeData.Size)
+	rd := sparseFdReader{
+		fdReader: fdReader{FileDescriptor: fd},
+		size:     size,
+	}
+
+	inodeId, err := dc.findRegular(inodeData, xattrs, rd)
+	if err != nil {
+		return 0, err
+	}
+	if inodeId != 0 {
+		return inodeId, nil
+	}
+
+	inodeId, written, err := dc.importRegular(inodeData, xattrs, rd)
+	if err != nil {
+		return 0, err
+	}
+	if written != size {
+		return 0, errors.New("failed to copy file")
+	}
+	return inodeId, nil
+}
+
 func (dc *dirImportContext) ImportDirectory(importDepth int, importPath string, fd int, st *unix.Stat_t) (InodeId, error) {
 	if !unix.S_ISDIR(st.Mode) {
 		return 0, errors.New("must be called on directory")
 	}
 
+	xattrs, err := readHostXattrs(fd)
+	if err != nil {
+		return 0, err
+	}
+
 	inodeData := InodeFromStat(st)
-	file, err := dc.MountView.FileManager.NewFile(inodeData)
+	file, err := dc.Storage.FileManager.NewFile(inodeData)
 	if err != nil {
 		return 0, err
 	}
 	defer file.Close()
 
-	fileDir := file.(FileObjectDir)
+	if err := dc.initXattrs(file, xattrs); err != nil {
+		return 0, err
+	}
+
+	// Entries are gathered and sorted so the directory can be bulk loaded
+	// rather than linking each entry individually.
+	var entries []dirEntry
 
 	buf := dc.Storage.Cache.Pool.Get().([]byte)
 	defer dc.Storage.Cache.Pool.Put(buf)
@@ -150,10 +314,14 @@ func (dc *dirImportContext) ImportDirectory(importDepth int, importPath string,
 					Device: childSt.Dev,
 					Inode:  childSt.Ino,
 				}
-				childInodeId, found := dc.HostInodeMap[hostInode]
+				var found bool
+				childInodeId, found = dc.HostInodeMap[hostInode]
 
 				if !found {
-					childInodeId, err = dc.ImportFile(childFd, &childSt)
+					childInodeId, err = dc.ImportFile(fd, name, childFd, &childSt)
+					if err == nil && childSt.Nlink > 1 && !dc.IgnoreHardlinks {
+						childInodeId, err = dc.hardlinks.privateInode(dc.Storage, int(tp), childInodeId, dc.copies[childInodeId])
+					}
 					if err == nil {
 						dc.HostInodeMap[hostInode] = childInodeId
 					}
@@ -170,47 +338,63 @@ func (dc *dirImportContext) ImportDirectory(importDepth int, importPath string,
 			if err := unix.Close(childFd); err != nil {
 				return 0, err
 			}
-			if err := fileDir.Link(name, int(tp), childInodeId, false); err != nil {
-				return 0, err
-			}
+			entries = append(entries, dirEntry{
+				Name:    name,
+				DtType:  int(tp),
+				InodeId: childInodeId,
+			})
+			dc.hardlinks.addLink(childInodeId)
 		}
 	}
 
+	sortDirEntries(entries)
+	if err := file.(*TreeFileDir).linkSorted(entries); err != nil {
+		return 0, err
+	}
 	return file.GetInodeId(), nil
 }
 
-func (sc *StorageContext) ImportPath(pathname string) (*StorageNode, error) {
-	mountView, err := sc.CreateEmptyMount()
-	if err != nil {
-		return nil, err
-	}
-
+// Imports the directory tree at `pathname` into storage. Returns the storage
+// node of the imported root directory along with statistics about how much
+// file data was deduplicated against existing data.
+func (sc *StorageContext) ImportPath(pathname string) (*StorageNode, *ImportStats, error) {
 	dc := &dirImportContext{
-		Storage:         sc,
-		MountView: mountView,
+		importWriter: importWriter{
+			Storage: sc,
+		},
 		HostInodeMap:        make(map[hostInode]InodeId),
 		IgnoreHardlinks: false,
 	}
 
 	var st unix.Stat_t
 	if err := unix.Stat(pathname, &st); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if !unix.S_ISDIR(st.Mode) {
-		return nil, errors.New("root import path must be a directory")
+		return nil, nil, errors.New("root import path must be a directory")
 	}
 
 	fd, err := unix.Open(pathname, unix.O_RDONLY, 0)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer unix.Close(fd)
 
 	inodeId, err := dc.ImportDirectory(0, "", fd, &st)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return nil, nil
+	file, err := sc.FileManager.OpenFile(unix.DT_DIR, inodeId)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	nd, err := dc.storageNode(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nd, &dc.Stats, nil
 }
@@ -0,0 +1,472 @@
+package storage
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/go-errors/errors"
+
+	"github.com/msg555/ctrfs/unix"
+)
+
+type tarImportNode struct {
+	InodeId
+	DtType int
+}
+
+// Directory being populated by a tar import. Entries are collected until the
+// whole archive has been read and then bulk loaded into the directory.
+type tarImportDir struct {
+	FileObjectDir
+	Entries map[string]dirEntry
+}
+
+type tarImportContext struct {
+	importWriter
+
+	// Directories created so far keyed by their joined path. Directories are
+	// kept open for the duration of the import as archives are not required to
+	// list a directory's entries together.
+	Dirs map[string]*tarImportDir
+
+	// Non-directory nodes imported so far keyed by their joined path, used to
+	// resolve hardlinks.
+	Files map[string]tarImportNode
+}
+
+func splitPath(path string) []string {
+	result := []string{""}
+
+	validate := func(part string) bool {
+		return part != "" && part != "."
+	}
+
+	last_i := 0
+	for i, ch := range path {
+		if ch == '/' {
+			part := path[last_i:i]
+			last_i = i + 1
+			if validate(part) {
+				result = append(result, part)
+			}
+		}
+	}
+
+	part := path[last_i:]
+	if validate(part) {
+		result = append(result, part)
+	}
+	return result
+}
+
+func joinPath(path []string) string {
+	if len(path) <= 1 {
+		return "/"
+	}
+	return strings.Join(path, "/")
+}
+
+func initNodeFromTar(header *tar.Header) (*InodeData, error) {
+	var dev uint64
+	var err error
+
+	mode := header.Mode & 07777
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		mode |= unix.S_IFREG
+	case tar.TypeSymlink:
+		mode |= unix.S_IFLNK
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+		dev, err = unix.Makedev(uint64(header.Devmajor), uint64(header.Devminor))
+		if err != nil {
+			return nil, err
+		}
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+		dev, err = unix.Makedev(uint64(header.Devmajor), uint64(header.Devminor))
+		if err != nil {
+			return nil, err
+		}
+	case tar.TypeDir:
+		mode |= unix.S_IFDIR
+	case tar.TypeFifo:
+		mode |= unix.S_IFIFO
+	default:
+		return nil, errors.New("unsupported object type in archive")
+	}
+
+	inodeData := &InodeData{
+		Mode:  uint32(mode),
+		Uid:   uint32(header.Uid),
+		Gid:   uint32(header.Gid),
+		Dev:   dev,
+		Mtim:  uint64(header.ModTime.UnixNano()),
+		Nlink: 1,
+	}
+	if !header.AccessTime.IsZero() {
+		inodeData.Atim = uint64(header.AccessTime.UnixNano())
+	}
+	if !header.ChangeTime.IsZero() {
+		inodeData.Ctim = uint64(header.ChangeTime.UnixNano())
+	}
+	return inodeData, nil
+}
+
+// Prefix of PAX records holding extended attributes.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// PAX records holding POSIX ACLs in text form, keyed by the extended attribute
+// the ACL is stored as.
+var paxACLRecords = map[string]string{
+	unix.XATTR_POSIX_ACL_ACCESS:  "SCHILY.acl.access",
+	unix.XATTR_POSIX_ACL_DEFAULT: "SCHILY.acl.default",
+}
+
+func xattrsFromTar(header *tar.Header) []xattrEntry {
+	var entries []xattrEntry
+	names := make(map[string]bool)
+	for key, value := range header.PAXRecords {
+		if strings.HasPrefix(key, paxXattrPrefix) {
+			entries = append(entries, xattrEntry{
+				Name:  key[len(paxXattrPrefix):],
+				Value: []byte(value),
+			})
+			names[key[len(paxXattrPrefix):]] = true
+		}
+	}
+
+	// ACLs in text form are converted to the binary attribute format unless the
+	// archive also stored the attribute directly. ACLs that cannot be
+	// represented, such as those naming users without a numeric id, are
+	// dropped.
+	for name, key := range paxACLRecords {
+		text, ok := header.PAXRecords[key]
+		if !ok || names[name] {
+			continue
+		}
+		acl, err := unix.ParseACLText(text)
+		if err != nil || (name == unix.XATTR_POSIX_ACL_ACCESS && acl.IsMinimal()) {
+			continue
+		}
+		entries = append(entries, xattrEntry{
+			Name:  name,
+			Value: acl.Bytes(),
+		})
+	}
+	return entries
+}
+
+func createMissingDirInode(fromInode *InodeData) *InodeData {
+	return &InodeData{
+		Mode: (fromInode.Mode & 0777) | unix.S_IFDIR,
+		Uid:  fromInode.Uid,
+		Gid:  fromInode.Gid,
+		Atim: fromInode.Atim,
+		Mtim: fromInode.Mtim,
+		Ctim: fromInode.Ctim,
+	}
+}
+
+func inodeDtType(inodeData *InodeData) int {
+	return int((inodeData.Mode & unix.S_IFMT) >> 12)
+}
+
+// Returns the directory at `path` creating it and any missing parents using
+// metadata derived from `inodeData` if needed.
+func (tc *tarImportContext) getDir(path []string, inodeData *InodeData) (*tarImportDir, error) {
+	key := joinPath(path)
+	if dir, ok := tc.Dirs[key]; ok {
+		return dir, nil
+	}
+
+	parent, err := tc.getDir(path[:len(path)-1], inodeData)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Warning: missing directory entry for '%s'", key)
+	return tc.createDir(parent, path, createMissingDirInode(inodeData))
+}
+
+func (tc *tarImportContext) createDir(parent *tarImportDir, path []string, inodeData *InodeData) (*tarImportDir, error) {
+	file, err := tc.Storage.FileManager.NewFile(inodeData)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := &tarImportDir{
+		FileObjectDir: file.(FileObjectDir),
+		Entries:       make(map[string]dirEntry),
+	}
+	tc.link(parent, path, unix.DT_DIR, dir.GetInodeId())
+
+	tc.Dirs[joinPath(path)] = dir
+	return dir, nil
+}
+
+// Links `inodeId` into `parent` replacing any existing entry. Replaced
+// directories are forgotten so later entries beneath them are not added to an
+// unreachable directory.
+func (tc *tarImportContext) link(parent *tarImportDir, path []string, dtType int, inodeId InodeId) {
+	name := path[len(path)-1]
+	key := joinPath(path)
+
+	if _, ok := parent.Entries[name]; ok {
+		log.Printf("Warning: duplicate entry at '%s', using later entry", key)
+		for dirKey, dir := range tc.Dirs {
+			if dirKey == key || strings.HasPrefix(dirKey, key+"/") {
+				dir.Close()
+				delete(tc.Dirs, dirKey)
+			}
+		}
+		delete(tc.Files, key)
+	}
+	parent.Entries[name] = dirEntry{
+		Name:    name,
+		DtType:  dtType,
+		InodeId: inodeId,
+	}
+}
+
+// Writes the collected entries of every directory still reachable from the
+// root.
+func (tc *tarImportContext) linkDirs() error {
+	for _, dir := range tc.Dirs {
+		entries := make([]dirEntry, 0, len(dir.Entries))
+		for _, entry := range dir.Entries {
+			entries = append(entries, entry)
+			tc.hardlinks.addLink(entry.InodeId)
+		}
+		sortDirEntries(entries)
+
+		if err := dir.FileObjectDir.(*TreeFileDir).linkSorted(entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tc *tarImportContext) importRecord(arch *tar.Reader, record *tar.Header) error {
+	path := splitPath(record.Name)
+	for _, name := range path[1:] {
+		if !validatePathName(name) {
+			log.Printf("Warning: skipping invalid path '%s'", record.Name)
+			return nil
+		}
+	}
+
+	if record.Typeflag == tar.TypeLink {
+		target, ok := tc.Files[joinPath(splitPath(record.Linkname))]
+		if !ok {
+			return errors.New("hardlink references non-existant file")
+		}
+		if len(path) == 1 {
+			return errors.New("hardlink cannot replace root directory")
+		}
+
+		parent, err := tc.getDir(path[:len(path)-1], &InodeData{Mode: unix.S_IFDIR | 0755})
+		if err != nil {
+			return err
+		}
+
+		// Give the target an inode of its own if this is its first hardlink.
+		inodeId, err := tc.hardlinks.privateInode(tc.Storage, target.DtType, target.InodeId, tc.copies[target.InodeId])
+		if err != nil {
+			return err
+		}
+		if inodeId != target.InodeId {
+			targetPath := splitPath(record.Linkname)
+			targetParent, ok := tc.Dirs[joinPath(targetPath[:len(targetPath)-1])]
+			if !ok {
+				return errors.New("hardlink target directory missing")
+			}
+			targetName := targetPath[len(targetPath)-1]
+			entry := targetParent.Entries[targetName]
+			entry.InodeId = inodeId
+			targetParent.Entries[targetName] = entry
+
+			target.InodeId = inodeId
+			tc.Files[joinPath(targetPath)] = target
+		}
+
+		tc.link(parent, path, target.DtType, target.InodeId)
+		tc.Files[joinPath(path)] = target
+		return nil
+	}
+
+	switch record.Typeflag {
+	case tar.TypeXHeader, tar.TypeXGlobalHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+		return nil
+	case tar.TypeReg, tar.TypeRegA, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeDir, tar.TypeFifo:
+	default:
+		log.Printf("Warning: skipping unsupported entry '%s'", record.Name)
+		return nil
+	}
+
+	inodeData, err := initNodeFromTar(record)
+	if err != nil {
+		return err
+	}
+	xattrs := xattrsFromTar(record)
+
+	if record.Typeflag == tar.TypeDir {
+		if dir, ok := tc.Dirs[joinPath(path)]; ok {
+			// Directory was implicitly created by an earlier entry or is listed
+			// more than once; the latest metadata wins.
+			err := dir.UpdateInode(func(dirInodeData *InodeData) error {
+				dirInodeData.Mode = inodeData.Mode
+				dirInodeData.Uid = inodeData.Uid
+				dirInodeData.Gid = inodeData.Gid
+				dirInodeData.Atim = inodeData.Atim
+				dirInodeData.Mtim = inodeData.Mtim
+				dirInodeData.Ctim = inodeData.Ctim
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, xattr := range xattrs {
+				if err := dir.SetXattr(xattr.Name, xattr.Value, 0); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		parent, err := tc.getDir(path[:len(path)-1], inodeData)
+		if err != nil {
+			return err
+		}
+		dir, err := tc.createDir(parent, path, inodeData)
+		if err != nil {
+			return err
+		}
+		return tc.initXattrs(dir, xattrs)
+	}
+
+	if len(path) == 1 {
+		return errors.New("archive root must be a directory")
+	}
+	parent, err := tc.getDir(path[:len(path)-1], inodeData)
+	if err != nil {
+		return err
+	}
+
+	var inodeId InodeId
+	switch record.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		inodeData.Size = uint64(record.Size)
+		if tc.Storage.ContentDefinedChunking && record.Size > int64(tc.Storage.Cache.BlockSize) {
+			inodeData.Flags |= INODE_FLAG_CHUNKED
+		}
+
+		var written int64
+		inodeId, written, err = tc.importRegular(inodeData, xattrs, arch)
+		if err != nil {
+			return err
+		}
+		if written != record.Size {
+			return errors.New("failed to copy file")
+		}
+	default:
+		file, err := tc.Storage.FileManager.NewFile(inodeData)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if err := tc.initXattrs(file, xattrs); err != nil {
+			return err
+		}
+		if record.Typeflag == tar.TypeSymlink {
+			if len(record.Linkname) > unix.PATH_MAX_LIMIT {
+				return errors.New("symlink path too long")
+			}
+			if err := file.(*TreeFileLnk).setTarget(record.Linkname); err != nil {
+				return err
+			}
+		}
+		inodeId = file.GetInodeId()
+	}
+
+	location := tarImportNode{
+		InodeId: inodeId,
+		DtType:  inodeDtType(inodeData),
+	}
+	tc.link(parent, path, location.DtType, inodeId)
+	tc.Files[joinPath(path)] = location
+	return nil
+}
+
+// Imports a tar archive, optionally gzip compressed, into storage. Returns the
+// storage node of the archive's root directory along with statistics about how
+// much file data was deduplicated against existing data.
+func (sc *StorageContext) ImportTar(r io.Reader) (*StorageNode, *ImportStats, error) {
+	br := bufio.NewReader(r)
+
+	fileHeader, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	// Check for gzip magic header, decompress stream if needed.
+	r = br
+	if len(fileHeader) == 2 && fileHeader[0] == 0x1F && fileHeader[1] == 0x8B {
+		gzr, err := gzip.NewReader(br)
+		if err == nil {
+			r = gzr
+		}
+	}
+
+	tc := &tarImportContext{
+		importWriter: importWriter{
+			Storage: sc,
+		},
+		Dirs:  make(map[string]*tarImportDir),
+		Files: make(map[string]tarImportNode),
+	}
+	defer func() {
+		for _, dir := range tc.Dirs {
+			dir.Close()
+		}
+	}()
+
+	root, err := sc.FileManager.NewFile(&InodeData{
+		Mode: unix.S_IFDIR | 0755,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	tc.Dirs[joinPath(nil)] = &tarImportDir{
+		FileObjectDir: root.(FileObjectDir),
+		Entries:       make(map[string]dirEntry),
+	}
+
+	arch := tar.NewReader(r)
+	for {
+		record, err := arch.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		if err := tc.importRecord(arch, record); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tc.linkDirs(); err != nil {
+		return nil, nil, err
+	}
+
+	nd, err := tc.storageNode(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nd, &tc.Stats, nil
+}
@@ -0,0 +1,591 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sysunix "golang.org/x/sys/unix"
+
+	"github.com/msg555/ctrfs/unix"
+)
+
+type tarTestEntry struct {
+	Header tar.Header
+	Data   []byte
+}
+
+func writeTestArchive(t *testing.T, entries []tarTestEntry, compress bool) *bytes.Buffer {
+	var buf bytes.Buffer
+
+	var gzw *gzip.Writer
+	tw := tar.NewWriter(&buf)
+	if compress {
+		gzw = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gzw)
+	}
+
+	for _, entry := range entries {
+		header := entry.Header
+		header.Size = int64(len(entry.Data))
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(entry.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gzw != nil {
+		if err := gzw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &buf
+}
+
+func lookupTestPath(t *testing.T, sc *StorageContext, nd *StorageNode, path ...string) (FileObject, InodeId) {
+	inodeId, _, err := sc.ResolveRoot(nd.InodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := sc.FileManager.OpenFile(unix.DT_DIR, inodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range path {
+		dir, ok := file.(FileObjectDir)
+		if !ok {
+			t.Fatalf("expected directory looking up '%s'", name)
+		}
+
+		var dtType int
+		dtType, inodeId, err = dir.Lookup(name)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inodeId == 0 {
+			t.Fatalf("missing entry '%s'", name)
+		}
+
+		file, err = sc.FileManager.OpenFile(dtType, inodeId)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { file.Close() })
+	return file, inodeId
+}
+
+func TestImportTar(t *testing.T) {
+	rng := rand.New(rand.NewSource(555))
+	data := make([]byte, 50000)
+	rng.Read(data)
+
+	modTime := time.Unix(1600000000, 0)
+	entries := []tarTestEntry{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0755, ModTime: modTime}},
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "./a/", Mode: 0700, ModTime: modTime}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "./a/x", Mode: 0644, ModTime: modTime}, Data: data},
+		{Header: tar.Header{Typeflag: tar.TypeLink, Name: "./a/z", Linkname: "./a/x", ModTime: modTime}},
+		{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "./a/s", Linkname: "x", ModTime: modTime}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "./b/c/y", Mode: 0644, ModTime: modTime}, Data: data},
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "./b/", Mode: 0750, ModTime: modTime}},
+	}
+
+	sc := storageContextCreate(t)
+	nd, stats, err := sc.ImportTar(writeTestArchive(t, entries, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BytesStored != int64(len(data)) || stats.BytesDeduplicated != int64(len(data)) {
+		t.Fatalf("unexpected import stats %+v", stats)
+	}
+	if nd.Inode.Mode != MODE_HARDLINK_LAYER {
+		t.Fatalf("expected root to be wrapped in a hardlink layer, found mode %o", nd.Inode.Mode)
+	}
+	root, _ := lookupTestPath(t, sc, nd)
+	if mode := root.GetInode().Mode; mode != unix.S_IFDIR|0755 {
+		t.Fatalf("unexpected root mode %o", mode)
+	}
+
+	// Hardlinks share an inode that is distinct from identical files that are
+	// not linked.
+	x, xInodeId := lookupTestPath(t, sc, nd, "a", "x")
+	checkRegContents(t, x.(FileObjectReg), data)
+	if _, zInodeId := lookupTestPath(t, sc, nd, "a", "z"); zInodeId != xInodeId {
+		t.Fatal("expected hardlink to share an inode")
+	}
+	y, yInodeId := lookupTestPath(t, sc, nd, "b", "c", "y")
+	if yInodeId == xInodeId {
+		t.Fatal("expected hardlinked file to have its own inode")
+	}
+	checkRegContents(t, y.(FileObjectReg), data)
+
+	_, layer, err := sc.ResolveRoot(nd.InodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, check := range []struct {
+		inodeId InodeId
+		count   uint32
+	}{{xInodeId, 2}, {yInodeId, 0}} {
+		count, err := layer.LinkCount(check.inodeId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != check.count {
+			t.Fatalf("expected link count %d, found %d", check.count, count)
+		}
+	}
+
+	s, _ := lookupTestPath(t, sc, nd, "a", "s")
+	if target, err := s.(FileObjectLnk).ReadLink(); err != nil || target != "x" {
+		t.Fatalf("unexpected symlink target '%s' '%v'", target, err)
+	}
+
+	// Implicitly created directories pick up metadata from their later entry.
+	b, _ := lookupTestPath(t, sc, nd, "b")
+	if mode := b.GetInode().Mode; mode != unix.S_IFDIR|0750 {
+		t.Fatalf("unexpected mode %o for implicit directory", mode)
+	}
+	c, _ := lookupTestPath(t, sc, nd, "b", "c")
+	if mode := c.GetInode().Mode; mode != unix.S_IFDIR|0644 {
+		t.Fatalf("unexpected mode %o for missing directory", mode)
+	}
+
+	for _, check := range []struct {
+		path  []string
+		nlink uint32
+	}{
+		{nil, 4},
+		{[]string{"a"}, 2},
+		{[]string{"a", "x"}, 2},
+		{[]string{"a", "s"}, 1},
+		{[]string{"b"}, 3},
+		{[]string{"b", "c"}, 2},
+		{[]string{"b", "c", "y"}, 1},
+	} {
+		file, _ := lookupTestPath(t, sc, nd, check.path...)
+		if nlink := file.GetInode().Nlink; nlink != check.nlink {
+			t.Fatalf("expected link count %d for %v, found %d", check.nlink, check.path, nlink)
+		}
+	}
+}
+
+func TestImportNodeAddress(t *testing.T) {
+	modTime := time.Unix(1600000000, 0)
+	entries := []tarTestEntry{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "d/", Mode: 0755, ModTime: modTime}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "d/x", Mode: 0644, ModTime: modTime}, Data: []byte("hello")},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "y", Mode: 0644, ModTime: modTime}, Data: []byte("hello")},
+		{Header: tar.Header{Typeflag: tar.TypeLink, Name: "z", Linkname: "d/x", ModTime: modTime}},
+		{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "s", Linkname: "d/x", ModTime: modTime}},
+	}
+
+	sc := storageContextCreate(t)
+	nd1, _, err := sc.ImportTar(writeTestArchive(t, entries, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var zeroAddress [HASH_BYTE_LENGTH]byte
+	if nd1.NodeAddress == zeroAddress {
+		t.Fatal("import did not compute a node address")
+	}
+
+	// The address computed while importing must match the stored tree.
+	th := treeContentHasher{sc: sc}
+	address, err := th.rootAddress(nd1.InodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(address, nd1.NodeAddress[:]) {
+		t.Fatal("node address does not match stored tree")
+	}
+
+	nd2, _, err := sc.ImportTar(writeTestArchive(t, entries, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nd2.NodeAddress != nd1.NodeAddress {
+		t.Fatal("identical archives imported with different node addresses")
+	}
+	if nd2.InodeId != nd1.InodeId {
+		t.Fatal("expected identical archive to resolve to the stored tree")
+	}
+
+	// The duplicate tree is freed so importing it again reuses its blocks.
+	numBlocks, err := sc.Blocks.GetNumBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sc.ImportTar(writeTestArchive(t, entries, false)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := sc.Blocks.GetNumBlocks(); err != nil || n != numBlocks {
+		t.Fatalf("duplicate import grew storage from %d to %d blocks '%v'", numBlocks, n, err)
+	}
+
+	entries[2].Data = []byte("world")
+	nd3, _, err := sc.ImportTar(writeTestArchive(t, entries, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nd3.NodeAddress == nd1.NodeAddress {
+		t.Fatal("different archives imported with the same node address")
+	}
+
+	for _, readOnly := range []bool{true, false} {
+		mnt, err := sc.CreateMount(nd3.NodeAddress[:], readOnly)
+		if err != nil {
+			t.Fatalf("unexpected error mounting node address '%s'", err)
+		}
+		checkMountFile(t, mnt, "y", "world")
+	}
+}
+
+func TestImportTarSpecialFiles(t *testing.T) {
+	modTime := time.Unix(1600000000, 0)
+	entries := []tarTestEntry{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "dev/", Mode: 0755, ModTime: modTime}},
+		{Header: tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3, ModTime: modTime}},
+		{Header: tar.Header{Typeflag: tar.TypeBlock, Name: "dev/big", Mode: 0660, Devmajor: 259, Devminor: 70000, ModTime: modTime}},
+		{Header: tar.Header{Typeflag: tar.TypeFifo, Name: "dev/fifo", Mode: 0600, ModTime: modTime}},
+	}
+
+	sc := storageContextCreate(t)
+	nd, _, err := sc.ImportTar(writeTestArchive(t, entries, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, check := range []struct {
+		name         string
+		mode         uint32
+		major, minor uint64
+	}{
+		{"null", unix.S_IFCHR | 0666, 1, 3},
+		{"big", unix.S_IFBLK | 0660, 259, 70000},
+		{"fifo", unix.S_IFIFO | 0600, 0, 0},
+	} {
+		file, _ := lookupTestPath(t, sc, nd, "dev", check.name)
+		if _, ok := file.(*TreeFileOther); !ok {
+			t.Fatalf("expected '%s' to be a special file", check.name)
+		}
+		inodeData := file.GetInode()
+		if inodeData.Mode != check.mode {
+			t.Fatalf("unexpected mode %o for '%s'", inodeData.Mode, check.name)
+		}
+		if unix.Major(inodeData.Dev) != check.major || unix.Minor(inodeData.Dev) != check.minor {
+			t.Fatalf("unexpected device %d:%d for '%s'", unix.Major(inodeData.Dev), unix.Minor(inodeData.Dev), check.name)
+		}
+	}
+}
+
+func TestImportTarDedupe(t *testing.T) {
+	rng := rand.New(rand.NewSource(555))
+	data := make([]byte, 50000)
+	rng.Read(data)
+
+	modTime := time.Unix(1600000000, 0)
+	entries := []tarTestEntry{
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "lib/x.so", Mode: 0644, ModTime: modTime}, Data: data},
+	}
+
+	sc := storageContextCreate(t)
+	nd1, _, err := sc.ImportTar(writeTestArchive(t, entries, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, inodeId1 := lookupTestPath(t, sc, nd1, "lib", "x.so")
+
+	// The same file within a different tree is stored as a copy of the inode.
+	entries[0].Header.Name = "lib64/x.so"
+	nd2, stats, err := sc.ImportTar(writeTestArchive(t, entries, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BytesStored != 0 || stats.BytesDeduplicated != int64(len(data)) {
+		t.Fatalf("unexpected stats for duplicate import %+v", stats)
+	}
+	_, inodeId2 := lookupTestPath(t, sc, nd2, "lib64", "x.so")
+	checkInodeCopy(t, sc, inodeId1, inodeId2)
+}
+
+func TestImportPathDedupe(t *testing.T) {
+	rng := rand.New(rand.NewSource(555))
+	data := make([]byte, 50000)
+	rng.Read(data)
+
+	dir := t.TempDir()
+	modTime := time.Unix(1600000000, 0)
+	for _, name := range []string{"x", "y"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sc := storageContextCreate(t)
+	nd, stats, err := sc.ImportPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BytesStored != int64(len(data)) || stats.BytesDeduplicated != int64(len(data)) {
+		t.Fatalf("unexpected import stats %+v", stats)
+	}
+
+	x, xInodeId := lookupTestPath(t, sc, nd, "x")
+	checkRegContents(t, x.(FileObjectReg), data)
+	_, yInodeId := lookupTestPath(t, sc, nd, "y")
+	checkInodeCopy(t, sc, xInodeId, yInodeId)
+
+	// Hardlinking one of the files gives it an inode of its own.
+	if err := os.Link(filepath.Join(dir, "x"), filepath.Join(dir, "z")); err != nil {
+		t.Fatal(err)
+	}
+	nd, _, err = sc.ImportPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, xInodeId = lookupTestPath(t, sc, nd, "x")
+	if _, zInodeId := lookupTestPath(t, sc, nd, "z"); zInodeId != xInodeId {
+		t.Fatal("expected hardlink to share an inode")
+	}
+	if _, yInodeId := lookupTestPath(t, sc, nd, "y"); yInodeId == xInodeId {
+		t.Fatal("expected hardlinked file to have its own inode")
+	}
+
+	mnt, err := sc.CreateMount(nd.NodeAddress[:], true)
+	if err != nil {
+		t.Fatalf("unexpected error mounting node address '%s'", err)
+	}
+	checkMountFile(t, mnt, "z", string(data))
+}
+
+func TestImportPathSparse(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sparse")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("hello"), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(4 << 20); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	sc := storageContextCreate(t)
+	nd, stats, err := sc.ImportPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BytesStored > int64(sc.Cache.BlockSize) {
+		t.Fatalf("unexpected import stats %+v", stats)
+	}
+
+	expected := make([]byte, 4<<20)
+	copy(expected[1<<20:], "hello")
+	file, _ := lookupTestPath(t, sc, nd, "sparse")
+	checkRegContents(t, file.(FileObjectReg), expected)
+	if blocks := file.GetInode().Blocks; blocks != 1 {
+		t.Fatalf("expected holes to not be stored, have %d blocks", blocks)
+	}
+	if off, err := file.(FileObjectReg).SeekData(0); err != nil || off != 1<<20 {
+		t.Fatalf("unexpected data offset %d '%v'", off, err)
+	}
+}
+
+func TestImportPathXattrs(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "f")
+	if err := ioutil.WriteFile(filePath, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	linkPath := filepath.Join(dir, "l")
+	if err := os.Symlink("f", linkPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sysunix.Setxattr(filePath, "user.foo", []byte("file"), 0); err != nil {
+		t.Skipf("host file system does not support user xattrs: '%s'", err)
+	}
+	if err := sysunix.Setxattr(filepath.Join(dir, "d"), "user.dir", []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Linux only permits user xattrs on regular files and directories, fall
+	// back to a trusted xattr on the symlink when running as root.
+	var linkXattr string
+	for _, name := range []string{"user.link", "trusted.link"} {
+		if err := sysunix.Lsetxattr(linkPath, name, []byte("link"), 0); err == nil {
+			linkXattr = name
+			break
+		}
+	}
+	if linkXattr == "" {
+		t.Skip("host file system does not support xattrs on symlinks")
+	}
+
+	sc := storageContextCreate(t)
+	nd, _, err := sc.ImportPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, _ := lookupTestPath(t, sc, nd, "f")
+	checkXattr(t, f, "user.foo", []byte("file"))
+	d, _ := lookupTestPath(t, sc, nd, "d")
+	checkXattr(t, d, "user.dir", []byte("value"))
+
+	// The symlink's own xattrs are imported rather than those of its target.
+	l, _ := lookupTestPath(t, sc, nd, "l")
+	checkXattr(t, l, linkXattr, []byte("link"))
+	checkXattr(t, l, "user.foo", nil)
+}
+
+func TestImportTarLargeDir(t *testing.T) {
+	modTime := time.Unix(1600000000, 0)
+	var entries []tarTestEntry
+	for i := 999; i >= 0; i-- {
+		entries = append(entries, tarTestEntry{
+			Header: tar.Header{Typeflag: tar.TypeReg, Name: fmt.Sprintf("d/f%d", i), Mode: 0644, ModTime: modTime},
+			Data:   []byte(fmt.Sprintf("%d", i)),
+		})
+	}
+
+	sc := storageContextCreate(t)
+	nd, _, err := sc.ImportTar(writeTestArchive(t, entries, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, _ := lookupTestPath(t, sc, nd, "d")
+	lastName := ""
+	count := 0
+	_, err = d.(FileObjectDir).Scan("", func(name string, dtType int, inodeId InodeId) bool {
+		if name <= lastName {
+			t.Fatalf("entry '%s' out of order", name)
+		}
+		lastName = name
+		count++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1000 {
+		t.Fatalf("expected 1000 entries, found %d", count)
+	}
+
+	f, _ := lookupTestPath(t, sc, nd, "d", "f123")
+	checkRegContents(t, f.(FileObjectReg), []byte("123"))
+}
+
+func TestImportTarLargeFile(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		sc := storageContextCreate(t)
+		sc.ContentDefinedChunking = chunked
+
+		// Enough blocks that the block list cannot be kept inline.
+		blockSize := sc.Cache.BlockSize
+		numBlocks := 2 * blockSize / 16
+		rng := rand.New(rand.NewSource(555))
+		data := make([]byte, numBlocks*blockSize+123)
+		rng.Read(data)
+
+		modTime := time.Unix(1600000000, 0)
+		entries := []tarTestEntry{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "big", Mode: 0644, ModTime: modTime}, Data: data},
+		}
+		nd, stats, err := sc.ImportTar(writeTestArchive(t, entries, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		file, _ := lookupTestPath(t, sc, nd, "big")
+		checkRegContents(t, file.(FileObjectReg), data)
+		inodeData := file.GetInode()
+		if inodeData.TreeNode == 0 {
+			t.Fatal("expected file to be stored as a tree")
+		}
+		if chunked != (inodeData.Flags&INODE_FLAG_CHUNKED != 0) {
+			t.Fatalf("unexpected inode flags %x", inodeData.Flags)
+		}
+		if stats.BytesStored != int64(len(data)) {
+			t.Fatalf("unexpected import stats %+v", stats)
+		}
+
+		// Chunks are never larger than a block so chunked files may need more.
+		minBlocks := uint64(numBlocks + 1)
+		if inodeData.Blocks < minBlocks || !chunked && inodeData.Blocks != minBlocks {
+			t.Fatalf("unexpected block count %d", inodeData.Blocks)
+		}
+	}
+}
+
+func TestImportTarXattrs(t *testing.T) {
+	modTime := time.Unix(1600000000, 0)
+	xattrHeader := func(name string, value string) tar.Header {
+		return tar.Header{
+			Typeflag:   tar.TypeReg,
+			Name:       name,
+			Mode:       0644,
+			ModTime:    modTime,
+			Format:     tar.FormatPAX,
+			PAXRecords: map[string]string{paxXattrPrefix + "user.foo": value},
+		}
+	}
+	entries := []tarTestEntry{
+		{Header: xattrHeader("x", "bar"), Data: []byte("data")},
+		{Header: xattrHeader("y", "baz"), Data: []byte("data")},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "z", Mode: 0644, ModTime: modTime}, Data: []byte("data")},
+		{Header: tar.Header{
+			Typeflag:   tar.TypeDir,
+			Name:       "d/",
+			Mode:       0755,
+			ModTime:    modTime,
+			Format:     tar.FormatPAX,
+			PAXRecords: map[string]string{paxXattrPrefix + "user.dir": "value"},
+		}},
+	}
+
+	sc := storageContextCreate(t)
+	nd, _, err := sc.ImportTar(writeTestArchive(t, entries, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x, xInodeId := lookupTestPath(t, sc, nd, "x")
+	checkXattr(t, x, "user.foo", []byte("bar"))
+	y, yInodeId := lookupTestPath(t, sc, nd, "y")
+	checkXattr(t, y, "user.foo", []byte("baz"))
+	z, zInodeId := lookupTestPath(t, sc, nd, "z")
+	checkXattr(t, z, "user.foo", nil)
+	if xInodeId == yInodeId || xInodeId == zInodeId {
+		t.Fatal("expected files with different xattrs to have their own inodes")
+	}
+
+	d, _ := lookupTestPath(t, sc, nd, "d")
+	checkXattr(t, d, "user.dir", []byte("value"))
+}
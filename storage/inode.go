@@ -2,15 +2,22 @@ package storage
 
 import (
 	"encoding/binary"
+	"time"
 
 	"github.com/msg555/ctrfs/blockfile"
 	"github.com/msg555/ctrfs/btree"
 	"github.com/msg555/ctrfs/unix"
 )
 
-const INODE_SIZE = 68
+const INODE_SIZE = 88
 const MODE_HARDLINK_LAYER = uint32(0xFFFFFFFF)
 
+const (
+	// File data is stored as variable sized content-defined chunks rather than
+	// fixed size blocks.
+	INODE_FLAG_CHUNKED = uint32(1 << iota)
+)
+
 type InodeId = blockfile.BlockIndex
 
 var bo = binary.LittleEndian
@@ -28,6 +35,26 @@ type InodeData struct {
 
 	// Block index of tree data if any for this file or directory.
 	TreeNode btree.TreeIndex
+
+	// Bitmask of INODE_FLAG_* values.
+	Flags uint32
+
+	// Number of directory entries referencing this inode. Directories also
+	// count their own '.' entry and the '..' entry of each subdirectory.
+	Nlink uint32
+
+	// Block index of the extended attribute tree if any for this inode.
+	XattrNode btree.TreeIndex
+
+	// Number of bytes at the end of the inode block holding inline extended
+	// attributes.
+	XattrInline uint32
+}
+
+// Returns the current time as a nanosecond timestamp suitable for the time
+// fields of an inode.
+func TimestampNow() uint64 {
+	return uint64(time.Now().UnixNano())
 }
 
 func (nd *InodeData) Write(buf []byte, contentHash bool) {
@@ -45,6 +72,15 @@ func (nd *InodeData) Write(buf []byte, contentHash bool) {
 	} else {
 		bo.PutUint64(buf[60:], uint64(nd.TreeNode))
 	}
+	bo.PutUint32(buf[68:], nd.Flags)
+	bo.PutUint32(buf[72:], nd.Nlink)
+	if contentHash {
+		bo.PutUint64(buf[76:], 0)
+		bo.PutUint32(buf[84:], 0)
+	} else {
+		bo.PutUint64(buf[76:], uint64(nd.XattrNode))
+		bo.PutUint32(buf[84:], nd.XattrInline)
+	}
 }
 
 func (nd *InodeData) Read(buf []byte) {
@@ -58,6 +94,10 @@ func (nd *InodeData) Read(buf []byte) {
 	nd.Size = bo.Uint64(buf[44:])
 	nd.Blocks = bo.Uint64(buf[52:])
 	nd.TreeNode = btree.TreeIndex(bo.Uint64(buf[60:]))
+	nd.Flags = bo.Uint32(buf[68:])
+	nd.Nlink = bo.Uint32(buf[72:])
+	nd.XattrNode = btree.TreeIndex(bo.Uint64(buf[76:]))
+	nd.XattrInline = bo.Uint32(buf[84:])
 }
 
 func (nd *InodeData) ToBytes() []byte {
@@ -47,11 +47,21 @@ func (mp *InodeTreeMap) Init(bf blockfile.BlockAllocator, treeRoot btree.TreeInd
 	return nil
 }
 
+// Maps `srcInodeId` to `dstInodeId`, replacing any existing mapping. An inode
+// is remapped again each time its copy is frozen into a read only layer.
 func (mp *InodeTreeMap) AddMapping(srcInodeId InodeId, dstInodeId InodeId) error {
+	// The tree root itself becomes read only when the layer holding it is
+	// frozen.
+	treeRoot, err := blockfile.Duplicate(mp, mp.blocks, mp.treeRoot, true)
+	if err != nil {
+		return err
+	}
+	mp.treeRoot = treeRoot
+
 	var key, val [8]byte
 	bo.PutUint64(key[:], uint64(srcInodeId))
 	bo.PutUint64(val[:], uint64(dstInodeId))
-	return mp.tree.Insert(mp, mp.treeRoot, key[:], val[:], false)
+	return mp.tree.Insert(mp, mp.treeRoot, key[:], val[:], true)
 }
 
 func (mp *InodeTreeMap) GetMappedNode(srcInodeId InodeId) (InodeId, error) {
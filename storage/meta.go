@@ -2,8 +2,10 @@ package storage
 
 import (
 	"errors"
+	"hash"
 
 	"github.com/msg555/ctrfs/blockfile"
+	"github.com/msg555/ctrfs/unix"
 )
 
 const (
@@ -36,20 +38,88 @@ func (sc *StorageContext) lookupAddressInode(contentAddress []byte) (InodeId, er
 	if err != nil {
 		return 0, err
 	}
+	if val == nil {
+		return 0, nil
+	}
 	return blockfile.BlockIndex(bo.Uint64(val)), nil
 }
 
-func (sc *StorageContext) cacheDataBlockContentAddress(blockIndex InodeId) ([]byte, error) {
+// Computes the content address of a data block. `data` must be exactly one
+// block in length.
+func (sc *StorageContext) dataBlockContentAddress(data []byte) []byte {
 	hsh := sc.HashFactory()
 	hsh.Write([]byte(HASH_HEADER_DATA_BLOCK))
+	hsh.Write(data)
+	return hsh.Sum(nil)
+}
+
+// Computes the content address `data` would have once zero padded to a full
+// block.
+func (sc *StorageContext) paddedDataBlockContentAddress(data []byte) []byte {
+	buf := sc.Cache.Pool.Get().([]byte)
+	defer sc.Cache.Pool.Put(buf)
+
+	n := copy(buf, data)
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	return sc.dataBlockContentAddress(buf)
+}
+
+// Stores a data block, zero padded to a full block, returning the index of an
+// existing block with identical content if one exists. Also returns the
+// content address of the block and whether a new block was written.
+func (sc *StorageContext) storeDataBlock(data []byte) (blockfile.BlockIndex, []byte, bool, error) {
+	buf := sc.Cache.Pool.Get().([]byte)
+	defer sc.Cache.Pool.Put(buf)
+
+	n := copy(buf, data)
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+
+	h := sc.dataBlockContentAddress(buf)
+	blockIndex, err := sc.lookupAddressInode(h)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if blockIndex != 0 {
+		return blockIndex, h, false, nil
+	}
+
+	blockIndex, err = sc.Blocks.Allocate(sc)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if err := sc.Blocks.Write(sc, blockIndex, buf); err != nil {
+		sc.Blocks.Free(blockIndex)
+		return 0, nil, false, err
+	}
+	err = sc.Blocks.AccessBlockMeta(blockIndex, func(meta []byte) (bool, error) {
+		if len(meta) < len(h) {
+			return false, errors.New("metadata too small to store content address")
+		}
+		copy(meta, h)
+		return true, nil
+	})
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if err := sc.insertBlockIntoCache(h, blockIndex); err != nil {
+		return 0, nil, false, err
+	}
+	return blockIndex, h, true, nil
+}
+
+func (sc *StorageContext) cacheDataBlockContentAddress(blockIndex InodeId) ([]byte, error) {
+	var h []byte
 	err := sc.Blocks.AccessBlock(nil, blockIndex, func(data []byte) (bool, error) {
-		hsh.Write(data)
+		h = sc.dataBlockContentAddress(data)
 		return false, nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	h := hsh.Sum(nil)
 	err = sc.Blocks.AccessBlockMeta(blockIndex, func(meta []byte) (bool, error) {
 		if len(meta) < len(h) {
 			return false, errors.New("metadata too small to store content address")
@@ -70,3 +140,198 @@ func updateBlockRefCount(bf blockfile.BlockAllocator, blockIndex blockfile.Block
 	return false, nil
 }
 */
+
+// Computes the content address of a regular file from the content addresses
+// of its data blocks (or chunks) added in file order along with its extended
+// attributes and inode data.
+type fileContentHasher struct {
+	sc   *StorageContext
+	data hash.Hash
+	xattrs hash.Hash
+}
+
+func (sc *StorageContext) newFileContentHasher() *fileContentHasher {
+	return &fileContentHasher{
+		sc:   sc,
+		data: sc.HashFactory(),
+		xattrs: sc.HashFactory(),
+	}
+}
+
+// Adds the extended attributes of the file, which must be sorted by name.
+func (hsh *fileContentHasher) addXattrs(entries []xattrEntry) {
+	for _, entry := range entries {
+		var header [5]byte
+		header[0] = byte(len(entry.Name))
+		bo.PutUint32(header[1:], uint32(len(entry.Value)))
+		hsh.xattrs.Write(header[:])
+		hsh.xattrs.Write([]byte(entry.Name))
+		hsh.xattrs.Write(entry.Value)
+	}
+}
+
+func (hsh *fileContentHasher) addBlock(block int64, blockAddress []byte) {
+	hsh.data.Write(fileBlockKey(block))
+	hsh.data.Write(blockAddress)
+}
+
+func (hsh *fileContentHasher) addChunk(end int64, length int, blockAddress []byte) {
+	var lengthBytes [4]byte
+	bo.PutUint32(lengthBytes[:], uint32(length))
+
+	hsh.data.Write(chunkKey(end))
+	hsh.data.Write(lengthBytes[:])
+	hsh.data.Write(blockAddress)
+}
+
+// Returns the content address of the file. Access and change times, link
+// count and the block layout of the file are not part of its identity and are
+// excluded from the address.
+func (hsh *fileContentHasher) contentAddress(inodeData *InodeData) []byte {
+	return hsh.nodeAddress(HASH_HEADER_FILE_BLOCK, inodeData)
+}
+
+func (hsh *fileContentHasher) nodeAddress(header string, inodeData *InodeData) []byte {
+	identity := *inodeData
+	identity.Atim = 0
+	identity.Ctim = 0
+	identity.Blocks = 0
+	identity.Nlink = 0
+
+	var inodeBytes [INODE_SIZE]byte
+	identity.Write(inodeBytes[:], true)
+
+	h := hsh.sc.HashFactory()
+	h.Write([]byte(header))
+	h.Write(inodeBytes[:])
+	h.Write(hsh.data.Sum(nil))
+	h.Write(hsh.xattrs.Sum(nil))
+	return h.Sum(nil)
+}
+
+// Computes the content address of an imported tree. Directories hash the
+// name, type and content address of each entry. Hardlinked files are
+// identified by the order they are first reached in rather than by inode id
+// so that identical trees have the same address wherever they are stored.
+type treeContentHasher struct {
+	sc        *StorageContext
+	hardlinks *HardlinkLayer
+	linkOrder map[InodeId]uint64
+
+	// Content addresses of regular files already computed during import.
+	fileAddresses map[InodeId][]byte
+}
+
+// Returns the content address of the tree rooted at `inodeId`, which may be a
+// hardlink layer.
+func (th *treeContentHasher) rootAddress(inodeId InodeId) ([]byte, error) {
+	rootInodeId, hardlinks, err := th.sc.ResolveRoot(inodeId)
+	if err != nil {
+		return nil, err
+	}
+	th.hardlinks = hardlinks
+	th.linkOrder = make(map[InodeId]uint64)
+
+	address, err := th.address(unix.DT_DIR, rootInodeId)
+	if err != nil || hardlinks == nil {
+		return address, err
+	}
+
+	h := th.sc.HashFactory()
+	h.Write([]byte(HASH_HEADER_HARDLINK_BLOCK))
+	h.Write(address)
+	return h.Sum(nil), nil
+}
+
+func (th *treeContentHasher) address(dtType int, inodeId InodeId) ([]byte, error) {
+	if address, ok := th.fileAddresses[inodeId]; ok {
+		return address, nil
+	}
+
+	file, err := th.sc.FileManager.OpenFile(dtType, inodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if reg, ok := file.(*TreeFileReg); ok {
+		return reg.contentAddress(th.sc)
+	}
+
+	obj := file.getObject()
+	obj.lock.RLock()
+	inodeData := obj.inodeData
+	xattrs, err := obj.readXattrs()
+	obj.lock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	hsh := th.sc.newFileContentHasher()
+	hsh.addXattrs(xattrs)
+	switch f := file.(type) {
+	case *TreeFileDir:
+		if err := th.addEntries(hsh, f); err != nil {
+			return nil, err
+		}
+		// The size of a directory depends on how its entries are stored.
+		inodeData.Size = 0
+		return hsh.nodeAddress(HASH_HEADER_DIR_BLOCK, &inodeData), nil
+	case *TreeFileLnk:
+		target, err := f.ReadLink()
+		if err != nil {
+			return nil, err
+		}
+		hsh.data.Write([]byte(target))
+	}
+	return hsh.contentAddress(&inodeData), nil
+}
+
+func (th *treeContentHasher) addEntries(hsh *fileContentHasher, dir *TreeFileDir) error {
+	var entries []dirEntry
+	_, err := dir.Scan("", func(name string, dtType int, inodeId InodeId) bool {
+		entries = append(entries, dirEntry{Name: name, DtType: dtType, InodeId: inodeId})
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	sortDirEntries(entries)
+
+	for _, entry := range entries {
+		// Entries for hardlinked files after the first only refer back to the
+		// order the file was first reached in.
+		var order uint64
+		linkCount, err := th.hardlinks.LinkCount(entry.InodeId)
+		if err != nil {
+			return err
+		}
+		first := true
+		if linkCount > 0 {
+			var seen bool
+			order, seen = th.linkOrder[entry.InodeId]
+			if !seen {
+				order = uint64(len(th.linkOrder)) + 1
+				th.linkOrder[entry.InodeId] = order
+			}
+			first = !seen
+		}
+
+		var header [10]byte
+		header[0] = byte(len(entry.Name))
+		header[1] = byte(entry.DtType)
+		bo.PutUint64(header[2:], order)
+		hsh.data.Write(header[:])
+		hsh.data.Write([]byte(entry.Name))
+		if !first {
+			continue
+		}
+
+		address, err := th.address(entry.DtType, entry.InodeId)
+		if err != nil {
+			return err
+		}
+		hsh.data.Write(address)
+	}
+	return nil
+}
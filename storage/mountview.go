@@ -1,13 +1,18 @@
 package storage
 
 import (
+	"io"
 	"os"
 	"path"
+	"strconv"
+	"sync"
 
 	"github.com/go-errors/errors"
 	"github.com/google/uuid"
 
 	"github.com/msg555/ctrfs/blockfile"
+	"github.com/msg555/ctrfs/btree"
+	"github.com/msg555/ctrfs/unix"
 )
 
 const (
@@ -15,55 +20,199 @@ const (
 	blockIndexRemapTree = 2
 )
 
+// Number of recently listed entry positions each DirView remembers. Resuming
+// from an older position falls back to searching the directory for it.
+const dirViewPositionCacheSize = 1024
+
+// A directory opened for listing. A listing can be resumed after any entry it
+// has listed even if that entry has since been unlinked; see
+// TreeFileDir.ScanFrom().
+type DirView struct {
+	FileObjectDir
+
+	positions btree.PositionCache
+}
+
+// A regular file opened for reading and writing through a mount.
+type FileView interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
 type MountView struct {
 	ID          uuid.UUID
+	RootInodeId InodeId
 	RootInode   InodeData
 	ReadOnly    bool
 	Storage     *StorageContext
 	FileManager TreeFileManager
 	Blocks     blockfile.BlockAllocator
 	InodeMap
+
+	// Hardlinks of the mounted tree, if it was wrapped in a hardlink layer.
+	Hardlinks *HardlinkLayer
+
+	// Layer stack of writable mounts. The last of `layers` is the writable
+	// layer; all others have been frozen by snapshots.
+	snapshotLock sync.Mutex
+	overlay      *blockfile.BlockOverlayAllocator
+	layers       []*blockfile.BlockFile
+	snapshots    map[string]*MountSnapshot
+
+	// Frozen layers of other mounts that this mount reads from, as happens for
+	// clones and snapshot mounts. Layers are counted by the storage context
+	// and closed once no open mount uses them.
+	baseLayers []*blockfile.BlockFile
+	closed     bool
+}
+
+// An immutable point-in-time view of a writable mount. Snapshots are only
+// tracked in memory by the MountView that took them. The frozen layers remain
+// on disk but a mount reopened with OpenMount() has no snapshots, so they
+// cannot be used to checkpoint work across restarts.
+type MountSnapshot struct {
+	Name        string
+	RootInodeId InodeId
+	Hardlinks   *HardlinkLayer
+
+	mount *MountView
+
+	// Number of the mount's layers captured by the snapshot.
+	numLayers int
+	blocks    *blockfile.BlockOverlayAllocator
+	remapRoot btree.TreeIndex
+}
+
+// Opens layer `layer` of the mount creating it if necessary.
+func (mnt *MountView) openLayer(layer int, preAllocatedBlocks blockfile.BlockIndex) (*blockfile.BlockFile, error) {
+	bf := &blockfile.BlockFile{
+		MetaDataSize:       mnt.Storage.Blocks.GetMetaDataSize(),
+		Cache:              mnt.Storage.Cache,
+		PreAllocatedBlocks: preAllocatedBlocks,
+	}
+	if err := bf.Open(mnt.layerPath(layer), 0666); err != nil {
+		return nil, err
+	}
+	return bf, nil
+}
+
+func (mnt *MountView) layerPath(layer int) string {
+	return path.Join(mnt.Storage.BasePath, "mounts", mnt.ID.String(), strconv.Itoa(layer))
 }
 
 // Creates a new empty mount. This mount does not have a root inode and it
 // should be created and set by the caller.
 func (sc *StorageContext) CreateEmptyMount() (*MountView, error) {
-	id := uuid.New()
+	return sc.createWritableMount(sc.Blocks, nil, 0, 0)
+}
 
-	// Create new block file for the mount.
-	blockFilePath := path.Join(sc.BasePath, "mounts", id.String())
-	bf := &blockfile.BlockFile{
-		Cache: sc.Cache,
-		PreAllocatedBlocks: 2,
+// Creates a writable mount layered over `base`, which is made up of the
+// storage context's blocks and the mount layers `baseLayers`. `remapRoot` is
+// the root of the inode map within `base`; if 0 a new inode map is created. If
+// `rootInodeId` is non-zero it is set as the root directory of the mount.
+func (sc *StorageContext) createWritableMount(base blockfile.BlockAllocator, baseLayers []*blockfile.BlockFile, remapRoot btree.TreeIndex, rootInodeId InodeId) (*MountView, error) {
+	mnt := &MountView{
+		ID:         uuid.New(),
+		ReadOnly:   false,
+		Storage:    sc,
+		snapshots:  make(map[string]*MountSnapshot),
+		baseLayers: baseLayers,
 	}
-	if err := bf.Open(blockFilePath, 0666); err != nil {
+
+	if err := os.Mkdir(path.Join(sc.BasePath, "mounts", mnt.ID.String()), 0777); err != nil {
 		return nil, err
 	}
 
-	imap := &InodeTreeMap{}
-	if err := imap.Init(bf, blockIndexRemapTree); err != nil {
+	var preAllocatedBlocks blockfile.BlockIndex
+	if remapRoot == 0 {
+		preAllocatedBlocks = blockIndexRemapTree
+	}
+	bf, err := mnt.openLayer(0, preAllocatedBlocks)
+	if err != nil {
+		return nil, err
+	}
+	overlay := &blockfile.BlockOverlayAllocator{}
+	if err := overlay.Init(base, bf); err != nil {
 		bf.Close()
 		return nil, err
 	}
-
-	mnt := &MountView{
-		ID: id,
-		ReadOnly: false,
-		Storage: sc,
-		Blocks: bf,
-		InodeMap: imap,
+	if remapRoot == 0 {
+		wrIndexShift, err := base.GetNumBlocks()
+		if err != nil {
+			bf.Close()
+			return nil, err
+		}
+		remapRoot = wrIndexShift + blockIndexRemapTree
 	}
 
-	if err := mnt.FileManager.Init(bf, imap); err != nil {
+	imap := &InodeTreeMap{}
+	if err := imap.Init(overlay, remapRoot); err != nil {
 		bf.Close()
 		return nil, err
 	}
 
-		RootInode: 3,
+	mnt.Blocks = overlay
+	mnt.InodeMap = imap
+	mnt.overlay = overlay
+	mnt.layers = []*blockfile.BlockFile{bf}
+
+	if err := mnt.FileManager.Init(overlay, imap); err != nil {
+		bf.Close()
+		return nil, err
+	}
+	if rootInodeId != 0 {
+		if err := mnt.SetRoot(rootInodeId); err != nil {
+			bf.Close()
+			return nil, err
+		}
+	}
 
+	sc.acquireLayers(baseLayers)
+	sc.acquireLayers(mnt.layers)
+	sc.registerMount(mnt)
 	return mnt, nil
 }
 
+// Creates a new writable mount that starts out with the current contents of
+// the mount `id`. The clone shares all existing blocks of the source read only
+// and has its own writable layer and inode map, so changes made to either
+// mount afterwards are not visible to the other. No file data is copied.
+func (sc *StorageContext) CloneMount(id uuid.UUID) (*MountView, error) {
+	src := sc.GetMount(id)
+	if src == nil {
+		return nil, errors.New("mount does not exist")
+	}
+
+	var clone *MountView
+	var err error
+	if src.ReadOnly {
+		var remapRoot btree.TreeIndex
+		if imap, ok := src.InodeMap.(*InodeTreeMap); ok {
+			remapRoot = imap.treeRoot
+		}
+		clone, err = sc.createWritableMount(src.Blocks, src.baseLayers, remapRoot, src.RootInodeId)
+	} else {
+		src.snapshotLock.Lock()
+		defer src.snapshotLock.Unlock()
+
+		var frozen *blockfile.BlockOverlayAllocator
+		var remapRoot btree.TreeIndex
+		frozen, remapRoot, err = src.freezeLayer()
+		if err != nil {
+			return nil, err
+		}
+		baseLayers := append(src.baseLayers[:len(src.baseLayers):len(src.baseLayers)], src.layers[:len(src.layers)-1]...)
+		clone, err = sc.createWritableMount(frozen, baseLayers, remapRoot, src.RootInodeId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	clone.Hardlinks = src.Hardlinks
+	return clone, nil
+}
+
+// Mounts the tree stored under `rootAddress`. Writable mounts are layered over
+// the storage context's blocks so the stored tree itself is never modified.
 func (sc *StorageContext) CreateMount(rootAddress []byte, readOnly bool) (*MountView, error) {
 	rootInodeId, err := sc.lookupAddressInode(rootAddress)
 	if err != nil {
@@ -72,98 +221,1018 @@ func (sc *StorageContext) CreateMount(rootAddress []byte, readOnly bool) (*Mount
 		return nil, errors.New("could not find root content address")
 	}
 
-	id := uuid.New()
+	if !readOnly {
+		mnt, err := sc.createWritableMount(sc.Blocks, nil, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := mnt.SetRoot(rootInodeId); err != nil {
+			return nil, err
+		}
+		return mnt, nil
+	}
+
 	mnt := &MountView{
-		ID:       id,
-		ReadOnly: readOnly,
+		ID:       uuid.New(),
+		ReadOnly: true,
 		Storage:  sc,
+		Blocks:   sc.Blocks,
+		InodeMap: &NullInodeMap{},
+	}
+	if err := mnt.FileManager.Init(mnt.Blocks, mnt.InodeMap); err != nil {
+		return nil, err
 	}
+	mnt.FileManager.readOnly = true
+	if err := mnt.SetRoot(rootInodeId); err != nil {
+		return nil, err
+	}
+	sc.registerMount(mnt)
+	return mnt, nil
+}
 
-/*
-	if rootInode.Mode == MODE_HARDLINK_LAYER {
-		// TODO
+// Opens the existing mount `id`. Only the mount's identity is restored;
+// snapshots taken by an earlier MountView of the mount are not.
+func (sc *StorageContext) OpenMount(id uuid.UUID) (*MountView, error) {
+	mnt := &MountView{
+		ID:        id,
+		Storage:   sc,
 	}
-	mnt.RootInode = *rootInode
 
-	if !readOnly {
-		mnt.WritePath = path.Join(sc.BasePath, "mounts", id.String())
+	st, err := os.Stat(path.Join(sc.BasePath, "mounts", id.String()))
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, errors.New("mount must be directory")
+	}
 
-		err := os.Mkdir(mnt.WritePath, 0777)
-		if err != nil {
-			return nil, err
-		}
+	return mnt, nil
+}
+
+// Sets the root directory of the mount to `inodeId`. If `inodeId` is a hardlink
+// layer the directory it wraps becomes the root.
+func (mnt *MountView) SetRoot(inodeId InodeId) error {
+	mappedInodeId, err := mnt.InodeMap.GetMappedNode(inodeId)
+	if err != nil {
+		return err
+	}
+	layer, err := readHardlinkLayer(mnt.Blocks, mappedInodeId)
+	if err != nil {
+		return err
+	}
+	if layer != nil {
+		mnt.Hardlinks = layer
+		inodeId = layer.RootInodeId
+	}
+
+	file, err := mnt.FileManager.OpenFile(unix.DT_DIR, inodeId)
+	if err != nil {
+		return err
+	}
+	mnt.RootInodeId = inodeId
+	mnt.RootInode = file.GetInode()
+	return file.Close()
+}
+
+// Freezes the current state of the mount into a named snapshot. The mount's
+// writable layer becomes read only and a fresh writable layer is stacked on
+// top of it; files open in the mount remain usable. The snapshot lasts only as
+// long as `mnt`.
+func (mnt *MountView) Snapshot(name string) (*MountSnapshot, error) {
+	if mnt.ReadOnly || mnt.overlay == nil {
+		return nil, errors.New("cannot snapshot read only mount")
+	}
 
-		ioutil.WriteFile(path.Join(mnt.WritePath, "root"), rootAddress, 0666)
+	mnt.snapshotLock.Lock()
+	defer mnt.snapshotLock.Unlock()
 
-		bf := &blockfile.BlockFile{
-			Cache: sc.Cache,
+	if mnt.closed {
+		return nil, errors.New("mount is closed")
+	}
+	if _, ok := mnt.snapshots[name]; ok {
+		return nil, errors.New("snapshot already exists")
+	}
+
+	numLayers := len(mnt.layers)
+	frozen, remapRoot, err := mnt.freezeLayer()
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &MountSnapshot{
+		Name:        name,
+		RootInodeId: mnt.RootInodeId,
+		Hardlinks:   mnt.Hardlinks,
+		mount:       mnt,
+		numLayers:   numLayers,
+		blocks:      frozen,
+		remapRoot:   remapRoot,
+	}
+	mnt.snapshots[name] = snap
+	return snap, nil
+}
+
+// Freezes the writable layer of the mount and stacks a fresh writable layer on
+// top of it. Returns the frozen layers and the root of the inode map within
+// them. Must be called with snapshotLock held.
+func (mnt *MountView) freezeLayer() (*blockfile.BlockOverlayAllocator, btree.TreeIndex, error) {
+	numLayers := len(mnt.layers)
+	if err := mnt.layers[numLayers-1].Sync(); err != nil {
+		return nil, 0, err
+	}
+
+	bf, err := mnt.openLayer(numLayers, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	frozen, err := mnt.overlay.PushLayer(bf)
+	if err != nil {
+		bf.Close()
+		os.Remove(mnt.layerPath(numLayers))
+		return nil, 0, err
+	}
+	mnt.layers = append(mnt.layers, bf)
+	mnt.Storage.acquireLayers(mnt.layers[numLayers:])
+	remapRoot := mnt.InodeMap.(*InodeTreeMap).treeRoot
+
+	if err := mnt.FileManager.reacquireOpenFiles(); err != nil {
+		return nil, 0, err
+	}
+	return frozen, remapRoot, nil
+}
+
+// Returns the snapshot named `name` or nil if no such snapshot exists.
+func (mnt *MountView) GetSnapshot(name string) *MountSnapshot {
+	mnt.snapshotLock.Lock()
+	defer mnt.snapshotLock.Unlock()
+	return mnt.snapshots[name]
+}
+
+// Discards all changes made to the mount since the snapshot `name` was taken.
+// Snapshots taken after `name` are discarded as well. The mount must not have
+// any open or acquired inodes. A fuse connection acquires every inode it hands
+// to the kernel, so a mount cannot be rolled back while it is being served.
+func (mnt *MountView) RollbackToSnapshot(name string) error {
+	mnt.snapshotLock.Lock()
+	defer mnt.snapshotLock.Unlock()
+
+	snap, ok := mnt.snapshots[name]
+	if !ok {
+		return errors.New("snapshot does not exist")
+	}
+	if mnt.FileManager.hasOpenFiles() {
+		return errors.New("cannot roll back mount with open files")
+	}
+	dropped := mnt.layers[snap.numLayers:]
+	if mnt.Storage.layersShared(dropped) {
+		return errors.New("cannot roll back layers shared with a cloned or snapshot mount")
+	}
+
+	// Drop every layer written after the snapshot was taken.
+	if err := mnt.Storage.releaseLayers(dropped); err != nil {
+		return err
+	}
+	for i := snap.numLayers; i < len(mnt.layers); i++ {
+		if err := os.Remove(mnt.layerPath(i)); err != nil {
+			return err
 		}
-		err = bf.Open(path.Join(mnt.WritePath, "blocks"), 0666)
-		if err != nil {
-			return nil, err
+	}
+	mnt.layers = mnt.layers[:snap.numLayers]
+	for otherName, other := range mnt.snapshots {
+		if other.numLayers > snap.numLayers {
+			delete(mnt.snapshots, otherName)
 		}
+	}
 
-		blockOverlay := &blockfile.BlockOverlayAllocator{}
-		err = blockOverlay.Init(sc.Blocks, bf)
-		if err != nil {
+	bf, err := mnt.openLayer(snap.numLayers, 0)
+	if err != nil {
+		return err
+	}
+	if err := mnt.overlay.Init(snap.blocks, bf); err != nil {
+		bf.Close()
+		return err
+	}
+	mnt.layers = append(mnt.layers, bf)
+	mnt.Storage.acquireLayers(mnt.layers[snap.numLayers:])
+
+	mnt.InodeMap.(*InodeTreeMap).treeRoot = snap.remapRoot
+	mnt.Hardlinks = snap.Hardlinks
+	if snap.RootInodeId == 0 {
+		mnt.RootInodeId = 0
+		mnt.RootInode = InodeData{}
+		return nil
+	}
+	return mnt.SetRoot(snap.RootInodeId)
+}
+
+// Creates a read only mount of the snapshot. The mount keeps the snapshot's
+// layers open until it is closed, even if the mount the snapshot was taken of
+// is closed first.
+func (snap *MountSnapshot) Mount() (*MountView, error) {
+	src := snap.mount
+	src.snapshotLock.Lock()
+	defer src.snapshotLock.Unlock()
+	if src.closed {
+		return nil, errors.New("mount is closed")
+	}
+
+	imap := &InodeTreeMap{}
+	if err := imap.Init(snap.blocks, snap.remapRoot); err != nil {
+		return nil, err
+	}
+
+	mnt := &MountView{
+		ID:         uuid.New(),
+		ReadOnly:   true,
+		Storage:    src.Storage,
+		Blocks:     snap.blocks,
+		InodeMap:   imap,
+		baseLayers: append(src.baseLayers[:len(src.baseLayers):len(src.baseLayers)], src.layers[:snap.numLayers]...),
+	}
+	if err := mnt.FileManager.Init(snap.blocks, imap); err != nil {
+		return nil, err
+	}
+	mnt.FileManager.readOnly = true
+
+	if snap.RootInodeId != 0 {
+		if err := mnt.SetRoot(snap.RootInodeId); err != nil {
 			return nil, err
 		}
+	}
+	mnt.Hardlinks = snap.Hardlinks
+	mnt.Storage.acquireLayers(mnt.baseLayers)
+	mnt.Storage.registerMount(mnt)
+	return mnt, nil
+}
 
-		mnt.Blocks = blockOverlay
-	} else {
-		mnt.Blocks = sc.Blocks
+// Returns the target of the symlink `inodeId`. Targets are usually stored in
+// the inode block itself so they are cached along with the inode. Returns
+// EINVAL if `inodeId` is not a symlink.
+func (mnt *MountView) Readlink(inodeId InodeId) (string, error) {
+	mappedInodeId, err := mnt.InodeMap.GetMappedNode(inodeId)
+	if err != nil {
+		return "", err
 	}
+	buf, err := mnt.Blocks.ReadAt(mappedInodeId, 0, INODE_SIZE, nil)
+	if err != nil {
+		return "", err
+	}
+	inodeData := InodeFromBytes(buf)
+	if !unix.S_ISLNK(inodeData.Mode) {
+		return "", unix.EINVAL
+	}
+	return readLinkTarget(mnt.Blocks, mappedInodeId, inodeData)
+}
+
+// Writes the dirty blocks of `inodeId` along with the mount's inode mappings
+// back to the writable layer of the mount and syncs it to disk. This includes
+// blocks written while the file was open earlier and since released.
+func (mnt *MountView) SyncFile(inodeId InodeId) error {
+	file, err := mnt.openInode(inodeId)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if imap, ok := mnt.InodeMap.(*InodeTreeMap); ok {
+		return imap.Sync()
+	}
+	return nil
+}
+
+// Writes all dirty blocks of the mount back to its writable layer and syncs
+// it to disk. Read only mounts have nothing to sync.
+func (mnt *MountView) Sync() error {
+	mnt.snapshotLock.Lock()
+	defer mnt.snapshotLock.Unlock()
+
+	if len(mnt.layers) == 0 || mnt.closed {
+		return nil
+	}
+	return mnt.layers[len(mnt.layers)-1].Sync()
+}
+
+// Syncs the mount and removes it from its storage context so that it can no
+// longer be looked up or cloned. Layers still used by clones or snapshot
+// mounts are kept open until those mounts are closed as well; all others are
+// closed. Snapshots of the mount can no longer be mounted.
+func (mnt *MountView) Close() error {
+	mnt.Storage.unregisterMount(mnt)
+	if err := mnt.Sync(); err != nil {
+		return err
+	}
+
+	mnt.snapshotLock.Lock()
+	defer mnt.snapshotLock.Unlock()
+	if mnt.closed {
+		return nil
+	}
+	mnt.closed = true
+	mnt.snapshots = nil
+
+	err := mnt.Storage.releaseLayers(mnt.layers)
+	if baseErr := mnt.Storage.releaseLayers(mnt.baseLayers); err == nil {
+		err = baseErr
+	}
+	return err
+}
+
+// Closes the mount. If `commit` is false the mount's layers are also removed
+// from disk unless a clone or snapshot mount is still using them.
+func (mnt *MountView) Destroy(commit bool) error {
+	shared := mnt.Storage.layersShared(mnt.layers)
+	if err := mnt.Close(); err != nil {
+		return err
+	}
+	if commit || shared || len(mnt.layers) == 0 {
+		return nil
+	}
+	return os.RemoveAll(path.Join(mnt.Storage.BasePath, "mounts", mnt.ID.String()))
+}
 
-	// TODO: Use the actual inode map
-	err = mnt.FileManager.Init(mnt.Blocks, &NullInodeMap{})
+// Returns the inode data of `inodeId` as currently visible through the mount.
+func (mnt *MountView) GetInode(inodeId InodeId) (*InodeData, error) {
+	mappedInodeId, err := mnt.InodeMap.GetMappedNode(inodeId)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := mnt.Blocks.ReadAt(mappedInodeId, 0, INODE_SIZE, nil)
 	if err != nil {
 		return nil, err
 	}
-*/
+	return InodeFromBytes(buf), nil
+}
 
-	return mnt, nil
+// Looks up `name` within the directory `inodeId`. Returns a nil inode if no
+// such entry exists.
+func (mnt *MountView) LookupChild(inodeId InodeId, name string) (*InodeData, InodeId, error) {
+	dir, err := mnt.FileManager.OpenFile(unix.DT_DIR, inodeId)
+	if err != nil {
+		return nil, 0, err
+	}
+	_, childInodeId, err := dir.(FileObjectDir).Lookup(name)
+	dir.Close()
+	if err != nil || childInodeId == 0 {
+		return nil, 0, err
+	}
+
+	childInode, err := mnt.GetInode(childInodeId)
+	if err != nil {
+		return nil, 0, err
+	}
+	return childInode, childInodeId, nil
 }
 
-func (sc *StorageContext) OpenMount(id uuid.UUID) (*MountView, error) {
-	mnt := &MountView{
-		ID:        id,
-		WritePath: path.Join(sc.BasePath, "mounts", id.String()),
-		Storage:   sc,
+// Opens the regular file `inodeId` for reading and writing. The view must be
+// released with ReleaseFileView().
+func (mnt *MountView) GetFileView(inodeId InodeId, inodeData *InodeData) (FileView, error) {
+	file, err := mnt.FileManager.OpenFile(inodeDtType(inodeData), inodeId)
+	if err != nil {
+		return nil, err
 	}
+	return file.(FileView), nil
+}
 
-	st, err := os.Stat(mnt.WritePath)
+func (mnt *MountView) ReleaseFileView(inodeId InodeId) error {
+	return mnt.FileManager.releaseFile(inodeId)
+}
+
+func (mnt *MountView) GetDirView(inodeId InodeId) (*DirView, error) {
+	file, err := mnt.FileManager.OpenFile(unix.DT_DIR, inodeId)
 	if err != nil {
 		return nil, err
 	}
-	if !st.IsDir() {
-		return nil, errors.New("mount must be directory")
+	file.(FileObjectDir).OpenListing()
+	return &DirView{
+		FileObjectDir: file.(FileObjectDir),
+		positions: btree.PositionCache{
+			MaxSize: dirViewPositionCacheSize,
+		},
+	}, nil
+}
+
+func (mnt *MountView) ReleaseDirView(dirView *DirView) error {
+	dirView.CloseListing()
+	return dirView.Close()
+}
+
+// Lists the entries of the directory after the entry at `position`. Pass
+// btree.PositionStart to list from the beginning. Each entry's position can
+// later be passed back to resume the listing after that entry.
+func (dv *DirView) ScanChildren(position btree.Position, entryCallback func(position btree.Position, name string, dtType int, inodeId InodeId) bool) (bool, error) {
+	return dv.ScanFrom(position, &dv.positions, entryCallback)
+}
+
+// Takes a reference to `inodeId` that keeps the file from being freed after
+// its last name is removed. The reference must be dropped with
+// ReleaseInode().
+func (mnt *MountView) AcquireInode(inodeId InodeId) error {
+	_, err := mnt.openInode(inodeId)
+	return err
+}
+
+// Drops a reference taken by AcquireInode(). Unlinked files are freed once
+// their last reference is dropped.
+func (mnt *MountView) ReleaseInode(inodeId InodeId) error {
+	return mnt.FileManager.releaseFile(inodeId)
+}
+
+// Opens `inodeId` as a file object of whatever type it has. The returned file
+// must be closed by the caller.
+func (mnt *MountView) openInode(inodeId InodeId) (FileObject, error) {
+	inodeData, err := mnt.GetInode(inodeId)
+	if err != nil {
+		return nil, err
 	}
+	return mnt.FileManager.OpenFile(inodeDtType(inodeData), inodeId)
+}
 
-	return mnt, nil
+// Returns the value of the extended attribute `name` of `inodeId`, if it
+// exists.
+func (mnt *MountView) GetXattr(inodeId InodeId, name string) ([]byte, bool, error) {
+	file, err := mnt.openInode(inodeId)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+	return file.GetXattr(name)
 }
 
-func (mnt *MountView) SetRoot(inodeId InodeId) error {
+// Returns the names of the extended attributes of `inodeId` in sorted order.
+func (mnt *MountView) ListXattrs(inodeId InodeId) ([]string, error) {
+	file, err := mnt.openInode(inodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.ListXattrs()
+}
+
+// Sets the extended attribute `name` of `inodeId`. `flags` takes the same
+// XATTR_CREATE and XATTR_REPLACE flags as setxattr(2). POSIX ACLs are
+// validated and setting the access ACL updates the mode of the file. The
+// change time of the file is updated.
+func (mnt *MountView) SetXattr(inodeId InodeId, name string, value []byte, flags int) error {
+	file, err := mnt.openInode(inodeId)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if isACLXattr(name) {
+		err = setACLXattr(file, name, value, flags)
+	} else {
+		err = file.SetXattr(name, value, flags)
+	}
+	if err != nil {
+		return err
+	}
+	return touchFileChange(file)
+}
+
+// Removes the extended attribute `name` of `inodeId`, updating the change time
+// of the file. Returns false if it did not exist.
+func (mnt *MountView) RemoveXattr(inodeId InodeId, name string) (bool, error) {
+	file, err := mnt.openInode(inodeId)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	removed, err := file.RemoveXattr(name)
+	if err != nil || !removed {
+		return removed, err
+	}
+	return true, touchFileChange(file)
+}
+
+// Returns true if a process with `uid` has all the access in `mask` (a
+// combination of R_OK, W_OK and X_OK) to `inodeId`, taking the file's access
+// ACL into account. `inGroup` reports whether the process is a member of a
+// group, counting both its primary and supplementary groups.
+func (mnt *MountView) CheckAccess(inodeId InodeId, uid uint32, inGroup func(gid uint32) bool, mask uint32) (bool, error) {
+	file, err := mnt.openInode(inodeId)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	return checkAccess(file, uid, inGroup, mask)
+}
+
+// Creates a new file described by `inodeData` and links it into the directory
+// `parentInodeId` as `name`. The file inherits the default ACL of the parent
+// if it has one, otherwise `umask` is applied to its mode. Returns EEXIST if
+// `name` already exists. Returns the inode id of the new file.
+func (mnt *MountView) CreateFile(parentInodeId InodeId, name string, inodeData *InodeData, umask uint32) (InodeId, error) {
+	return mnt.createFile(parentInodeId, name, inodeData, umask, nil)
+}
+
+// Creates a symlink to `target` described by `inodeData` and links it into the
+// directory `parentInodeId` as `name`. Symlinks always have mode 0777.
+func (mnt *MountView) CreateSymlink(parentInodeId InodeId, name string, target string, inodeData *InodeData) (InodeId, error) {
+	inodeData.Mode = unix.S_IFLNK | 0777
+	return mnt.createFile(parentInodeId, name, inodeData, 0, func(file FileObject) error {
+		return file.(*TreeFileLnk).setTarget(target)
+	})
+}
+
+// Creates a file as with CreateFile(). If `initFunc` is not nil it is called
+// with the new file before it is linked into the directory.
+func (mnt *MountView) createFile(parentInodeId InodeId, name string, inodeData *InodeData, umask uint32, initFunc func(file FileObject) error) (InodeId, error) {
+	parentFile, err := mnt.FileManager.OpenFile(unix.DT_DIR, parentInodeId)
+	if err != nil {
+		return 0, err
+	}
+	defer parentFile.Close()
+	parent := parentFile.(FileObjectDir)
+
+	_, existingInodeId, err := parent.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	if existingInodeId != 0 {
+		return 0, unix.EEXIST
+	}
+
+	xattrs, err := inheritACL(parent, inodeData, umask)
+	if err != nil {
+		return 0, err
+	}
+
+	// Directories hold a link to themselves; the parent's link is added by
+	// Link().
+	inodeData.Nlink = 0
+	if unix.S_ISDIR(inodeData.Mode) {
+		inodeData.Nlink = 1
+	}
+	file, err := mnt.FileManager.NewFile(inodeData)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if err := linkNewFile(parent, name, inodeDtType(inodeData), file, xattrs, initFunc); err != nil {
+		// Free the new file when it is closed above.
+		file.getObject().markDiscarded()
+		return 0, err
+	}
+	return file.GetInodeId(), touchFile(parent)
+}
+
+// Initializes the newly created `file` and links it into `parent` as `name`.
+func linkNewFile(parent FileObjectDir, name string, dtType int, file FileObject, xattrs []xattrEntry, initFunc func(file FileObject) error) error {
+	tf := file.getObject()
+	tf.lock.Lock()
+	err := tf.initXattrs(xattrs)
+	tf.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if initFunc != nil {
+		if err := initFunc(file); err != nil {
+			return err
+		}
+	}
+	return parent.Link(name, dtType, file.GetInodeId(), false)
+}
+
+// Updates the modification and change times of a file whose data, or a
+// directory whose entries, have changed.
+func touchFile(file FileObject) error {
+	now := TimestampNow()
+	return file.UpdateInode(func(inodeData *InodeData) error {
+		inodeData.Mtim = now
+		inodeData.Ctim = now
+		return nil
+	})
+}
+
+// Updates the change time of `file` to the current time.
+func touchFileChange(file FileObject) error {
+	now := TimestampNow()
+	return file.UpdateInode(func(inodeData *InodeData) error {
+		inodeData.Ctim = now
+		return nil
+	})
+}
+
+// Links the existing file `inodeId` into the directory `parentInodeId` as
+// `name`. Returns EEXIST if `name` already exists, EPERM if `inodeId` is a
+// directory and ENOENT if it has already been removed.
+func (mnt *MountView) LinkFile(parentInodeId InodeId, name string, inodeId InodeId) error {
+	file, err := mnt.openInode(inodeId)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	inodeData := file.GetInode()
+	if unix.S_ISDIR(inodeData.Mode) {
+		return unix.EPERM
+	}
+	if inodeData.Nlink == 0 {
+		return unix.ENOENT
+	}
+
+	parentFile, err := mnt.FileManager.OpenFile(unix.DT_DIR, parentInodeId)
+	if err != nil {
+		return err
+	}
+	defer parentFile.Close()
+	parent := parentFile.(FileObjectDir)
+
+	_, existingInodeId, err := parent.Lookup(name)
+	if err != nil {
+		return err
+	}
+	if existingInodeId != 0 {
+		return unix.EEXIST
+	}
+
+	if err := parent.Link(name, inodeDtType(&inodeData), inodeId, false); err != nil {
+		return err
+	}
+	if err := file.UpdateInode(func(inodeData *InodeData) error {
+		inodeData.Ctim = TimestampNow()
+		return nil
+	}); err != nil {
+		return err
+	}
+	return touchFile(parent)
+}
+
+// Removes the entry `name` from the directory `parentInodeId`. If `dir` is
+// set the entry must be an empty directory as with rmdir(2), otherwise it
+// must not be a directory as with unlink(2). Returns ENOENT, ENOTDIR, EISDIR
+// or ENOTEMPTY if these conditions are not met.
+func (mnt *MountView) RemoveFile(parentInodeId InodeId, name string, dir bool) error {
+	parentFile, err := mnt.FileManager.OpenFile(unix.DT_DIR, parentInodeId)
+	if err != nil {
+		return err
+	}
+	defer parentFile.Close()
+	parent := parentFile.(FileObjectDir)
+
+	dtType, inodeId, err := parent.Lookup(name)
+	if err != nil {
+		return err
+	}
+	if inodeId == 0 {
+		return unix.ENOENT
+	}
+	if dir && dtType != unix.DT_DIR {
+		return unix.ENOTDIR
+	}
+	if !dir && dtType == unix.DT_DIR {
+		return unix.EISDIR
+	}
+
+	file, err := mnt.FileManager.OpenFile(dtType, inodeId)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if dir {
+		empty := true
+		if _, err := file.(FileObjectDir).Scan("", func(string, int, InodeId) bool {
+			empty = false
+			return false
+		}); err != nil {
+			return err
+		}
+		if !empty {
+			return unix.ENOTEMPTY
+		}
+	}
+
+	if _, err := parent.Unlink(name); err != nil {
+		return err
+	}
+	if err := file.UpdateInode(func(inodeData *InodeData) error {
+		// A removed directory also loses the link from its own '.' entry.
+		if dir {
+			inodeData.Nlink = 0
+		}
+		inodeData.Ctim = TimestampNow()
+		return nil
+	}); err != nil {
+		return err
+	}
+	file.getObject().markUnlinked()
+	return touchFile(parent)
+}
+
+// Checks that the entry `dtType` may replace the existing entry `inodeId` of
+// type `oldDtType` as with rename(2). Returns ENOTDIR, EISDIR or ENOTEMPTY if
+// it may not.
+func (mnt *MountView) checkReplaceable(dtType, oldDtType int, inodeId InodeId) error {
+	if dtType == unix.DT_DIR && oldDtType != unix.DT_DIR {
+		return unix.ENOTDIR
+	}
+	if dtType != unix.DT_DIR && oldDtType == unix.DT_DIR {
+		return unix.EISDIR
+	}
+	if oldDtType != unix.DT_DIR {
+		return nil
+	}
+
+	file, err := mnt.FileManager.OpenFile(oldDtType, inodeId)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	empty := true
+	if _, err := file.(FileObjectDir).Scan("", func(string, int, InodeId) bool {
+		empty = false
+		return false
+	}); err != nil {
+		return err
+	}
+	if !empty {
+		return unix.ENOTEMPTY
+	}
+	return nil
 }
 
-func (mnt *MountView) Readlink(inodeData *InodeData) (string, error) {
-	// TODO: Cache this in block-cache somehow?
-	/*
-		fin, err := mnt.Storage.Cas.Open(inodeData.Address[:])
+// Moves the entry `oldName` of `oldParent`, referring to `inodeId` of type
+// `dtType`, to `newName` in the different directory `newParent`. `newName` is
+// linked before `oldName` is unlinked. If unlinking fails the entry that
+// `newName` replaced, if any, is linked back in its place so that the entry
+// is left only under its old name.
+func moveEntry(oldParent FileObjectDir, oldName string, newParent FileObjectDir, newName string, dtType int, inodeId InodeId, replacedDtType int, replacedInodeId InodeId) error {
+	if err := newParent.Link(newName, dtType, inodeId, true); err != nil {
+		return err
+	}
+	found, err := oldParent.Unlink(oldName)
+	if err == nil || found {
+		return err
+	}
+
+	if replacedInodeId != 0 {
+		newParent.Link(newName, replacedDtType, replacedInodeId, true)
+	} else {
+		newParent.Unlink(newName)
+	}
+	return err
+}
+
+// Moves the entry `oldName` of the directory `oldParentInodeId` to `newName`
+// in the directory `newParentInodeId` as with rename(2), replacing any
+// existing entry. A replaced directory must be empty. Renames within a single
+// directory replace the old name with the new one atomically while moves
+// between directories are undone if they fail part way. Returns ENOENT,
+// ENOTDIR, EISDIR or ENOTEMPTY if these conditions are not met. Moving a
+// directory beneath itself is left for the caller to prevent.
+func (mnt *MountView) RenameFile(oldParentInodeId InodeId, oldName string, newParentInodeId InodeId, newName string) error {
+	oldParentFile, err := mnt.FileManager.OpenFile(unix.DT_DIR, oldParentInodeId)
+	if err != nil {
+		return err
+	}
+	defer oldParentFile.Close()
+	oldParent := oldParentFile.(FileObjectDir)
+
+	newParentFile, err := mnt.FileManager.OpenFile(unix.DT_DIR, newParentInodeId)
+	if err != nil {
+		return err
+	}
+	defer newParentFile.Close()
+	newParent := newParentFile.(FileObjectDir)
+
+	dtType, inodeId, err := oldParent.Lookup(oldName)
+	if err != nil {
+		return err
+	}
+	if inodeId == 0 {
+		return unix.ENOENT
+	}
+	replacedDtType, replacedInodeId, err := newParent.Lookup(newName)
+	if err != nil {
+		return err
+	}
+	if replacedInodeId == inodeId {
+		return nil
+	}
+
+	var replaced FileObject
+	if replacedInodeId != 0 {
+		if err := mnt.checkReplaceable(dtType, replacedDtType, replacedInodeId); err != nil {
+			return err
+		}
+		replaced, err = mnt.FileManager.OpenFile(replacedDtType, replacedInodeId)
 		if err != nil {
-			return "", err
+			return err
 		}
-		defer fin.Close()
+		defer replaced.Close()
+	}
+
+	if oldParentInodeId == newParentInodeId {
+		err = oldParent.Rename(oldName, newName)
+	} else {
+		err = moveEntry(oldParent, oldName, newParent, newName, dtType, inodeId, replacedDtType, replacedInodeId)
+	}
+	if err != nil {
+		return err
+	}
+
+	now := TimestampNow()
+	if replaced != nil {
+		if err := replaced.UpdateInode(func(inodeData *InodeData) error {
+			// A replaced directory also loses the link from its own '.' entry.
+			if replacedDtType == unix.DT_DIR {
+				inodeData.Nlink = 0
+			}
+			inodeData.Ctim = now
+			return nil
+		}); err != nil {
+			return err
+		}
+		replaced.getObject().markUnlinked()
+	}
+	if err := mnt.touchInode(dtType, inodeId, now); err != nil {
+		return err
+	}
+	if err := touchFile(oldParent); err != nil {
+		return err
+	}
+	if oldParentInodeId == newParentInodeId {
+		return nil
+	}
+	return touchFile(newParent)
+}
 
-		target, err := ioutil.ReadAll(fin)
+// Updates the change time of `inodeId` to `now`.
+func (mnt *MountView) touchInode(dtType int, inodeId InodeId, now uint64) error {
+	file, err := mnt.FileManager.OpenFile(dtType, inodeId)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.UpdateInode(func(inodeData *InodeData) error {
+		inodeData.Ctim = now
+		return nil
+	})
+}
+
+// Changes the inode data of `inodeId` through `updateFunc` and returns the
+// updated inode. Shrinking a regular file truncates its data and changing the
+// permission bits of a file with an access ACL updates the ACL to match. The
+// change time is always updated.
+func (mnt *MountView) UpdateInode(inodeId InodeId, updateFunc func(inodeData *InodeData) error) (*InodeData, error) {
+	file, err := mnt.openInode(inodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	acl, err := readACL(file, unix.XATTR_POSIX_ACL_ACCESS)
+	if err != nil {
+		return nil, err
+	}
+
+	var origMode uint32
+	err = file.UpdateInode(func(inodeData *InodeData) error {
+		origMode = inodeData.Mode
+		if err := updateFunc(inodeData); err != nil {
+			return err
+		}
+		inodeData.Ctim = TimestampNow()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	inodeData := file.GetInode()
+	if acl != nil && (inodeData.Mode^origMode)&0777 != 0 {
+		err := file.SetXattr(unix.XATTR_POSIX_ACL_ACCESS, acl.WithMode(inodeData.Mode).Bytes(), 0)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
+	}
+	return &inodeData, nil
+}
+
+// Copies `length` bytes of the regular file `srcInodeId` at `srcOff` into the
+// regular file `dstInodeId` at `dstOff` as with copy_file_range(2). Data is
+// shared between the files where possible rather than duplicated. Returns the
+// number of bytes copied.
+func (mnt *MountView) CopyFileRange(srcInodeId InodeId, srcOff int64, dstInodeId InodeId, dstOff int64, length int64) (int64, error) {
+	src, err := mnt.openInode(srcInodeId)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	dst, err := mnt.openInode(dstInodeId)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
 
-		return string(target), nil
-	*/
-	return "", nil
+	srcMode, dstMode := src.GetInode().Mode, dst.GetInode().Mode
+	if unix.S_ISDIR(srcMode) || unix.S_ISDIR(dstMode) {
+		return 0, unix.EISDIR
+	}
+	if !unix.S_ISREG(srcMode) || !unix.S_ISREG(dstMode) {
+		return 0, unix.EINVAL
+	}
+
+	copied, err := dst.(FileObjectReg).CloneRange(src.(FileObjectReg), srcOff, dstOff, length)
+	if err != nil || copied == 0 {
+		return copied, err
+	}
+	return copied, touchFile(dst)
 }
 
-func (mnt *MountView) Destroy(commit bool) error {
-	return nil
+// Replaces the contents of the regular file `dstInodeId` with those of
+// `srcInodeId` as with the FICLONE ioctl(2). The data of `srcInodeId` is
+// shared rather than copied and only duplicated when either file is written.
+func (mnt *MountView) CloneFile(srcInodeId, dstInodeId InodeId) error {
+	if srcInodeId == dstInodeId {
+		return unix.EINVAL
+	}
+	src, err := mnt.openRegular(srcInodeId)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := mnt.openRegular(dstInodeId)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if _, err := mnt.UpdateInode(dstInodeId, func(inodeData *InodeData) error {
+		inodeData.Size = 0
+		return nil
+	}); err != nil {
+		return err
+	}
+	_, err = mnt.CopyFileRange(srcInodeId, 0, dstInodeId, 0, int64(src.GetInode().Size))
+	return err
+}
+
+// Opens `inodeId` as a regular file. Returns EISDIR for directories and
+// EINVAL for other types of files.
+func (mnt *MountView) openRegular(inodeId InodeId) (FileObjectReg, error) {
+	file, err := mnt.openInode(inodeId)
+	if err != nil {
+		return nil, err
+	}
+	mode := file.GetInode().Mode
+	if unix.S_ISREG(mode) {
+		return file.(FileObjectReg), nil
+	}
+	file.Close()
+	if unix.S_ISDIR(mode) {
+		return nil, unix.EISDIR
+	}
+	return nil, unix.EINVAL
+}
+
+// Returns the offset of the first data or hole at or after `off` in the
+// regular file `inodeId` as with lseek(2). `whence` must be SEEK_DATA or
+// SEEK_HOLE.
+func (mnt *MountView) SeekFile(inodeId InodeId, off int64, whence int) (int64, error) {
+	file, err := mnt.openRegular(inodeId)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	switch whence {
+	case unix.SEEK_DATA:
+		return file.SeekData(off)
+	case unix.SEEK_HOLE:
+		return file.SeekHole(off)
+	}
+	return 0, unix.EINVAL
+}
+
+// Returns the number of bytes of data allocated to the regular file
+// `inodeId`; see TreeFileReg.AllocatedBytes().
+func (mnt *MountView) AllocatedBytes(inodeId InodeId) (int64, error) {
+	file, err := mnt.openRegular(inodeId)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return file.AllocatedBytes()
+}
+
+// Manipulates the space allocated to the regular file `inodeId` as with
+// fallocate(2).
+func (mnt *MountView) Fallocate(inodeId InodeId, mode int, off, length int64) error {
+	file, err := mnt.openRegular(inodeId)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := file.Fallocate(mode, off, length); err != nil {
+		return err
+	}
+	return touchFile(file)
 }
@@ -0,0 +1,1518 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/msg555/ctrfs/blockfile"
+	"github.com/msg555/ctrfs/btree"
+	"github.com/msg555/ctrfs/unix"
+)
+
+func checkMountFile(t *testing.T, mnt *MountView, name string, expected string) {
+	dir, err := mnt.FileManager.OpenFile(unix.DT_DIR, mnt.RootInodeId)
+	if err != nil {
+		t.Fatalf("unexpected error opening root '%s'", err)
+	}
+	defer dir.Close()
+
+	_, inodeId, err := dir.(FileObjectDir).Lookup(name)
+	if err != nil {
+		t.Fatalf("unexpected error looking up '%s': '%s'", name, err)
+	}
+	if expected == "" {
+		if inodeId != 0 {
+			t.Fatalf("expected '%s' to not exist", name)
+		}
+		return
+	}
+	if inodeId == 0 {
+		t.Fatalf("expected '%s' to exist", name)
+	}
+
+	file, err := mnt.FileManager.OpenFile(unix.DT_REG, inodeId)
+	if err != nil {
+		t.Fatalf("unexpected error opening '%s': '%s'", name, err)
+	}
+	defer file.Close()
+	checkRegContents(t, file.(FileObjectReg), []byte(expected))
+}
+
+func writeMountFile(t *testing.T, mnt *MountView, dir FileObjectDir, name string, data string) {
+	_, inodeId, err := dir.Lookup(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var file FileObject
+	if inodeId == 0 {
+		file, err = mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFREG | 0644})
+		if err == nil {
+			err = dir.Link(name, unix.DT_REG, file.GetInodeId(), false)
+		}
+	} else {
+		file, err = mnt.FileManager.OpenFile(unix.DT_REG, inodeId)
+	}
+	if err != nil {
+		t.Fatalf("unexpected error creating '%s': '%s'", name, err)
+	}
+	defer file.Close()
+
+	if _, err := file.(FileObjectReg).WriteAt([]byte(data), 0); err != nil {
+		t.Fatalf("unexpected error writing '%s': '%s'", name, err)
+	}
+}
+
+func TestMountSnapshot(t *testing.T) {
+	sc := storageContextCreate(t)
+
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+
+	rootFile, err := mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFDIR | 0755})
+	if err != nil {
+		t.Fatalf("unexpected error creating root '%s'", err)
+	}
+	root := rootFile.(FileObjectDir)
+	writeMountFile(t, mnt, root, "a", "version one")
+	if err := mnt.SetRoot(root.GetInodeId()); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := mnt.Snapshot("one")
+	if err != nil {
+		t.Fatalf("unexpected error creating snapshot '%s'", err)
+	}
+	if _, err := mnt.Snapshot("one"); err == nil {
+		t.Fatal("expected duplicate snapshot name to fail")
+	}
+
+	// The root directory stays open across the snapshot and must remain
+	// writable.
+	writeMountFile(t, mnt, root, "a", "version two")
+	writeMountFile(t, mnt, root, "b", "new file")
+	if _, err := mnt.Snapshot("two"); err != nil {
+		t.Fatalf("unexpected error creating snapshot '%s'", err)
+	}
+	writeMountFile(t, mnt, root, "c", "another file")
+
+	checkMountFile(t, mnt, "a", "version two")
+	checkMountFile(t, mnt, "b", "new file")
+	checkMountFile(t, mnt, "c", "another file")
+
+	roMnt, err := snap.Mount()
+	if err != nil {
+		t.Fatalf("unexpected error mounting snapshot '%s'", err)
+	}
+	checkMountFile(t, roMnt, "a", "version one")
+	checkMountFile(t, roMnt, "b", "")
+	checkMountFile(t, roMnt, "c", "")
+
+	roRoot, err := roMnt.FileManager.OpenFile(unix.DT_DIR, roMnt.RootInodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := roRoot.(FileObjectDir).Link("d", unix.DT_REG, root.GetInodeId(), false); err == nil {
+		t.Fatal("expected write to snapshot mount to fail")
+	}
+	roRoot.Close()
+
+	if err := mnt.RollbackToSnapshot("one"); err == nil {
+		t.Fatal("expected rollback with open files to fail")
+	}
+	root.Close()
+
+	// Inodes known to the kernel through a fuse connection are held in the
+	// same way and also prevent rolling back.
+	if err := mnt.AcquireInode(mnt.RootInodeId); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnt.RollbackToSnapshot("one"); err == nil {
+		t.Fatal("expected rollback with acquired inodes to fail")
+	}
+	if err := mnt.ReleaseInode(mnt.RootInodeId); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mnt.RollbackToSnapshot("one"); err != nil {
+		t.Fatalf("unexpected error rolling back '%s'", err)
+	}
+	if mnt.GetSnapshot("two") != nil {
+		t.Fatal("expected later snapshot to be discarded")
+	}
+	checkMountFile(t, mnt, "a", "version one")
+	checkMountFile(t, mnt, "b", "")
+	checkMountFile(t, mnt, "c", "")
+
+	// The mount remains writable after rolling back.
+	rootFile, err = mnt.FileManager.OpenFile(unix.DT_DIR, mnt.RootInodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeMountFile(t, mnt, rootFile.(FileObjectDir), "a", "version three")
+	rootFile.Close()
+	checkMountFile(t, mnt, "a", "version three")
+	checkMountFile(t, roMnt, "a", "version one")
+
+	// Snapshots are not persisted; reopening the mount does not restore them.
+	reopened, err := sc.OpenMount(mnt.ID)
+	if err != nil {
+		t.Fatalf("unexpected error opening mount '%s'", err)
+	}
+	if reopened.GetSnapshot("one") != nil {
+		t.Fatal("expected reopened mount to have no snapshots")
+	}
+	if err := reopened.RollbackToSnapshot("one"); err == nil {
+		t.Fatal("expected rollback of reopened mount to fail")
+	}
+}
+
+func TestCloneMount(t *testing.T) {
+	sc := storageContextCreate(t)
+
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+
+	rootFile, err := mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFDIR | 0755})
+	if err != nil {
+		t.Fatalf("unexpected error creating root '%s'", err)
+	}
+	root := rootFile.(FileObjectDir)
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	writeMountFile(t, mnt, root, "data", string(data))
+	writeMountFile(t, mnt, root, "a", "original")
+	if err := mnt.SetRoot(root.GetInodeId()); err != nil {
+		t.Fatal(err)
+	}
+
+	clones := make([]*MountView, 3)
+	for i := range clones {
+		clones[i], err = sc.CloneMount(mnt.ID)
+		if err != nil {
+			t.Fatalf("unexpected error cloning mount '%s'", err)
+		}
+		if sc.GetMount(clones[i].ID) != clones[i] {
+			t.Fatal("expected clone to be registered")
+		}
+
+		// Cloning should not copy any file data.
+		numBlocks, err := clones[i].layers[0].GetNumBlocks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if numBlocks > 4 {
+			t.Fatalf("clone unexpectedly wrote %d blocks", numBlocks)
+		}
+	}
+
+	// The source remains writable through its open root.
+	writeMountFile(t, mnt, root, "a", "source  ")
+	root.Close()
+
+	for i, clone := range clones {
+		cloneRoot, err := clone.FileManager.OpenFile(unix.DT_DIR, clone.RootInodeId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeMountFile(t, clone, cloneRoot.(FileObjectDir), "a", fmt.Sprintf("clone %d ", i))
+		cloneRoot.Close()
+	}
+
+	checkMountFile(t, mnt, "a", "source  ")
+	checkMountFile(t, mnt, "data", string(data))
+	for i, clone := range clones {
+		checkMountFile(t, clone, "a", fmt.Sprintf("clone %d ", i))
+		checkMountFile(t, clone, "data", string(data))
+	}
+
+	// Clones can be cloned in turn.
+	clone, err := sc.CloneMount(clones[0].ID)
+	if err != nil {
+		t.Fatalf("unexpected error cloning mount '%s'", err)
+	}
+	checkMountFile(t, clone, "a", "clone 0 ")
+
+	if _, err := sc.CloneMount(uuid.New()); err == nil {
+		t.Fatal("expected cloning unknown mount to fail")
+	}
+
+	// Closed mounts are no longer registered but their clones keep working.
+	if err := mnt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sc.GetMount(mnt.ID) != nil {
+		t.Fatal("expected closed mount to be unregistered")
+	}
+	if _, err := sc.CloneMount(mnt.ID); err == nil {
+		t.Fatal("expected cloning closed mount to fail")
+	}
+	checkMountFile(t, clones[1], "data", string(data))
+}
+
+// Returns the number of file descriptors open in the test process.
+func numOpenFds(t *testing.T) int {
+	t.Helper()
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(fds)
+}
+
+func TestMountCloseLayers(t *testing.T) {
+	sc := storageContextCreate(t)
+	startFds := numOpenFds(t)
+
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+	rootFile, err := mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFDIR | 0755})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := rootFile.(FileObjectDir)
+	writeMountFile(t, mnt, root, "a", "original")
+	if err := mnt.SetRoot(root.GetInodeId()); err != nil {
+		t.Fatal(err)
+	}
+	root.Close()
+
+	snap, err := mnt.Snapshot("one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mnt.Snapshot("two"); err != nil {
+		t.Fatal(err)
+	}
+	snapMnt, err := snap.Mount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone, err := sc.CloneMount(mnt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloneClone, err := sc.CloneMount(clone.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Layers that clones or snapshot mounts read cannot be rolled back.
+	if err := mnt.RollbackToSnapshot("two"); err == nil {
+		t.Fatal("expected rollback of shared layers to fail")
+	}
+
+	// Mounts keep reading the layers they share with closed mounts.
+	if err := mnt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snap.Mount(); err == nil {
+		t.Fatal("expected mounting snapshot of closed mount to fail")
+	}
+	if err := clone.Destroy(false); err != nil {
+		t.Fatal(err)
+	}
+	checkMountFile(t, snapMnt, "a", "original")
+	checkMountFile(t, cloneClone, "a", "original")
+
+	if err := snapMnt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cloneClone.Destroy(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := cloneClone.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := numOpenFds(t); n != startFds {
+		t.Fatalf("closing mounts leaked %d file descriptors", n-startFds)
+	}
+
+	// Destroyed mounts are removed from disk once nothing uses their layers.
+	for _, check := range []struct {
+		mnt    *MountView
+		exists bool
+	}{
+		{mnt, true},
+		{clone, true},
+		{cloneClone, false},
+	} {
+		_, err := os.Stat(path.Join(sc.BasePath, "mounts", check.mnt.ID.String()))
+		if exists := err == nil; exists != check.exists {
+			t.Fatalf("expected mount directory to exist: %v", check.exists)
+		}
+	}
+}
+
+func TestMountHardlinks(t *testing.T) {
+	sc := storageContextCreate(t)
+
+	now := time.Now()
+	buf := writeTestArchive(t, []tarTestEntry{
+		{Header: tar.Header{Name: "x", Typeflag: tar.TypeReg, Mode: 0644, ModTime: now}, Data: []byte("original")},
+		{Header: tar.Header{Name: "y", Typeflag: tar.TypeReg, Mode: 0644, ModTime: now}, Data: []byte("original")},
+		{Header: tar.Header{Name: "z", Typeflag: tar.TypeLink, Linkname: "x", ModTime: now}},
+	}, false)
+	nd, _, err := sc.ImportTar(buf)
+	if err != nil {
+		t.Fatalf("unexpected error importing archive '%s'", err)
+	}
+
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+	if err := mnt.SetRoot(nd.InodeId); err != nil {
+		t.Fatal(err)
+	}
+	if mnt.Hardlinks == nil {
+		t.Fatal("expected mount to load hardlink layer")
+	}
+
+	root, err := mnt.FileManager.OpenFile(unix.DT_DIR, mnt.RootInodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeMountFile(t, mnt, root.(FileObjectDir), "x", "modified")
+	root.Close()
+
+	checkMountFile(t, mnt, "x", "modified")
+	checkMountFile(t, mnt, "z", "modified")
+	checkMountFile(t, mnt, "y", "original")
+
+	clone, err := sc.CloneMount(mnt.ID)
+	if err != nil {
+		t.Fatalf("unexpected error cloning mount '%s'", err)
+	}
+	root, err = clone.FileManager.OpenFile(unix.DT_DIR, clone.RootInodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeMountFile(t, clone, root.(FileObjectDir), "z", "cloned  ")
+	root.Close()
+
+	checkMountFile(t, clone, "x", "cloned  ")
+	checkMountFile(t, clone, "y", "original")
+	checkMountFile(t, mnt, "x", "modified")
+	checkMountFile(t, mnt, "z", "modified")
+}
+
+func TestMountDedupedFiles(t *testing.T) {
+	sc := storageContextCreate(t)
+
+	now := time.Now()
+	data := strings.Repeat("original", 1000)
+	buf := writeTestArchive(t, []tarTestEntry{
+		{Header: tar.Header{Name: "x", Typeflag: tar.TypeReg, Mode: 0644, ModTime: now}, Data: []byte(data)},
+		{Header: tar.Header{Name: "y", Typeflag: tar.TypeReg, Mode: 0644, ModTime: now}, Data: []byte(data)},
+	}, false)
+	nd, _, err := sc.ImportTar(buf)
+	if err != nil {
+		t.Fatalf("unexpected error importing archive '%s'", err)
+	}
+
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+	if err := mnt.SetRoot(nd.InodeId); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := mnt.FileManager.OpenFile(unix.DT_DIR, mnt.RootInodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeMountFile(t, mnt, root.(FileObjectDir), "x", "modified")
+	root.Close()
+
+	checkMountFile(t, mnt, "x", "modified"+data[len("modified"):])
+	checkMountFile(t, mnt, "y", data)
+
+	if err := mnt.RemoveFile(mnt.RootInodeId, "x", false); err != nil {
+		t.Fatal(err)
+	}
+	checkMountFile(t, mnt, "x", "")
+	checkMountFile(t, mnt, "y", data)
+}
+
+func TestMountXattrs(t *testing.T) {
+	sc := storageContextCreate(t)
+
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+	rootFile, err := mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFDIR | 0755})
+	if err != nil {
+		t.Fatalf("unexpected error creating root '%s'", err)
+	}
+	rootInodeId := rootFile.GetInodeId()
+	rootFile.Close()
+	if err := mnt.SetRoot(rootInodeId); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := mnt.GetInode(rootInodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	large := make([]byte, 2000)
+	if err := mnt.SetXattr(rootInodeId, "user.small", []byte("one"), 0); err != nil {
+		t.Fatal(err)
+	}
+	after, err := mnt.GetInode(rootInodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Ctim <= before.Ctim || after.Mtim != before.Mtim {
+		t.Fatal("expected setting an xattr to update only the change time")
+	}
+	if err := mnt.SetXattr(rootInodeId, "user.large", large, 0); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := mnt.Snapshot("one")
+	if err != nil {
+		t.Fatalf("unexpected error creating snapshot '%s'", err)
+	}
+
+	// Changes after the snapshot must not be visible through it.
+	if err := mnt.SetXattr(rootInodeId, "user.small", []byte("two"), unix.XATTR_REPLACE); err != nil {
+		t.Fatal(err)
+	}
+	before, err = mnt.GetInode(rootInodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if removed, err := mnt.RemoveXattr(rootInodeId, "user.large"); err != nil || !removed {
+		t.Fatalf("failed to remove xattr '%v'", err)
+	}
+	after, err = mnt.GetInode(rootInodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Ctim <= before.Ctim {
+		t.Fatal("expected removing an xattr to update the change time")
+	}
+
+	roMnt, err := snap.Mount()
+	if err != nil {
+		t.Fatalf("unexpected error mounting snapshot '%s'", err)
+	}
+	for _, check := range []struct {
+		mnt   *MountView
+		names string
+		small string
+	}{
+		{mnt, "[user.small]", "two"},
+		{roMnt, "[user.large user.small]", "one"},
+	} {
+		names, err := check.mnt.ListXattrs(check.mnt.RootInodeId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(names) != check.names {
+			t.Fatalf("unexpected xattr names %v", names)
+		}
+		value, _, err := check.mnt.GetXattr(check.mnt.RootInodeId, "user.small")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != check.small {
+			t.Fatalf("unexpected xattr value '%s'", value)
+		}
+	}
+}
+
+func TestMountNamespace(t *testing.T) {
+	sc := storageContextCreate(t)
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+	rootFile, err := mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFDIR | 0755, Nlink: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootInodeId := rootFile.GetInodeId()
+	rootFile.Close()
+	if err := mnt.SetRoot(rootInodeId); err != nil {
+		t.Fatal(err)
+	}
+
+	checkNlink := func(inodeId InodeId, expected uint32) {
+		t.Helper()
+		inodeData, err := mnt.GetInode(inodeId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inodeData.Nlink != expected {
+			t.Fatalf("expected link count %d, found %d", expected, inodeData.Nlink)
+		}
+	}
+
+	dirInodeId, err := mnt.CreateFile(rootInodeId, "d", &InodeData{Mode: unix.S_IFDIR | 0755}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInodeId, err := mnt.CreateFile(dirInodeId, "f", &InodeData{Mode: unix.S_IFREG | 0644}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNlink(rootInodeId, 3)
+	checkNlink(dirInodeId, 2)
+	checkNlink(fileInodeId, 1)
+
+	if err := mnt.LinkFile(rootInodeId, "g", fileInodeId); err != nil {
+		t.Fatal(err)
+	}
+	checkNlink(fileInodeId, 2)
+	for _, check := range []struct {
+		err      error
+		expected unix.Errno
+	}{
+		{mnt.LinkFile(rootInodeId, "g", fileInodeId), unix.EEXIST},
+		{mnt.LinkFile(rootInodeId, "e", dirInodeId), unix.EPERM},
+		{mnt.RemoveFile(rootInodeId, "missing", false), unix.ENOENT},
+		{mnt.RemoveFile(rootInodeId, "d", false), unix.EISDIR},
+		{mnt.RemoveFile(rootInodeId, "g", true), unix.ENOTDIR},
+		{mnt.RemoveFile(rootInodeId, "d", true), unix.ENOTEMPTY},
+	} {
+		if check.err != check.expected {
+			t.Fatalf("expected '%s', got '%v'", check.expected, check.err)
+		}
+	}
+
+	if err := mnt.RemoveFile(dirInodeId, "f", false); err != nil {
+		t.Fatal(err)
+	}
+	checkNlink(fileInodeId, 1)
+	if err := mnt.RemoveFile(rootInodeId, "d", true); err != nil {
+		t.Fatal(err)
+	}
+	checkNlink(dirInodeId, 0)
+	checkNlink(rootInodeId, 2)
+
+	if _, inodeId, err := mnt.LookupChild(rootInodeId, "d"); err != nil || inodeId != 0 {
+		t.Fatalf("expected removed directory to be gone '%v'", err)
+	}
+}
+
+func TestMountRename(t *testing.T) {
+	sc := storageContextCreate(t)
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+	rootFile, err := mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFDIR | 0755, Nlink: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootInodeId := rootFile.GetInodeId()
+	rootFile.Close()
+	if err := mnt.SetRoot(rootInodeId); err != nil {
+		t.Fatal(err)
+	}
+
+	checkNlink := func(inodeId InodeId, expected uint32) {
+		t.Helper()
+		inodeData, err := mnt.GetInode(inodeId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inodeData.Nlink != expected {
+			t.Fatalf("expected link count %d, found %d", expected, inodeData.Nlink)
+		}
+	}
+	checkEntry := func(parentInodeId InodeId, name string, expected InodeId) {
+		t.Helper()
+		_, inodeId, err := mnt.LookupChild(parentInodeId, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inodeId != expected {
+			t.Fatalf("expected %s to refer to %d, found %d", name, expected, inodeId)
+		}
+	}
+	create := func(parentInodeId InodeId, name string, mode uint32) InodeId {
+		t.Helper()
+		inodeId, err := mnt.CreateFile(parentInodeId, name, &InodeData{Mode: mode}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inodeId
+	}
+
+	dirA := create(rootInodeId, "a", unix.S_IFDIR|0755)
+	dirB := create(rootInodeId, "b", unix.S_IFDIR|0755)
+	fileF := create(dirA, "f", unix.S_IFREG|0644)
+	fileG := create(dirA, "g", unix.S_IFREG|0644)
+
+	// Rename within an inline directory replacing an existing file.
+	if err := mnt.RenameFile(dirA, "f", dirA, "g"); err != nil {
+		t.Fatal(err)
+	}
+	checkEntry(dirA, "f", 0)
+	checkEntry(dirA, "g", fileF)
+	checkNlink(fileF, 1)
+	checkNlink(fileG, 0)
+
+	// Move a directory between parents.
+	sub := create(dirA, "sub", unix.S_IFDIR|0755)
+	checkNlink(dirA, 3)
+	if err := mnt.RenameFile(dirA, "sub", dirB, "moved"); err != nil {
+		t.Fatal(err)
+	}
+	checkEntry(dirA, "sub", 0)
+	checkEntry(dirB, "moved", sub)
+	checkNlink(dirA, 2)
+	checkNlink(dirB, 3)
+	checkNlink(sub, 2)
+
+	for _, check := range []struct {
+		err      error
+		expected unix.Errno
+	}{
+		{mnt.RenameFile(dirA, "missing", dirA, "x"), unix.ENOENT},
+		{mnt.RenameFile(dirA, "g", rootInodeId, "b"), unix.EISDIR},
+		{mnt.RenameFile(rootInodeId, "b", dirA, "g"), unix.ENOTDIR},
+	} {
+		if check.err != check.expected {
+			t.Fatalf("expected '%s', got '%v'", check.expected, check.err)
+		}
+	}
+	create(sub, "inner", unix.S_IFREG|0644)
+	if err := mnt.RenameFile(rootInodeId, "a", dirB, "moved"); err != unix.ENOTEMPTY {
+		t.Fatalf("expected ENOTEMPTY, got '%v'", err)
+	}
+
+	// Renames within a directory stored as a tree swap both entries at once.
+	for i := 0; i < 200; i++ {
+		create(dirB, fmt.Sprintf("file-%03d", i), unix.S_IFREG|0644)
+	}
+	dir, err := mnt.FileManager.OpenFile(unix.DT_DIR, dirB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	if dir.GetInode().TreeNode == 0 {
+		t.Fatal("expected large directory to be stored as a tree")
+	}
+	for i := 0; i < 200; i += 2 {
+		oldName, newName := fmt.Sprintf("file-%03d", i), fmt.Sprintf("file-%03d", i+1)
+		_, inodeId, err := mnt.LookupChild(dirB, oldName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mnt.RenameFile(dirB, oldName, dirB, newName); err != nil {
+			t.Fatal(err)
+		}
+		checkEntry(dirB, oldName, 0)
+		checkEntry(dirB, newName, inodeId)
+	}
+	count := 0
+	if _, err := dir.(FileObjectDir).ScanFrom(0, nil, func(_ btree.Position, name string, dtType int, inodeId InodeId) bool {
+		count++
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != 101 {
+		t.Fatalf("expected 101 entries after renames, found %d", count)
+	}
+	checkNlink(dirB, 3)
+
+	// Blocks replaced by each rename are freed and reused.
+	numBlocks := func() blockfile.BlockIndex {
+		n, err := mnt.layers[len(mnt.layers)-1].GetNumBlocks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	expected := numBlocks()
+	for i := 0; i < 100; i++ {
+		oldName, newName := "file-001", "renamed"
+		if i%2 == 1 {
+			oldName, newName = newName, oldName
+		}
+		if err := mnt.RenameFile(dirB, oldName, dirB, newName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := numBlocks(); n > expected+8 {
+		t.Fatalf("renames leaked %d blocks", n-expected)
+	}
+}
+
+// Directory whose unlinks always fail, used to interrupt moves between
+// directories.
+type failingUnlinkDir struct {
+	FileObjectDir
+}
+
+func (d failingUnlinkDir) Unlink(name string) (bool, error) {
+	return false, unix.EIO
+}
+
+func TestMountRenameFailure(t *testing.T) {
+	sc := storageContextCreate(t)
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+	rootFile, err := mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFDIR | 0755, Nlink: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootInodeId := rootFile.GetInodeId()
+	rootFile.Close()
+	if err := mnt.SetRoot(rootInodeId); err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(parentInodeId InodeId, name string, mode uint32) InodeId {
+		t.Helper()
+		inodeId, err := mnt.CreateFile(parentInodeId, name, &InodeData{Mode: mode}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inodeId
+	}
+	openDir := func(inodeId InodeId) FileObjectDir {
+		t.Helper()
+		file, err := mnt.FileManager.OpenFile(unix.DT_DIR, inodeId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			file.Close()
+		})
+		return file.(FileObjectDir)
+	}
+	checkState := func(expected map[string]InodeId, nlinks map[InodeId]uint32) {
+		t.Helper()
+		for path, expectedInodeId := range expected {
+			parentInodeId := rootInodeId
+			parts := strings.Split(path, "/")
+			for _, part := range parts[:len(parts)-1] {
+				_, parentInodeId, err = mnt.LookupChild(parentInodeId, part)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, inodeId, err := mnt.LookupChild(parentInodeId, parts[len(parts)-1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inodeId != expectedInodeId {
+				t.Fatalf("expected %s to refer to %d, found %d", path, expectedInodeId, inodeId)
+			}
+		}
+		for inodeId, expected := range nlinks {
+			inodeData, err := mnt.GetInode(inodeId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inodeData.Nlink != expected {
+				t.Fatalf("expected link count %d for %d, found %d", expected, inodeId, inodeData.Nlink)
+			}
+		}
+	}
+
+	dirA := create(rootInodeId, "a", unix.S_IFDIR|0755)
+	dirB := create(rootInodeId, "b", unix.S_IFDIR|0755)
+	fileF := create(dirA, "f", unix.S_IFREG|0644)
+	dirD := create(dirA, "d", unix.S_IFDIR|0755)
+	dirE := create(dirB, "e", unix.S_IFDIR|0755)
+	a := failingUnlinkDir{openDir(dirA)}
+	b := openDir(dirB)
+
+	expected := map[string]InodeId{
+		"a/f": fileF,
+		"a/d": dirD,
+		"b/f": 0,
+		"b/e": dirE,
+	}
+	nlinks := map[InodeId]uint32{
+		dirA:  3,
+		dirB:  3,
+		fileF: 1,
+		dirD:  2,
+		dirE:  2,
+	}
+
+	// A move that fails to unlink the old name leaves the entry where it was.
+	if err := moveEntry(a, "f", b, "f", unix.DT_REG, fileF, 0, 0); err != unix.EIO {
+		t.Fatalf("expected EIO, got '%v'", err)
+	}
+	checkState(expected, nlinks)
+
+	// The entry replaced by a failed move is restored.
+	if err := moveEntry(a, "d", b, "e", unix.DT_DIR, dirD, unix.DT_DIR, dirE); err != unix.EIO {
+		t.Fatalf("expected EIO, got '%v'", err)
+	}
+	checkState(expected, nlinks)
+
+	// The same moves succeed once unlinking works.
+	if err := mnt.RenameFile(dirA, "d", dirB, "e"); err != nil {
+		t.Fatal(err)
+	}
+	expected["a/d"] = 0
+	expected["b/e"] = dirD
+	nlinks[dirA] = 2
+	nlinks[dirE] = 0
+	checkState(expected, nlinks)
+}
+
+func TestMountCreateFileFailure(t *testing.T) {
+	sc := storageContextCreate(t)
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+	rootFile, err := mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFDIR | 0755, Nlink: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootInodeId := rootFile.GetInodeId()
+	rootFile.Close()
+	if err := mnt.SetRoot(rootInodeId); err != nil {
+		t.Fatal(err)
+	}
+
+	longName := strings.Repeat("n", 300)
+	longTarget := strings.Repeat("a/", sc.Cache.BlockSize)
+	createFailing := func() {
+		if _, err := mnt.CreateFile(rootInodeId, longName, &InodeData{Mode: unix.S_IFREG | 0644}, 0); err != unix.ENAMETOOLONG {
+			t.Fatalf("expected ENAMETOOLONG linking long name, got '%v'", err)
+		}
+		if _, err := mnt.CreateFile(rootInodeId, longName, &InodeData{Mode: unix.S_IFDIR | 0755}, 0); err != unix.ENAMETOOLONG {
+			t.Fatalf("expected ENAMETOOLONG linking long name, got '%v'", err)
+		}
+		if _, err := mnt.CreateSymlink(rootInodeId, "link", longTarget, &InodeData{}); err != unix.ENAMETOOLONG {
+			t.Fatalf("expected ENAMETOOLONG setting long target, got '%v'", err)
+		}
+	}
+	numBlocks := func() blockfile.BlockIndex {
+		n, err := mnt.layers[len(mnt.layers)-1].GetNumBlocks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// The inodes of files that fail to be created must be freed and reused.
+	createFailing()
+	expected := numBlocks()
+	for i := 0; i < 5; i++ {
+		createFailing()
+	}
+	if n := numBlocks(); n != expected {
+		t.Fatalf("failed creates leaked %d blocks", n-expected)
+	}
+
+	if _, inodeId, err := mnt.LookupChild(rootInodeId, "link"); err != nil || inodeId != 0 {
+		t.Fatalf("expected failed symlink to not be linked '%v'", err)
+	}
+	inodeData, err := mnt.GetInode(rootInodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inodeData.Nlink != 2 {
+		t.Fatalf("expected root link count 2, found %d", inodeData.Nlink)
+	}
+}
+
+func TestMountUpdateInode(t *testing.T) {
+	sc := storageContextCreate(t)
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+	rootFile, err := mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFDIR | 0755, Nlink: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := rootFile.(FileObjectDir)
+	defer root.Close()
+	if err := mnt.SetRoot(root.GetInodeId()); err != nil {
+		t.Fatal(err)
+	}
+
+	writeMountFile(t, mnt, root, "f", "hello world")
+	_, inodeId, err := root.Lookup("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setSize := func(size uint64) {
+		inodeData, err := mnt.UpdateInode(inodeId, func(inodeData *InodeData) error {
+			inodeData.Size = size
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inodeData.Size != size || inodeData.Ctim == 0 {
+			t.Fatalf("unexpected inode after resize %+v", inodeData)
+		}
+	}
+
+	// Shrinking discards data that extending the file again reveals as zeroes.
+	setSize(5)
+	checkMountFile(t, mnt, "f", "hello")
+	setSize(10000)
+	checkMountFile(t, mnt, "f", "hello"+string(make([]byte, 9995)))
+
+	// Changing the mode keeps the access ACL in sync.
+	acl, err := unix.ParseACLText("user::rw-,user:2000:rwx,group::r--,mask::rwx,other::---")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mnt.SetXattr(inodeId, unix.XATTR_POSIX_ACL_ACCESS, acl.Bytes(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mnt.UpdateInode(inodeId, func(inodeData *InodeData) error {
+		inodeData.Mode = unix.S_IFREG | 0640
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if allowed, _ := mnt.CheckAccess(inodeId, 2000, inGroups(2000), unix.ACL_WRITE); allowed {
+		t.Fatal("expected chmod to restrict the acl mask")
+	}
+	if allowed, _ := mnt.CheckAccess(inodeId, 2000, inGroups(2000), unix.ACL_READ); !allowed {
+		t.Fatal("expected named user to keep read access")
+	}
+}
+
+// Returns the data block holding offset `off` of the file.
+func fileDataBlock(t *testing.T, file FileObjectReg, off int64) blockfile.BlockIndex {
+	tf := file.(*TreeFileReg)
+	if tf.isChunked() {
+		chunk, err := tf.findChunk(off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunk == nil || chunk.Start > off {
+			return 0
+		}
+		return chunk.BlockIndex
+	}
+	index, err := tf.lookupBlock(off/int64(tf.manager.blocks.GetBlockSize()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return index
+}
+
+func TestMountCopyFileRange(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		sc := storageContextCreate(t)
+		mnt, err := sc.CreateEmptyMount()
+		if err != nil {
+			t.Fatalf("unexpected error creating mount '%s'", err)
+		}
+		rootFile, err := mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFDIR | 0755, Nlink: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rootInodeId := rootFile.GetInodeId()
+		rootFile.Close()
+		if err := mnt.SetRoot(rootInodeId); err != nil {
+			t.Fatal(err)
+		}
+
+		var flags uint32
+		if chunked {
+			flags = INODE_FLAG_CHUNKED
+		}
+		openFile := func(name string) FileObjectReg {
+			inodeId, err := mnt.CreateFile(rootInodeId, name, &InodeData{Mode: unix.S_IFREG | 0644, Flags: flags}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file, err := mnt.FileManager.OpenFile(unix.DT_REG, inodeId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { file.Close() })
+			return file.(FileObjectReg)
+		}
+
+		blockSize := int64(sc.Cache.BlockSize)
+		rng := rand.New(rand.NewSource(555))
+		data := make([]byte, 10*blockSize+100)
+		rng.Read(data)
+
+		src := openFile("src")
+		if _, err := src.WriteAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		// Cloning a whole file shares its data blocks.
+		dst := openFile("dst")
+		copied, err := mnt.CopyFileRange(src.GetInodeId(), 0, dst.GetInodeId(), 0, 1<<30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if copied != int64(len(data)) {
+			t.Fatalf("unexpected number of bytes copied %d", copied)
+		}
+		checkRegContents(t, dst, data)
+		for _, off := range []int64{0, 5 * blockSize, int64(len(data)) - 1} {
+			if fileDataBlock(t, src, off) != fileDataBlock(t, dst, off) {
+				t.Fatalf("expected data at %d to be shared", off)
+			}
+		}
+
+		// Writes to either file are not seen by the other.
+		expected := append([]byte(nil), data...)
+		msg := []byte("hello world")
+		if _, err := dst.WriteAt(msg, 5*blockSize+10); err != nil {
+			t.Fatal(err)
+		}
+		copy(expected[5*blockSize+10:], msg)
+		checkRegContents(t, dst, expected)
+		checkRegContents(t, src, data)
+		if fileDataBlock(t, src, 5*blockSize) == fileDataBlock(t, dst, 5*blockSize) {
+			t.Fatal("expected written data to no longer be shared")
+		}
+
+		// Releasing the source's references leaves the clone intact.
+		if err := src.UpdateInode(func(inodeData *InodeData) error {
+			inodeData.Size = 0
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		checkRegContents(t, dst, expected)
+
+		// Unaligned ranges are copied.
+		part := openFile("part")
+		copied, err = mnt.CopyFileRange(dst.GetInodeId(), 100, part.GetInodeId(), 7, 3*blockSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if copied != 3*blockSize {
+			t.Fatalf("unexpected number of bytes copied %d", copied)
+		}
+		checkRegContents(t, part, append(make([]byte, 7), expected[100:100+3*blockSize]...))
+
+		// Overlapping ranges within a file are rejected.
+		if _, err := mnt.CopyFileRange(dst.GetInodeId(), 0, dst.GetInodeId(), blockSize, 2*blockSize); err != unix.EINVAL {
+			t.Fatalf("expected EINVAL copying overlapping range, got '%v'", err)
+		}
+		if _, err := mnt.CopyFileRange(rootInodeId, 0, dst.GetInodeId(), 0, blockSize); err != unix.EISDIR {
+			t.Fatalf("expected EISDIR copying from directory, got '%v'", err)
+		}
+	}
+}
+
+func TestMountCloneFile(t *testing.T) {
+	sc := storageContextCreate(t)
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+	rootFile, err := mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFDIR | 0755, Nlink: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootInodeId := rootFile.GetInodeId()
+	rootFile.Close()
+	if err := mnt.SetRoot(rootInodeId); err != nil {
+		t.Fatal(err)
+	}
+
+	openFile := func(name string) FileObjectReg {
+		inodeId, err := mnt.CreateFile(rootInodeId, name, &InodeData{Mode: unix.S_IFREG | 0644}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := mnt.FileManager.OpenFile(unix.DT_REG, inodeId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { file.Close() })
+		return file.(FileObjectReg)
+	}
+
+	blockSize := int64(sc.Cache.BlockSize)
+	rng := rand.New(rand.NewSource(555))
+	data := make([]byte, 4*blockSize)
+	rng.Read(data)
+
+	src := openFile("src")
+	if _, err := src.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The previous, longer contents of the destination are replaced.
+	dst := openFile("dst")
+	if _, err := dst.WriteAt(make([]byte, 6*blockSize), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnt.CloneFile(src.GetInodeId(), dst.GetInodeId()); err != nil {
+		t.Fatalf("unexpected error cloning file '%s'", err)
+	}
+	checkRegContents(t, dst, data)
+	for off := int64(0); off < int64(len(data)); off += blockSize {
+		if fileDataBlock(t, src, off) != fileDataBlock(t, dst, off) {
+			t.Fatalf("expected data at %d to be shared", off)
+		}
+	}
+
+	// Writing to the source copies only the written block.
+	expected := append([]byte(nil), data...)
+	if _, err := src.WriteAt([]byte("changed"), blockSize); err != nil {
+		t.Fatal(err)
+	}
+	copy(expected[blockSize:], "changed")
+	checkRegContents(t, src, expected)
+	checkRegContents(t, dst, data)
+	if fileDataBlock(t, src, blockSize) == fileDataBlock(t, dst, blockSize) {
+		t.Fatal("expected written block to no longer be shared")
+	}
+	if fileDataBlock(t, src, 2*blockSize) != fileDataBlock(t, dst, 2*blockSize) {
+		t.Fatal("expected unwritten block to remain shared")
+	}
+
+	if err := mnt.CloneFile(src.GetInodeId(), src.GetInodeId()); err != unix.EINVAL {
+		t.Fatalf("expected EINVAL cloning file onto itself, got '%v'", err)
+	}
+	if err := mnt.CloneFile(src.GetInodeId(), rootInodeId); err != unix.EISDIR {
+		t.Fatalf("expected EISDIR cloning onto directory, got '%v'", err)
+	}
+}
+
+func TestMountSymlink(t *testing.T) {
+	sc := storageContextCreate(t)
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+	rootFile, err := mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFDIR | 0755, Nlink: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootInodeId := rootFile.GetInodeId()
+	rootFile.Close()
+	if err := mnt.SetRoot(rootInodeId); err != nil {
+		t.Fatal(err)
+	}
+
+	// Short targets are stored inline and long ones in a data block.
+	longTarget := strings.Repeat("a/", sc.Cache.BlockSize/2)
+	for _, check := range []struct {
+		name, target string
+		blocks       uint64
+	}{
+		{"short", "../target", 0},
+		{"long", longTarget, 1},
+	} {
+		inodeId, err := mnt.CreateSymlink(rootInodeId, check.name, check.target, &InodeData{Uid: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		inodeData, err := mnt.GetInode(inodeId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inodeData.Mode != unix.S_IFLNK|0777 || inodeData.Size != uint64(len(check.target)) || inodeData.Blocks != check.blocks {
+			t.Fatalf("unexpected inode for '%s' %+v", check.name, inodeData)
+		}
+		if target, err := mnt.Readlink(inodeId); err != nil || target != check.target {
+			t.Fatalf("unexpected target for '%s' '%v'", check.name, err)
+		}
+
+		// Extended attributes are kept apart from the target.
+		if err := mnt.SetXattr(inodeId, "trusted.x", []byte(strings.Repeat("x", 500)), 0); err != nil {
+			t.Fatal(err)
+		}
+		file, err := mnt.FileManager.OpenFile(unix.DT_LNK, inodeId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target, err := file.(FileObjectLnk).ReadLink(); err != nil || target != check.target {
+			t.Fatalf("unexpected target for '%s' '%v'", check.name, err)
+		}
+		file.Close()
+	}
+
+	if _, err := mnt.CreateSymlink(rootInodeId, "short", "x", &InodeData{}); err != unix.EEXIST {
+		t.Fatalf("expected EEXIST, got '%v'", err)
+	}
+	if _, err := mnt.CreateSymlink(rootInodeId, "toolong", longTarget+longTarget, &InodeData{}); err != unix.ENAMETOOLONG {
+		t.Fatalf("expected ENAMETOOLONG, got '%v'", err)
+	}
+	if _, err := mnt.Readlink(rootInodeId); err != unix.EINVAL {
+		t.Fatalf("expected EINVAL reading link of directory, got '%v'", err)
+	}
+}
+
+func TestMountSeekFallocate(t *testing.T) {
+	sc := storageContextCreate(t)
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+	rootFile, err := mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFDIR | 0755, Nlink: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootInodeId := rootFile.GetInodeId()
+	rootFile.Close()
+	if err := mnt.SetRoot(rootInodeId); err != nil {
+		t.Fatal(err)
+	}
+
+	inodeId, err := mnt.CreateFile(rootInodeId, "f", &InodeData{Mode: unix.S_IFREG | 0644}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inodeData, err := mnt.GetInode(inodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := mnt.GetFileView(inodeId, inodeData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.ReleaseFileView(inodeId)
+
+	// Data in the first and fourth blocks with a hole between them.
+	blockSize := int64(sc.Cache.BlockSize)
+	data := []byte(strings.Repeat("x", int(blockSize)))
+	for _, off := range []int64{0, 3 * blockSize} {
+		if _, err := file.WriteAt(data, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkSeek := func(off int64, whence int, expected int64) {
+		t.Helper()
+		result, err := mnt.SeekFile(inodeId, off, whence)
+		if err != nil {
+			t.Fatalf("unexpected error seeking '%s'", err)
+		}
+		if result != expected {
+			t.Fatalf("expected seek from %d to give %d, got %d", off, expected, result)
+		}
+	}
+	checkSeek(0, unix.SEEK_DATA, 0)
+	checkSeek(0, unix.SEEK_HOLE, blockSize)
+	checkSeek(blockSize, unix.SEEK_DATA, 3*blockSize)
+	checkSeek(3*blockSize, unix.SEEK_HOLE, 4*blockSize)
+
+	// Punching out the first block leaves only the last block as data.
+	if err := mnt.Fallocate(inodeId, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, 0, blockSize); err != nil {
+		t.Fatalf("unexpected error punching hole '%s'", err)
+	}
+	checkSeek(0, unix.SEEK_DATA, 3*blockSize)
+
+	// Allocating past the end extends the file.
+	if err := mnt.Fallocate(inodeId, 0, 4*blockSize, blockSize); err != nil {
+		t.Fatalf("unexpected error allocating '%s'", err)
+	}
+	if inodeData, err := mnt.GetInode(inodeId); err != nil || inodeData.Size != uint64(5*blockSize) {
+		t.Fatalf("expected allocation to extend file '%v'", err)
+	}
+
+	if _, err := mnt.SeekFile(inodeId, 0, io.SeekEnd); err != unix.EINVAL {
+		t.Fatalf("expected EINVAL, got '%v'", err)
+	}
+	if _, err := mnt.SeekFile(rootInodeId, 0, unix.SEEK_DATA); err != unix.EISDIR {
+		t.Fatalf("expected EISDIR, got '%v'", err)
+	}
+	if err := mnt.Fallocate(rootInodeId, 0, 0, blockSize); err != unix.EISDIR {
+		t.Fatalf("expected EISDIR, got '%v'", err)
+	}
+}
+
+func TestMountUnlinkOpen(t *testing.T) {
+	sc := storageContextCreate(t)
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+	rootFile, err := mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFDIR | 0755, Nlink: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootInodeId := rootFile.GetInodeId()
+	rootFile.Close()
+	if err := mnt.SetRoot(rootInodeId); err != nil {
+		t.Fatal(err)
+	}
+
+	inodeId, err := mnt.CreateFile(rootInodeId, "f", &InodeData{Mode: unix.S_IFREG | 0644}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inodeData, err := mnt.GetInode(inodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	view, err := mnt.GetFileView(inodeId, inodeData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mnt.AcquireInode(inodeId); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(strings.Repeat("x", sc.Cache.BlockSize+10))
+	if _, err := view.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	dataBlock := fileDataBlock(t, view.(FileObjectReg), 0)
+
+	if err := mnt.RemoveFile(rootInodeId, "f", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnt.LinkFile(rootInodeId, "g", inodeId); err != unix.ENOENT {
+		t.Fatalf("expected ENOENT linking removed file, got '%v'", err)
+	}
+
+	// The file remains usable while references to it are held.
+	if err := mnt.ReleaseFileView(inodeId); err != nil {
+		t.Fatal(err)
+	}
+	view, err = mnt.GetFileView(inodeId, inodeData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	if _, err := view.ReadAt(buf, 0); err != nil || string(buf) != string(data) {
+		t.Fatalf("unexpected data read from removed file '%v'", err)
+	}
+	if err := mnt.ReleaseFileView(inodeId); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnt.ReleaseInode(inodeId); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dropping the last reference frees the inode and data blocks for reuse.
+	reused := make(map[blockfile.BlockIndex]bool)
+	for i := 0; i < 8; i++ {
+		index, err := mnt.Blocks.Allocate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reused[index] = true
+	}
+	if !reused[inodeId] || !reused[dataBlock] {
+		t.Fatal("expected blocks of removed file to be freed")
+	}
+}
+
+func TestMountSync(t *testing.T) {
+	sc := storageContextCreate(t)
+	mnt, err := sc.CreateEmptyMount()
+	if err != nil {
+		t.Fatalf("unexpected error creating mount '%s'", err)
+	}
+	rootFile, err := mnt.FileManager.NewFile(&InodeData{Mode: unix.S_IFDIR | 0755, Nlink: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootInodeId := rootFile.GetInodeId()
+	rootFile.Close()
+	if err := mnt.SetRoot(rootInodeId); err != nil {
+		t.Fatal(err)
+	}
+
+	// Returns true if `data` has been written to the writable layer on disk.
+	onDisk := func(data []byte) bool {
+		layer, err := ioutil.ReadFile(mnt.layerPath(len(mnt.layers) - 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Contains(layer, data)
+	}
+	// Writes a new file that is left open until the test ends.
+	writeFile := func(name string, data []byte) InodeId {
+		inodeId, err := mnt.CreateFile(rootInodeId, name, &InodeData{Mode: unix.S_IFREG | 0644}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inodeData, err := mnt.GetInode(inodeId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		view, err := mnt.GetFileView(inodeId, inodeData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { mnt.ReleaseFileView(inodeId) })
+		if _, err := view.WriteAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		return inodeId
+	}
+
+	data1 := []byte(strings.Repeat("sync file one ", 20))
+	inodeId := writeFile("a", data1)
+	if err := mnt.SyncFile(inodeId); err != nil {
+		t.Fatal(err)
+	}
+	if !onDisk(data1) {
+		t.Fatal("expected synced file data to be written to disk")
+	}
+
+	// Blocks written before the file was released are synced once reopened.
+	data3 := []byte(strings.Repeat("sync file three ", 20))
+	inodeId = writeFile("c", data3)
+	if err := mnt.ReleaseFileView(inodeId); err != nil {
+		t.Fatal(err)
+	}
+	if onDisk(data3) {
+		t.Fatal("expected released file data to still be cached")
+	}
+	inodeData, err := mnt.GetInode(inodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mnt.GetFileView(inodeId, inodeData); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnt.SyncFile(inodeId); err != nil {
+		t.Fatal(err)
+	}
+	if !onDisk(data3) {
+		t.Fatal("expected reopened file data to be written to disk")
+	}
+
+	data2 := []byte(strings.Repeat("sync file two ", 20))
+	writeFile("b", data2)
+	if err := mnt.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !onDisk(data2) {
+		t.Fatal("expected mount data to be written to disk")
+	}
+}
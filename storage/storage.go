@@ -7,13 +7,14 @@ import (
 	"os"
 	"os/user"
 	"path"
+	"sync"
+
+	"github.com/google/uuid"
 
 	"github.com/msg555/ctrfs/blockcache"
 	"github.com/msg555/ctrfs/blockfile"
 	"github.com/msg555/ctrfs/btree"
 	"github.com/msg555/ctrfs/unix"
-
-	"github.com/boltdb/bolt"
 )
 
 const (
@@ -31,10 +32,22 @@ type StorageContext struct {
 	FileManager TreeFileManager
 	BasePath    string
 
+	// If set, imported regular files larger than a block are split into
+	// content-defined chunks rather than fixed size blocks. This allows data to
+	// be deduplicated between similar files even when their content has shifted.
+	ContentDefinedChunking bool
+
 	dataBlockCache	btree.BTree
+
+	mountLock sync.Mutex
+	mounts    map[uuid.UUID]*MountView
+
+	// Number of open mounts using each mount layer.
+	layerRefs map[*blockfile.BlockFile]int
 }
 
 type StorageNode struct {
+	InodeId     InodeId
 	Inode       *InodeData
 	NodeAddress [HASH_BYTE_LENGTH]byte
 }
@@ -56,15 +69,12 @@ func OpenStorageContext(basePath string) (*StorageContext, error) {
 		return nil, err
 	}
 
-	nodeDB, err := bolt.Open(path.Join(basePath, "contentmap.db"), 0666, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	sc := &StorageContext{
 		HashFactory: hashFactory,
 		Cache: blockcache.New(65536, 4096),
 		BasePath:    basePath,
+		mounts:      make(map[uuid.UUID]*MountView),
+		layerRefs:   make(map[*blockfile.BlockFile]int),
 
 		dataBlockCache: btree.BTree{
 			MaxKeySize: HASH_BYTE_LENGTH,
@@ -84,8 +94,7 @@ func OpenStorageContext(basePath string) (*StorageContext, error) {
 	}
 	sc.Blocks = bf
 
-	tf := &TreeFileManager{}
-	if err := tf.Init(bf, &NullInodeMap{}); err != nil {
+	if err := sc.FileManager.Init(bf, &NullInodeMap{}); err != nil {
 		sc.Close()
 		return nil, err
 	}
@@ -99,6 +108,68 @@ func OpenStorageContext(basePath string) (*StorageContext, error) {
 	return sc, nil
 }
 
+func (sc *StorageContext) registerMount(mnt *MountView) {
+	sc.mountLock.Lock()
+	defer sc.mountLock.Unlock()
+	sc.mounts[mnt.ID] = mnt
+}
+
+func (sc *StorageContext) unregisterMount(mnt *MountView) {
+	sc.mountLock.Lock()
+	defer sc.mountLock.Unlock()
+	if sc.mounts[mnt.ID] == mnt {
+		delete(sc.mounts, mnt.ID)
+	}
+}
+
+// Counts a use of each of `layers` by a mount.
+func (sc *StorageContext) acquireLayers(layers []*blockfile.BlockFile) {
+	sc.mountLock.Lock()
+	defer sc.mountLock.Unlock()
+	for _, layer := range layers {
+		sc.layerRefs[layer]++
+	}
+}
+
+// Drops a use of each of `layers`, closing the layers no mount uses any
+// longer. Returns the first error encountered closing a layer.
+func (sc *StorageContext) releaseLayers(layers []*blockfile.BlockFile) error {
+	sc.mountLock.Lock()
+	defer sc.mountLock.Unlock()
+
+	var firstErr error
+	for _, layer := range layers {
+		sc.layerRefs[layer]--
+		if sc.layerRefs[layer] > 0 {
+			continue
+		}
+		delete(sc.layerRefs, layer)
+		if err := layer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Returns true if any of `layers` is used by more than one mount.
+func (sc *StorageContext) layersShared(layers []*blockfile.BlockFile) bool {
+	sc.mountLock.Lock()
+	defer sc.mountLock.Unlock()
+	for _, layer := range layers {
+		if sc.layerRefs[layer] > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the mount with the passed ID or nil if no such mount exists.
+func (sc *StorageContext) GetMount(id uuid.UUID) *MountView {
+	sc.mountLock.Lock()
+	defer sc.mountLock.Unlock()
+	return sc.mounts[id]
+}
+
 func (sc *StorageContext) Close() error {
 	err := sc.Blocks.Close()
 	if err != nil {
@@ -4,6 +4,8 @@ import (
 	"io"
 	"sync"
 
+	"github.com/go-errors/errors"
+
 	"github.com/msg555/ctrfs/blockfile"
 	"github.com/msg555/ctrfs/btree"
 	"github.com/msg555/ctrfs/unix"
@@ -17,9 +19,15 @@ type FileObject interface {
 	GetInode() InodeData
 	UpdateInode(updateFunc func(inodeData *InodeData) error) error
 
+	GetXattr(name string) (value []byte, found bool, err error)
+	ListXattrs() ([]string, error)
+	SetXattr(name string, value []byte, flags int) error
+	RemoveXattr(name string) (bool, error)
+
 	Sync() error
 
 	addRef()
+	getObject() *TreeFileObject
 }
 
 type FileObjectReg interface {
@@ -29,6 +37,12 @@ type FileObjectReg interface {
 	io.Reader
 	io.Writer
 	io.Seeker
+
+	SeekData(off int64) (int64, error)
+	SeekHole(off int64) (int64, error)
+	Fallocate(mode int, off, length int64) error
+	AllocatedBytes() (int64, error)
+	CloneRange(src FileObjectReg, srcOff, dstOff, length int64) (int64, error)
 }
 
 type FileObjectDir interface {
@@ -37,7 +51,11 @@ type FileObjectDir interface {
 	Lookup(name string) (dtType int, inodeId InodeId, err error)
 	Link(name string, dtType int, inodeId InodeId, overwrite bool) error
 	Unlink(name string) (bool, error)
+	Rename(oldName, newName string) error
 	Scan(startName string, entryCallback func(name string, dtType int, inodeId InodeId) (contnue bool)) (complete bool, err error)
+	ScanFrom(position btree.Position, cache *btree.PositionCache, entryCallback func(position btree.Position, name string, dtType int, inodeId InodeId) (contnue bool)) (complete bool, err error)
+	OpenListing()
+	CloseListing()
 }
 
 type FileObjectLnk interface {
@@ -51,10 +69,19 @@ type FileObjectOther interface{ FileObject }
 type TreeFileManager struct {
 	blocks        blockfile.BlockAllocator
 	fileBlockTree btree.BTree
+	fileChunkTree btree.BTree
 	direntTree    btree.BTree
+	xattrTree     btree.BTree
+
+	// Positions of the entries of directories stored as a dirent tree.
+	direntPositions btree.PositionIndex
 
 	inodeMap InodeMap
 
+	// Set for managers of read only mounts. Files are read in place rather than
+	// being copied into writable blocks when opened.
+	readOnly bool
+
 	fileMapLock sync.Mutex
 	fileMap     map[InodeId]FileObject
 }
@@ -69,6 +96,18 @@ type TreeFileObject struct {
 	manager   *TreeFileManager
 
 	initialized bool
+
+	// Set once the last name of the file has been removed from its mount. The
+	// file is freed when its last reference is closed.
+	unlinked bool
+}
+
+// Tags the dirty blocks of a file that has no open file object. Blocks written
+// through a file object are moved to its inode's tag when the object is
+// released so a later sync of the file still writes them back.
+type inodeTag struct {
+	manager *TreeFileManager
+	inodeId InodeId
 }
 
 type TreeFileReg struct{
@@ -78,7 +117,16 @@ type TreeFileReg struct{
 	offsetLock      sync.RWMutex
 }
 
-type TreeFileDir struct{ TreeFileObject }
+type TreeFileDir struct {
+	TreeFileObject
+
+	// Number of open listings of the directory and the names of entries
+	// removed while any are open, by position. Listings resuming after a
+	// removed entry continue with the entries that sort after its name.
+	listingLock      sync.Mutex
+	listings         int
+	removedPositions map[btree.Position]string
+}
 type TreeFileOther struct{ TreeFileObject }
 
 func (tm *TreeFileManager) Init(blocks blockfile.BlockAllocator, inodeMap InodeMap) error {
@@ -87,10 +135,18 @@ func (tm *TreeFileManager) Init(blocks blockfile.BlockAllocator, inodeMap InodeM
 		MaxKeySize: 8,
 		EntrySize:  8,
 	}
+	tm.fileChunkTree = btree.BTree{
+		MaxKeySize: 8,
+		EntrySize:  12,
+	}
 	tm.direntTree = btree.BTree{
 		MaxKeySize: 255,
 		EntrySize:  9,
 	}
+	tm.xattrTree = btree.BTree{
+		MaxKeySize: 255,
+		EntrySize:  12,
+	}
 	tm.inodeMap = inodeMap
 	tm.fileMap = make(map[InodeId]FileObject)
 
@@ -98,33 +154,66 @@ func (tm *TreeFileManager) Init(blocks blockfile.BlockAllocator, inodeMap InodeM
 	if err != nil {
 		return err
 	}
-	return tm.direntTree.Open(blocks)
+	err = tm.fileChunkTree.Open(blocks)
+	if err != nil {
+		return err
+	}
+	err = tm.direntTree.Open(blocks)
+	if err != nil {
+		return err
+	}
+	err = tm.direntPositions.Open(blocks, tm.direntTree.MaxKeySize)
+	if err != nil {
+		return err
+	}
+	return tm.xattrTree.Open(blocks)
 }
 
-func (tm *TreeFileManager) NewFile(inodeData *InodeData) (FileObject, error) {
-	tf := TreeFileObject{
-		refCount:    1,
-		inodeData:   *inodeData,
-		manager:     tm,
-		initialized: true,
+// Creates an empty file object of the passed dt type for `inodeId`. The
+// returned object has not yet been initialized.
+func (tm *TreeFileManager) newFileObject(dtType int, inodeId InodeId) (FileObject, *TreeFileObject) {
+	switch dtType {
+	case unix.DT_REG:
+		tfi := &TreeFileReg{}
+		tfi.inodeId = inodeId
+		tfi.srcInodeId = inodeId
+		tfi.refCount = 1
+		tfi.manager = tm
+		return tfi, &tfi.TreeFileObject
+	case unix.DT_LNK:
+		tfi := &TreeFileLnk{}
+		tfi.inodeId = inodeId
+		tfi.srcInodeId = inodeId
+		tfi.refCount = 1
+		tfi.manager = tm
+		return tfi, &tfi.TreeFileObject
+	case unix.DT_DIR:
+		tfi := &TreeFileDir{}
+		tfi.inodeId = inodeId
+		tfi.srcInodeId = inodeId
+		tfi.refCount = 1
+		tfi.manager = tm
+		return tfi, &tfi.TreeFileObject
+	default:
+		tfi := &TreeFileOther{}
+		tfi.inodeId = inodeId
+		tfi.srcInodeId = inodeId
+		tfi.refCount = 1
+		tfi.manager = tm
+		return tfi, &tfi.TreeFileObject
 	}
+}
 
-	inodeId, err := tm.blocks.Allocate(tf)
+func (tm *TreeFileManager) NewFile(inodeData *InodeData) (FileObject, error) {
+	inodeId, err := tm.blocks.Allocate(nil)
 	if err != nil {
 		return nil, err
 	}
 
-	tf.inodeId = inodeId
-	tf.srcInodeId = inodeId
+	fo, tf := tm.newFileObject(int((inodeData.Mode&unix.S_IFMT)>>12), inodeId)
+	tf.inodeData = *inodeData
+	tf.initialized = true
 
-	var fo FileObject
-	if unix.S_ISREG(inodeData.Mode) || unix.S_ISLNK(inodeData.Mode) {
-		fo = &TreeFileReg{TreeFileObject: tf}
-	} else if unix.S_ISDIR(inodeData.Mode) {
-		fo = &TreeFileDir{TreeFileObject: tf}
-	} else {
-		fo = &TreeFileOther{TreeFileObject: tf}
-	}
 	if err := tm.blocks.WriteAt(tf, inodeId, 0, tf.inodeData.ToBytes()); err != nil {
 		tm.blocks.Free(inodeId)
 		return nil, err
@@ -143,32 +232,11 @@ func (tm *TreeFileManager) OpenFile(dtType int, inodeId InodeId) (FileObject, er
 	tm.fileMapLock.Lock()
 	fo, ok := tm.fileMap[inodeId]
 	if !ok {
-		tf = &TreeFileObject{
-			inodeId:    inodeId,
-			srcInodeId: inodeId,
-			refCount:   1,
-			manager:    tm,
-		}
-		if dtType == unix.DT_REG {
-			tfi := &TreeFileReg{TreeFileObject: *tf}
-			tf = &tfi.TreeFileObject
-			fo = tfi
-		} else if dtType == unix.DT_DIR {
-			tfi := &TreeFileDir{TreeFileObject: *tf}
-			tf = &tfi.TreeFileObject
-			fo = tfi
-		} else if dtType == unix.DT_LNK {
-			tfi := &TreeFileLnk{TreeFileObject: *tf}
-			tf = &tfi.TreeFileObject
-			fo = tfi
-		} else {
-			tfi := &TreeFileOther{TreeFileObject: *tf}
-			tf = &tfi.TreeFileObject
-			fo = tfi
-		}
+		fo, tf = tm.newFileObject(dtType, inodeId)
 		tm.fileMap[inodeId] = fo
 	} else {
 		fo.addRef()
+		tf = fo.getObject()
 	}
 	tm.fileMapLock.Unlock()
 
@@ -196,32 +264,11 @@ func (tm *TreeFileManager) OpenFile(dtType int, inodeId InodeId) (FileObject, er
 			panic("opening file with wrong type")
 		}
 
-		// Inode block and tree node block (if exists) need to be writable.
-		tf.inodeId, err = blockfile.Duplicate(tf, tm.blocks, inodeId, true)
-		if err != nil {
-			return nil, err
-		}
-		if tf.inodeId != inodeId {
-			err := tm.inodeMap.AddMapping(inodeId, tf.inodeId)
-			if err != nil {
-				return nil, err
-			}
-		}
-
-		if tf.inodeData.TreeNode != 0 {
-			newTreeNode, err := blockfile.Duplicate(tf, tm.blocks, tf.inodeData.TreeNode, true)
-			if err != nil {
+		tf.inodeId = inodeId
+		if !tm.readOnly {
+			if err := tf.makeWritable(); err != nil {
 				return nil, err
 			}
-			if newTreeNode != tf.inodeData.TreeNode {
-				tf.inodeData.TreeNode = newTreeNode
-
-				// Update indoe with changed tree node
-				copy(buf, tf.inodeData.ToBytes())
-				if err := tm.blocks.Write(tf, tf.inodeId, buf); err != nil {
-					return nil, err
-				}
-			}
 		}
 
 		tf.initialized = true
@@ -230,17 +277,180 @@ func (tm *TreeFileManager) OpenFile(dtType int, inodeId InodeId) (FileObject, er
 	return fo, nil
 }
 
-func (tf *TreeFileObject) Close() error {
-	tf.manager.fileMapLock.Lock()
-	defer tf.manager.fileMapLock.Unlock()
+// Copies the inode block and tree root blocks (if they exist) of the file into
+// writable blocks if they are read only. Must be called with tf.lock held.
+func (tf *TreeFileObject) makeWritable() error {
+	tm := tf.manager
 
-	tf.refCount--
-	if tf.refCount == 0 {
-		delete(tf.manager.fileMap, tf.srcInodeId)
+	inodeId, err := blockfile.Duplicate(tf, tm.blocks, tf.inodeId, true)
+	if err != nil {
+		return err
+	}
+	if inodeId != tf.inodeId {
+		if err := tm.inodeMap.AddMapping(tf.srcInodeId, inodeId); err != nil {
+			return err
+		}
+		tf.inodeId = inodeId
+	}
+
+	updated := false
+	for _, treeNode := range []*btree.TreeIndex{&tf.inodeData.TreeNode, &tf.inodeData.XattrNode} {
+		if *treeNode == 0 {
+			continue
+		}
+		newTreeNode, err := blockfile.Duplicate(tf, tm.blocks, *treeNode, true)
+		if err != nil {
+			return err
+		}
+		if newTreeNode != *treeNode {
+			*treeNode = newTreeNode
+			updated = true
+		}
+	}
+	if updated {
+		// Update inode with changed tree nodes
+		if err := tm.blocks.WriteAt(tf, tf.inodeId, 0, tf.inodeData.ToBytes()); err != nil {
+			return err
+		}
+	}
+
+	if tf.inodeData.Mode&unix.S_IFMT == unix.S_IFDIR && tf.inodeData.TreeNode != 0 {
+		// Directories stored as a tree keep the root of their position index
+		// following the inode.
+		buf, err := tm.blocks.ReadAt(tf.inodeId, INODE_SIZE, 8, nil)
+		if err != nil {
+			return err
+		}
+		positionRoot := btree.TreeIndex(bo.Uint64(buf))
+		newPositionRoot, err := blockfile.Duplicate(tf, tm.blocks, positionRoot, true)
+		if err != nil {
+			return err
+		}
+		if newPositionRoot != positionRoot {
+			bo.PutUint64(buf, uint64(newPositionRoot))
+			return tm.blocks.WriteAt(tf, tf.inodeId, INODE_SIZE, buf)
+		}
+	}
+	return nil
+}
+
+// Makes all open files writable again after the blocks they refer to have
+// been frozen into a read only layer.
+func (tm *TreeFileManager) reacquireOpenFiles() error {
+	tm.fileMapLock.Lock()
+	files := make([]*TreeFileObject, 0, len(tm.fileMap))
+	for _, fo := range tm.fileMap {
+		files = append(files, fo.getObject())
+	}
+	tm.fileMapLock.Unlock()
+
+	for _, tf := range files {
+		tf.lock.Lock()
+		var err error
+		if tf.initialized {
+			err = tf.makeWritable()
+		}
+		tf.lock.Unlock()
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// Returns true if any files of the manager are currently open.
+func (tm *TreeFileManager) hasOpenFiles() bool {
+	tm.fileMapLock.Lock()
+	defer tm.fileMapLock.Unlock()
+	return len(tm.fileMap) != 0
+}
+
+// Closes a reference to the file. Once the last reference to an unlinked file
+// is closed its blocks are freed.
+func (tf *TreeFileObject) Close() error {
+	tm := tf.manager
+	tm.fileMapLock.Lock()
+	tf.refCount--
+	if tf.refCount != 0 {
+		tm.fileMapLock.Unlock()
+		return nil
+	}
+	fo, ok := tm.fileMap[tf.srcInodeId]
+	delete(tm.fileMap, tf.srcInodeId)
+	tm.fileMapLock.Unlock()
+
+	if !ok || fo.getObject() != tf {
+		return nil
+	}
+	if err := tf.retagBlocks(fo); err != nil {
+		return err
+	}
+	return tm.freeUnlinked(fo)
+}
+
+// Marks the file as unlinked if its last link has been removed.
+func (tf *TreeFileObject) markUnlinked() {
+	tf.lock.Lock()
+	tf.unlinked = tf.inodeData.Nlink == 0
+	tf.lock.Unlock()
+}
+
+// Marks a newly created file that was never linked so that it is freed once
+// its last reference is closed.
+func (tf *TreeFileObject) markDiscarded() {
+	tf.lock.Lock()
+	tf.inodeData.Nlink = 0
+	tf.unlinked = true
+	tf.lock.Unlock()
+}
+
+// Frees the inode and all blocks of `fo` if it has been unlinked. Files stored
+// in read only layers are left in place; imported files may be shared between
+// several names without counting them as links.
+func (tm *TreeFileManager) freeUnlinked(fo FileObject) error {
+	tf := fo.getObject()
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+
+	if !tf.initialized || !tf.unlinked || tf.inodeData.Nlink != 0 || tm.readOnly || tm.blocks.IsBlockReadOnly(tf.srcInodeId) {
+		return nil
+	}
+
+	switch fo.(type) {
+	case *TreeFileReg:
+		if err := fo.(*TreeFileReg).freeData(); err != nil {
+			return err
+		}
+	case *TreeFileDir:
+		if err := fo.(*TreeFileDir).freeTree(); err != nil {
+			return err
+		}
+	case *TreeFileLnk:
+		if tf.inodeData.TreeNode != 0 {
+			if err := tm.releaseBlock(tf.inodeData.TreeNode); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tf.freeXattrs(); err != nil {
+		return err
+	}
+
+	tf.initialized = false
+	return tm.blocks.Free(tf.inodeId)
+}
+
+// Closes a reference to the open file `inodeId`.
+func (tm *TreeFileManager) releaseFile(inodeId InodeId) error {
+	tm.fileMapLock.Lock()
+	fo, ok := tm.fileMap[inodeId]
+	tm.fileMapLock.Unlock()
+	if !ok {
+		return errors.New("file is not open")
+	}
+	return fo.Close()
+}
+
 func (tf *TreeFileObject) GetInodeId() InodeId {
 	return tf.srcInodeId
 }
@@ -268,14 +478,74 @@ func (tf *TreeFileObject) UpdateInode(updateFunc func(*InodeData) error) error {
 	return nil
 }
 
+// Returns `nlink` adjusted by `delta`, stopping at zero.
+func addLinkCount(nlink uint32, delta int) uint32 {
+	if delta < 0 && uint32(-delta) > nlink {
+		return 0
+	}
+	return uint32(int64(nlink) + int64(delta))
+}
+
+// Adjusts the link count of `inodeId` by `delta`.
+func (tm *TreeFileManager) addLinks(dtType int, inodeId InodeId, delta int) error {
+	file, err := tm.OpenFile(dtType, inodeId)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.UpdateInode(func(inodeData *InodeData) error {
+		inodeData.Nlink = addLinkCount(inodeData.Nlink, delta)
+		return nil
+	})
+}
+
 func (tf *TreeFileObject) Sync() error {
 	return tf.manager.blocks.SyncTag(tf)
 }
 
+// Writes back the dirty blocks of the file. Blocks are tagged by either the
+// typed file `file` or its embedded file object depending on which wrote them,
+// or by the file's inode if they were written through an earlier file object.
+func (tf *TreeFileObject) syncTags(file interface{}) error {
+	if err := tf.manager.blocks.SyncTag(inodeTag{tf.manager, tf.srcInodeId}); err != nil {
+		return err
+	}
+	if err := tf.manager.blocks.SyncTag(file); err != nil {
+		return err
+	}
+	return tf.manager.blocks.SyncTag(tf)
+}
+
+// Moves the dirty blocks of the released file object to the tag of its inode.
+func (tf *TreeFileObject) retagBlocks(file interface{}) error {
+	tag := inodeTag{tf.manager, tf.srcInodeId}
+	if err := tf.manager.blocks.RetagBlocks(file, tag); err != nil {
+		return err
+	}
+	return tf.manager.blocks.RetagBlocks(tf, tag)
+}
+
+func (tf *TreeFileReg) Sync() error {
+	return tf.syncTags(tf)
+}
+
+func (tf *TreeFileDir) Sync() error {
+	return tf.syncTags(tf)
+}
+
+func (tf *TreeFileLnk) Sync() error {
+	return tf.syncTags(tf)
+}
+
 func (tf *TreeFileObject) addRef() {
 	tf.refCount++
 }
 
+func (tf *TreeFileObject) getObject() *TreeFileObject {
+	return tf
+}
+
 func (tf *TreeFileOther) cacheContentAddress(sc *StorageContext) ([]byte, error) {
 	// TODO
 	return nil, nil
@@ -1,14 +1,17 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/msg555/ctrfs/blockcache"
 	"github.com/msg555/ctrfs/blockfile"
+	"github.com/msg555/ctrfs/btree"
 	"github.com/msg555/ctrfs/unix"
 )
 
@@ -22,9 +25,12 @@ func blockFileCreate(cache *blockcache.BlockCache) (blockfile.BlockAllocator, er
 		f.Close()
 		return nil, err
 	}
+	// Use the same metadata size as storage contexts so test layers can be
+	// overlaid on their blocks.
 	bf := blockfile.BlockFile{
-		Cache: cache,
-		File:  f,
+		MetaDataSize: 36,
+		Cache:        cache,
+		File:         f,
 	}
 	bf.Init()
 	return &bf, nil
@@ -322,12 +328,103 @@ func TestRegTruncate(t *testing.T) {
 	}
 }
 
+// Truncation removes blocks by scanning the block tree from the new end of the
+// file, which requires block keys to sort numerically.
+func TestRegTruncateTree(t *testing.T) {
+	cache := blockcache.New(20, 4096)
+	bf, err := blockFileCreate(cache)
+	if err != nil {
+		t.Fatalf("unexpected error creating block file '%s'", err)
+	}
+	defer bf.Close()
+
+	tm := TreeFileManager{}
+	tm.Init(bf, &NullInodeMap{})
+
+	tfi, err := tm.NewFile(&InodeData{
+		Mode: unix.S_IFREG,
+	})
+	if err != nil {
+		t.Fatalf("error creating new file '%s'", err)
+	}
+	tf := tfi.(FileObjectReg)
+	defer tf.Close()
+
+	blockSize := bf.GetBlockSize()
+	numBlocks := 300
+	data := bytes.Repeat([]byte{0xAB}, numBlocks*blockSize)
+	if _, err := tf.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	keepBlocks := 10
+	for _, size := range []int{keepBlocks * blockSize, numBlocks * blockSize} {
+		err := tf.UpdateInode(func(inodeData *InodeData) error {
+			inodeData.Size = uint64(size)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := make([]byte, len(data))
+	copy(expected, data[:keepBlocks*blockSize])
+	checkRegContents(t, tf, expected)
+}
+
 type direntHolder struct {
 	DtType int
 	InodeId
 }
 
-func fuzzDir(t *testing.T, rng *rand.Rand, tf FileObjectDir, state map[string]direntHolder) {
+// Checks that the link counts of the inodes in `pool` and of `tf` match the
+// entries in `state`.
+func checkLinkCounts(t *testing.T, tf FileObjectDir, pool []direntHolder, state map[string]direntHolder) {
+	links := make(map[InodeId]uint32)
+	subdirs := uint32(0)
+	for _, entry := range state {
+		links[entry.InodeId]++
+		if entry.DtType == unix.DT_DIR {
+			subdirs++
+		}
+	}
+
+	for _, entry := range pool {
+		file, err := tf.getObject().manager.OpenFile(entry.DtType, entry.InodeId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nlink := file.GetInode().Nlink
+		file.Close()
+		if nlink != links[entry.InodeId] {
+			t.Fatalf("expected link count %d, found %d", links[entry.InodeId], nlink)
+		}
+	}
+	if nlink := tf.GetInode().Nlink; nlink != subdirs {
+		t.Fatalf("expected directory link count %d, found %d", subdirs, nlink)
+	}
+}
+
+// Creates files of various types to be linked into directories.
+func createLinkPool(t *testing.T, tm *TreeFileManager) []direntHolder {
+	var pool []direntHolder
+	for i := 0; i < 20; i++ {
+		mode := []uint32{unix.S_IFREG, unix.S_IFDIR, unix.S_IFLNK, unix.S_IFIFO}[i%4]
+		file, err := tm.NewFile(&InodeData{Mode: mode | 0644})
+		if err != nil {
+			t.Fatalf("error creating file '%s'", err)
+		}
+		pool = append(pool, direntHolder{
+			DtType:  int(mode >> 12),
+			InodeId: file.GetInodeId(),
+		})
+		file.Close()
+	}
+	return pool
+}
+
+func fuzzDir(t *testing.T, rng *rand.Rand, tf FileObjectDir, pool []direntHolder, state map[string]direntHolder) {
 	keyDomain := 100
 	for i := 0; i < 10000; i++ {
 		name := fmt.Sprintf("%d", rng.Int()%keyDomain)
@@ -356,16 +453,16 @@ func fuzzDir(t *testing.T, rng *rand.Rand, tf FileObjectDir, state map[string]di
 			}
 		case 1: // Link
 			overwrite := rng.Int()%2 == 0
-			dtType := 1 + rng.Int()%16
-			inodeId := rng.Int63()
-			if err := tf.Link(name, dtType, inodeId, overwrite); err != nil {
-				t.Fatalf("link failed '%s'", err)
-			}
-			if !ok || overwrite {
-				state[name] = direntHolder{
-					DtType:  dtType,
-					InodeId: inodeId,
+			entry := pool[rng.Int()%len(pool)]
+			err := tf.Link(name, entry.DtType, entry.InodeId, overwrite)
+			if ok && !overwrite {
+				if err != unix.EEXIST {
+					t.Fatalf("expected EEXIST linking existing entry, got '%v'", err)
 				}
+			} else if err != nil {
+				t.Fatalf("link failed '%s'", err)
+			} else {
+				state[name] = entry
 			}
 		case 2: // Unlink
 			removed, err := tf.Unlink(name)
@@ -405,6 +502,7 @@ func fuzzDir(t *testing.T, rng *rand.Rand, tf FileObjectDir, state map[string]di
 			if count != len(state) {
 				t.Fatal("scan did not find all elements")
 			}
+			checkLinkCounts(t, tf, pool, state)
 		}
 	}
 }
@@ -428,9 +526,10 @@ func TestDirFuzz(t *testing.T) {
 	}
 	tf1 := tfi1.(FileObjectDir)
 
+	pool := createLinkPool(t, &tm1)
 	rng := rand.New(rand.NewSource(555))
 	state := make(map[string]direntHolder)
-	fuzzDir(t, rng, tf1, state)
+	fuzzDir(t, rng, tf1, pool, state)
 
 	bf2, err := blockFileCreate(cache)
 	if err != nil {
@@ -457,7 +556,7 @@ func TestDirFuzz(t *testing.T) {
 	}
 	tf2 := tfi2.(FileObjectDir)
 
-	fuzzDir(t, rng, tf2, state)
+	fuzzDir(t, rng, tf2, pool, state)
 
 	err = tf2.Close()
 	if err != nil {
@@ -470,5 +569,908 @@ func TestDirFuzz(t *testing.T) {
 	}
 	tf2 = tfi2.(FileObjectDir)
 
-	fuzzDir(t, rng, tf2, state)
+	fuzzDir(t, rng, tf2, pool, state)
+}
+
+func TestDirScanFrom(t *testing.T) {
+	cache := blockcache.New(20, 4096)
+	bf, err := blockFileCreate(cache)
+	if err != nil {
+		t.Fatalf("unexpected error creating block file '%s'", err)
+	}
+	defer bf.Close()
+
+	tm := TreeFileManager{}
+	tm.Init(bf, &NullInodeMap{})
+
+	tfi, err := tm.NewFile(&InodeData{
+		Mode: unix.S_IFDIR,
+	})
+	if err != nil {
+		t.Fatalf("error creating new dir '%s'", err)
+	}
+	tf := tfi.(FileObjectDir)
+
+	file, err := tm.NewFile(&InodeData{
+		Mode: unix.S_IFREG,
+	})
+	if err != nil {
+		t.Fatalf("error creating new file '%s'", err)
+	}
+	defer file.Close()
+
+	// Names sharing a long common prefix used to collide as readdir offsets.
+	names := make(map[string]bool)
+	for i := 0; i < 500; i++ {
+		name := fmt.Sprintf("common-prefix-%04d", i)
+		if err := tf.Link(name, unix.DT_REG, file.GetInodeId(), false); err != nil {
+			t.Fatal(err)
+		}
+		names[name] = true
+	}
+
+	var positions btree.PositionCache
+	seen := make(map[string]bool)
+	position := btree.PositionStart
+	for batch := 0; ; batch++ {
+		count := 0
+		var lastName string
+		_, err := tf.ScanFrom(position, &positions, func(entryPosition btree.Position, name string, dtType int, inodeId InodeId) bool {
+			if count == 10 {
+				return false
+			}
+			if seen[name] {
+				t.Fatalf("entry %s listed twice", name)
+			}
+			seen[name] = true
+			position = entryPosition
+			lastName = name
+			count++
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count == 0 {
+			break
+		}
+
+		// Unlink the entry we will resume from and add a new entry.
+		if _, err := tf.Unlink(lastName); err != nil {
+			t.Fatal(err)
+		}
+		if err := tf.Link(fmt.Sprintf("added-%d", batch), unix.DT_REG, file.GetInodeId(), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name := range names {
+		if !seen[name] {
+			t.Fatalf("entry %s never listed", name)
+		}
+	}
+	if nlink := file.GetInode().Nlink; nlink != 500 {
+		t.Fatalf("expected link count 500, found %d", nlink)
+	}
+}
+
+func TestDirScanFromInline(t *testing.T) {
+	cache := blockcache.New(20, 4096)
+	bf, err := blockFileCreate(cache)
+	if err != nil {
+		t.Fatalf("unexpected error creating block file '%s'", err)
+	}
+	defer bf.Close()
+
+	tm := TreeFileManager{}
+	tm.Init(bf, &NullInodeMap{})
+
+	tfi, err := tm.NewFile(&InodeData{
+		Mode: unix.S_IFDIR,
+	})
+	if err != nil {
+		t.Fatalf("error creating new dir '%s'", err)
+	}
+	tf := tfi.(FileObjectDir)
+
+	file, err := tm.NewFile(&InodeData{
+		Mode: unix.S_IFREG,
+	})
+	if err != nil {
+		t.Fatalf("error creating new file '%s'", err)
+	}
+	defer file.Close()
+
+	for _, name := range []string{"d", "b", "e", "a", "c"} {
+		if err := tf.Link(name, unix.DT_REG, file.GetInodeId(), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tf.GetInode().TreeNode != 0 {
+		t.Fatal("expected small directory to be stored inline")
+	}
+
+	scanNames := func(position btree.Position, positionCache *btree.PositionCache) ([]string, []btree.Position) {
+		var names []string
+		var positions []btree.Position
+		_, err := tf.ScanFrom(position, positionCache, func(entryPosition btree.Position, name string, dtType int, inodeId InodeId) bool {
+			names = append(names, name)
+			positions = append(positions, entryPosition)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return names, positions
+	}
+
+	var positionCache btree.PositionCache
+	names, positions := scanNames(btree.PositionStart, &positionCache)
+	if strings.Join(names, ",") != "a,b,c,d,e" {
+		t.Fatalf("unexpected directory listing %v", names)
+	}
+
+	// Resume after "b" both while it exists and after it has been unlinked.
+	if names, _ := scanNames(positions[1], nil); strings.Join(names, ",") != "c,d,e" {
+		t.Fatalf("unexpected directory listing %v", names)
+	}
+	if _, err := tf.Unlink("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.ScanFrom(positions[1], nil, func(btree.Position, string, int, InodeId) bool { return true }); err != btree.ErrorPositionNotFound {
+		t.Fatalf("expected ErrorPositionNotFound, got '%v'", err)
+	}
+	if names, _ := scanNames(positions[1], &positionCache); strings.Join(names, ",") != "c,d,e" {
+		t.Fatalf("unexpected directory listing %v", names)
+	}
+
+	// Positions are stored with the entries so they do not change as entries
+	// are linked ahead of them, nor when the directory moves into a tree.
+	expected := make(map[string]btree.Position)
+	for i, name := range names {
+		if name != "b" {
+			expected[name] = positions[i]
+		}
+	}
+	checkPositions := func() {
+		found := 0
+		_, err := tf.ScanFrom(btree.PositionStart, nil, func(entryPosition btree.Position, name string, dtType int, inodeId InodeId) bool {
+			if pos, ok := expected[name]; ok {
+				if pos != entryPosition {
+					t.Fatalf("position of %s changed", name)
+				}
+				found++
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != len(expected) {
+			t.Fatalf("expected %d entries, found %d", len(expected), found)
+		}
+	}
+	for i := 0; tf.GetInode().TreeNode == 0; i++ {
+		if err := tf.Link(fmt.Sprintf("0-%03d", i), unix.DT_REG, file.GetInodeId(), false); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 0 {
+			checkPositions()
+		}
+	}
+	checkPositions()
+}
+
+// Resuming a listing after an entry removed between two batches continues
+// with the entries that follow its name, without relying on a position cache.
+func TestDirScanFromRemoved(t *testing.T) {
+	for _, count := range []int{5, 300} {
+		cache := blockcache.New(20, 4096)
+		bf, err := blockFileCreate(cache)
+		if err != nil {
+			t.Fatalf("unexpected error creating block file '%s'", err)
+		}
+		defer bf.Close()
+
+		tm := TreeFileManager{}
+		tm.Init(bf, &NullInodeMap{})
+
+		tfi, err := tm.NewFile(&InodeData{
+			Mode: unix.S_IFDIR,
+		})
+		if err != nil {
+			t.Fatalf("error creating new dir '%s'", err)
+		}
+		tf := tfi.(FileObjectDir)
+
+		file, err := tm.NewFile(&InodeData{
+			Mode: unix.S_IFREG,
+		})
+		if err != nil {
+			t.Fatalf("error creating new file '%s'", err)
+		}
+		defer file.Close()
+
+		for i := 0; i < count; i++ {
+			if err := tf.Link(fmt.Sprintf("%04d", i), unix.DT_REG, file.GetInodeId(), false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if inline := tf.GetInode().TreeNode == 0; inline != (count == 5) {
+			t.Fatalf("unexpected inline state %v for %d entries", inline, count)
+		}
+
+		// Lists up to `limit` entries after `position`.
+		scanNames := func(position btree.Position, limit int) ([]string, []btree.Position, error) {
+			var names []string
+			var positions []btree.Position
+			_, err := tf.ScanFrom(position, nil, func(entryPosition btree.Position, name string, dtType int, inodeId InodeId) bool {
+				if len(names) == limit {
+					return false
+				}
+				names = append(names, name)
+				positions = append(positions, entryPosition)
+				return true
+			})
+			return names, positions, err
+		}
+
+		tf.OpenListing()
+		names, positions, err := scanNames(btree.PositionStart, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(names, ",") != "0000,0001,0002" {
+			t.Fatalf("unexpected directory listing %v", names)
+		}
+
+		// Unlink the entry the next batch resumes after and rename the one
+		// before it.
+		if _, err := tf.Unlink("0002"); err != nil {
+			t.Fatal(err)
+		}
+		if err := tf.Rename("0001", "zzzz"); err != nil {
+			t.Fatal(err)
+		}
+		for i, expected := range []string{"0003", "0003"} {
+			names, _, err = scanNames(positions[i+1], 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != 1 || names[0] != expected {
+				t.Fatalf("expected listing to resume at %s, got %v", expected, names)
+			}
+		}
+
+		// Removed positions are forgotten once no listing is open.
+		tf.CloseListing()
+		if _, _, err := scanNames(positions[2], 1); err != btree.ErrorPositionNotFound {
+			t.Fatalf("expected ErrorPositionNotFound, got '%v'", err)
+		}
+	}
+}
+
+// Unlinking from an inline directory whose entries fill the inode block
+// exactly must not leave a stale copy of the last entry behind.
+func TestDirUnlinkFullInline(t *testing.T) {
+	cache := blockcache.New(20, 4096)
+	bf, err := blockFileCreate(cache)
+	if err != nil {
+		t.Fatalf("unexpected error creating block file '%s'", err)
+	}
+	defer bf.Close()
+
+	tm := TreeFileManager{}
+	tm.Init(bf, &NullInodeMap{})
+
+	tfi, err := tm.NewFile(&InodeData{
+		Mode: unix.S_IFDIR,
+	})
+	if err != nil {
+		t.Fatalf("error creating new dir '%s'", err)
+	}
+	tf := tfi.(FileObjectDir)
+
+	file, err := tm.NewFile(&InodeData{
+		Mode: unix.S_IFREG,
+	})
+	if err != nil {
+		t.Fatalf("error creating new file '%s'", err)
+	}
+	defer file.Close()
+
+	// Fill the inline area with equally sized entries so that the space freed
+	// by an unlink lines up exactly with the last entry.
+	avail := bf.GetBlockSize() - INODE_SIZE
+	entrySize := 255 + inlineDirentSize
+	for avail%entrySize != 0 {
+		entrySize--
+	}
+	var names []string
+	for i := 0; i < avail/entrySize; i++ {
+		names = append(names, fmt.Sprintf("%03d%s", i, strings.Repeat("x", entrySize-inlineDirentSize-3)))
+	}
+	for _, name := range names {
+		if err := tf.Link(name, unix.DT_REG, file.GetInodeId(), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tf.GetInode().TreeNode != 0 {
+		t.Fatal("expected full directory to be stored inline")
+	}
+
+	if _, err := tf.Unlink(names[0]); err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	if _, err := tf.Scan("", func(name string, dtType int, inodeId InodeId) bool {
+		listed = append(listed, name)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(listed, ",") != strings.Join(names[1:], ",") {
+		t.Fatalf("unexpected directory listing after unlink %v", listed)
+	}
+}
+
+func checkXattr(t *testing.T, file FileObject, name string, expected []byte) {
+	value, found, err := file.GetXattr(name)
+	if err != nil {
+		t.Fatalf("unexpected error getting xattr '%s'", err)
+	}
+	if expected == nil {
+		if found {
+			t.Fatalf("expected xattr %s to not exist", name)
+		}
+		return
+	}
+	if !found {
+		t.Fatalf("expected xattr %s to exist", name)
+	}
+	if !bytes.Equal(value, expected) {
+		t.Fatalf("unexpected value for xattr %s", name)
+	}
+}
+
+func TestXattr(t *testing.T) {
+	cache := blockcache.New(20, 4096)
+	bf, err := blockFileCreate(cache)
+	if err != nil {
+		t.Fatalf("unexpected error creating block file '%s'", err)
+	}
+	defer bf.Close()
+
+	tm := TreeFileManager{}
+	tm.Init(bf, &NullInodeMap{})
+
+	file, err := tm.NewFile(&InodeData{Mode: unix.S_IFREG})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf := file.(FileObjectReg)
+	fillPath(t, tf, 5*4096)
+	expected := make([]byte, 5*4096)
+	tf.ReadAt(expected, 0)
+
+	if err := tf.SetXattr("user.a", []byte("one"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.SetXattr("user.a", []byte("two"), unix.XATTR_CREATE); err != unix.EEXIST {
+		t.Fatalf("expected EEXIST, got '%v'", err)
+	}
+	if err := tf.SetXattr("user.b", []byte("two"), unix.XATTR_REPLACE); err != unix.ENODATA {
+		t.Fatalf("expected ENODATA, got '%v'", err)
+	}
+	if err := tf.SetXattr("user.b", nil, unix.XATTR_CREATE); err != nil {
+		t.Fatal(err)
+	}
+	if tf.GetInode().XattrInline == 0 || tf.GetInode().XattrNode != 0 {
+		t.Fatal("expected small xattrs to be stored inline")
+	}
+	checkXattr(t, tf, "user.a", []byte("one"))
+	checkXattr(t, tf, "user.b", []byte{})
+	checkXattr(t, tf, "user.c", nil)
+
+	// Growing the file's inline block map must not disturb inline xattrs.
+	fillPath(t, tf, 40*4096)
+	expected = make([]byte, 40*4096)
+	tf.ReadAt(expected, 0)
+	checkXattr(t, tf, "user.a", []byte("one"))
+
+	// Large values move all xattrs into a tree.
+	large := bytes.Repeat([]byte("x"), 3000)
+	if err := tf.SetXattr("user.c", large, 0); err != nil {
+		t.Fatal(err)
+	}
+	if tf.GetInode().XattrInline != 0 || tf.GetInode().XattrNode == 0 {
+		t.Fatal("expected large xattrs to be stored in a tree")
+	}
+	if err := tf.SetXattr("user.a", []byte("three"), unix.XATTR_REPLACE); err != nil {
+		t.Fatal(err)
+	}
+	checkXattr(t, tf, "user.a", []byte("three"))
+	checkXattr(t, tf, "user.b", []byte{})
+	checkXattr(t, tf, "user.c", large)
+	checkRegContents(t, tf, expected)
+
+	if err := tf.SetXattr("user.d", make([]byte, 4097), 0); err != unix.E2BIG {
+		t.Fatalf("expected E2BIG, got '%v'", err)
+	}
+
+	names, err := tf.ListXattrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(names) != "[user.a user.b user.c]" {
+		t.Fatalf("unexpected xattr names %v", names)
+	}
+
+	removed, err := tf.RemoveXattr("user.c")
+	if err != nil || !removed {
+		t.Fatalf("failed to remove xattr '%v'", err)
+	}
+	if removed, _ := tf.RemoveXattr("user.c"); removed {
+		t.Fatal("removed non-existant xattr")
+	}
+	checkXattr(t, tf, "user.c", nil)
+
+	// Directories that outgrow their inline entries move them into a tree
+	// without losing inline xattrs, and xattrs set on a full directory are
+	// moved into a tree instead.
+	for i, setFirst := range []bool{true, false} {
+		dirFile, err := tm.NewFile(&InodeData{Mode: unix.S_IFDIR})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := dirFile.(FileObjectDir)
+		if setFirst {
+			if err := dir.SetXattr("user.dir", []byte("value"), 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for j := 0; j < 500; j++ {
+			if err := dir.Link(fmt.Sprintf("entry-%d", j), unix.DT_REG, file.GetInodeId(), false); err != nil {
+				t.Fatal(err)
+			}
+			if j == 100 && !setFirst {
+				if err := dir.SetXattr("user.dir", []byte("value"), 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		checkXattr(t, dir, "user.dir", []byte("value"))
+
+		count := 0
+		if _, err := dir.Scan("", func(name string, dtType int, inodeId InodeId) bool {
+			count++
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if count != 500 {
+			t.Fatalf("case %d: expected 500 entries, found %d", i, count)
+		}
+		dir.Close()
+	}
+}
+
+func checkRegContents(t *testing.T, tf FileObjectReg, expected []byte) {
+	if tf.GetInode().Size != uint64(len(expected)) {
+		t.Fatalf("unexpected file size, wanted=%d got=%d", len(expected), tf.GetInode().Size)
+	}
+	buf := make([]byte, len(expected)+100)
+	n, err := tf.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(expected) {
+		t.Fatalf("read unexpected number of bytes, wanted=%d got=%d", len(expected), n)
+	}
+	if !bytes.Equal(buf[:n], expected) {
+		t.Fatal("unexpected data read")
+	}
+}
+
+func storageContextCreate(t *testing.T) *StorageContext {
+	tmpDir, err := ioutil.TempDir("", "ctrfs-test")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir '%s'", err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	sc, err := OpenStorageContext(tmpDir)
+	if err != nil {
+		t.Fatalf("unexpected error opening storage context '%s'", err)
+	}
+	t.Cleanup(func() {
+		sc.Close()
+	})
+	return sc
+}
+
+func TestChunkedReadWrite(t *testing.T) {
+	sc := storageContextCreate(t)
+	cache := sc.Cache
+	bf1 := sc.Blocks
+	tm1 := &sc.FileManager
+
+	tfi1, err := tm1.NewFile(&InodeData{
+		Mode:  unix.S_IFREG,
+		Flags: INODE_FLAG_CHUNKED,
+	})
+	if err != nil {
+		t.Fatalf("error creating new file '%s'", err)
+	}
+	tf1 := tfi1.(FileObjectReg)
+
+	rng := rand.New(rand.NewSource(555))
+	expected := make([]byte, 100000)
+	rng.Read(expected)
+
+	iw := importWriter{Storage: sc}
+	written, _, err := iw.importData(tf1.(*TreeFileReg), bytes.NewReader(expected))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(len(expected)) {
+		t.Fatal("imported unexpected number of bytes")
+	}
+	checkRegContents(t, tf1, expected)
+	if err := tf1.Close(); err != nil {
+		t.Fatal("error closing layer 1 file")
+	}
+
+	bf2, err := blockFileCreate(cache)
+	if err != nil {
+		t.Fatalf("unexpected error creating block file '%s'", err)
+	}
+	defer bf2.Close()
+
+	bfOverlay := &blockfile.BlockOverlayAllocator{}
+	bfOverlay.Init(bf1, bf2)
+	defer bfOverlay.Close()
+
+	imap := InodeTreeMap{}
+	err = imap.Init(bfOverlay, 0)
+	if err != nil {
+		t.Fatalf("unexpected error creating inode map '%s'", err)
+	}
+
+	tm2 := TreeFileManager{}
+	tm2.Init(bfOverlay, &imap)
+
+	tfi2, err := tm2.OpenFile(unix.DT_REG, tf1.GetInodeId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf2 := tfi2.(FileObjectReg)
+	checkRegContents(t, tf2, expected)
+
+	// Overwrite data spanning several chunks and extend past the end.
+	for _, off := range []int{5000, 40000, 99990} {
+		msg := make([]byte, 9000)
+		rng.Read(msg)
+		if _, err := tf2.WriteAt(msg, int64(off)); err != nil {
+			t.Fatal(err)
+		}
+		if off+len(msg) > len(expected) {
+			expected = append(expected, make([]byte, off+len(msg)-len(expected))...)
+		}
+		copy(expected[off:], msg)
+		checkRegContents(t, tf2, expected)
+	}
+
+	// Shrink to the middle of a chunk.
+	tf2.UpdateInode(func(inodeData *InodeData) error {
+		inodeData.Size = 54321
+		return nil
+	})
+	expected = expected[:54321]
+	checkRegContents(t, tf2, expected)
+
+	// Sparse extend and then write after the hole.
+	tf2.UpdateInode(func(inodeData *InodeData) error {
+		inodeData.Size = 70000
+		return nil
+	})
+	expected = append(expected, make([]byte, 70000-len(expected))...)
+	checkRegContents(t, tf2, expected)
+
+	msg := []byte("hello world")
+	if _, err := tf2.WriteAt(msg, 80000); err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, make([]byte, 80000-len(expected))...)
+	expected = append(expected, msg...)
+	checkRegContents(t, tf2, expected)
+
+	err = tf2.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tfi2, err = tm2.OpenFile(unix.DT_REG, tf1.GetInodeId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRegContents(t, tfi2.(FileObjectReg), expected)
+}
+
+func TestSparse(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		sc := storageContextCreate(t)
+		blockSize := int64(sc.Cache.BlockSize)
+
+		inodeData := &InodeData{Mode: unix.S_IFREG}
+		if chunked {
+			inodeData.Flags = INODE_FLAG_CHUNKED
+		}
+		tfi, err := sc.FileManager.NewFile(inodeData)
+		if err != nil {
+			t.Fatalf("error creating new file '%s'", err)
+		}
+		tf := tfi.(FileObjectReg)
+		defer tf.Close()
+
+		rng := rand.New(rand.NewSource(555))
+		expected := make([]byte, 40*blockSize)
+		rng.Read(expected[:3*blockSize])
+		rng.Read(expected[30*blockSize : 32*blockSize])
+		if _, err := tf.WriteAt(expected[:3*blockSize], 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tf.WriteAt(expected[30*blockSize:32*blockSize], 30*blockSize); err != nil {
+			t.Fatal(err)
+		}
+		if err := tf.UpdateInode(func(inodeData *InodeData) error {
+			inodeData.Size = uint64(len(expected))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		checkRegContents(t, tf, expected)
+
+		if off, err := tf.SeekHole(0); err != nil || off < 3*blockSize || off >= 30*blockSize {
+			t.Fatalf("unexpected hole offset %d '%v'", off, err)
+		}
+		if off, err := tf.SeekData(10 * blockSize); err != nil || off > 30*blockSize || off < 3*blockSize {
+			t.Fatalf("unexpected data offset %d '%v'", off, err)
+		}
+		if off, err := tf.SeekData(10); err != nil || off != 10 {
+			t.Fatalf("unexpected data offset %d '%v'", off, err)
+		}
+		if _, err := tf.SeekData(33 * blockSize); err != unix.ENXIO {
+			t.Fatalf("expected ENXIO seeking data past last extent, got '%v'", err)
+		}
+		if _, err := tf.SeekHole(int64(len(expected))); err != unix.ENXIO {
+			t.Fatalf("expected ENXIO seeking hole at end of file, got '%v'", err)
+		}
+
+		// Punching a hole releases the data and reads back as zeroes.
+		blocks := tf.GetInode().Blocks
+		if err := tf.Fallocate(unix.FALLOC_FL_PUNCH_HOLE, 0, blockSize); err != unix.EOPNOTSUPP {
+			t.Fatalf("expected EOPNOTSUPP punching hole without keep size, got '%v'", err)
+		}
+		if err := tf.Fallocate(unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, 100, 3*blockSize); err != nil {
+			t.Fatal(err)
+		}
+		copy(expected[100:3*blockSize], make([]byte, 3*blockSize-100))
+		checkRegContents(t, tf, expected)
+		if tf.GetInode().Blocks >= blocks {
+			t.Fatalf("expected punching a hole to release blocks, have %d", tf.GetInode().Blocks)
+		}
+
+		// Zeroing a range leaves it allocated.
+		if err := tf.Fallocate(unix.FALLOC_FL_ZERO_RANGE, 30*blockSize+5, 20); err != nil {
+			t.Fatal(err)
+		}
+		copy(expected[30*blockSize+5:], make([]byte, 20))
+		checkRegContents(t, tf, expected)
+		if off, err := tf.SeekData(30 * blockSize); err != nil || off != 30*blockSize {
+			t.Fatalf("unexpected data offset %d '%v'", off, err)
+		}
+
+		// Allocating past the end of the file extends it unless asked not to.
+		if err := tf.Fallocate(unix.FALLOC_FL_KEEP_SIZE, int64(len(expected)), blockSize); err != nil {
+			t.Fatal(err)
+		}
+		checkRegContents(t, tf, expected)
+		if err := tf.Fallocate(0, 38*blockSize, 4*blockSize); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, make([]byte, 2*blockSize)...)
+		checkRegContents(t, tf, expected)
+		if off, err := tf.SeekData(38 * blockSize); err != nil || off != 38*blockSize {
+			t.Fatalf("unexpected data offset %d '%v'", off, err)
+		}
+
+		// Truncating within a hole leaves the hole unallocated.
+		if err := tf.UpdateInode(func(inodeData *InodeData) error {
+			inodeData.Size = uint64(20*blockSize + 7)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		expected = expected[:20*blockSize+7]
+		checkRegContents(t, tf, expected)
+		if _, err := tf.SeekData(3 * blockSize); err != unix.ENXIO {
+			t.Fatalf("expected ENXIO seeking data in truncated hole, got '%v'", err)
+		}
+
+		// A chunk shortened by truncation only counts its remaining data.
+		if err := tf.UpdateInode(func(inodeData *InodeData) error {
+			inodeData.Size = 7
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		expectedAllocated := blockSize
+		if chunked {
+			expectedAllocated = 7
+		}
+		if allocated, err := tf.AllocatedBytes(); err != nil || allocated != expectedAllocated {
+			t.Fatalf("expected %d bytes allocated, got %d '%v'", expectedAllocated, allocated, err)
+		}
+	}
+}
+
+func importTestFile(t *testing.T, iw *importWriter, data []byte, chunked bool) InodeId {
+	inodeData := &InodeData{
+		Mode: unix.S_IFREG,
+		Size: uint64(len(data)),
+	}
+	if chunked {
+		inodeData.Flags |= INODE_FLAG_CHUNKED
+	}
+
+	inodeId, written, err := iw.importRegular(inodeData, nil, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("error importing file '%s'", err)
+	}
+	if written != int64(len(data)) {
+		t.Fatal("imported unexpected number of bytes")
+	}
+
+	tfi, err := iw.Storage.FileManager.OpenFile(unix.DT_REG, inodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tfi.Close()
+	checkRegContents(t, tfi.(FileObjectReg), data)
+	return inodeId
+}
+
+// Checks that `copyInodeId` is a distinct inode holding a copy of the stored
+// inode `inodeId`, sharing its block map and data blocks.
+func checkInodeCopy(t *testing.T, sc *StorageContext, inodeId, copyInodeId InodeId) {
+	if copyInodeId == inodeId {
+		t.Fatalf("expected duplicate of inode %d to have an inode of its own", inodeId)
+	}
+	orig, err := sc.Blocks.Read(inodeId, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup, err := sc.Blocks.Read(copyInodeId, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(orig, dup) {
+		t.Fatalf("expected inode %d to be a copy of inode %d", copyInodeId, inodeId)
+	}
+}
+
+func TestImportDedupe(t *testing.T) {
+	sc := storageContextCreate(t)
+	iw := importWriter{Storage: sc}
+
+	rng := rand.New(rand.NewSource(555))
+	data := make([]byte, 100000)
+	rng.Read(data)
+
+	importTestFile(t, &iw, data, false)
+	if iw.Stats.BytesStored != int64(len(data)) || iw.Stats.BytesDeduplicated != 0 {
+		t.Fatalf("unexpected stats for first import %+v", iw.Stats)
+	}
+
+	iw.Stats = ImportStats{}
+	importTestFile(t, &iw, data, false)
+	if iw.Stats.BytesStored != 0 || iw.Stats.BytesDeduplicated != int64(len(data)) {
+		t.Fatalf("unexpected stats for duplicate import %+v", iw.Stats)
+	}
+
+	// Changing a single byte should only require one new block.
+	iw.Stats = ImportStats{}
+	modified := append([]byte(nil), data...)
+	modified[50000]++
+	importTestFile(t, &iw, modified, false)
+	if iw.Stats.BytesStored != int64(sc.Cache.BlockSize) {
+		t.Fatalf("unexpected stats for modified import %+v", iw.Stats)
+	}
+
+	// Inserting a byte defeats fixed block dedupe but most chunks should still
+	// be shared.
+	iw.Stats = ImportStats{}
+	importTestFile(t, &iw, data, true)
+	shifted := append([]byte{0x55}, data...)
+	iw.Stats = ImportStats{}
+	importTestFile(t, &iw, shifted, true)
+	if iw.Stats.BytesDeduplicated < int64(len(data))*3/4 {
+		t.Fatalf("unexpected stats for shifted chunked import %+v", iw.Stats)
+	}
+}
+
+func TestImportWholeFileDedupe(t *testing.T) {
+	sc := storageContextCreate(t)
+	iw := importWriter{Storage: sc}
+
+	rng := rand.New(rand.NewSource(555))
+	data := make([]byte, 100000)
+	rng.Read(data)
+
+	inodeId := importTestFile(t, &iw, data, false)
+
+	// Streaming import of a duplicate should resolve to a copy of the existing
+	// inode.
+	iw.Stats = ImportStats{}
+	checkInodeCopy(t, sc, inodeId, importTestFile(t, &iw, data, false))
+	if iw.Stats.BytesStored != 0 || iw.Stats.BytesDeduplicated != int64(len(data)) {
+		t.Fatalf("unexpected stats for duplicate import %+v", iw.Stats)
+	}
+
+	// Looking up a duplicate up front should find it without writing anything.
+	iw.Stats = ImportStats{}
+	foundInodeId, err := iw.findRegular(&InodeData{
+		Mode: unix.S_IFREG,
+		Size: uint64(len(data)),
+	}, nil, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkInodeCopy(t, sc, inodeId, foundInodeId)
+	if iw.Stats.BytesDeduplicated != int64(len(data)) {
+		t.Fatalf("unexpected stats for duplicate lookup %+v", iw.Stats)
+	}
+
+	// Identical data with different metadata must not share an inode.
+	foundInodeId, err = iw.findRegular(&InodeData{
+		Mode: unix.S_IFREG | 0755,
+		Size: uint64(len(data)),
+	}, nil, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if foundInodeId != 0 {
+		t.Fatal("file with different mode matched existing inode")
+	}
+
+	// Extended attributes are part of a file's identity as well.
+	foundInodeId, err = iw.findRegular(&InodeData{
+		Mode: unix.S_IFREG,
+		Size: uint64(len(data)),
+	}, []xattrEntry{{Name: "user.a", Value: []byte("1")}}, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if foundInodeId != 0 {
+		t.Fatal("file with different extended attributes matched existing inode")
+	}
+
+	// A chunked import gets its own inode but the up front lookup must agree
+	// with the address computed while importing.
+	chunkedInodeId := importTestFile(t, &iw, data, true)
+	if chunkedInodeId == inodeId {
+		t.Fatal("chunked file unexpectedly shared fixed block inode")
+	}
+	foundInodeId, err = iw.findRegular(&InodeData{
+		Mode:  unix.S_IFREG,
+		Size:  uint64(len(data)),
+		Flags: INODE_FLAG_CHUNKED,
+	}, nil, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkInodeCopy(t, sc, chunkedInodeId, foundInodeId)
 }
@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"github.com/msg555/ctrfs/blockfile"
+	"github.com/msg555/ctrfs/btree"
+)
+
+/*
+Chunked files store their data as a sequence of variable sized chunks, each
+no larger than a block, rather than as fixed size blocks. This allows chunk
+boundaries to be chosen based on content so that similar files share most of
+their data blocks even when data has been inserted or removed.
+
+The chunk tree maps the exclusive end offset of each chunk to the data block
+holding the chunk and the length of the chunk. End offsets are encoded big
+endian so that keys sort numerically. Any part of a chunk's data block past
+the chunk length is kept zeroed. Ranges of the file not covered by a chunk
+are holes and read back as zeroes.
+
+Chunk Entry
+	key   - end     uint64 (big endian)
+	value - block   uint64
+	        length  uint32
+*/
+
+type fileChunk struct {
+	Start      int64
+	End        int64
+	BlockIndex blockfile.BlockIndex
+}
+
+func chunkKey(end int64) btree.KeyType {
+	return fileBlockKey(end)
+}
+
+func (tf *TreeFileReg) isChunked() bool {
+	return tf.inodeData.Flags&INODE_FLAG_CHUNKED != 0
+}
+
+func (tf *TreeFileReg) ensureChunkTree() error {
+	if tf.inodeData.TreeNode != 0 {
+		return nil
+	}
+
+	treeRoot, err := tf.manager.fileChunkTree.CreateEmpty(tf)
+	if err != nil {
+		return err
+	}
+	tf.inodeData.TreeNode = treeRoot
+	return tf.manager.blocks.WriteAt(tf, tf.inodeId, 0, tf.inodeData.ToBytes())
+}
+
+// Returns the first chunk that ends after `off` or nil if there is no such
+// chunk. Note that the returned chunk may start after `off` if `off` falls
+// within a hole.
+func (tf *TreeFileReg) findChunk(off int64) (*fileChunk, error) {
+	if tf.inodeData.TreeNode == 0 {
+		return nil, nil
+	}
+
+	key, val, _, err := tf.manager.fileChunkTree.LowerBound(tf.inodeData.TreeNode, chunkKey(off+1))
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, nil
+	}
+
+	end := int64(fileKeyOrder.Uint64(key))
+	return &fileChunk{
+		Start:      end - int64(bo.Uint32(val[8:])),
+		End:        end,
+		BlockIndex: blockfile.BlockIndex(bo.Uint64(val)),
+	}, nil
+}
+
+func (tf *TreeFileReg) putChunk(chunk *fileChunk, overwrite bool) error {
+	var val [12]byte
+	bo.PutUint64(val[:], uint64(chunk.BlockIndex))
+	bo.PutUint32(val[8:], uint32(chunk.End-chunk.Start))
+	return tf.manager.fileChunkTree.Insert(tf, tf.inodeData.TreeNode, chunkKey(chunk.End), val[:], overwrite)
+}
+
+// Copy on write the chunk's data block if coming from a read only or shared
+// block.
+func (tf *TreeFileReg) writableChunk(chunk *fileChunk) error {
+	dupBlockIndex, err := tf.manager.writableBlock(tf, chunk.BlockIndex)
+	if err != nil {
+		return err
+	}
+	if dupBlockIndex == chunk.BlockIndex {
+		return nil
+	}
+	chunk.BlockIndex = dupBlockIndex
+	return tf.putChunk(chunk, true)
+}
+
+// Creates or extends a chunk so that it covers `off`. `next` should be the
+// first chunk starting after `off`, if any.
+func (tf *TreeFileReg) allocateChunk(off int64, next *fileChunk) (*fileChunk, error) {
+	blockSize := int64(tf.manager.blocks.GetBlockSize())
+
+	limit := off + blockSize
+	if next != nil && next.Start < limit {
+		limit = next.Start
+	}
+
+	// Prefer to grow the preceding chunk if it has room to avoid creating lots
+	// of small chunks when appending to a file.
+	if off > 0 {
+		prev, err := tf.findChunk(off - 1)
+		if err != nil {
+			return nil, err
+		}
+		if prev != nil && prev.End == off && prev.End-prev.Start < blockSize {
+			if err := tf.writableChunk(prev); err != nil {
+				return nil, err
+			}
+			if err := tf.manager.fileChunkTree.Delete(tf, tf.inodeData.TreeNode, chunkKey(prev.End)); err != nil {
+				return nil, err
+			}
+
+			prev.End = prev.Start + blockSize
+			if limit < prev.End {
+				prev.End = limit
+			}
+			return prev, tf.putChunk(prev, false)
+		}
+	}
+
+	blockIndex, err := tf.manager.blocks.Allocate(tf)
+	if err != nil {
+		return nil, err
+	}
+
+	chunk := &fileChunk{
+		Start:      off,
+		End:        limit,
+		BlockIndex: blockIndex,
+	}
+	if err := tf.putChunk(chunk, false); err != nil {
+		return nil, err
+	}
+
+	tf.inodeData.Blocks++
+	return chunk, tf.manager.blocks.WriteAt(tf, tf.inodeId, 0, tf.inodeData.ToBytes())
+}
+
+func (tf *TreeFileReg) readChunked(p []byte, off int64) error {
+	for len(p) > 0 {
+		chunk, err := tf.findChunk(off)
+		if err != nil {
+			return err
+		}
+
+		n := int64(len(p))
+		if chunk == nil || off < chunk.Start {
+			// Offset is within a hole, treat as zeroes
+			if chunk != nil && chunk.Start-off < n {
+				n = chunk.Start - off
+			}
+			for i := int64(0); i < n; i++ {
+				p[i] = 0
+			}
+		} else {
+			if chunk.End-off < n {
+				n = chunk.End - off
+			}
+			_, err = tf.manager.blocks.ReadAt(chunk.BlockIndex, int(off-chunk.Start), int(n), p[:n])
+			if err != nil {
+				return err
+			}
+		}
+
+		p = p[n:]
+		off += n
+	}
+	return nil
+}
+
+func (tf *TreeFileReg) writeChunked(p []byte, off int64) (int, error) {
+	if err := tf.ensureChunkTree(); err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for written < len(p) {
+		chunk, err := tf.findChunk(off)
+		if err != nil {
+			return written, err
+		}
+
+		if chunk == nil || off < chunk.Start {
+			chunk, err = tf.allocateChunk(off, chunk)
+		} else {
+			err = tf.writableChunk(chunk)
+		}
+		if err != nil {
+			return written, err
+		}
+
+		n := int64(len(p) - written)
+		if chunk.End-off < n {
+			n = chunk.End - off
+		}
+		err = tf.manager.blocks.WriteAt(tf, chunk.BlockIndex, int(off-chunk.Start), p[written:written+int(n)])
+		if err != nil {
+			return written, err
+		}
+
+		written += int(n)
+		off += n
+	}
+	return written, nil
+}
+
+// Removes all chunk data past the current inode size.
+func (tf *TreeFileReg) truncateChunked() error {
+	size := int64(tf.inodeData.Size)
+	for {
+		chunk, err := tf.findChunk(size)
+		if err != nil {
+			return err
+		}
+		if chunk == nil {
+			return nil
+		}
+
+		oldKey := chunkKey(chunk.End)
+		if size <= chunk.Start {
+			err = tf.manager.fileChunkTree.Delete(tf, tf.inodeData.TreeNode, oldKey)
+			if err != nil {
+				return err
+			}
+			if err := tf.manager.releaseBlock(chunk.BlockIndex); err != nil {
+				return err
+			}
+			tf.inodeData.Blocks--
+			continue
+		}
+
+		// Chunk straddles the new size; zero the tail and shorten it. The
+		// shortened entry is written before the old one is removed so that an
+		// error part way through never drops the chunk's block from the tree.
+		dupBlockIndex, err := tf.manager.writableBlock(tf, chunk.BlockIndex)
+		if err != nil {
+			return err
+		}
+		chunk.BlockIndex = dupBlockIndex
+
+		zeroes := make([]byte, chunk.End-size)
+		err = tf.manager.blocks.WriteAt(tf, chunk.BlockIndex, int(size-chunk.Start), zeroes)
+		if err != nil {
+			return err
+		}
+
+		chunk.End = size
+		if err := tf.putChunk(chunk, true); err != nil {
+			return err
+		}
+		err = tf.manager.fileChunkTree.Delete(tf, tf.inodeData.TreeNode, oldKey)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (tf *TreeFileReg) hashChunks(sc *StorageContext, hsh *fileContentHasher) error {
+	if tf.inodeData.TreeNode == 0 {
+		return nil
+	}
+
+	var scanErr error
+	_, err := tf.manager.fileChunkTree.Scan(tf.inodeData.TreeNode, nil, func(_ btree.IndexType, key []byte, val []byte) bool {
+		bca, err := sc.cacheDataBlockContentAddress(blockfile.BlockIndex(bo.Uint64(val)))
+		if err != nil {
+			scanErr = err
+			return false
+		}
+		hsh.addChunk(int64(fileKeyOrder.Uint64(key)), int(bo.Uint32(val[8:])), bca)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return scanErr
+}
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"github.com/msg555/ctrfs/blockfile"
+	"github.com/msg555/ctrfs/unix"
+)
+
+/*
+Cloning file data shares data blocks between files instead of copying them.
+Data blocks in the writable layer count their additional references in the
+block metadata following the content address; a count of zero means the
+block is owned by a single file. Writing to a shared block copies it first
+and releasing a shared block only drops a reference. Blocks of read only
+layers are always copied on write so they are shared without counting
+references.
+
+Block Metadata
+	content address  [HASH_BYTE_LENGTH]byte
+	extra references uint32
+*/
+
+const blockRefCountOffset = HASH_BYTE_LENGTH
+
+// Returns true if the block allocator has room in its block metadata to count
+// references to shared blocks.
+func (tm *TreeFileManager) canShareBlocks() bool {
+	return tm.blocks.GetMetaDataSize() >= blockRefCountOffset+4
+}
+
+// Adds a reference to the data block `index`.
+func (tm *TreeFileManager) shareBlock(index blockfile.BlockIndex) error {
+	if tm.blocks.IsBlockReadOnly(index) {
+		return nil
+	}
+	return tm.blocks.AccessBlockMeta(index, func(meta []byte) (bool, error) {
+		bo.PutUint32(meta[blockRefCountOffset:], bo.Uint32(meta[blockRefCountOffset:])+1)
+		return true, nil
+	})
+}
+
+// Drops a reference to the data block `index`, freeing it if no references
+// remain.
+func (tm *TreeFileManager) releaseBlock(index blockfile.BlockIndex) error {
+	if tm.blocks.IsBlockReadOnly(index) {
+		return nil
+	}
+	if !tm.canShareBlocks() {
+		return tm.blocks.Free(index)
+	}
+	shared := false
+	err := tm.blocks.AccessBlockMeta(index, func(meta []byte) (bool, error) {
+		refs := bo.Uint32(meta[blockRefCountOffset:])
+		if refs == 0 {
+			return false, nil
+		}
+		bo.PutUint32(meta[blockRefCountOffset:], refs-1)
+		shared = true
+		return true, nil
+	})
+	if err != nil || shared {
+		return err
+	}
+	return tm.blocks.Free(index)
+}
+
+// Returns a data block with the contents of `index` that may be written to,
+// copying the block if it is read only or shared with other files.
+func (tm *TreeFileManager) writableBlock(tag interface{}, index blockfile.BlockIndex) (blockfile.BlockIndex, error) {
+	if tm.blocks.IsBlockReadOnly(index) {
+		return blockfile.Duplicate(tag, tm.blocks, index, false)
+	}
+	if !tm.canShareBlocks() {
+		return index, nil
+	}
+
+	shared := false
+	err := tm.blocks.AccessBlockMeta(index, func(meta []byte) (bool, error) {
+		shared = bo.Uint32(meta[blockRefCountOffset:]) != 0
+		return false, nil
+	})
+	if err != nil || !shared {
+		return index, err
+	}
+
+	dupIndex, err := blockfile.Duplicate(tag, tm.blocks, index, false)
+	if err != nil {
+		return 0, err
+	}
+	return dupIndex, tm.releaseBlock(index)
+}
+
+// Locks the destination and source files of a clone in a consistent order.
+// Returns a function that unlocks them.
+func lockClone(dst, src *TreeFileReg) func() {
+	if dst == src {
+		dst.lock.Lock()
+		return dst.lock.Unlock
+	}
+	if dst.inodeId < src.inodeId {
+		dst.lock.Lock()
+		src.lock.RLock()
+	} else {
+		src.lock.RLock()
+		dst.lock.Lock()
+	}
+	return func() {
+		src.lock.RUnlock()
+		dst.lock.Unlock()
+	}
+}
+
+// Makes the `length` bytes of the file at `dstOff` a copy of the data of `src`
+// at `srcOff` as with copy_file_range(2). Data blocks, or chunks of chunked
+// files, that line up between the two ranges are shared with `src` rather
+// than copied. The copy stops at the end of `src`. `src` may be the file
+// itself if the ranges do not overlap. Returns the number of bytes copied.
+func (tf *TreeFileReg) CloneRange(src FileObjectReg, srcOff, dstOff, length int64) (int64, error) {
+	srcFile, ok := src.(*TreeFileReg)
+	if !ok || srcOff < 0 || dstOff < 0 || length < 0 {
+		return 0, unix.EINVAL
+	}
+	if srcFile.manager != tf.manager {
+		return 0, unix.EXDEV
+	}
+
+	unlock := lockClone(tf, srcFile)
+	defer unlock()
+
+	srcSize := int64(srcFile.inodeData.Size)
+	if srcOff >= srcSize || length == 0 {
+		return 0, nil
+	}
+	if length > srcSize-srcOff {
+		length = srcSize - srcOff
+	}
+	if srcFile == tf && srcOff < dstOff+length && dstOff < srcOff+length {
+		return 0, unix.EINVAL
+	}
+
+	blockSize := int64(tf.manager.blocks.GetBlockSize())
+	var err error
+	switch {
+	case !tf.manager.canShareBlocks():
+		err = tf.copyRange(srcFile, srcOff, dstOff, length)
+	case tf.isChunked() && srcFile.isChunked():
+		err = tf.cloneChunks(srcFile, srcOff, dstOff, length)
+	case !tf.isChunked() && !srcFile.isChunked() && (dstOff-srcOff)%blockSize == 0:
+		err = tf.cloneBlocks(srcFile, srcOff, dstOff, length)
+	default:
+		err = tf.copyRange(srcFile, srcOff, dstOff, length)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if uint64(dstOff+length) > tf.inodeData.Size {
+		tf.inodeData.Size = uint64(dstOff + length)
+	}
+	return length, tf.manager.blocks.WriteAt(tf, tf.inodeId, 0, tf.inodeData.ToBytes())
+}
+
+// Copies data from `src` without sharing any data blocks. Must be called with
+// the locks of both files held.
+func (tf *TreeFileReg) copyRange(src *TreeFileReg, srcOff, dstOff, length int64) error {
+	buf := make([]byte, tf.manager.blocks.GetBlockSize())
+	for length > 0 {
+		n := int64(len(buf))
+		if length < n {
+			n = length
+		}
+		if _, err := src.readAt(buf[:n], srcOff); err != nil {
+			return err
+		}
+		if _, err := tf.writeAt(buf[:n], dstOff); err != nil {
+			return err
+		}
+		srcOff += n
+		dstOff += n
+		length -= n
+	}
+	return nil
+}
+
+// Clones a range between two block mode files whose offsets are equal modulo
+// the block size. Must be called with the locks of both files held.
+func (tf *TreeFileReg) cloneBlocks(src *TreeFileReg, srcOff, dstOff, length int64) error {
+	blockSize := int64(tf.manager.blocks.GetBlockSize())
+	for length > 0 {
+		n := blockSize - dstOff%blockSize
+		if length < n {
+			n = length
+		}
+
+		// The last block of `src` may be shared even though it is partial when
+		// it ends up as the last block of the file; the rest of the block is
+		// kept zeroed.
+		whole := n == blockSize || (dstOff%blockSize == 0 &&
+			srcOff+n == int64(src.inodeData.Size) && dstOff+n >= int64(tf.inodeData.Size))
+
+		var err error
+		if whole {
+			err = tf.cloneBlock(src, srcOff/blockSize, dstOff/blockSize)
+		} else {
+			err = tf.copyRange(src, srcOff, dstOff, n)
+		}
+		if err != nil {
+			return err
+		}
+
+		srcOff += n
+		dstOff += n
+		length -= n
+	}
+	return nil
+}
+
+// Replaces file block `dstBlock` with a shared reference to `srcBlock` of
+// `src`.
+func (tf *TreeFileReg) cloneBlock(src *TreeFileReg, srcBlock, dstBlock int64) error {
+	index, err := src.lookupBlock(srcBlock, false)
+	if err != nil {
+		return err
+	}
+	if err := tf.unmapBlocks(dstBlock, dstBlock+1); err != nil {
+		return err
+	}
+	if index == 0 {
+		return nil
+	}
+	if err := tf.manager.shareBlock(index); err != nil {
+		return err
+	}
+	return tf.mapBlock(dstBlock, index)
+}
+
+// Clones a range between two chunked files. Chunks lying entirely within the
+// source range are shared unless they would overlap a chunk of the file left
+// around the destination range. Must be called with the locks of both files held.
+func (tf *TreeFileReg) cloneChunks(src *TreeFileReg, srcOff, dstOff, length int64) error {
+	if err := tf.ensureChunkTree(); err != nil {
+		return err
+	}
+	if err := tf.punchChunks(dstOff, dstOff+length); err != nil {
+		return err
+	}
+
+	shift := dstOff - srcOff
+	srcEnd := srcOff + length
+	for pos := srcOff; pos < srcEnd; {
+		chunk, err := src.findChunk(pos)
+		if err != nil {
+			return err
+		}
+		if chunk == nil || chunk.Start >= srcEnd {
+			return nil
+		}
+
+		// The last chunk of `src` may extend past its end but the rest of the
+		// chunk is kept zeroed so it can still be shared.
+		shared := false
+		if srcOff <= chunk.Start && (chunk.End <= srcEnd || srcEnd == int64(src.inodeData.Size)) {
+			next, err := tf.findChunk(chunk.Start + shift)
+			if err != nil {
+				return err
+			}
+			if next == nil || next.Start >= chunk.End+shift {
+				if err := tf.manager.shareBlock(chunk.BlockIndex); err != nil {
+					return err
+				}
+				err := tf.putChunk(&fileChunk{
+					Start:      chunk.Start + shift,
+					End:        chunk.End + shift,
+					BlockIndex: chunk.BlockIndex,
+				}, false)
+				if err != nil {
+					return err
+				}
+				tf.inodeData.Blocks++
+				shared = true
+			}
+		}
+
+		if !shared {
+			start, end := chunk.Start, chunk.End
+			if start < pos {
+				start = pos
+			}
+			if end > srcEnd {
+				end = srcEnd
+			}
+			if err := tf.copyRange(src, start, start+shift, end-start); err != nil {
+				return err
+			}
+		}
+		pos = chunk.End
+	}
+	return nil
+}
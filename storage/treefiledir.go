@@ -1,34 +1,197 @@
 package storage
 
 import (
-	"strings"
+	"sort"
+
+	"github.com/go-errors/errors"
 
 	"github.com/msg555/ctrfs/btree"
+	"github.com/msg555/ctrfs/unix"
 )
 
-func (tf *TreeFileDir) convertToTreeFile() error {
-	treeRoot, err := tf.manager.direntTree.CreateEmpty(tf)
+/*
+Directories with few entries store them inline in the inode block following
+the inode, sorted by name. Each entry records the readdir position assigned to
+it when it was linked so that positions remain stable as other entries are
+added and removed, and are carried over when the directory outgrows the inode
+block and its entries move into a dirent tree.
+
+Inline Entry (sorted by name)
+	nameLen  uint8
+	name     [nameLen]byte
+	inodeId  uint64
+	dtType   uint8
+	position uint64
+
+Larger directories keep their entries in a dirent tree and the root of the
+tree's position index in the inode block following the inode.
+
+Tree Entry
+	key   - name
+	value - inodeId uint64
+	        dtType  uint8
+*/
+
+// Size of an inline directory entry excluding its name.
+const inlineDirentSize = 18
+
+// Directory entry used when populating a directory in bulk.
+type dirEntry struct {
+	Name    string
+	DtType  int
+	InodeId InodeId
+
+	// Readdir position of the entry, if assigned.
+	Position btree.Position
+}
+
+func sortDirEntries(entries []dirEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+}
+
+// Assigns readdir positions to `entries` in the order given.
+func assignDirPositions(entries []dirEntry) error {
+	names := make([]btree.KeyType, len(entries))
+	for i, entry := range entries {
+		names[i] = []byte(entry.Name)
+	}
+	positions, err := btree.AssignPositions(names)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		entries[i].Position = positions[i]
+	}
+	return nil
+}
+
+func readInlineDirents(data []byte) []dirEntry {
+	var entries []dirEntry
+	for pos := INODE_SIZE; pos < len(data); {
+		nameLen := int(data[pos])
+		if nameLen == 0 {
+			break
+		}
+		if pos+nameLen+inlineDirentSize > len(data) {
+			break
+		}
+
+		entry := data[pos+1+nameLen:]
+		entries = append(entries, dirEntry{
+			Name:     string(data[pos+1 : pos+1+nameLen]),
+			InodeId:  InodeId(bo.Uint64(entry)),
+			DtType:   int(entry[8]),
+			Position: btree.Position(bo.Uint64(entry[9:])),
+		})
+		pos += nameLen + inlineDirentSize
+	}
+	return entries
+}
+
+// Returns the space needed to store `entries` inline.
+func inlineDirentsSize(entries []dirEntry) int {
+	size := 0
+	for _, entry := range entries {
+		size += len(entry.Name) + inlineDirentSize
+	}
+	return size
+}
+
+// Stores `entries`, which must be sorted by name, inline in the inode block
+// `data` replacing any existing entries. Returns false without modifying
+// `data` if the entries do not fit.
+func writeInlineDirents(data []byte, entries []dirEntry) bool {
+	if INODE_SIZE+inlineDirentsSize(entries) > len(data) {
+		return false
+	}
+
+	pos := INODE_SIZE
+	for _, entry := range entries {
+		data[pos] = byte(len(entry.Name))
+		copy(data[pos+1:], entry.Name)
+		buf := data[pos+1+len(entry.Name):]
+		bo.PutUint64(buf, uint64(entry.InodeId))
+		buf[8] = byte(entry.DtType)
+		bo.PutUint64(buf[9:], uint64(entry.Position))
+		pos += len(entry.Name) + inlineDirentSize
+	}
+	for ; pos < len(data); pos++ {
+		data[pos] = 0
+	}
+	return true
+}
+
+// Writes a new dirent tree containing `entries`, which must be sorted by name
+// and have positions assigned, along with the index of their positions. The
+// root of the position index is stored in `data` following the inode.
+func (tf *TreeFileDir) buildTree(data []byte, entries []dirEntry) (btree.TreeIndex, error) {
+	names := make([]btree.KeyType, len(entries))
+	positions := make([]btree.Position, len(entries))
+	builder := tf.manager.direntTree.NewBuilder(tf)
+	for i, entry := range entries {
+		var val [9]byte
+		bo.PutUint64(val[:], uint64(entry.InodeId))
+		val[8] = byte(entry.DtType)
+		if err := builder.Add([]byte(entry.Name), val[:]); err != nil {
+			builder.Abort()
+			return 0, err
+		}
+		names[i] = []byte(entry.Name)
+		positions[i] = entry.Position
+	}
+	treeRoot, err := builder.Finish()
+	if err != nil {
+		return 0, err
+	}
+
+	positionRoot, err := tf.manager.direntPositions.BuildAssigned(tf, names, positions)
+	if err != nil {
+		tf.manager.direntTree.FreeTree(treeRoot, false)
+		return 0, err
+	}
+	bo.PutUint64(data[INODE_SIZE:], uint64(positionRoot))
+	return treeRoot, nil
+}
+
+// Returns the root of the position index of a directory stored as a tree.
+func (tf *TreeFileDir) positionRoot() (btree.TreeIndex, error) {
+	buf, err := tf.manager.blocks.ReadAt(tf.inodeId, INODE_SIZE, 8, nil)
 	if err != nil {
+		return 0, err
+	}
+	return btree.TreeIndex(bo.Uint64(buf)), nil
+}
+
+// Frees the dirent tree and position index of the directory, if any.
+func (tf *TreeFileDir) freeTree() error {
+	if tf.inodeData.TreeNode == 0 {
+		return nil
+	}
+	positionRoot, err := tf.positionRoot()
+	if err != nil {
+		return err
+	}
+	if err := tf.manager.direntPositions.FreeTree(positionRoot, true); err != nil {
 		return err
 	}
+	return tf.manager.direntTree.FreeTree(tf.inodeData.TreeNode, true)
+}
+
+// Moves the inline entries of the directory into a dirent tree keeping their
+// positions.
+func (tf *TreeFileDir) convertToTreeFile() error {
 	return tf.manager.blocks.AccessBlock(tf, tf.inodeId, func(data []byte) (bool, error) {
-		pos := INODE_SIZE
-		for pos < len(data) {
-			nameLen := int(data[pos])
-			if nameLen == 0 {
-				break
-			}
-			if pos+nameLen+10 > len(data) {
-				break
-			}
+		data = tf.inlineData(data)
+		entries := readInlineDirents(data)
 
-			entryName := data[pos+1 : pos+1+nameLen]
-			val := data[pos+1+nameLen : pos+10+nameLen]
-			err := tf.manager.direntTree.Insert(tf, treeRoot, entryName, val, false)
-			if err != nil {
-				return false, err
-			}
-			pos += 10 + nameLen
+		treeRoot, err := tf.buildTree(data, entries)
+		if err != nil {
+			return false, err
+		}
+		for i := INODE_SIZE + 8; i < len(data); i++ {
+			data[i] = 0
 		}
 		tf.inodeData.TreeNode = treeRoot
 		copy(data, tf.inodeData.ToBytes())
@@ -36,32 +199,72 @@ func (tf *TreeFileDir) convertToTreeFile() error {
 	})
 }
 
-func (tf *TreeFileDir) lookupInline(name string) (int, InodeId, error) {
-	var dtType int
-	var inodeId InodeId
-	err := tf.manager.blocks.AccessBlock(tf, tf.inodeId, func(data []byte) (bool, error) {
-		for pos := INODE_SIZE; pos < len(data); {
-			nameLen := int(data[pos])
-			if nameLen == 0 {
-				break
-			}
-			if pos+nameLen+10 > len(data) {
-				break
-			}
+// Populates an empty directory with `entries`, which must be sorted by name
+// and contain no duplicates. Entries are stored inline when they fit,
+// otherwise the dirent tree is bulk loaded. The directory's link count is set
+// from its subdirectories but, unlike Link(), the link counts of the entries
+// are left to the caller.
+func (tf *TreeFileDir) linkSorted(entries []dirEntry) error {
+	return tf.manager.blocks.AccessBlock(tf, tf.inodeId, func(data []byte) (bool, error) {
+		data = tf.inlineData(data)
+		if tf.inodeData.TreeNode != 0 || data[INODE_SIZE] != 0 {
+			return false, errors.New("directory is not empty")
+		}
 
-			entryName := string(data[pos+1 : pos+1+nameLen])
-			if name == entryName {
-				inodeId = InodeId(bo.Uint64(data[pos+1+nameLen:]))
-				dtType = int(data[pos+9+nameLen])
-				return false, nil
+		tf.inodeData.Nlink = 2
+		for _, entry := range entries {
+			if entry.DtType == unix.DT_DIR {
+				tf.inodeData.Nlink++
 			}
 		}
+		copy(data, tf.inodeData.ToBytes())
+
+		if err := assignDirPositions(entries); err != nil {
+			return false, err
+		}
+		if writeInlineDirents(data, entries) {
+			return true, nil
+		}
+
+		treeRoot, err := tf.buildTree(data, entries)
+		if err != nil {
+			return false, err
+		}
+		tf.inodeData.TreeNode = treeRoot
+		copy(data, tf.inodeData.ToBytes())
+		return true, nil
+	})
+}
+
+// Returns the inline entries of the directory, sorted by name.
+func (tf *TreeFileDir) inlineEntries() ([]dirEntry, error) {
+	var entries []dirEntry
+	err := tf.manager.blocks.AccessBlock(tf, tf.inodeId, func(data []byte) (bool, error) {
+		entries = readInlineDirents(tf.inlineData(data))
 		return false, nil
 	})
+	return entries, err
+}
+
+// Returns the index within `entries` of the entry `name` or where it would be
+// inserted, and whether it exists.
+func searchDirEntries(entries []dirEntry, name string) (int, bool) {
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].Name >= name
+	})
+	return i, i < len(entries) && entries[i].Name == name
+}
+
+func (tf *TreeFileDir) lookupInline(name string) (int, InodeId, error) {
+	entries, err := tf.inlineEntries()
 	if err != nil {
 		return 0, 0, err
 	}
-	return dtType, inodeId, err
+	i, found := searchDirEntries(entries, name)
+	if !found {
+		return 0, 0, nil
+	}
+	return entries[i].DtType, entries[i].InodeId, nil
 }
 
 func (tf *TreeFileDir) lookupTree(name string) (int, InodeId, error) {
@@ -82,51 +285,44 @@ func (tf *TreeFileDir) Lookup(name string) (int, InodeId, error) {
 	return tf.lookupTree(name)
 }
 
+// Links `name` into the inline entries of the directory, assigning it the
+// first free position near its preferred position. Returns false if the
+// entries would no longer fit inline.
 func (tf *TreeFileDir) linkInline(name string, dtType int, inodeId InodeId, overwrite bool) (bool, error) {
 	updated := false
 	err := tf.manager.blocks.AccessBlock(tf, tf.inodeId, func(data []byte) (bool, error) {
-		insertPos := 0
-		pos := INODE_SIZE
-		for pos < len(data) {
-			nameLen := int(data[pos])
-			if nameLen == 0 {
-				break
+		data = tf.inlineData(data)
+		entries := readInlineDirents(data)
+
+		i, found := searchDirEntries(entries, name)
+		if found {
+			if !overwrite {
+				return false, unix.EEXIST
 			}
-			if pos+nameLen+10 > len(data) {
-				break
+			entries[i].InodeId = inodeId
+			entries[i].DtType = dtType
+		} else {
+			used := make(map[btree.Position]bool, len(entries))
+			for _, entry := range entries {
+				used[entry.Position] = true
 			}
-
-			entryName := string(data[pos+1 : pos+1+nameLen])
-			cmp := strings.Compare(name, entryName)
-			if cmp < 0 {
-				insertPos = pos
-			} else if cmp == 0 {
-				bo.PutUint64(data[pos+1+nameLen:], uint64(inodeId))
-				data[pos+9+nameLen] = byte(dtType)
-
-				updated = true
-				return true, nil
+			position, err := btree.AssignPosition([]byte(name), used)
+			if err != nil {
+				return false, err
 			}
 
-			pos += nameLen + 10
-		}
-		if pos+10+len(name) > len(data) {
-			// No room for new entry
-			return false, nil
-		}
-		if insertPos == 0 {
-			// Element fits in at end of list
-			insertPos = pos
+			entries = append(entries, dirEntry{})
+			copy(entries[i+1:], entries[i:])
+			entries[i] = dirEntry{
+				Name:     name,
+				DtType:   dtType,
+				InodeId:  inodeId,
+				Position: position,
+			}
 		}
-		// Rotate elements toward the back
-		copy(data[insertPos+10+len(name):], data[insertPos:pos])
 
-		// Write new entry
-		data[insertPos] = byte(len(name))
-		copy(data[insertPos+1:], name)
-		bo.PutUint64(data[insertPos+1+len(name):], uint64(inodeId))
-		data[insertPos+9+len(name)] = byte(dtType)
-		return false, nil
+		updated = writeInlineDirents(data, entries)
+		return updated, nil
 	})
 	return updated, err
 }
@@ -136,13 +332,21 @@ func (tf *TreeFileDir) linkTree(name string, dtType int, inodeId InodeId, overwr
 	bo.PutUint64(entry[:], uint64(inodeId))
 	entry[8] = byte(dtType)
 	err := tf.manager.direntTree.Insert(tf, tf.inodeData.TreeNode, []byte(name), entry[:], overwrite)
-	if !overwrite && err == btree.ErrorKeyAlreadyExists {
-		return nil
+	if err == btree.ErrorKeyAlreadyExists {
+		return unix.EEXIST
+	} else if err != nil {
+		return err
 	}
+
+	positionRoot, err := tf.positionRoot()
+	if err != nil {
+		return err
+	}
+	_, err = tf.manager.direntPositions.Assign(tf, positionRoot, []byte(name))
 	return err
 }
 
-func (tf *TreeFileDir) Link(name string, dtType int, inodeId InodeId, overwrite bool) error {
+func (tf *TreeFileDir) linkEntry(name string, dtType int, inodeId InodeId, overwrite bool) error {
 	if tf.inodeData.TreeNode == 0 {
 		written, err := tf.linkInline(name, dtType, inodeId, overwrite)
 		if err != nil {
@@ -158,30 +362,129 @@ func (tf *TreeFileDir) Link(name string, dtType int, inodeId InodeId, overwrite
 	return tf.linkTree(name, dtType, inodeId, overwrite)
 }
 
+// Links `inodeId` into the directory as `name`. An existing entry is replaced
+// if `overwrite` is set, otherwise EEXIST is returned. Returns ENAMETOOLONG if
+// `name` is too long to store. The link counts of the linked inode, any
+// replaced inode and the directory itself are updated to match.
+func (tf *TreeFileDir) Link(name string, dtType int, inodeId InodeId, overwrite bool) error {
+	if len(name) > tf.manager.direntTree.MaxKeySize {
+		return unix.ENAMETOOLONG
+	}
+
+	oldDtType, oldInodeId, err := tf.Lookup(name)
+	if err != nil {
+		return err
+	}
+	if oldInodeId != 0 && !overwrite {
+		return unix.EEXIST
+	}
+	if oldInodeId == inodeId && oldDtType == dtType {
+		return nil
+	}
+
+	if err := tf.manager.addLinks(dtType, inodeId, 1); err != nil {
+		return err
+	}
+	if err := tf.linkEntry(name, dtType, inodeId, overwrite); err != nil {
+		tf.manager.addLinks(dtType, inodeId, -1)
+		return err
+	}
+
+	subdirs := 0
+	if dtType == unix.DT_DIR {
+		subdirs++
+	}
+	if oldInodeId != 0 {
+		if err := tf.manager.addLinks(oldDtType, oldInodeId, -1); err != nil {
+			return err
+		}
+		if oldDtType == unix.DT_DIR {
+			subdirs--
+		}
+	}
+	return tf.addSubdirs(subdirs)
+}
+
+// Adjusts the directory's link count for `delta` subdirectories being added
+// or removed.
+func (tf *TreeFileDir) addSubdirs(delta int) error {
+	if delta == 0 {
+		return nil
+	}
+	return tf.UpdateInode(func(inodeData *InodeData) error {
+		inodeData.Nlink = addLinkCount(inodeData.Nlink, delta)
+		return nil
+	})
+}
+
+// Marks the directory as being listed until CloseListing() is called. While
+// any listing is open the positions of removed entries are remembered so that
+// ScanFrom() can resume after them.
+func (tf *TreeFileDir) OpenListing() {
+	tf.listingLock.Lock()
+	defer tf.listingLock.Unlock()
+	tf.listings++
+}
+
+// Closes a listing opened with OpenListing().
+func (tf *TreeFileDir) CloseListing() {
+	tf.listingLock.Lock()
+	defer tf.listingLock.Unlock()
+	tf.listings--
+	if tf.listings == 0 {
+		tf.removedPositions = nil
+	}
+}
+
+// Remembers that the entry `name` at `position` was removed if the directory
+// is being listed.
+func (tf *TreeFileDir) removePosition(position btree.Position, name string) {
+	tf.listingLock.Lock()
+	defer tf.listingLock.Unlock()
+	if tf.listings == 0 {
+		return
+	}
+	if tf.removedPositions == nil {
+		tf.removedPositions = make(map[btree.Position]string)
+	}
+	tf.removedPositions[position] = name
+}
+
+// Returns the name of the removed entry that was at `position`, if it is
+// remembered.
+func (tf *TreeFileDir) removedName(position btree.Position) (string, bool) {
+	tf.listingLock.Lock()
+	defer tf.listingLock.Unlock()
+	name, ok := tf.removedPositions[position]
+	return name, ok
+}
+
+// Releases the position of the removed tree entry `name`.
+func (tf *TreeFileDir) releasePosition(positionRoot btree.TreeIndex, name string) error {
+	position, err := tf.manager.direntPositions.Position(positionRoot, []byte(name))
+	if err == btree.ErrorPositionNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	tf.removePosition(position, name)
+	return tf.manager.direntPositions.Release(tf, positionRoot, []byte(name))
+}
+
 func (tf *TreeFileDir) unlinkInline(name string) (bool, error) {
 	found := false
 	err := tf.manager.blocks.AccessBlock(tf, tf.inodeId, func(data []byte) (bool, error) {
-		pos := INODE_SIZE
-		for pos < len(data) {
-			nameLen := int(data[pos])
-			if nameLen == 0 {
-				break
-			}
-			if pos+nameLen+10 > len(data) {
-				break
-			}
+		data = tf.inlineData(data)
+		entries := readInlineDirents(data)
 
-			entryName := string(data[pos+1 : pos+1+nameLen])
-			if name == entryName {
-				// Rotate entry list forward
-				found = true
-				copy(data[pos:], data[pos+nameLen+10:])
-				return true, nil
-			}
-
-			pos += nameLen + 10
+		var i int
+		i, found = searchDirEntries(entries, name)
+		if !found {
+			return false, nil
 		}
-		return false, nil
+		tf.removePosition(entries[i].Position, name)
+		// Writing the remaining entries clears the space freed at the end.
+		return writeInlineDirents(data, append(entries[:i], entries[i+1:]...)), nil
 	})
 	return found, err
 }
@@ -193,47 +496,226 @@ func (tf *TreeFileDir) unlinkTree(name string) (bool, error) {
 	} else if err != nil {
 		return false, err
 	}
+
+	positionRoot, err := tf.positionRoot()
+	if err != nil {
+		return true, err
+	}
+	if err := tf.releasePosition(positionRoot, name); err != nil {
+		return true, err
+	}
 	return true, nil
 }
 
+// Removes the entry `name` from the directory updating the link counts of the
+// unlinked inode and the directory. Returns false if no such entry exists.
 func (tf *TreeFileDir) Unlink(name string) (bool, error) {
+	dtType, inodeId, err := tf.Lookup(name)
+	if err != nil || inodeId == 0 {
+		return false, err
+	}
+
+	var found bool
 	if tf.inodeData.TreeNode == 0 {
-		return tf.unlinkInline(name)
+		found, err = tf.unlinkInline(name)
+	} else {
+		found, err = tf.unlinkTree(name)
+	}
+	if err != nil || !found {
+		return found, err
+	}
+
+	if err := tf.manager.addLinks(dtType, inodeId, -1); err != nil {
+		return true, err
 	}
-	return tf.unlinkTree(name)
+	if dtType == unix.DT_DIR {
+		return true, tf.addSubdirs(-1)
+	}
+	return true, nil
 }
 
-func (tf *TreeFileDir) scanInline(startName string, entryCallback func(name string, dtType int, inodeId InodeId) bool) (bool, error) {
-	var complete bool
+// Renames the inline entry `oldName` to `newName`, replacing any entry
+// already named `newName`. Returns false if the entries would no longer fit
+// inline.
+func (tf *TreeFileDir) renameInline(oldName, newName string) (bool, error) {
+	updated := false
 	err := tf.manager.blocks.AccessBlock(tf, tf.inodeId, func(data []byte) (bool, error) {
-		started := false
-		for pos := INODE_SIZE; pos < len(data); {
-			nameLen := int(data[pos])
-			if nameLen == 0 {
-				break
-			}
-			if pos+nameLen+10 > len(data) {
-				break
-			}
+		data = tf.inlineData(data)
+		entries := readInlineDirents(data)
+
+		i, found := searchDirEntries(entries, oldName)
+		if !found {
+			return false, unix.ENOENT
+		}
+		entry := entries[i]
+
+		// The old name keeps its position reserved until it is removed so that
+		// the new name cannot take it over.
+		used := make(map[btree.Position]bool, len(entries))
+		for _, other := range entries {
+			used[other.Position] = true
+		}
+		entries = append(entries[:i], entries[i+1:]...)
 
-			entryName := string(data[pos+1 : pos+1+nameLen])
-			if !started {
-				started = startName <= entryName
+		j, found := searchDirEntries(entries, newName)
+		if found {
+			entries[j].DtType = entry.DtType
+			entries[j].InodeId = entry.InodeId
+		} else {
+			position, err := btree.AssignPosition([]byte(newName), used)
+			if err != nil {
+				return false, err
 			}
-			if started {
-				ctn := entryCallback(entryName, int(data[pos+9+nameLen]), InodeId(bo.Uint64(data[pos+1+nameLen:])))
-				if !ctn {
-					break
-				}
+			entries = append(entries, dirEntry{})
+			copy(entries[j+1:], entries[j:])
+			entries[j] = dirEntry{
+				Name:     newName,
+				DtType:   entry.DtType,
+				InodeId:  entry.InodeId,
+				Position: position,
 			}
 		}
-		complete = true
-		return false, nil
+
+		updated = writeInlineDirents(data, entries)
+		if updated {
+			tf.removePosition(entry.Position, oldName)
+		}
+		return updated, nil
 	})
+	return updated, err
+}
+
+// Renames the entry `oldName` of a directory stored as a tree to `newName`.
+// Both dirent tree changes are made in a single transaction so the entry is
+// never visible under both or neither name. The new name's position is
+// assigned before the transaction is published and released again if
+// publishing fails. The old name's position is only released once the rename
+// has taken effect.
+func (tf *TreeFileDir) renameTree(oldName, newName string) error {
+	tr := &tf.manager.direntTree
+	tx := tr.Begin(tf, tf.inodeData.TreeNode)
+
+	val, err := tx.Find([]byte(oldName))
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		return unix.ENOENT
+	}
+	newVal, err := tx.Find([]byte(newName))
+	if err != nil {
+		return err
+	}
+	if err := tx.Delete([]byte(oldName)); err != nil {
+		return err
+	}
+	if err := tx.Insert([]byte(newName), val, true); err != nil {
+		return err
+	}
+
+	positionRoot, err := tf.positionRoot()
+	if err != nil {
+		return err
+	}
+	if _, err := tf.manager.direntPositions.Assign(tf, positionRoot, []byte(newName)); err != nil {
+		return err
+	}
+	releaseNew := func() {
+		if newVal == nil {
+			tf.manager.direntPositions.Release(tf, positionRoot, []byte(newName))
+		}
+	}
+
+	treeRoot, err := tx.Commit()
+	if err != nil {
+		releaseNew()
+		return err
+	}
+	if err := tf.UpdateInode(func(inodeData *InodeData) error {
+		inodeData.TreeNode = treeRoot
+		return nil
+	}); err != nil {
+		tx.Rollback()
+		releaseNew()
+		return err
+	}
+	if err := tx.FreeSuperseded(); err != nil {
+		return err
+	}
+	return tf.releasePosition(positionRoot, oldName)
+}
+
+// Renames the entry `oldName` to `newName` replacing any existing entry named
+// `newName`, whose inode loses a link. Nothing is done if both names already
+// refer to the same inode. Returns ENOENT if `oldName` does not
+// exist and ENAMETOOLONG if `newName` is too long to store.
+func (tf *TreeFileDir) Rename(oldName, newName string) error {
+	if len(newName) > tf.manager.direntTree.MaxKeySize {
+		return unix.ENAMETOOLONG
+	}
+
+	dtType, inodeId, err := tf.Lookup(oldName)
+	if err != nil {
+		return err
+	}
+	if inodeId == 0 {
+		return unix.ENOENT
+	}
+	oldDtType, oldInodeId, err := tf.Lookup(newName)
+	if err != nil {
+		return err
+	}
+	if oldInodeId == inodeId {
+		// Both names already refer to the same inode.
+		return nil
+	}
+
+	renamed := false
+	if tf.inodeData.TreeNode == 0 {
+		renamed, err = tf.renameInline(oldName, newName)
+		if err != nil {
+			return err
+		}
+		if !renamed {
+			if err := tf.convertToTreeFile(); err != nil {
+				return err
+			}
+		}
+	}
+	if !renamed {
+		if err := tf.renameTree(oldName, newName); err != nil {
+			return err
+		}
+	}
+
+	if oldInodeId == 0 {
+		return nil
+	}
+	if err := tf.manager.addLinks(oldDtType, oldInodeId, -1); err != nil {
+		return err
+	}
+	subdirs := 0
+	if dtType == unix.DT_DIR {
+		subdirs++
+	}
+	if oldDtType == unix.DT_DIR {
+		subdirs--
+	}
+	return tf.addSubdirs(subdirs)
+}
+
+func (tf *TreeFileDir) scanInline(startName string, entryCallback func(name string, dtType int, inodeId InodeId) bool) (bool, error) {
+	entries, err := tf.inlineEntries()
 	if err != nil {
 		return false, err
 	}
-	return complete, nil
+	start, _ := searchDirEntries(entries, startName)
+	for _, entry := range entries[start:] {
+		if !entryCallback(entry.Name, entry.DtType, entry.InodeId) {
+			return false, nil
+		}
+	}
+	return true, nil
 }
 
 func (tf *TreeFileDir) scanTree(startName string, entryCallback func(name string, dtType int, inodeId InodeId) bool) (bool, error) {
@@ -249,6 +731,108 @@ func (tf *TreeFileDir) Scan(startName string, entryCallback func(name string, dt
 	return tf.scanTree(startName, entryCallback)
 }
 
+// Scans the directory entries that sort after the entry at `position`. Pass
+// btree.PositionStart to scan from the first entry. Positions are stable
+// across modifications to the directory. Positions of entries that have since
+// been unlinked are resolved through `cache`, if non-nil, or while a listing
+// opened before the unlink remains open; otherwise ErrorPositionNotFound is
+// returned.
+func (tf *TreeFileDir) ScanFrom(position btree.Position, cache *btree.PositionCache, entryCallback func(position btree.Position, name string, dtType int, inodeId InodeId) bool) (bool, error) {
+	if tf.inodeData.TreeNode != 0 {
+		return tf.scanTreeFrom(position, cache, entryCallback)
+	}
+	return tf.scanInlineFrom(position, cache, entryCallback)
+}
+
+func (tf *TreeFileDir) scanTreeFrom(position btree.Position, cache *btree.PositionCache, entryCallback func(position btree.Position, name string, dtType int, inodeId InodeId) bool) (bool, error) {
+	positionRoot, err := tf.positionRoot()
+	if err != nil {
+		return false, err
+	}
+
+	var startName btree.KeyType
+	if position != btree.PositionStart {
+		name, ok := btree.KeyType(nil), false
+		if cache != nil {
+			name, ok = cache.Lookup(position)
+		}
+		if !ok {
+			name, err = tf.manager.direntPositions.Key(positionRoot, position)
+			if err == btree.ErrorPositionNotFound {
+				removed, found := tf.removedName(position)
+				if !found {
+					return false, err
+				}
+				name = []byte(removed)
+			} else if err != nil {
+				return false, err
+			}
+		}
+		startName = btree.KeySuccessor(name)
+	}
+
+	c := tf.manager.direntTree.Range(tf.inodeData.TreeNode, startName, nil, false)
+	defer c.Close()
+
+	for c.Next() {
+		entryPosition, err := tf.manager.direntPositions.Position(positionRoot, c.Key())
+		if err != nil {
+			return false, err
+		}
+		if cache != nil {
+			cache.Add(entryPosition, c.Key())
+		}
+		val := c.Value()
+		if !entryCallback(entryPosition, string(c.Key()), int(val[8]), InodeId(bo.Uint64(val))) {
+			return false, nil
+		}
+	}
+	if err := c.Err(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (tf *TreeFileDir) scanInlineFrom(position btree.Position, cache *btree.PositionCache, entryCallback func(position btree.Position, name string, dtType int, inodeId InodeId) bool) (bool, error) {
+	entries, err := tf.inlineEntries()
+	if err != nil {
+		return false, err
+	}
+
+	start := 0
+	if position != btree.PositionStart {
+		name, ok := btree.KeyType(nil), false
+		if cache != nil {
+			name, ok = cache.Lookup(position)
+		}
+		for i := 0; !ok && i < len(entries); i++ {
+			if entries[i].Position == position {
+				name, ok = []byte(entries[i].Name), true
+			}
+		}
+		if !ok {
+			removed, found := tf.removedName(position)
+			if !found {
+				return false, btree.ErrorPositionNotFound
+			}
+			name = []byte(removed)
+		}
+		start = sort.Search(len(entries), func(i int) bool {
+			return entries[i].Name > string(name)
+		})
+	}
+
+	for _, entry := range entries[start:] {
+		if cache != nil {
+			cache.Add(entry.Position, []byte(entry.Name))
+		}
+		if !entryCallback(entry.Position, entry.Name, entry.DtType, entry.InodeId) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
 func (tf *TreeFileDir) cacheContentAddress(sc* StorageContext) ([]byte, error) {
 	// TODO
 	return nil, nil
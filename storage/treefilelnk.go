@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"github.com/go-errors/errors"
+
+	"github.com/msg555/ctrfs/blockfile"
+	"github.com/msg555/ctrfs/unix"
+)
+
+/*
+Symlink targets are stored inline in the inode block directly after the inode
+when they fit alongside the file's inline extended attributes. Otherwise the
+target is stored in a data block referenced by TreeNode. The size of a symlink
+is the length of its target and targets may be no longer than a block.
+*/
+
+type TreeFileLnk struct {
+	TreeFileObject
+
+	// Target of the symlink, once it has been read.
+	target       string
+	targetCached bool
+}
+
+// Reads the target of the symlink described by `inodeData` whose inode is
+// stored in block `inodeIndex`.
+func readLinkTarget(blocks blockfile.BlockAllocator, inodeIndex blockfile.BlockIndex, inodeData *InodeData) (string, error) {
+	index, off := inodeIndex, INODE_SIZE
+	if inodeData.TreeNode != 0 {
+		index, off = blockfile.BlockIndex(inodeData.TreeNode), 0
+	}
+	size := int(inodeData.Size)
+	if off+size > blocks.GetBlockSize() {
+		return "", errors.New("symlink target too long")
+	}
+	buf, err := blocks.ReadAt(index, off, size, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// Returns the target of the symlink. The target is kept with the file object
+// once it has been read.
+func (tf *TreeFileLnk) ReadLink() (string, error) {
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+
+	if !tf.targetCached {
+		target, err := readLinkTarget(tf.manager.blocks, tf.inodeId, &tf.inodeData)
+		if err != nil {
+			return "", err
+		}
+		tf.target = target
+		tf.targetCached = true
+	}
+	return tf.target, nil
+}
+
+// Sets the target of a newly created symlink. Returns ENOENT if `target` is
+// empty and ENAMETOOLONG if it is longer than a block.
+func (tf *TreeFileLnk) setTarget(target string) error {
+	if len(target) == 0 {
+		return unix.ENOENT
+	}
+	if len(target) > tf.manager.blocks.GetBlockSize() {
+		return unix.ENAMETOOLONG
+	}
+
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+
+	if tf.inodeData.Size != 0 {
+		return errors.New("symlink target already set")
+	}
+
+	inline := false
+	err := tf.manager.blocks.AccessBlock(tf, tf.inodeId, func(data []byte) (bool, error) {
+		if INODE_SIZE+len(target) > len(tf.inlineData(data)) {
+			return false, nil
+		}
+		copy(data[INODE_SIZE:], target)
+		tf.inodeData.Size = uint64(len(target))
+		copy(data, tf.inodeData.ToBytes())
+		inline = true
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !inline {
+		blockIndex, err := tf.manager.blocks.Allocate(tf)
+		if err != nil {
+			return err
+		}
+		if err := tf.manager.blocks.WriteAt(tf, blockIndex, 0, []byte(target)); err != nil {
+			tf.manager.blocks.Free(blockIndex)
+			return err
+		}
+
+		tf.inodeData.TreeNode = blockIndex
+		tf.inodeData.Blocks = 1
+		tf.inodeData.Size = uint64(len(target))
+		if err := tf.manager.blocks.WriteAt(tf, tf.inodeId, 0, tf.inodeData.ToBytes()); err != nil {
+			return err
+		}
+	}
+
+	tf.target = target
+	tf.targetCached = true
+	return nil
+}
+
+func (tf *TreeFileLnk) cacheContentAddress(sc *StorageContext) ([]byte, error) {
+	// TODO
+	return nil, nil
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"github.com/go-errors/errors"
+
+	"github.com/msg555/ctrfs/blockfile"
+	"github.com/msg555/ctrfs/btree"
+)
+
+/*
+Loads the contents of a newly created regular file whose data blocks are
+already stored, as happens during import. Blocks and chunks are appended in
+increasing offset order so rather than inserting each entry into the file's
+tree, entries are streamed into a btree.Builder and the tree is written once
+when the load finishes.
+
+Block files keep their block list inline until it no longer fits, at which
+point the inline entries seed the builder. Chunked files always load into a
+builder. The inode's tree node and block count are only updated by finish so
+an abandoned load leaves the file as it was before the builder started.
+*/
+type fileLoader struct {
+	tf      *TreeFileReg
+	builder *btree.Builder
+
+	// Number of blocks added to the builder that are not yet counted by the
+	// inode.
+	blocks uint64
+}
+
+func (tf *TreeFileReg) newLoader() *fileLoader {
+	return &fileLoader{tf: tf}
+}
+
+// Starts building the file's tree, seeding it with any inline block entries.
+func (fl *fileLoader) startBuilder() error {
+	tf := fl.tf
+	if tf.isChunked() {
+		fl.builder = tf.manager.fileChunkTree.NewBuilder(tf)
+		return nil
+	}
+
+	fl.builder = tf.manager.fileBlockTree.NewBuilder(tf)
+	return tf.manager.blocks.AccessBlock(tf, tf.inodeId, func(data []byte) (bool, error) {
+		for i := 0; i < int(tf.inodeData.Blocks); i++ {
+			entry := data[INODE_SIZE+i*16:]
+			key := fileBlockKey(int64(bo.Uint64(entry)))
+			if err := fl.builder.Add(key, entry[8:16]); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	})
+}
+
+func (fl *fileLoader) add(key btree.KeyType, val btree.ValueType) error {
+	if fl.builder == nil {
+		if err := fl.startBuilder(); err != nil {
+			return err
+		}
+	}
+	if err := fl.builder.Add(key, val); err != nil {
+		return err
+	}
+	fl.blocks++
+	return nil
+}
+
+// Appends `length` bytes held in the existing data block `index` to the end of
+// the file. The file size must be block aligned.
+func (fl *fileLoader) appendBlock(index blockfile.BlockIndex, length int) error {
+	tf := fl.tf
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+
+	blockSize := uint64(tf.manager.blocks.GetBlockSize())
+	if tf.inodeData.Size%blockSize != 0 {
+		return errors.New("file size not block aligned")
+	}
+	block := int64(tf.inodeData.Size / blockSize)
+
+	mapped := false
+	if fl.builder == nil {
+		var err error
+		mapped, err = tf.mapBlockInline(block, index)
+		if err != nil {
+			return err
+		}
+	}
+	if !mapped {
+		var val [8]byte
+		bo.PutUint64(val[:], uint64(index))
+		if err := fl.add(fileBlockKey(block), val[:]); err != nil {
+			return err
+		}
+	}
+
+	tf.inodeData.Size += uint64(length)
+	return nil
+}
+
+// Appends a chunk of `length` bytes held in the existing data block `index`
+// to the end of the file.
+func (fl *fileLoader) appendChunk(index blockfile.BlockIndex, length int) error {
+	tf := fl.tf
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+
+	end := int64(tf.inodeData.Size) + int64(length)
+
+	var val [12]byte
+	bo.PutUint64(val[:], uint64(index))
+	bo.PutUint32(val[8:], uint32(length))
+	if err := fl.add(chunkKey(end), val[:]); err != nil {
+		return err
+	}
+
+	tf.inodeData.Size = uint64(end)
+	return nil
+}
+
+// Extends the file by a hole `length` bytes long. `off` must be the current
+// size of the file.
+func (fl *fileLoader) appendHole(off, length int64) error {
+	tf := fl.tf
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+
+	if uint64(off) != tf.inodeData.Size {
+		return errors.New("hole does not start at end of file")
+	}
+	tf.inodeData.Size += uint64(length)
+	return nil
+}
+
+// Writes out the file's tree, if one was started, and the updated inode.
+func (fl *fileLoader) finish() error {
+	tf := fl.tf
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+
+	if fl.builder != nil {
+		treeRoot, err := fl.builder.Finish()
+		fl.builder = nil
+		if err != nil {
+			return err
+		}
+		tf.inodeData.TreeNode = treeRoot
+		tf.inodeData.Blocks += fl.blocks
+		fl.blocks = 0
+	}
+	return tf.manager.blocks.WriteAt(tf, tf.inodeId, 0, tf.inodeData.ToBytes())
+}
+
+// Releases the tree blocks written so far by an unfinished load.
+func (fl *fileLoader) abort() error {
+	if fl.builder == nil {
+		return nil
+	}
+	err := fl.builder.Abort()
+	fl.builder = nil
+	fl.blocks = 0
+	return err
+}
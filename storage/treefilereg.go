@@ -1,11 +1,27 @@
 package storage
 
 import (
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/go-errors/errors"
+
 	"github.com/msg555/ctrfs/blockfile"
 	"github.com/msg555/ctrfs/btree"
 	"github.com/msg555/ctrfs/unix"
 )
 
+// Keys of the file block tree are encoded big endian so that they sort
+// numerically.
+var fileKeyOrder = binary.BigEndian
+
+func fileBlockKey(block int64) btree.KeyType {
+	var key [8]byte
+	fileKeyOrder.PutUint64(key[:], uint64(block))
+	return key[:]
+}
+
 func (tf *TreeFileReg) UpdateInode(updateFunc func(*InodeData) error) error {
 	return tf.TreeFileObject.UpdateInode(func(inodeData *InodeData) error {
 		origSize := inodeData.Size
@@ -40,6 +56,9 @@ func (tf *TreeFileReg) searchBlockInline(data []byte, block int64) (int, bool) {
 }
 
 func (tf *TreeFileReg) truncate() error {
+	if tf.isChunked() {
+		return tf.truncateChunked()
+	}
 	if tf.inodeData.Size == 0 {
 		tf.inodeData.Blocks = 0
 		if tf.inodeData.TreeNode != 0 {
@@ -54,82 +73,121 @@ func (tf *TreeFileReg) truncate() error {
 
 	blockSize := int64(tf.manager.blocks.GetBlockSize())
 
-	var err error
+	// Zero the tail of a partial last block so that it reads back as zeroes if
+	// the file grows again. A hole already reads as zeroes.
 	off := int64(tf.inodeData.Size) % blockSize
 	if off != 0 {
-		buf := tf.manager.blocks.GetCache().Pool.Get().([]byte)
-		defer tf.manager.blocks.GetCache().Pool.Put(buf)
-		for i := 0; i < int(blockSize-off); i++ {
-			buf[i] = 0
-		}
-
 		lastBlock := (int64(tf.inodeData.Size) - 1) / blockSize
-		err = tf.writeBlock(lastBlock, int(off), buf[:blockSize-off])
+		index, err := tf.lookupBlock(lastBlock, false)
 		if err != nil {
 			return err
 		}
+		if index != 0 {
+			buf := tf.manager.blocks.GetCache().Pool.Get().([]byte)
+			defer tf.manager.blocks.GetCache().Pool.Put(buf)
+			for i := 0; i < int(blockSize-off); i++ {
+				buf[i] = 0
+			}
+
+			err = tf.writeBlock(lastBlock, int(off), buf[:blockSize-off])
+			if err != nil {
+				return err
+			}
+		}
 	}
 
+	return tf.unmapBlocks((int64(tf.inodeData.Size)+blockSize-1)/blockSize, math.MaxInt64)
+}
+
+// Releases all data blocks of the file along with its block map. Must be
+// called with tf.lock held.
+func (tf *TreeFileReg) freeData() error {
+	if tf.isChunked() {
+		tf.inodeData.Size = 0
+		if err := tf.truncateChunked(); err != nil {
+			return err
+		}
+		if tf.inodeData.TreeNode != 0 {
+			return tf.manager.fileChunkTree.FreeTree(tf.inodeData.TreeNode, true)
+		}
+		return nil
+	}
+
+	if err := tf.unmapBlocks(0, math.MaxInt64); err != nil {
+		return err
+	}
+	if tf.inodeData.TreeNode != 0 {
+		return tf.manager.fileBlockTree.FreeTree(tf.inodeData.TreeNode, true)
+	}
+	return nil
+}
+
+// Unmaps all file blocks in [lowBlock, highBlock) releasing their data blocks.
+func (tf *TreeFileReg) unmapBlocks(lowBlock, highBlock int64) error {
 	if tf.inodeData.TreeNode == 0 {
-		err = tf.truncateInline((int64(tf.inodeData.Size) + blockSize - 1) / blockSize)
-	} else {
-		err = tf.truncateTree((int64(tf.inodeData.Size) + blockSize - 1) / blockSize)
+		return tf.unmapBlocksInline(lowBlock, highBlock)
 	}
-	return err
+	return tf.unmapBlocksTree(lowBlock, highBlock)
 }
 
-func (tf *TreeFileReg) truncateInline(lowBlock int64) error {
+func (tf *TreeFileReg) unmapBlocksInline(lowBlock, highBlock int64) error {
 	return tf.manager.blocks.AccessBlock(tf, tf.inodeId, func(data []byte) (bool, error) {
 		writeInd := 0
 		for i := 0; i < int(tf.inodeData.Blocks); i++ {
 			buf := data[INODE_SIZE+i*16 : INODE_SIZE+(i+1)*16]
 			blk := int64(bo.Uint64(buf))
-			if blk < lowBlock {
+			if blk < lowBlock || highBlock <= blk {
 				if writeInd != i {
 					copy(data[INODE_SIZE+writeInd*16:], buf)
 				}
 				writeInd++
-			} else {
-				tf.manager.blocks.Free(int64(bo.Uint64(buf[8:])))
+			} else if err := tf.manager.releaseBlock(int64(bo.Uint64(buf[8:]))); err != nil {
+				return false, err
 			}
 		}
 		tf.inodeData.Blocks = uint64(writeInd)
+		copy(data, tf.inodeData.ToBytes())
 		return true, nil
 	})
 }
 
-func (tf *TreeFileReg) truncateTree(lowBlock int64) error {
-	var key [8]byte
-	bo.PutUint64(key[:], uint64(lowBlock))
+func (tf *TreeFileReg) unmapBlocksTree(lowBlock, highBlock int64) error {
+	key := fileBlockKey(lowBlock)
 	for {
-		k, v, _, err := tf.manager.fileBlockTree.LowerBound(tf.inodeData.TreeNode, key[:])
+		k, v, _, err := tf.manager.fileBlockTree.LowerBound(tf.inodeData.TreeNode, key)
 		if err != nil {
 			return err
 		}
-		if k == nil {
+		if k == nil || int64(fileKeyOrder.Uint64(k)) >= highBlock {
 			return nil
 		}
 		err = tf.manager.fileBlockTree.Delete(tf, tf.inodeData.TreeNode, k)
 		if err != nil {
 			return err
 		}
-		tf.manager.blocks.Free(blockfile.BlockIndex(bo.Uint64(v)))
+		if err := tf.manager.releaseBlock(blockfile.BlockIndex(bo.Uint64(v))); err != nil {
+			return err
+		}
+		tf.inodeData.Blocks--
 	}
 }
 
 func (tf *TreeFileReg) convertToTreeFile() error {
-	treeRoot, err := tf.manager.fileBlockTree.CreateEmpty(tf)
-	if err != nil {
-		return err
-	}
 	return tf.manager.blocks.AccessBlock(tf, tf.inodeId, func(data []byte) (bool, error) {
+		// Inline entries are kept sorted by block so they can be loaded directly.
+		builder := tf.manager.fileBlockTree.NewBuilder(tf)
 		for i := 0; i < int(tf.inodeData.Blocks); i++ {
 			entry := data[INODE_SIZE+i*16:]
-			err := tf.manager.fileBlockTree.Insert(tf, treeRoot, entry[:8], entry[8:16], false)
-			if err != nil {
+			key := fileBlockKey(int64(bo.Uint64(entry)))
+			if err := builder.Add(key, entry[8:16]); err != nil {
+				builder.Abort()
 				return false, err
 			}
 		}
+		treeRoot, err := builder.Finish()
+		if err != nil {
+			return false, err
+		}
 		tf.inodeData.TreeNode = treeRoot
 		copy(data, tf.inodeData.ToBytes())
 		return true, nil
@@ -145,9 +203,9 @@ func (tf *TreeFileReg) lookupBlockInline(block int64, forWriting bool) (blockfil
 		if match {
 			result = blockfile.BlockIndex(bo.Uint64(insertData[8:]))
 
-			// Copy on write if coming from a read only block.
+			// Copy on write if coming from a read only or shared block.
 			if forWriting {
-				dupBlockIndex, err := blockfile.Duplicate(tf, tf.manager.blocks, result, true)
+				dupBlockIndex, err := tf.manager.writableBlock(tf, result)
 				if err != nil {
 					return false, err
 				}
@@ -163,7 +221,7 @@ func (tf *TreeFileReg) lookupBlockInline(block int64, forWriting bool) (blockfil
 			return false, nil
 		}
 
-		if INODE_SIZE+int(tf.inodeData.Blocks+1)*16 > len(data) {
+		if INODE_SIZE+int(tf.inodeData.Blocks+1)*16 > len(tf.inlineData(data)) {
 			// No more space for an inline block
 			return false, nil
 		}
@@ -187,19 +245,18 @@ func (tf *TreeFileReg) lookupBlockInline(block int64, forWriting bool) (blockfil
 }
 
 func (tf *TreeFileReg) lookupBlockTree(block int64, forWriting bool) (blockfile.BlockIndex, error) {
-	var key [8]byte
-	bo.PutUint64(key[:], uint64(block))
+	key := fileBlockKey(block)
 
-	blockIndexBytes, _, err := tf.manager.fileBlockTree.Find(tf.inodeData.TreeNode, key[:])
+	blockIndexBytes, _, err := tf.manager.fileBlockTree.Find(tf.inodeData.TreeNode, key)
 	if err != nil {
 		return 0, err
 	}
 	if blockIndexBytes != nil {
 		blockIndex := blockfile.BlockIndex(bo.Uint64(blockIndexBytes))
 
-		// Copy on write if coming from a read only block.
+		// Copy on write if coming from a read only or shared block.
 		if forWriting {
-			dupBlockIndex, err := blockfile.Duplicate(tf, tf.manager.blocks, blockIndex, true)
+			dupBlockIndex, err := tf.manager.writableBlock(tf, blockIndex)
 			if err != nil {
 				return 0, err
 			}
@@ -207,7 +264,7 @@ func (tf *TreeFileReg) lookupBlockTree(block int64, forWriting bool) (blockfile.
 				var val [8]byte
 				bo.PutUint64(val[:], uint64(dupBlockIndex))
 
-				err = tf.manager.fileBlockTree.Insert(tf, tf.inodeData.TreeNode, key[:], val[:], true)
+				err = tf.manager.fileBlockTree.Insert(tf, tf.inodeData.TreeNode, key, val[:], true)
 				if err != nil {
 					return 0, err
 				}
@@ -228,7 +285,7 @@ func (tf *TreeFileReg) lookupBlockTree(block int64, forWriting bool) (blockfile.
 
 	var val [8]byte
 	bo.PutUint64(val[:], uint64(blockIndex))
-	err = tf.manager.fileBlockTree.Insert(tf, tf.inodeData.TreeNode, key[:], val[:], false)
+	err = tf.manager.fileBlockTree.Insert(tf, tf.inodeData.TreeNode, key, val[:], false)
 	if err != nil {
 		return 0, err
 	}
@@ -242,6 +299,59 @@ func (tf *TreeFileReg) lookupBlockTree(block int64, forWriting bool) (blockfile.
 	return blockIndex, nil
 }
 
+// Maps file block `block` to the existing data block `index`. The file block
+// must not already be mapped.
+func (tf *TreeFileReg) mapBlock(block int64, index blockfile.BlockIndex) error {
+	if tf.inodeData.TreeNode == 0 {
+		mapped, err := tf.mapBlockInline(block, index)
+		if err != nil || mapped {
+			return err
+		}
+
+		if err := tf.convertToTreeFile(); err != nil {
+			return err
+		}
+	}
+
+	var val [8]byte
+	bo.PutUint64(val[:], uint64(index))
+	err := tf.manager.fileBlockTree.Insert(tf, tf.inodeData.TreeNode, fileBlockKey(block), val[:], false)
+	if err != nil {
+		return err
+	}
+
+	tf.inodeData.Blocks++
+	return tf.manager.blocks.WriteAt(tf, tf.inodeId, 0, tf.inodeData.ToBytes())
+}
+
+// Adds a mapping from file block `block` to data block `index` to the inline
+// block list. Returns false if there is no space left for the entry.
+func (tf *TreeFileReg) mapBlockInline(block int64, index blockfile.BlockIndex) (bool, error) {
+	mapped := false
+	err := tf.manager.blocks.AccessBlock(tf, tf.inodeId, func(data []byte) (bool, error) {
+		insertInd, match := tf.searchBlockInline(data, block)
+		if match {
+			return false, errors.New("block already mapped")
+		}
+		if INODE_SIZE+int(tf.inodeData.Blocks+1)*16 > len(tf.inlineData(data)) {
+			// No more space for an inline block
+			return false, nil
+		}
+
+		insertData := data[INODE_SIZE+insertInd*16:]
+		copy(insertData[16:16*(int(tf.inodeData.Blocks)-insertInd+1)], insertData)
+		bo.PutUint64(insertData, uint64(block))
+		bo.PutUint64(insertData[8:], uint64(index))
+
+		tf.inodeData.Blocks++
+		copy(data, tf.inodeData.ToBytes())
+
+		mapped = true
+		return true, nil
+	})
+	return mapped, err
+}
+
 func (tf *TreeFileReg) lookupBlock(block int64, forWriting bool) (blockfile.BlockIndex, error) {
 	if tf.inodeData.TreeNode == 0 {
 		blockIndex, err := tf.lookupBlockInline(block, forWriting)
@@ -292,13 +402,23 @@ func (tf *TreeFileReg) ReadAt(p []byte, off int64) (int, error) {
 
 	tf.lock.RLock()
 	defer tf.lock.RUnlock()
+	return tf.readAt(p, off)
+}
 
+// Reads data as with ReadAt(). Must be called with tf.lock held.
+func (tf *TreeFileReg) readAt(p []byte, off int64) (int, error) {
 	if off >= int64(tf.inodeData.Size) {
 		return 0, nil
 	}
 	if int64(len(p)) > int64(tf.inodeData.Size)-off {
 		p = p[:int64(tf.inodeData.Size)-int64(off)]
 	}
+	if tf.isChunked() {
+		if err := tf.readChunked(p, off); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
 
 	blockSize := int64(tf.manager.blocks.GetBlockSize())
 	dataBlockStart := off / int64(blockSize)
@@ -326,19 +446,7 @@ func (tf *TreeFileReg) ReadAt(p []byte, off int64) (int, error) {
 	return read, nil
 }
 
-func (tf *TreeFileReg) WriteAt(p []byte, off int64) (int, error) {
-	if off < 0 {
-		return 0, unix.EINVAL
-	}
-	if len(p) == 0 {
-		// From my understanding of write(2) if zero bytes are written it will not
-		// extend the file even if the file pointer is beyond the end of the file.
-		return 0, nil
-	}
-
-	tf.lock.Lock()
-	defer tf.lock.Unlock()
-
+func (tf *TreeFileReg) writeBlocks(p []byte, off int64) (int, error) {
 	blockSize := int64(tf.manager.blocks.GetBlockSize())
 	dataBlockStart := off / int64(blockSize)
 
@@ -361,6 +469,36 @@ func (tf *TreeFileReg) WriteAt(p []byte, off int64) (int, error) {
 
 		written += int(endInd - startInd)
 	}
+	return written, nil
+}
+
+func (tf *TreeFileReg) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, unix.EINVAL
+	}
+	if len(p) == 0 {
+		// From my understanding of write(2) if zero bytes are written it will not
+		// extend the file even if the file pointer is beyond the end of the file.
+		return 0, nil
+	}
+
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+	return tf.writeAt(p, off)
+}
+
+// Writes data as with WriteAt(). Must be called with tf.lock held.
+func (tf *TreeFileReg) writeAt(p []byte, off int64) (int, error) {
+	var written int
+	var err error
+	if tf.isChunked() {
+		written, err = tf.writeChunked(p, off)
+	} else {
+		written, err = tf.writeBlocks(p, off)
+	}
+	if err != nil {
+		return written, err
+	}
 
 	if uint64(off)+uint64(len(p)) > tf.inodeData.Size {
 		tf.inodeData.Size = uint64(off) + uint64(len(p))
@@ -377,26 +515,39 @@ func (tf *TreeFileReg) WriteAt(p []byte, off int64) (int, error) {
 }
 
 func (tf *TreeFileReg) cacheContentAddress(sc *StorageContext) ([]byte, error) {
+	contentAddress, err := tf.contentAddress(sc)
+	if err != nil {
+		return nil, err
+	}
+	if err := sc.insertBlockIntoCache(contentAddress, tf.inodeId); err != nil {
+		return nil, err
+	}
+	return contentAddress, nil
+}
+
+// Computes the content address of the file from its stored data blocks.
+func (tf *TreeFileReg) contentAddress(sc *StorageContext) ([]byte, error) {
 	blocks := tf.manager.blocks
 	if blocks != sc.Blocks {
 		panic("cannot cache content address for mount blocks")
 	}
 
-	hsh := sc.HashFactory()
-	hsh.Write([]byte("file:"))
-
-	if tf.inodeData.TreeNode == 0 {
+	hsh := sc.newFileContentHasher()
+	if tf.isChunked() {
+		if err := tf.hashChunks(sc, hsh); err != nil {
+			return nil, err
+		}
+	} else if tf.inodeData.TreeNode == 0 {
 		err := blocks.AccessBlock(tf, tf.inodeId, func(data []byte) (bool, error) {
 			for i := 0; i < int(tf.inodeData.Blocks); i++ {
 				buf := data[INODE_SIZE+i*16:]
-				hsh.Write(buf[:8])
 
 				blockNode := blockfile.BlockIndex(bo.Uint64(buf[8:]))
-				if bca, err := sc.cacheDataBlockContentAddress(blockNode); err != nil {
+				bca, err := sc.cacheDataBlockContentAddress(blockNode)
+				if err != nil {
 					return false, err
-				} else {
-					hsh.Write(bca)
 				}
+				hsh.addBlock(int64(bo.Uint64(buf)), bca)
 			}
 			return false, nil
 		})
@@ -404,27 +555,31 @@ func (tf *TreeFileReg) cacheContentAddress(sc *StorageContext) ([]byte, error) {
 			return nil, err
 		}
 	} else {
+		var scanErr error
 		_, err := tf.manager.fileBlockTree.Scan(tf.inodeData.TreeNode, nil, func(_ btree.IndexType, key []byte, val []byte) bool {
-			hsh.Write(key)
-
 			blockNode := blockfile.BlockIndex(bo.Uint64(val))
-			if bca, err := sc.cacheDataBlockContentAddress(blockNode); err != nil {
+			bca, err := sc.cacheDataBlockContentAddress(blockNode)
+			if err != nil {
+				scanErr = err
 				return false
-			} else {
-				hsh.Write(bca)
 			}
+			hsh.addBlock(int64(fileKeyOrder.Uint64(key)), bca)
 			return true
 		})
 		if err != nil {
 			return nil, err
 		}
+		if scanErr != nil {
+			return nil, scanErr
+		}
 	}
 
-	contentAddress := hsh.Sum(nil)
-	if err := sc.insertBlockIntoCache(contentAddress, tf.inodeId); err != nil {
+	xattrs, err := tf.readXattrs()
+	if err != nil {
 		return nil, err
 	}
-	return contentAddress, nil
+	hsh.addXattrs(xattrs)
+	return hsh.contentAddress(&tf.inodeData), nil
 }
 
 func (tf *TreeFileReg) Read(p []byte) (int, error) {
@@ -432,7 +587,7 @@ func (tf *TreeFileReg) Read(p []byte) (int, error) {
 	defer tf.offsetLock.Unlock()
 
 	n, err := tf.ReadAt(p, tf.offset)
-	tf.offset += n
+	tf.offset += int64(n)
 	return n, err
 }
 
@@ -441,7 +596,7 @@ func (tf *TreeFileReg) Write(p []byte) (int, error) {
 	defer tf.offsetLock.Unlock()
 
 	n, err := tf.WriteAt(p, tf.offset)
-	tf.offset += n
+	tf.offset += int64(n)
 	return n, err
 }
 
@@ -449,14 +604,33 @@ func (tf *TreeFileReg) Seek(offset int64, whence int) (int64, error) {
 	tf.offsetLock.Lock()
 	defer tf.offsetLock.Unlock()
 
+	if whence == unix.SEEK_DATA || whence == unix.SEEK_HOLE {
+		var off int64
+		var err error
+		if whence == unix.SEEK_DATA {
+			off, err = tf.SeekData(offset)
+		} else {
+			off, err = tf.SeekHole(offset)
+		}
+		if err != nil {
+			return tf.offset, err
+		}
+		tf.offset = off
+		return off, nil
+	}
+
 	base := int64(0)
 	if whence == io.SeekCurrent {
 		base = tf.offset
 	} else if whence == io.SeekEnd {
 		tf.lock.RLock()
 		defer tf.lock.RUnlock()
-		base = tf.inodeData.Size
+		base = int64(tf.inodeData.Size)
 	}
 
+	if base+offset < 0 {
+		return tf.offset, unix.EINVAL
+	}
 	tf.offset = base + offset
+	return tf.offset, nil
 }
@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"github.com/msg555/ctrfs/btree"
+	"github.com/msg555/ctrfs/unix"
+)
+
+/*
+Regular files are sparse. Any file block (or range not covered by a chunk)
+without a data block mapped to it is a hole and reads back as zeroes. Holes
+are created by extending a file past its data, by importing blocks that are
+entirely zero and by punching holes with Fallocate().
+*/
+
+// Returns the first range of the file backed by data that ends after `off`.
+// The range may start before `off` and may extend past the end of the file.
+// Returns false if there is no data after `off`. Must be called with tf.lock
+// held.
+func (tf *TreeFileReg) nextDataExtent(off int64) (int64, int64, bool, error) {
+	if tf.isChunked() {
+		chunk, err := tf.findChunk(off)
+		if err != nil || chunk == nil {
+			return 0, 0, false, err
+		}
+		return chunk.Start, chunk.End, true, nil
+	}
+
+	blockSize := int64(tf.manager.blocks.GetBlockSize())
+	block := off / blockSize
+
+	found := false
+	if tf.inodeData.TreeNode == 0 {
+		err := tf.manager.blocks.AccessBlock(tf, tf.inodeId, func(data []byte) (bool, error) {
+			ind, _ := tf.searchBlockInline(data, block)
+			if ind < int(tf.inodeData.Blocks) {
+				block = int64(bo.Uint64(data[INODE_SIZE+ind*16:]))
+				found = true
+			}
+			return false, nil
+		})
+		if err != nil {
+			return 0, 0, false, err
+		}
+	} else {
+		key, _, _, err := tf.manager.fileBlockTree.LowerBound(tf.inodeData.TreeNode, fileBlockKey(block))
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if key != nil {
+			block = int64(fileKeyOrder.Uint64(key))
+			found = true
+		}
+	}
+	return block * blockSize, (block + 1) * blockSize, found, nil
+}
+
+// Returns the number of bytes of data mapped to the file. For chunked files
+// this is the total length of the chunks, which may each use only part of
+// their data block, rather than a multiple of the block size.
+func (tf *TreeFileReg) AllocatedBytes() (int64, error) {
+	tf.lock.RLock()
+	defer tf.lock.RUnlock()
+
+	if !tf.isChunked() {
+		return int64(tf.inodeData.Blocks) * int64(tf.manager.blocks.GetBlockSize()), nil
+	}
+	if tf.inodeData.TreeNode == 0 {
+		return 0, nil
+	}
+
+	var allocated int64
+	_, err := tf.manager.fileChunkTree.Scan(tf.inodeData.TreeNode, nil, func(index btree.IndexType, key btree.KeyType, val btree.ValueType) bool {
+		allocated += int64(bo.Uint32(val[8:]))
+		return true
+	})
+	return allocated, err
+}
+
+// Returns the offset of the first byte of data at or after `off` as with
+// lseek(2) SEEK_DATA. Returns ENXIO if there is no data at or after `off`.
+func (tf *TreeFileReg) SeekData(off int64) (int64, error) {
+	if off < 0 {
+		return 0, unix.EINVAL
+	}
+
+	tf.lock.RLock()
+	defer tf.lock.RUnlock()
+
+	size := int64(tf.inodeData.Size)
+	if off >= size {
+		return 0, unix.ENXIO
+	}
+	start, _, found, err := tf.nextDataExtent(off)
+	if err != nil {
+		return 0, err
+	}
+	if !found || start >= size {
+		return 0, unix.ENXIO
+	}
+	if start < off {
+		start = off
+	}
+	return start, nil
+}
+
+// Returns the offset of the first hole at or after `off` as with lseek(2)
+// SEEK_HOLE. The end of the file counts as a hole. Returns ENXIO if `off` is
+// at or past the end of the file.
+func (tf *TreeFileReg) SeekHole(off int64) (int64, error) {
+	if off < 0 {
+		return 0, unix.EINVAL
+	}
+
+	tf.lock.RLock()
+	defer tf.lock.RUnlock()
+
+	size := int64(tf.inodeData.Size)
+	if off >= size {
+		return 0, unix.ENXIO
+	}
+	for off < size {
+		start, end, found, err := tf.nextDataExtent(off)
+		if err != nil {
+			return 0, err
+		}
+		if !found || start > off {
+			return off, nil
+		}
+		off = end
+	}
+	return size, nil
+}
+
+// Manipulates the space allocated to the range `length` bytes long at `off`
+// as with fallocate(2). `mode` of 0 allocates blocks for any holes in the
+// range. FALLOC_FL_PUNCH_HOLE, which must be combined with
+// FALLOC_FL_KEEP_SIZE, releases the data of the range. FALLOC_FL_ZERO_RANGE
+// replaces the range with zeroed blocks. Unless FALLOC_FL_KEEP_SIZE is set the
+// file is extended to cover the range.
+func (tf *TreeFileReg) Fallocate(mode int, off, length int64) error {
+	if off < 0 || length <= 0 {
+		return unix.EINVAL
+	}
+	keepSize := mode&unix.FALLOC_FL_KEEP_SIZE != 0
+	switch mode &^ unix.FALLOC_FL_KEEP_SIZE {
+	case 0, unix.FALLOC_FL_ZERO_RANGE:
+	case unix.FALLOC_FL_PUNCH_HOLE:
+		if !keepSize {
+			return unix.EOPNOTSUPP
+		}
+	default:
+		return unix.EOPNOTSUPP
+	}
+
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+
+	end := off + length
+	if mode&(unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_ZERO_RANGE) != 0 {
+		punchEnd := end
+		if size := int64(tf.inodeData.Size); punchEnd > size {
+			punchEnd = size
+		}
+		if off < punchEnd {
+			if err := tf.punchHole(off, punchEnd); err != nil {
+				return err
+			}
+		}
+	}
+	if mode&unix.FALLOC_FL_PUNCH_HOLE == 0 {
+		if err := tf.allocateRange(off, end); err != nil {
+			return err
+		}
+		if !keepSize && uint64(end) > tf.inodeData.Size {
+			tf.inodeData.Size = uint64(end)
+		}
+	}
+	return tf.manager.blocks.WriteAt(tf, tf.inodeId, 0, tf.inodeData.ToBytes())
+}
+
+// Releases the data of the range [off, end) of the file which must lie within
+// the file. Data blocks only partially covered by the range are zeroed
+// instead. Must be called with tf.lock held.
+func (tf *TreeFileReg) punchHole(off, end int64) error {
+	if tf.isChunked() {
+		return tf.punchChunks(off, end)
+	}
+
+	blockSize := int64(tf.manager.blocks.GetBlockSize())
+	lowBlock := (off + blockSize - 1) / blockSize
+	highBlock := end / blockSize
+	if lowBlock >= highBlock {
+		return tf.zeroBlockRange(off, end)
+	}
+	if err := tf.zeroBlockRange(off, lowBlock*blockSize); err != nil {
+		return err
+	}
+	if err := tf.zeroBlockRange(highBlock*blockSize, end); err != nil {
+		return err
+	}
+	return tf.unmapBlocks(lowBlock, highBlock)
+}
+
+// Zeroes the mapped parts of [off, end) which must lie within a single block.
+func (tf *TreeFileReg) zeroBlockRange(off, end int64) error {
+	if off >= end {
+		return nil
+	}
+	blockSize := int64(tf.manager.blocks.GetBlockSize())
+	block := off / blockSize
+	index, err := tf.lookupBlock(block, false)
+	if err != nil || index == 0 {
+		return err
+	}
+	return tf.writeBlock(block, int(off-block*blockSize), make([]byte, end-off))
+}
+
+func (tf *TreeFileReg) punchChunks(off, end int64) error {
+	for pos := off; pos < end; {
+		chunk, err := tf.findChunk(pos)
+		if err != nil {
+			return err
+		}
+		if chunk == nil || chunk.Start >= end {
+			return nil
+		}
+
+		if off <= chunk.Start && chunk.End <= end {
+			err = tf.manager.fileChunkTree.Delete(tf, tf.inodeData.TreeNode, chunkKey(chunk.End))
+			if err != nil {
+				return err
+			}
+			if err := tf.manager.releaseBlock(chunk.BlockIndex); err != nil {
+				return err
+			}
+			tf.inodeData.Blocks--
+		} else {
+			// The chunk is only partially covered so zero the covered part.
+			if err := tf.writableChunk(chunk); err != nil {
+				return err
+			}
+			zeroStart, zeroEnd := chunk.Start, chunk.End
+			if zeroStart < off {
+				zeroStart = off
+			}
+			if zeroEnd > end {
+				zeroEnd = end
+			}
+			err := tf.manager.blocks.WriteAt(tf, chunk.BlockIndex, int(zeroStart-chunk.Start), make([]byte, zeroEnd-zeroStart))
+			if err != nil {
+				return err
+			}
+		}
+		pos = chunk.End
+	}
+	return nil
+}
+
+// Backs every hole within [off, end) with zeroed data blocks. Must be called
+// with tf.lock held.
+func (tf *TreeFileReg) allocateRange(off, end int64) error {
+	if tf.isChunked() {
+		for pos := off; pos < end; {
+			start, dataEnd, found, err := tf.nextDataExtent(pos)
+			if err != nil {
+				return err
+			}
+			holeEnd := end
+			if found && start < holeEnd {
+				holeEnd = start
+			}
+			if pos < holeEnd {
+				if _, err := tf.writeChunked(make([]byte, holeEnd-pos), pos); err != nil {
+					return err
+				}
+			}
+			if !found {
+				return nil
+			}
+			pos = dataEnd
+		}
+		return nil
+	}
+
+	blockSize := int64(tf.manager.blocks.GetBlockSize())
+	zeroes := make([]byte, blockSize)
+	for block := off / blockSize; block*blockSize < end; block++ {
+		index, err := tf.lookupBlock(block, false)
+		if err != nil {
+			return err
+		}
+		if index != 0 {
+			continue
+		}
+		// Newly allocated blocks may hold stale data so zero them explicitly.
+		if err := tf.writeBlock(block, 0, zeroes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
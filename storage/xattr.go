@@ -0,0 +1,447 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/msg555/ctrfs/blockfile"
+	"github.com/msg555/ctrfs/btree"
+	"github.com/msg555/ctrfs/unix"
+)
+
+/*
+Extended attributes are stored inline at the end of the inode block while
+they are small and fit in the space not used by the file's own inline data.
+Otherwise all of the inode's attributes are moved into an attribute tree that
+maps each name to a block holding its value. Values are never modified in
+place; setting an attribute writes its value to a new block so that blocks
+shared with read only layers are left untouched.
+
+Inline Attribute (sorted by name)
+	nameLen  uint8
+	valueLen uint16
+	name     [nameLen]byte
+	value    [valueLen]byte
+
+Tree Entry
+	key   - name
+	value - block   uint64
+	        length  uint32
+*/
+
+type xattrEntry struct {
+	Name  string
+	Value []byte
+}
+
+func sortXattrEntries(entries []xattrEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+}
+
+// Returns the part of the inode block `data` available to the file's own
+// inline data, excluding any inline extended attributes.
+func (tf *TreeFileObject) inlineData(data []byte) []byte {
+	return data[:len(data)-int(tf.inodeData.XattrInline)]
+}
+
+// Returns the offset of the end of the file's own inline data within the inode
+// block `data`.
+func (tf *TreeFileObject) inlineDataEnd(data []byte) int {
+	data = tf.inlineData(data)
+	if tf.inodeData.TreeNode != 0 {
+		if tf.inodeData.Mode&unix.S_IFMT == unix.S_IFDIR {
+			// Root of the directory's position index
+			return INODE_SIZE + 8
+		}
+		return INODE_SIZE
+	}
+
+	switch tf.inodeData.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		return INODE_SIZE + inlineDirentsSize(readInlineDirents(data))
+	case unix.S_IFREG:
+		if tf.inodeData.Flags&INODE_FLAG_CHUNKED == 0 {
+			return INODE_SIZE + int(tf.inodeData.Blocks)*16
+		}
+	case unix.S_IFLNK:
+		return INODE_SIZE + int(tf.inodeData.Size)
+	}
+	return INODE_SIZE
+}
+
+// Returns the largest number of bytes of inline attributes allowed within an
+// inode block of `blockSize` bytes.
+func maxInlineXattrSize(blockSize int) int {
+	return blockSize / 4
+}
+
+func encodeInlineXattrs(entries []xattrEntry) []byte {
+	var buf []byte
+	for _, entry := range entries {
+		var header [3]byte
+		header[0] = byte(len(entry.Name))
+		bo.PutUint16(header[1:], uint16(len(entry.Value)))
+		buf = append(buf, header[:]...)
+		buf = append(buf, entry.Name...)
+		buf = append(buf, entry.Value...)
+	}
+	return buf
+}
+
+func decodeInlineXattrs(buf []byte) []xattrEntry {
+	var entries []xattrEntry
+	for pos := 0; pos+3 <= len(buf); {
+		nameLen := int(buf[pos])
+		valueLen := int(bo.Uint16(buf[pos+1:]))
+		pos += 3
+		if nameLen == 0 || pos+nameLen+valueLen > len(buf) {
+			break
+		}
+
+		value := make([]byte, valueLen)
+		copy(value, buf[pos+nameLen:])
+		entries = append(entries, xattrEntry{
+			Name:  string(buf[pos : pos+nameLen]),
+			Value: value,
+		})
+		pos += nameLen + valueLen
+	}
+	return entries
+}
+
+// Returns the inline attributes of the file. Must be called with tf.lock
+// held.
+func (tf *TreeFileObject) readInlineXattrs() ([]xattrEntry, error) {
+	if tf.inodeData.XattrInline == 0 {
+		return nil, nil
+	}
+
+	blockSize := tf.manager.blocks.GetBlockSize()
+	size := int(tf.inodeData.XattrInline)
+	buf, err := tf.manager.blocks.ReadAt(tf.inodeId, blockSize-size, size, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeInlineXattrs(buf), nil
+}
+
+// Replaces the inline attributes of the file with `entries`, which must be
+// sorted by name. Returns false without making any changes if the attributes
+// do not fit inline. Must be called with tf.lock held.
+func (tf *TreeFileObject) writeInlineXattrs(entries []xattrEntry) (bool, error) {
+	buf := encodeInlineXattrs(entries)
+
+	written := false
+	err := tf.manager.blocks.AccessBlock(tf, tf.inodeId, func(data []byte) (bool, error) {
+		if len(buf) > maxInlineXattrSize(len(data)) {
+			return false, nil
+		}
+		start := len(data) - len(buf)
+		if start < tf.inlineDataEnd(data) {
+			return false, nil
+		}
+
+		// Space released by the attributes is zeroed so that it reads as free
+		// inline file data.
+		for i := len(data) - int(tf.inodeData.XattrInline); i < start; i++ {
+			data[i] = 0
+		}
+		copy(data[start:], buf)
+
+		tf.inodeData.XattrInline = uint32(len(buf))
+		copy(data, tf.inodeData.ToBytes())
+		written = true
+		return true, nil
+	})
+	return written, err
+}
+
+// Writes `value` to a new block. Returns the tree entry referencing it.
+func (tf *TreeFileObject) writeXattrValue(value []byte) ([]byte, error) {
+	blockIndex, err := tf.manager.blocks.Allocate(tf)
+	if err != nil {
+		return nil, err
+	}
+	if err := tf.manager.blocks.WriteAt(tf, blockIndex, 0, value); err != nil {
+		tf.manager.blocks.Free(blockIndex)
+		return nil, err
+	}
+
+	var entry [12]byte
+	bo.PutUint64(entry[:], uint64(blockIndex))
+	bo.PutUint32(entry[8:], uint32(len(value)))
+	return entry[:], nil
+}
+
+func (tf *TreeFileObject) readXattrValue(entry []byte) ([]byte, error) {
+	blockIndex := blockfile.BlockIndex(bo.Uint64(entry))
+	length := int(bo.Uint32(entry[8:]))
+	return tf.manager.blocks.ReadAt(blockIndex, 0, length, nil)
+}
+
+// Frees the value block referenced by the tree entry `entry` unless it is
+// shared with a read only layer.
+func (tf *TreeFileObject) freeXattrValue(entry []byte) error {
+	blockIndex := blockfile.BlockIndex(bo.Uint64(entry))
+	if tf.manager.blocks.IsBlockReadOnly(blockIndex) {
+		return nil
+	}
+	return tf.manager.blocks.Free(blockIndex)
+}
+
+// Moves the inline attributes of the file, `entries`, into a new attribute
+// tree. Must be called with tf.lock held.
+func (tf *TreeFileObject) convertToXattrTree(entries []xattrEntry) error {
+	builder := tf.manager.xattrTree.NewBuilder(tf)
+	for _, entry := range entries {
+		val, err := tf.writeXattrValue(entry.Value)
+		if err == nil {
+			err = builder.Add([]byte(entry.Name), val)
+		}
+		if err != nil {
+			builder.Abort()
+			return err
+		}
+	}
+	treeRoot, err := builder.Finish()
+	if err != nil {
+		return err
+	}
+
+	return tf.manager.blocks.AccessBlock(tf, tf.inodeId, func(data []byte) (bool, error) {
+		for i := len(data) - int(tf.inodeData.XattrInline); i < len(data); i++ {
+			data[i] = 0
+		}
+		tf.inodeData.XattrInline = 0
+		tf.inodeData.XattrNode = treeRoot
+		copy(data, tf.inodeData.ToBytes())
+		return true, nil
+	})
+}
+
+// Returns all attributes of the file sorted by name. Must be called with
+// tf.lock held.
+func (tf *TreeFileObject) readXattrs() ([]xattrEntry, error) {
+	if tf.inodeData.XattrNode == 0 {
+		return tf.readInlineXattrs()
+	}
+
+	var entries []xattrEntry
+	var scanErr error
+	_, err := tf.manager.xattrTree.Scan(tf.inodeData.XattrNode, nil, func(_ btree.IndexType, key []byte, val []byte) bool {
+		value, err := tf.readXattrValue(val)
+		if err != nil {
+			scanErr = err
+			return false
+		}
+		entries = append(entries, xattrEntry{
+			Name:  string(key),
+			Value: value,
+		})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, scanErr
+}
+
+// Sets the attributes of a newly created file that has none. Must be called
+// with tf.lock held.
+func (tf *TreeFileObject) initXattrs(entries []xattrEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	sortXattrEntries(entries)
+
+	written, err := tf.writeInlineXattrs(entries)
+	if err != nil || written {
+		return err
+	}
+	return tf.convertToXattrTree(entries)
+}
+
+// Frees the attribute tree of the file along with the value blocks it
+// references. Inline attributes need no cleanup.
+func (tf *TreeFileObject) freeXattrs() error {
+	if tf.inodeData.XattrNode == 0 {
+		return nil
+	}
+
+	var values [][]byte
+	_, err := tf.manager.xattrTree.Scan(tf.inodeData.XattrNode, nil, func(_ btree.IndexType, key []byte, val []byte) bool {
+		values = append(values, append([]byte(nil), val...))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, val := range values {
+		if err := tf.freeXattrValue(val); err != nil {
+			return err
+		}
+	}
+	return tf.manager.xattrTree.FreeTree(tf.inodeData.XattrNode, true)
+}
+
+func validateXattr(name string, value []byte, blockSize int) error {
+	if name == "" || len(name) > unix.NAME_MAX || strings.IndexByte(name, 0) != -1 {
+		return unix.ERANGE
+	}
+	if len(value) > blockSize {
+		return unix.E2BIG
+	}
+	return nil
+}
+
+// Returns the value of the extended attribute `name` and whether it exists.
+func (tf *TreeFileObject) GetXattr(name string) ([]byte, bool, error) {
+	tf.lock.RLock()
+	defer tf.lock.RUnlock()
+
+	if tf.inodeData.XattrNode != 0 {
+		val, _, err := tf.manager.xattrTree.Find(tf.inodeData.XattrNode, []byte(name))
+		if err != nil || val == nil {
+			return nil, false, err
+		}
+		value, err := tf.readXattrValue(val)
+		return value, err == nil, err
+	}
+
+	entries, err := tf.readInlineXattrs()
+	if err != nil {
+		return nil, false, err
+	}
+	for _, entry := range entries {
+		if entry.Name == name {
+			return entry.Value, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// Returns the names of all extended attributes of the file sorted by name.
+func (tf *TreeFileObject) ListXattrs() ([]string, error) {
+	tf.lock.RLock()
+	defer tf.lock.RUnlock()
+
+	var names []string
+	if tf.inodeData.XattrNode != 0 {
+		_, err := tf.manager.xattrTree.Scan(tf.inodeData.XattrNode, nil, func(_ btree.IndexType, key []byte, val []byte) bool {
+			names = append(names, string(key))
+			return true
+		})
+		return names, err
+	}
+
+	entries, err := tf.readInlineXattrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	return names, nil
+}
+
+// Sets the extended attribute `name` to `value`. `flags` may include
+// XATTR_CREATE to fail with EEXIST if the attribute exists or XATTR_REPLACE to
+// fail with ENODATA if it does not.
+func (tf *TreeFileObject) SetXattr(name string, value []byte, flags int) error {
+	if err := validateXattr(name, value, tf.manager.blocks.GetBlockSize()); err != nil {
+		return err
+	}
+
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+
+	if tf.inodeData.XattrNode == 0 {
+		entries, err := tf.readInlineXattrs()
+		if err != nil {
+			return err
+		}
+
+		ind := sort.Search(len(entries), func(i int) bool {
+			return entries[i].Name >= name
+		})
+		exists := ind < len(entries) && entries[ind].Name == name
+		if exists && flags&unix.XATTR_CREATE != 0 {
+			return unix.EEXIST
+		}
+		if !exists && flags&unix.XATTR_REPLACE != 0 {
+			return unix.ENODATA
+		}
+
+		updated := make([]xattrEntry, 0, len(entries)+1)
+		updated = append(updated, entries[:ind]...)
+		updated = append(updated, xattrEntry{Name: name, Value: value})
+		if exists {
+			ind++
+		}
+		updated = append(updated, entries[ind:]...)
+
+		written, err := tf.writeInlineXattrs(updated)
+		if err != nil || written {
+			return err
+		}
+		if err := tf.convertToXattrTree(entries); err != nil {
+			return err
+		}
+	}
+
+	oldVal, _, err := tf.manager.xattrTree.Find(tf.inodeData.XattrNode, []byte(name))
+	if err != nil {
+		return err
+	}
+	if oldVal != nil && flags&unix.XATTR_CREATE != 0 {
+		return unix.EEXIST
+	}
+	if oldVal == nil && flags&unix.XATTR_REPLACE != 0 {
+		return unix.ENODATA
+	}
+
+	val, err := tf.writeXattrValue(value)
+	if err != nil {
+		return err
+	}
+	if err := tf.manager.xattrTree.Insert(tf, tf.inodeData.XattrNode, []byte(name), val, true); err != nil {
+		return err
+	}
+	if oldVal != nil {
+		return tf.freeXattrValue(oldVal)
+	}
+	return nil
+}
+
+// Removes the extended attribute `name`. Returns false if no such attribute
+// exists.
+func (tf *TreeFileObject) RemoveXattr(name string) (bool, error) {
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+
+	if tf.inodeData.XattrNode != 0 {
+		val, _, err := tf.manager.xattrTree.Find(tf.inodeData.XattrNode, []byte(name))
+		if err != nil || val == nil {
+			return false, err
+		}
+		if err := tf.manager.xattrTree.Delete(tf, tf.inodeData.XattrNode, []byte(name)); err != nil {
+			return false, err
+		}
+		return true, tf.freeXattrValue(val)
+	}
+
+	entries, err := tf.readInlineXattrs()
+	if err != nil {
+		return false, err
+	}
+	for i, entry := range entries {
+		if entry.Name == name {
+			updated := append(entries[:i:i], entries[i+1:]...)
+			_, err := tf.writeInlineXattrs(updated)
+			return true, err
+		}
+	}
+	return false, nil
+}
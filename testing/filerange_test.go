@@ -0,0 +1,99 @@
+package testing
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	sysunix "golang.org/x/sys/unix"
+
+	"github.com/msg555/ctrfs/unix"
+)
+
+// Drives the lseek, fallocate and copy_file_range requests through the kernel.
+func TestFileRangeRequests(t *testing.T) {
+	srv, err := CreateTestServer()
+	if err != nil {
+		t.Fatalf("Failed to setup test server: '%s'", err)
+	}
+	defer func() {
+		err := srv.Close()
+		if err != nil {
+			t.Fatalf("Failed to shutdown server: '%s'", err)
+		}
+	}()
+
+	addr, err := srv.ImportArchive("basic")
+	if err != nil {
+		t.Fatalf("Failed to import test archive: '%s'", err)
+	}
+
+	mountPoint, err := srv.MountWritable(addr)
+	if err != nil {
+		t.Fatalf("Failed to mount: '%s'", err)
+	}
+
+	const dataOff = 1 << 20
+	blockSize := int64(srv.Server.Storage.Cache.BlockSize)
+
+	src, err := os.Create(path.Join(mountPoint, "sparse"))
+	if err != nil {
+		t.Fatalf("Failed to create file: '%s'", err)
+	}
+	defer src.Close()
+	if _, err := src.WriteAt([]byte("hello"), dataOff); err != nil {
+		t.Fatalf("Failed to write file: '%s'", err)
+	}
+
+	// lseek
+	if off, err := sysunix.Seek(int(src.Fd()), 0, unix.SEEK_DATA); err != nil || off != dataOff {
+		t.Fatalf("Unexpected data offset %d '%v'", off, err)
+	}
+	if off, err := sysunix.Seek(int(src.Fd()), dataOff, unix.SEEK_HOLE); err != nil || off != dataOff+5 {
+		t.Fatalf("Unexpected hole offset %d '%v'", off, err)
+	}
+	if _, err := sysunix.Seek(int(src.Fd()), dataOff+5, unix.SEEK_DATA); err != unix.ENXIO {
+		t.Fatalf("Expected ENXIO seeking data past the end, got '%v'", err)
+	}
+
+	// fallocate
+	if err := sysunix.Fallocate(int(src.Fd()), 0, 0, 2*dataOff); err != nil {
+		t.Fatalf("Failed to allocate: '%s'", err)
+	}
+	if st, err := src.Stat(); err != nil || st.Size() != 2*dataOff {
+		t.Fatalf("Unexpected size after allocating '%v'", err)
+	}
+	err = sysunix.Fallocate(int(src.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, dataOff, blockSize)
+	if err != nil {
+		t.Fatalf("Failed to punch hole: '%s'", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := src.ReadAt(buf, dataOff); err != nil || !bytes.Equal(buf, make([]byte, 5)) {
+		t.Fatalf("Expected punched hole to read as zeroes '%v'", err)
+	}
+	if _, err := src.WriteAt([]byte("world"), dataOff); err != nil {
+		t.Fatalf("Failed to write file: '%s'", err)
+	}
+
+	// copy_file_range
+	dst, err := os.Create(path.Join(mountPoint, "copy"))
+	if err != nil {
+		t.Fatalf("Failed to create file: '%s'", err)
+	}
+	defer dst.Close()
+	srcOff, dstOff := int64(dataOff), int64(3)
+	n, err := sysunix.CopyFileRange(int(src.Fd()), &srcOff, int(dst.Fd()), &dstOff, 5, 0)
+	if err != nil || n != 5 {
+		t.Fatalf("Failed to copy file range %d '%v'", n, err)
+	}
+
+	data, err := ioutil.ReadFile(path.Join(mountPoint, "copy"))
+	if err != nil {
+		t.Fatalf("Failed to read file: '%s'", err)
+	}
+	if string(data) != "\x00\x00\x00world" {
+		t.Fatalf("Unexpected copied data %q", data)
+	}
+}
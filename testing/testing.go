@@ -64,16 +64,24 @@ func (srv *TestServer) ImportArchive(name string) ([]byte, error) {
 	}
 	defer f.Close()
 
-	sc, err := srv.Server.Storage.ImportTar(f)
+	nd, _, err := srv.Server.Storage.ImportTar(f)
 	if err != nil {
 		return nil, err
 	}
 
-	return sc.NodeAddress[:], nil
+	return nd.NodeAddress[:], nil
 }
 
 func (srv *TestServer) Mount(addr []byte) (string, error) {
-	err := srv.Server.Mount(srv.mountDir, addr, true)
+	return srv.mount(addr, true)
+}
+
+func (srv *TestServer) MountWritable(addr []byte) (string, error) {
+	return srv.mount(addr, false)
+}
+
+func (srv *TestServer) mount(addr []byte, readOnly bool) (string, error) {
+	err := srv.Server.Mount(srv.mountDir, addr, readOnly, fusefs.SyncIgnore)
 	if err != nil {
 		return "", err
 	}
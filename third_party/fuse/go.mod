@@ -0,0 +1,5 @@
+module bazil.org/fuse
+
+go 1.13
+
+require golang.org/x/sys v0.0.0-20191210023423-ac6580df4449
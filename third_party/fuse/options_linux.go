@@ -0,0 +1,5 @@
+package fuse
+
+func daemonTimeout(name string) MountOption {
+	return dummyOption
+}
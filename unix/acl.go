@@ -0,0 +1,327 @@
+package unix
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+const (
+	XATTR_POSIX_ACL_ACCESS  = "system.posix_acl_access"
+	XATTR_POSIX_ACL_DEFAULT = "system.posix_acl_default"
+
+	ACL_USER_OBJ  = 0x01
+	ACL_USER      = 0x02
+	ACL_GROUP_OBJ = 0x04
+	ACL_GROUP     = 0x08
+	ACL_MASK      = 0x10
+	ACL_OTHER     = 0x20
+
+	ACL_READ    = 0x04
+	ACL_WRITE   = 0x02
+	ACL_EXECUTE = 0x01
+
+	ACL_UNDEFINED_ID = 0xffffffff
+
+	posixACLXattrVersion = 2
+	posixACLHeaderSize   = 4
+	posixACLEntrySize    = 8
+)
+
+type ACLEntry struct {
+	Tag  uint16
+	Perm uint16
+	Id   uint32
+}
+
+// A POSIX access control list. Entries are kept in the order the kernel
+// expects; sorted by tag and then by id.
+type ACL []ACLEntry
+
+// Parses an ACL in the binary format used by the system.posix_acl_* extended
+// attributes.
+func ParseACL(data []byte) (ACL, error) {
+	if len(data) < posixACLHeaderSize || (len(data)-posixACLHeaderSize)%posixACLEntrySize != 0 {
+		return nil, EINVAL
+	}
+	if Hbo.Uint32(data) != posixACLXattrVersion {
+		return nil, EINVAL
+	}
+
+	acl := make(ACL, 0, (len(data)-posixACLHeaderSize)/posixACLEntrySize)
+	for pos := posixACLHeaderSize; pos < len(data); pos += posixACLEntrySize {
+		acl = append(acl, ACLEntry{
+			Tag:  Hbo.Uint16(data[pos:]),
+			Perm: Hbo.Uint16(data[pos+2:]),
+			Id:   Hbo.Uint32(data[pos+4:]),
+		})
+	}
+	if !acl.Valid() {
+		return nil, EINVAL
+	}
+	return acl, nil
+}
+
+// Parses an ACL in the short or long text form written by acl_to_text(3), as
+// stored in the SCHILY.acl.* records of pax archives. Named users and groups
+// must either be numeric or be followed by a numeric id field as written by
+// star.
+func ParseACLText(text string) (ACL, error) {
+	var acl ACL
+	for _, entryText := range strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == '\n'
+	}) {
+		if pos := strings.IndexByte(entryText, '#'); pos != -1 {
+			entryText = entryText[:pos]
+		}
+		entryText = strings.TrimSpace(entryText)
+		if entryText == "" {
+			continue
+		}
+
+		fields := strings.Split(entryText, ":")
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, errors.Errorf("malformed acl entry '%s'", entryText)
+		}
+
+		entry := ACLEntry{Id: ACL_UNDEFINED_ID}
+		named := fields[1] != ""
+		switch fields[0] {
+		case "user", "u":
+			entry.Tag = ACL_USER_OBJ
+			if named {
+				entry.Tag = ACL_USER
+			}
+		case "group", "g":
+			entry.Tag = ACL_GROUP_OBJ
+			if named {
+				entry.Tag = ACL_GROUP
+			}
+		case "mask", "m":
+			entry.Tag = ACL_MASK
+		case "other", "o":
+			entry.Tag = ACL_OTHER
+		default:
+			return nil, errors.Errorf("unknown acl tag '%s'", fields[0])
+		}
+
+		if named {
+			idText := fields[1]
+			if len(fields) == 4 {
+				idText = fields[3]
+			}
+			id, err := strconv.ParseUint(idText, 10, 32)
+			if err != nil {
+				return nil, errors.Errorf("acl entry '%s' has no numeric id", entryText)
+			}
+			entry.Id = uint32(id)
+		}
+
+		perm := fields[2]
+		if len(perm) != 3 {
+			return nil, errors.Errorf("malformed acl permissions '%s'", perm)
+		}
+		for i, bit := range []uint16{ACL_READ, ACL_WRITE, ACL_EXECUTE} {
+			switch perm[i] {
+			case "rwx"[i]:
+				entry.Perm |= bit
+			case '-':
+			default:
+				return nil, errors.Errorf("malformed acl permissions '%s'", perm)
+			}
+		}
+
+		acl = append(acl, entry)
+	}
+
+	acl.sort()
+	if !acl.Valid() {
+		return nil, errors.New("invalid acl")
+	}
+	return acl, nil
+}
+
+func (acl ACL) sort() {
+	sort.SliceStable(acl, func(i, j int) bool {
+		if acl[i].Tag != acl[j].Tag {
+			return acl[i].Tag < acl[j].Tag
+		}
+		return acl[i].Id < acl[j].Id
+	})
+}
+
+// Returns true if the ACL is well formed. It must be sorted, contain exactly
+// one owner, owning group and other entry, contain a mask entry if it has any
+// named entries and have no duplicate named entries.
+func (acl ACL) Valid() bool {
+	counts := make(map[uint16]int)
+	for i, entry := range acl {
+		if entry.Perm&^(ACL_READ|ACL_WRITE|ACL_EXECUTE) != 0 {
+			return false
+		}
+		if i > 0 {
+			prev := acl[i-1]
+			if prev.Tag > entry.Tag || (prev.Tag == entry.Tag && prev.Id >= entry.Id) {
+				return false
+			}
+		}
+		switch entry.Tag {
+		case ACL_USER, ACL_GROUP:
+		case ACL_USER_OBJ, ACL_GROUP_OBJ, ACL_MASK, ACL_OTHER:
+			if entry.Id != ACL_UNDEFINED_ID {
+				return false
+			}
+		default:
+			return false
+		}
+		counts[entry.Tag]++
+	}
+	if counts[ACL_USER_OBJ] != 1 || counts[ACL_GROUP_OBJ] != 1 || counts[ACL_OTHER] != 1 {
+		return false
+	}
+	if counts[ACL_USER]+counts[ACL_GROUP] > 0 && counts[ACL_MASK] != 1 {
+		return false
+	}
+	return true
+}
+
+// Returns the ACL encoded in the binary extended attribute format.
+func (acl ACL) Bytes() []byte {
+	data := make([]byte, posixACLHeaderSize+len(acl)*posixACLEntrySize)
+	Hbo.PutUint32(data, posixACLXattrVersion)
+	pos := posixACLHeaderSize
+	for _, entry := range acl {
+		Hbo.PutUint16(data[pos:], entry.Tag)
+		Hbo.PutUint16(data[pos+2:], entry.Perm)
+		Hbo.PutUint32(data[pos+4:], entry.Id)
+		pos += posixACLEntrySize
+	}
+	return data
+}
+
+// Returns true if the ACL has no entries beyond those represented by the
+// permission bits of a file mode.
+func (acl ACL) IsMinimal() bool {
+	return len(acl) == 3
+}
+
+// Returns the entry for the group class of the ACL. This is the mask entry if
+// one exists and the owning group entry otherwise.
+func (acl ACL) groupClass() *ACLEntry {
+	var groupObj *ACLEntry
+	for i := range acl {
+		switch acl[i].Tag {
+		case ACL_MASK:
+			return &acl[i]
+		case ACL_GROUP_OBJ:
+			groupObj = &acl[i]
+		}
+	}
+	return groupObj
+}
+
+// Returns the permission bits of a file mode equivalent to the ACL.
+func (acl ACL) Mode() uint32 {
+	var mode uint32
+	for _, entry := range acl {
+		switch entry.Tag {
+		case ACL_USER_OBJ:
+			mode |= uint32(entry.Perm) << 6
+		case ACL_OTHER:
+			mode |= uint32(entry.Perm)
+		}
+	}
+	if group := acl.groupClass(); group != nil {
+		mode |= uint32(group.Perm) << 3
+	}
+	return mode
+}
+
+// Returns a copy of the ACL with the owner, group class and other entries
+// restricted to the permission bits of `mode`.
+func (acl ACL) Mask(mode uint32) ACL {
+	result := make(ACL, len(acl))
+	copy(result, acl)
+	for i := range result {
+		switch result[i].Tag {
+		case ACL_USER_OBJ:
+			result[i].Perm &= uint16(mode>>6) & 07
+		case ACL_OTHER:
+			result[i].Perm &= uint16(mode) & 07
+		}
+	}
+	if group := result.groupClass(); group != nil {
+		group.Perm &= uint16(mode>>3) & 07
+	}
+	return result
+}
+
+// Returns a copy of the ACL with the owner, group class and other entries set
+// to the permission bits of `mode`, as done by chmod(2).
+func (acl ACL) WithMode(mode uint32) ACL {
+	result := make(ACL, len(acl))
+	copy(result, acl)
+	for i := range result {
+		switch result[i].Tag {
+		case ACL_USER_OBJ:
+			result[i].Perm = uint16(mode>>6) & 07
+		case ACL_OTHER:
+			result[i].Perm = uint16(mode) & 07
+		}
+	}
+	if group := result.groupClass(); group != nil {
+		group.Perm = uint16(mode>>3) & 07
+	}
+	return result
+}
+
+// Returns true if a process with `uid` whose group membership is reported by
+// `inGroup` is granted all the permissions in `mask` by the ACL of a file
+// owned by `ownerUid` and `ownerGid`. Follows the POSIX access check
+// algorithm.
+func (acl ACL) TestAccess(uid uint32, inGroup func(gid uint32) bool, ownerUid, ownerGid, mask uint32) bool {
+	var maskPerm uint16 = ACL_READ | ACL_WRITE | ACL_EXECUTE
+	for _, entry := range acl {
+		if entry.Tag == ACL_MASK {
+			maskPerm = entry.Perm
+		}
+	}
+	granted := func(perm uint16) bool {
+		return uint32(perm)&mask == mask
+	}
+
+	for _, entry := range acl {
+		switch entry.Tag {
+		case ACL_USER_OBJ:
+			if uid == ownerUid {
+				return granted(entry.Perm)
+			}
+		case ACL_USER:
+			if uid == entry.Id {
+				return granted(entry.Perm & maskPerm)
+			}
+		}
+	}
+
+	groupMatched := false
+	for _, entry := range acl {
+		if (entry.Tag == ACL_GROUP_OBJ && inGroup(ownerGid)) || (entry.Tag == ACL_GROUP && inGroup(entry.Id)) {
+			if granted(entry.Perm & maskPerm) {
+				return true
+			}
+			groupMatched = true
+		}
+	}
+	if groupMatched {
+		return false
+	}
+
+	for _, entry := range acl {
+		if entry.Tag == ACL_OTHER {
+			return granted(entry.Perm)
+		}
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package unix
 
 import (
+	"math"
 	"os"
 	"unsafe"
 
@@ -14,6 +15,7 @@ const (
 	PATH_MAX       = 4096
 	PATH_MAX_LIMIT = 1 << 16
 
+	O_DSYNC    = unix.O_DSYNC
 	O_NOFOLLOW = unix.O_NOFOLLOW
 	O_PATH     = unix.O_PATH
 	O_RDONLY   = unix.O_RDONLY
@@ -33,17 +35,39 @@ const (
 	S_ISUID = unix.S_ISUID
 	S_ISVTX = unix.S_ISVTX
 
-	EACCES  = unix.EACCES
-	EBADF   = unix.EBADF
-	EINVAL  = unix.EINVAL
-	EIO     = unix.EIO
-	EISDIR  = unix.EISDIR
-	ENODATA = unix.ENODATA
-	ENOENT  = unix.ENOENT
-	ENOSYS  = unix.ENOSYS
-	ENOTDIR = unix.ENOTDIR
-	ENOTSUP = unix.ENOTSUP
-	EROFS   = unix.EROFS
+	E2BIG        = unix.E2BIG
+	EACCES       = unix.EACCES
+	EAGAIN       = unix.EAGAIN
+	EBADF        = unix.EBADF
+	EEXIST       = unix.EEXIST
+	EINTR        = unix.EINTR
+	EINVAL       = unix.EINVAL
+	EIO          = unix.EIO
+	EISDIR       = unix.EISDIR
+	ENAMETOOLONG = unix.ENAMETOOLONG
+	ENODATA      = unix.ENODATA
+	ENOENT       = unix.ENOENT
+	ENOSYS       = unix.ENOSYS
+	ENOTDIR      = unix.ENOTDIR
+	ENOTEMPTY    = unix.ENOTEMPTY
+	ENOTSUP      = unix.ENOTSUP
+	ENOTTY       = unix.ENOTTY
+	ENXIO        = unix.ENXIO
+	EOPNOTSUPP   = unix.EOPNOTSUPP
+	EPERM        = unix.EPERM
+	ERANGE       = unix.ERANGE
+	EROFS        = unix.EROFS
+	EXDEV        = unix.EXDEV
+
+	FALLOC_FL_KEEP_SIZE  = unix.FALLOC_FL_KEEP_SIZE
+	FALLOC_FL_PUNCH_HOLE = unix.FALLOC_FL_PUNCH_HOLE
+	FALLOC_FL_ZERO_RANGE = unix.FALLOC_FL_ZERO_RANGE
+
+	SEEK_DATA = 3
+	SEEK_HOLE = 4
+
+	XATTR_CREATE  = unix.XATTR_CREATE
+	XATTR_REPLACE = unix.XATTR_REPLACE
 
 	DT_UNKNOWN = 0
 	DT_FIFO    = S_IFIFO >> 12
@@ -61,17 +85,42 @@ type Stat_t = unix.Stat_t
 type Statfs_t = unix.Statfs_t
 type Errno = unix.Errno
 
-// Supports basic makedev implementation. Most kernels support major/minors
-// larger than 255 however how this is encoded varies between kernels therefore
-// we only support 8 bit major/minors which is consistently represented.
+// Returns the device number for `major` and `minor` in the 64 bit encoding
+// used by Linux for st_rdev.
 func Makedev(major, minor uint64) (uint64, error) {
-	if 255 < major {
+	if major > math.MaxUint32 {
 		return 0, errors.New("major number too large")
 	}
-	if 255 < minor {
+	if minor > math.MaxUint32 {
 		return 0, errors.New("minor number too large")
 	}
-	return major<<8 | minor, nil
+	return unix.Mkdev(uint32(major), uint32(minor)), nil
+}
+
+func Major(dev uint64) uint64 {
+	return uint64(unix.Major(dev))
+}
+
+func Minor(dev uint64) uint64 {
+	return uint64(unix.Minor(dev))
+}
+
+// Encodes a device number in the 32 bit format the kernel uses to exchange
+// device numbers with fuse. Returns an error if the major number does not fit
+// in 12 bits or the minor number does not fit in 20 bits.
+func EncodeDev32(dev uint64) (uint32, error) {
+	major, minor := Major(dev), Minor(dev)
+	if major >= 1<<12 || minor >= 1<<20 {
+		return 0, errors.New("device number too large")
+	}
+	return uint32(minor&0xff | major<<8 | (minor&^0xff)<<12), nil
+}
+
+// Decodes a device number in the 32 bit format used by fuse.
+func DecodeDev32(rdev uint32) uint64 {
+	major := (rdev & 0xfff00) >> 8
+	minor := (rdev & 0xff) | ((rdev >> 12) & 0xfff00)
+	return unix.Mkdev(major, minor)
 }
 
 func S_ISDIR(mode uint32) bool {
@@ -153,13 +202,16 @@ func FileStatToUnixMode(fsMode os.FileMode) uint32 {
 	return unixMode
 }
 
+// Returns true if the permission bits of `mode` grant everything in `mask`.
+// Only the bits of the most specific class that applies are considered; the
+// owner class if `user` is set, then the group class if `group` is set, and
+// otherwise the other class.
 func TestAccess(user, group bool, mode, mask uint32) bool {
 	modeEffective := mode & 07
 	if user {
-		modeEffective |= (mode >> 6) & 07
-	}
-	if group {
-		modeEffective |= (mode >> 6) & 07
+		modeEffective = (mode >> 6) & 07
+	} else if group {
+		modeEffective = (mode >> 3) & 07
 	}
 	return (mask & modeEffective) == mask
 }
@@ -230,6 +282,20 @@ func Pread(fd int, p []byte, offset int64) (int, error) {
 	})
 }
 
+// Repositions the offset of `fd` as with lseek(2), retrying on EINTR.
+func Seek(fd int, offset int64, whence int) (int64, error) {
+	for {
+		off, err := unix.Seek(fd, offset, whence)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return off, errors.New(err)
+		}
+		return off, nil
+	}
+}
+
 func Readlinkat(dirfd int, path string, buf []byte) (int, error) {
 	return RetrySyscallIE(func() (int, error) {
 		return unix.Readlinkat(dirfd, path, buf)
@@ -276,3 +342,27 @@ func Statfs(path string, buf *Statfs_t) error {
 		return unix.Statfs(path, buf)
 	})
 }
+
+func Flistxattr(fd int, dest []byte) (int, error) {
+	return RetrySyscallIE(func() (int, error) {
+		return unix.Flistxattr(fd, dest)
+	})
+}
+
+func Fgetxattr(fd int, attr string, dest []byte) (int, error) {
+	return RetrySyscallIE(func() (int, error) {
+		return unix.Fgetxattr(fd, attr, dest)
+	})
+}
+
+func Llistxattr(path string, dest []byte) (int, error) {
+	return RetrySyscallIE(func() (int, error) {
+		return unix.Llistxattr(path, dest)
+	})
+}
+
+func Lgetxattr(path string, attr string, dest []byte) (int, error) {
+	return RetrySyscallIE(func() (int, error) {
+		return unix.Lgetxattr(path, attr, dest)
+	})
+}